@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The JSON form of a program is meant for tools written in other languages,
+// so it spells everything out: every node is an object whose "type" is the
+// name of its Go struct, followed by its fields under their Go names, and a
+// "span" covering the source it came from. Tokens are objects too:
+//
+//	{"type": "IDENTIFIER", "lexeme": "a", "line": 1, "column": 5, "offset": 4}
+//
+// JSON strings can only hold UTF-8, so a token whose lexeme isn't (like a
+// string with a stray byte in it) also has a "lexemeBase64" with its bytes,
+// and a string literal like that has a null value.
+//
+// A whole program looks like {"statements": [...]}. astFromJSON reads that
+// back in, so a tool can rewrite a program and hand it to the interpreter.
+
+// jsonObject is a JSON object that keeps its keys in the order we wrote
+// them, so that "type" comes first and the output is stable.
+type jsonObject []jsonField
+
+type jsonField struct {
+	name  string
+	value any
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := o.write(&buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// write writes the object to buffer, along with the objects and arrays inside
+// it. Calling json.Marshal on each of those instead would check and copy its
+// output again at every level, which for a deeply nested syntax tree takes
+// time quadratic in its depth.
+func (o jsonObject) write(buffer *bytes.Buffer) error {
+	buffer.WriteString("{")
+	for i, field := range o {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		if err := writeJSON(buffer, field.name); err != nil {
+			return err
+		}
+		buffer.WriteString(":")
+		if err := writeJSON(buffer, field.value); err != nil {
+			return err
+		}
+	}
+	buffer.WriteString("}")
+	return nil
+}
+
+func writeJSON(buffer *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case jsonObject:
+		return v.write(buffer)
+	case []any:
+		buffer.WriteString("[")
+		for i, element := range v {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			if err := writeJSON(buffer, element); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("]")
+		return nil
+	default:
+		data, err := json.Marshal(v)
+		buffer.Write(data)
+		return err
+	}
+}
+
+// astToJSON writes the JSON form of statements, on one line unless indent.
+// Indenting a deeply nested program makes it a lot bigger.
+func astToJSON(statements []Stmt, indent bool) ([]byte, error) {
+	e := &astEncoder{}
+	var buffer bytes.Buffer
+	if err := writeJSON(&buffer, jsonObject{{"statements", e.stmts(statements)}}); err != nil {
+		return nil, err
+	}
+	if !indent {
+		return buffer.Bytes(), nil
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buffer.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
+
+// astEncoder works out each node's span from the spans of the nodes inside it
+// and its own tokens, as it writes them.
+type astEncoder struct {
+	// spans are the spans of the nodes being written, innermost last.
+	spans []tokenSpan
+}
+
+// A tokenSpan is the first and last tokens of a node in the source, which
+// are zero Tokens until it has any.
+type tokenSpan struct {
+	first, last Token
+}
+
+func (s *tokenSpan) add(token Token) {
+	if token.line == 0 {
+		return
+	}
+	if s.first.line == 0 || token.offset < s.first.offset {
+		s.first = token
+	}
+	if s.last.line == 0 || token.offset > s.last.offset {
+		s.last = token
+	}
+}
+
+// toJSON gives the stretch of source from the start of the first token to the
+// end of the last, or null if there are no real tokens (as for an empty
+// block). Keywords and punctuation that the AST doesn't keep, like "print" or
+// a closing brace, fall outside the span.
+func (s tokenSpan) toJSON() any {
+	if s.first.line == 0 {
+		return nil
+	}
+	start, end := tokenStart(s.first), tokenEnd(s.last)
+	return jsonObject{
+		{"start", jsonObject{{"line", start.line}, {"column", start.column}, {"offset", start.offset}}},
+		{"end", jsonObject{{"line", end.line}, {"column", end.column}, {"offset", end.offset}}},
+	}
+}
+
+// begin starts the span of a node, and end finishes it, adding it to the span
+// of the node around it and to the node itself.
+func (e *astEncoder) begin() {
+	e.spans = append(e.spans, tokenSpan{})
+}
+
+func (e *astEncoder) end(node jsonObject) jsonObject {
+	span := e.spans[len(e.spans)-1]
+	e.spans = e.spans[:len(e.spans)-1]
+	if len(e.spans) > 0 {
+		parent := &e.spans[len(e.spans)-1]
+		parent.add(span.first)
+		parent.add(span.last)
+	}
+	return append(node, jsonField{"span", span.toJSON()})
+}
+
+func (e *astEncoder) stmts(statements []Stmt) []any {
+	result := make([]any, len(statements))
+	for i, stmt := range statements {
+		result[i] = e.stmt(stmt)
+	}
+	return result
+}
+
+func (e *astEncoder) stmt(stmt Stmt) any {
+	e.begin()
+	var node jsonObject
+	switch v := stmt.(type) {
+	case *Block:
+		node = jsonObject{{"type", "Block"}, {"statements", e.stmts(v.statements)}}
+	case *Class:
+		name := e.token(v.name)
+		var superclass any
+		if v.superclass != nil {
+			superclass = e.expr(v.superclass)
+		}
+		methods := make([]any, len(v.methods))
+		for i, method := range v.methods {
+			methods[i] = e.stmt(method)
+		}
+		node = jsonObject{
+			{"type", "Class"},
+			{"name", name},
+			{"superclass", superclass},
+			{"methods", methods},
+		}
+	case *ErrorStmt:
+		node = jsonObject{{"type", "ErrorStmt"}, {"tokens", e.tokens(v.tokens)}}
+	case *Expression:
+		node = jsonObject{{"type", "Expression"}, {"expression", e.expr(v.expression)}}
+	case *Function:
+		node = jsonObject{
+			{"type", "Function"},
+			{"name", e.token(v.name)},
+			{"params", e.tokens(v.params)},
+			{"body", e.stmts(v.body)},
+		}
+	case *If:
+		node = jsonObject{
+			{"type", "If"},
+			{"condition", e.expr(v.condition)},
+			{"thenBranch", e.stmt(v.thenBranch)},
+			{"elseBranch", e.optionalStmt(v.elseBranch)},
+		}
+	case *Print:
+		node = jsonObject{{"type", "Print"}, {"expression", e.expr(v.expression)}}
+	case *Return:
+		node = jsonObject{
+			{"type", "Return"},
+			{"keyword", e.token(v.keyword)},
+			{"value", e.expr(v.value)},
+		}
+	case *Var:
+		node = jsonObject{
+			{"type", "Var"},
+			{"name", e.token(v.name)},
+			{"initializer", e.expr(v.initializer)},
+		}
+	case *While:
+		node = jsonObject{
+			{"type", "While"},
+			{"condition", e.expr(v.condition)},
+			{"body", e.stmt(v.body)},
+		}
+	default:
+		panic(fmt.Sprintf("Unreachable. stmt has value %v; its type is %T which we don't know how to handle.", stmt, stmt))
+	}
+	return e.end(node)
+}
+
+func (e *astEncoder) optionalStmt(stmt Stmt) any {
+	if stmt == nil {
+		return nil
+	}
+	return e.stmt(stmt)
+}
+
+// expr turns a nil expr (such as a Var with no initializer) into null.
+func (e *astEncoder) expr(expr Expr) any {
+	if expr == nil {
+		return nil
+	}
+	e.begin()
+	var node jsonObject
+	switch v := expr.(type) {
+	case *Assign:
+		node = jsonObject{{"type", "Assign"}, {"name", e.token(v.name)}, {"value", e.expr(v.value)}}
+	case *Binary:
+		node = jsonObject{
+			{"type", "Binary"},
+			{"left", e.expr(v.left)},
+			{"operator", e.token(v.operator)},
+			{"right", e.expr(v.right)},
+		}
+	case *Call:
+		callee := e.expr(v.callee)
+		arguments := make([]any, len(v.arguments))
+		for i, argument := range v.arguments {
+			arguments[i] = e.expr(argument)
+		}
+		node = jsonObject{
+			{"type", "Call"},
+			{"callee", callee},
+			{"paren", e.token(v.paren)},
+			{"arguments", arguments},
+		}
+	case *Get:
+		node = jsonObject{{"type", "Get"}, {"object", e.expr(v.object)}, {"name", e.token(v.name)}}
+	case *Grouping:
+		node = jsonObject{{"type", "Grouping"}, {"expression", e.expr(v.expression)}}
+	case *Literal:
+		value := v.value
+		// JSON has no way of writing infinity, which is what a huge
+		// number literal turns into. Readers can get the value from
+		// the token's lexeme instead, which is what astFromJSON does.
+		if !fitsInJSON(value) {
+			value = nil
+		}
+		node = jsonObject{{"type", "Literal"}, {"value", value}, {"token", e.optionalToken(v.token)}}
+	case *Logical:
+		node = jsonObject{
+			{"type", "Logical"},
+			{"left", e.expr(v.left)},
+			{"operator", e.token(v.operator)},
+			{"right", e.expr(v.right)},
+		}
+	case *Set:
+		node = jsonObject{
+			{"type", "Set"},
+			{"object", e.expr(v.object)},
+			{"name", e.token(v.name)},
+			{"value", e.expr(v.value)},
+		}
+	case *Super:
+		node = jsonObject{{"type", "Super"}, {"keyword", e.token(v.keyword)}, {"method", e.token(v.method)}}
+	case *This:
+		node = jsonObject{{"type", "This"}, {"keyword", e.token(v.keyword)}}
+	case *Unary:
+		node = jsonObject{{"type", "Unary"}, {"operator", e.token(v.operator)}, {"right", e.expr(v.right)}}
+	case *Variable:
+		node = jsonObject{{"type", "Variable"}, {"name", e.token(v.name)}}
+	default:
+		panic(fmt.Sprintf("Unreachable. expr has value %v; its type is %T which we don't know how to handle.", expr, expr))
+	}
+	return e.end(node)
+}
+
+// A token's literal isn't written out, since it can always be worked out
+// again from its type and lexeme.
+func (e *astEncoder) token(token Token) jsonObject {
+	e.spans[len(e.spans)-1].add(token)
+	node := jsonObject{
+		{"type", token.tokenType.String()},
+		{"lexeme", token.lexeme},
+		{"line", token.line},
+		{"column", token.column},
+		{"offset", token.offset},
+	}
+	if !utf8.ValidString(token.lexeme) {
+		node = append(node, jsonField{"lexemeBase64", base64.StdEncoding.EncodeToString([]byte(token.lexeme))})
+	}
+	return node
+}
+
+// optionalToken writes the zero Token, which the parser uses for tokens that
+// aren't in the source, as null.
+func (e *astEncoder) optionalToken(token Token) any {
+	if token.line == 0 {
+		return nil
+	}
+	return e.token(token)
+}
+
+func (e *astEncoder) tokens(tokens []Token) []any {
+	result := make([]any, len(tokens))
+	for i, token := range tokens {
+		result[i] = e.token(token)
+	}
+	return result
+}
+
+type position struct {
+	line   int
+	column int
+	offset int
+}
+
+func tokenStart(token Token) position {
+	return position{token.line - strings.Count(token.lexeme, "\n"), token.column, token.offset}
+}
+
+// tokenEnd is the position just after the token's last byte.
+func tokenEnd(token Token) position {
+	offset := token.offset + len(token.lexeme)
+	if i := strings.LastIndexByte(token.lexeme, '\n'); i >= 0 {
+		return position{token.line, len(token.lexeme) - i, offset}
+	}
+	return position{token.line, token.column + len(token.lexeme), offset}
+}
+
+// stmtTokens calls f on every token in stmt, including the ones in nested
+// statements and expressions.
+func stmtTokens(stmt Stmt, f func(Token)) {
+	switch v := stmt.(type) {
+	case *Block:
+		for _, s := range v.statements {
+			stmtTokens(s, f)
+		}
+	case *Class:
+		f(v.name)
+		if v.superclass != nil {
+			exprTokens(v.superclass, f)
+		}
+		for _, method := range v.methods {
+			stmtTokens(method, f)
+		}
+	case *ErrorStmt:
+		for _, token := range v.tokens {
+			f(token)
+		}
+	case *Expression:
+		exprTokens(v.expression, f)
+	case *Function:
+		f(v.name)
+		for _, param := range v.params {
+			f(param)
+		}
+		for _, s := range v.body {
+			stmtTokens(s, f)
+		}
+	case *If:
+		exprTokens(v.condition, f)
+		stmtTokens(v.thenBranch, f)
+		if v.elseBranch != nil {
+			stmtTokens(v.elseBranch, f)
+		}
+	case *Print:
+		exprTokens(v.expression, f)
+	case *Return:
+		f(v.keyword)
+		exprTokens(v.value, f)
+	case *Var:
+		f(v.name)
+		exprTokens(v.initializer, f)
+	case *While:
+		exprTokens(v.condition, f)
+		stmtTokens(v.body, f)
+	}
+}
+
+// exprTokens calls f on every token in expr. expr may be nil.
+func exprTokens(expr Expr, f func(Token)) {
+	switch v := expr.(type) {
+	case *Assign:
+		f(v.name)
+		exprTokens(v.value, f)
+	case *Binary:
+		exprTokens(v.left, f)
+		f(v.operator)
+		exprTokens(v.right, f)
+	case *Call:
+		exprTokens(v.callee, f)
+		for _, argument := range v.arguments {
+			exprTokens(argument, f)
+		}
+		f(v.paren)
+	case *Get:
+		exprTokens(v.object, f)
+		f(v.name)
+	case *Grouping:
+		exprTokens(v.expression, f)
+	case *Literal:
+		f(v.token)
+	case *Logical:
+		exprTokens(v.left, f)
+		f(v.operator)
+		exprTokens(v.right, f)
+	case *Set:
+		exprTokens(v.object, f)
+		f(v.name)
+		exprTokens(v.value, f)
+	case *Super:
+		f(v.keyword)
+		f(v.method)
+	case *This:
+		f(v.keyword)
+	case *Unary:
+		f(v.operator)
+		exprTokens(v.right, f)
+	case *Variable:
+		f(v.name)
+	}
+}
+
+// astDecoder reads the JSON form of a program back in, once it's been
+// unmarshaled in one go into maps, slices and so on. Rather than checking for
+// an error after every field, it remembers the first error it runs into and
+// makes every later call a no-op, so the caller only has to check err once at
+// the end.
+type astDecoder struct {
+	err error
+}
+
+func astFromJSON(data []byte) ([]Stmt, error) {
+	var program struct {
+		Statements []any `json:"statements"`
+	}
+	if err := json.Unmarshal(data, &program); err != nil {
+		return nil, err
+	}
+	if program.Statements == nil {
+		return nil, errors.New("expected an object with a \"statements\" array")
+	}
+
+	d := &astDecoder{}
+	statements := make([]Stmt, len(program.Statements))
+	for i, value := range program.Statements {
+		statements[i] = d.stmt(value)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return statements, nil
+}
+
+func (d *astDecoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+}
+
+// jsonText is value as JSON again, for an error message.
+func jsonText(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// node splits a node into its type and fields. It returns "" for null.
+func (d *astDecoder) node(value any) (string, map[string]any) {
+	if d.err != nil || value == nil {
+		return "", nil
+	}
+	fields, ok := value.(map[string]any)
+	if !ok {
+		d.fail("expected a node, got %s", jsonText(value))
+		return "", nil
+	}
+	nodeType, ok := fields["type"].(string)
+	if !ok {
+		d.fail("node has no \"type\": %s", jsonText(value))
+		return "", nil
+	}
+	return nodeType, fields
+}
+
+func (d *astDecoder) stmt(value any) Stmt {
+	stmt := d.optionalStmt(value)
+	if stmt == nil {
+		d.fail("missing statement")
+	}
+	return stmt
+}
+
+func (d *astDecoder) optionalStmt(value any) Stmt {
+	nodeType, fields := d.node(value)
+	if nodeType == "" {
+		return nil
+	}
+
+	var stmt Stmt
+	switch nodeType {
+	case "Block":
+		stmt = &Block{d.stmts(fields["statements"]), nil}
+	case "Class":
+		var superclass *Variable
+		if expr := d.optionalExpr(fields["superclass"]); expr != nil {
+			variable, ok := expr.(*Variable)
+			if !ok {
+				d.fail("superclass must be a Variable, got %T", expr)
+			}
+			superclass = variable
+		}
+		var methods []*Function
+		for _, value := range d.list(fields["methods"]) {
+			function, ok := d.stmt(value).(*Function)
+			if !ok {
+				d.fail("methods must be Functions")
+			}
+			methods = append(methods, function)
+		}
+		stmt = &Class{d.token(fields["name"]), superclass, methods}
+	case "ErrorStmt":
+		stmt = &ErrorStmt{d.tokens(fields["tokens"])}
+	case "Expression":
+		stmt = &Expression{d.expr(fields["expression"])}
+	case "Function":
+		stmt = &Function{d.token(fields["name"]), d.tokens(fields["params"]), d.stmts(fields["body"]), nil, nil}
+	case "If":
+		stmt = &If{d.expr(fields["condition"]), d.stmt(fields["thenBranch"]), d.optionalStmt(fields["elseBranch"])}
+	case "Print":
+		stmt = &Print{d.expr(fields["expression"])}
+	case "Return":
+		stmt = &Return{d.token(fields["keyword"]), d.optionalExpr(fields["value"])}
+	case "Var":
+		stmt = &Var{d.token(fields["name"]), d.optionalExpr(fields["initializer"])}
+	case "While":
+		stmt = &While{d.expr(fields["condition"]), d.stmt(fields["body"])}
+	default:
+		d.fail("unknown statement type %q", nodeType)
+	}
+	return stmt
+}
+
+func (d *astDecoder) stmts(value any) []Stmt {
+	statements := []Stmt{}
+	for _, value := range d.list(value) {
+		statements = append(statements, d.stmt(value))
+	}
+	return statements
+}
+
+func (d *astDecoder) expr(value any) Expr {
+	expr := d.optionalExpr(value)
+	if expr == nil {
+		d.fail("missing expression")
+	}
+	return expr
+}
+
+func (d *astDecoder) optionalExpr(value any) Expr {
+	nodeType, fields := d.node(value)
+	if nodeType == "" {
+		return nil
+	}
+
+	var expr Expr
+	switch nodeType {
+	case "Assign":
+		expr = &Assign{d.tokenOf(fields["name"], IDENTIFIER), d.expr(fields["value"]), nil}
+	case "Binary":
+		operator := d.tokenOf(fields["operator"], BANG_EQUAL, EQUAL_EQUAL, GREATER, GREATER_EQUAL, LESS, LESS_EQUAL, MINUS, PLUS, SLASH, STAR)
+		expr = &Binary{d.expr(fields["left"]), operator, d.expr(fields["right"])}
+	case "Call":
+		var arguments []Expr
+		for _, value := range d.list(fields["arguments"]) {
+			arguments = append(arguments, d.expr(value))
+		}
+		expr = &Call{d.expr(fields["callee"]), d.token(fields["paren"]), arguments}
+	case "Get":
+		expr = &Get{d.expr(fields["object"]), d.tokenOf(fields["name"], IDENTIFIER), nil}
+	case "Grouping":
+		expr = &Grouping{d.expr(fields["expression"])}
+	case "Literal":
+		token := d.optionalToken(fields["token"])
+		value := fields["value"]
+		switch value.(type) {
+		case nil, bool, float64, string:
+		default:
+			d.fail("bad literal value %s", jsonText(value))
+		}
+		// The value has to be the token's, unless the parser made the
+		// literal up. A number too big for JSON, or a string that isn't
+		// UTF-8, is written as null.
+		if d.err == nil && token.line != 0 {
+			expected, ok := literalValues[token.tokenType]
+			if token.tokenType == NUMBER || token.tokenType == STRING {
+				expected, ok = token.literal, true
+				if value == nil && !fitsInJSON(expected) {
+					value = expected
+				}
+			}
+			if !ok {
+				d.fail("a literal can't be a %v token", token.tokenType)
+			} else if value != expected {
+				d.fail("literal value %s doesn't match its token %q", jsonText(value), token.lexeme)
+			}
+		}
+		expr = &Literal{value, token}
+	case "Logical":
+		expr = &Logical{d.expr(fields["left"]), d.tokenOf(fields["operator"], AND, OR), d.expr(fields["right"])}
+	case "Set":
+		expr = &Set{d.expr(fields["object"]), d.tokenOf(fields["name"], IDENTIFIER), d.expr(fields["value"]), nil}
+	case "Super":
+		expr = &Super{d.token(fields["keyword"]), d.token(fields["method"]), nil, nil}
+	case "This":
+		expr = &This{d.token(fields["keyword"]), nil}
+	case "Unary":
+		expr = &Unary{d.tokenOf(fields["operator"], BANG, MINUS), d.expr(fields["right"])}
+	case "Variable":
+		expr = &Variable{d.token(fields["name"]), nil}
+	default:
+		d.fail("unknown expression type %q", nodeType)
+	}
+	return expr
+}
+
+func (d *astDecoder) list(value any) []any {
+	if d.err != nil || value == nil {
+		return nil
+	}
+	list, ok := value.([]any)
+	if !ok {
+		d.fail("expected an array, got %s", jsonText(value))
+	}
+	return list
+}
+
+func (d *astDecoder) token(value any) Token {
+	if d.err == nil && value == nil {
+		d.fail("missing token")
+	}
+	return d.optionalToken(value)
+}
+
+// tokenOf is token for a token that has to be one of types, like the operator
+// of a Binary, which the interpreter has no way of handling otherwise.
+func (d *astDecoder) tokenOf(value any, types ...TokenType) Token {
+	token := d.token(value)
+	if d.err == nil && !slices.Contains(types, token.tokenType) {
+		d.fail("%v isn't allowed here: %s", token.tokenType, jsonText(value))
+	}
+	return token
+}
+
+func (d *astDecoder) optionalToken(value any) Token {
+	if d.err != nil || value == nil {
+		return Token{}
+	}
+	fields, ok := value.(map[string]any)
+	typeName, typeOK := fields["type"].(string)
+	lexeme, lexemeOK := fields["lexeme"].(string)
+	line, lineOK := fields["line"].(float64)
+	column, columnOK := fields["column"].(float64)
+	offset, offsetOK := fields["offset"].(float64)
+	if !ok || !typeOK || !lexemeOK || !lineOK || !columnOK || !offsetOK {
+		d.fail("expected a token, got %s", jsonText(value))
+		return Token{}
+	}
+	if encoded, ok := fields["lexemeBase64"].(string); ok {
+		bytes, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			d.fail("bad lexemeBase64 %q", encoded)
+			return Token{}
+		}
+		lexeme = string(bytes)
+	}
+	tokenType, ok := tokenTypesByName[typeName]
+	if !ok {
+		d.fail("unknown token type %q", typeName)
+		return Token{}
+	}
+	var literal any
+	switch tokenType {
+	case NUMBER:
+		f, err := strconv.ParseFloat(lexeme, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			d.fail("bad number %q", lexeme)
+		}
+		literal = f
+	case STRING:
+		if len(lexeme) < 2 || lexeme[0] != '"' || lexeme[len(lexeme)-1] != '"' {
+			d.fail("bad string %q", lexeme)
+			return Token{}
+		}
+		literal = lexeme[1 : len(lexeme)-1]
+	}
+	return Token{tokenType, lexeme, literal, int(line), int(column), int(offset), ""}
+}
+
+func (d *astDecoder) tokens(value any) []Token {
+	tokens := []Token{}
+	for _, value := range d.list(value) {
+		tokens = append(tokens, d.token(value))
+	}
+	return tokens
+}
+
+// fitsInJSON says whether a literal's value can be written as JSON as it is.
+func fitsInJSON(value any) bool {
+	switch v := value.(type) {
+	case float64:
+		return !math.IsInf(v, 0) && !math.IsNaN(v)
+	case string:
+		return utf8.ValidString(v)
+	default:
+		return true
+	}
+}
+
+// literalValues are the values of the literals whose tokens don't have one.
+var literalValues = map[TokenType]any{TRUE: true, FALSE: false, NIL: nil}
+
+var tokenTypesByName = func() map[string]TokenType {
+	result := make(map[string]TokenType)
+	for t := LEFT_PAREN; t <= EOF; t++ {
+		result[t.String()] = t
+	}
+	return result
+}()
+
+// parseCommand implements "jlox parse", which prints the AST of a file,
+// either as S-expressions (like "jlox ast") or as JSON.
+func parseCommand(args []string) {
+	flags := flag.NewFlagSet("parse", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the AST as JSON")
+	indent := flags.Bool("indent", false, "indent the JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox parse [flags] file.lox")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	bytes, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(66)
+	}
+	statements := NewParser(NewScanner(string(bytes)).ScanTokens()).parse()
+
+	if *asJSON {
+		output, err := astToJSON(statements, *indent)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(70)
+		}
+		fmt.Println(string(output))
+	} else {
+		fmt.Print(printStatements(statements))
+	}
+
+	if hadError {
+		os.Exit(65)
+	}
+}
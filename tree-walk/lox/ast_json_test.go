@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// printJSON is the JSON form of a program that prints expression, which is
+// given as JSON too.
+func printJSON(expression string) []byte {
+	return []byte(fmt.Sprintf(`{"statements": [{"type": "Print", "expression": %v}]}`, expression))
+}
+
+func tokenJSON(tokenType, lexeme string) string {
+	return fmt.Sprintf(`{"type": %q, "lexeme": %q, "line": 1, "column": 1, "offset": 0}`, tokenType, lexeme)
+}
+
+func numberJSON(lexeme string) string {
+	return fmt.Sprintf(`{"type": "Literal", "value": %v, "token": %v}`, lexeme, tokenJSON("NUMBER", lexeme))
+}
+
+// TestBadJSONPrograms checks that a JSON program that couldn't have come
+// from the parser is refused when it's loaded, rather than crashing the
+// interpreter when it runs.
+func TestBadJSONPrograms(t *testing.T) {
+	one, two := numberJSON("1"), numberJSON("2")
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{
+			"binary operator",
+			printJSON(fmt.Sprintf(`{"type": "Binary", "left": %v, "operator": %v, "right": %v}`, one, tokenJSON("COMMA", ","), two)),
+			"COMMA isn't allowed here",
+		},
+		{
+			"logical operator",
+			printJSON(fmt.Sprintf(`{"type": "Logical", "left": %v, "operator": %v, "right": %v}`, one, tokenJSON("PLUS", "+"), two)),
+			"PLUS isn't allowed here",
+		},
+		{
+			"unary operator",
+			printJSON(fmt.Sprintf(`{"type": "Unary", "operator": %v, "right": %v}`, tokenJSON("STAR", "*"), one)),
+			"STAR isn't allowed here",
+		},
+		{
+			"assignment to a number",
+			printJSON(fmt.Sprintf(`{"type": "Assign", "name": %v, "value": %v}`, tokenJSON("NUMBER", "1"), two)),
+			"NUMBER isn't allowed here",
+		},
+		{
+			"field called this",
+			printJSON(fmt.Sprintf(`{"type": "Set", "object": %v, "name": %v, "value": %v}`, one, tokenJSON("THIS", "this"), two)),
+			"THIS isn't allowed here",
+		},
+		{
+			"literal value",
+			printJSON(fmt.Sprintf(`{"type": "Literal", "value": 2, "token": %v}`, tokenJSON("NUMBER", "1"))),
+			`doesn't match its token "1"`,
+		},
+		{
+			"string literal value",
+			printJSON(fmt.Sprintf(`{"type": "Literal", "value": "b", "token": %v}`, tokenJSON("STRING", `"a"`))),
+			`doesn't match its token "\"a\""`,
+		},
+		{
+			"true literal value",
+			printJSON(fmt.Sprintf(`{"type": "Literal", "value": false, "token": %v}`, tokenJSON("TRUE", "true"))),
+			`doesn't match its token "true"`,
+		},
+		{
+			"lexeme bytes",
+			printJSON(`{"type": "Literal", "value": null, "token": {"type": "STRING", "lexeme": "\"?\"", "line": 1, "column": 1, "offset": 0, "lexemeBase64": "not base64"}}`),
+			`bad lexemeBase64 "not base64"`,
+		},
+		{
+			"literal token",
+			printJSON(fmt.Sprintf(`{"type": "Literal", "value": 1, "token": %v}`, tokenJSON("IDENTIFIER", "a"))),
+			"a literal can't be a IDENTIFIER token",
+		},
+	} {
+		_, err := astFromJSON(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got the error %v, want one saying %q", test.name, err, test.want)
+		}
+	}
+}
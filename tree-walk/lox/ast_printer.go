@@ -1,46 +1,71 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"strings"
 )
 
-func printStatements(statements []Stmt, indent int) string {
+// There are two ways of printing the AST. The S-expression form is the one
+// from the book's AstPrinter: compact, one top-level statement per line, and
+// handy for seeing how an expression was grouped. The tree form puts every
+// node on its own line, indented under its parent, which is easier to read
+// for anything with blocks or functions in it.
+
+func printStatements(statements []Stmt) string {
 	var builder strings.Builder
 	for _, stmt := range statements {
-		builder.WriteString(printStmt(stmt, indent))
-		// builder.WriteString("; ")
+		builder.WriteString(printStmt(stmt))
+		builder.WriteString("\n")
 	}
 	return builder.String()
 }
 
-func printIndent(indent int) string {
-	var builder strings.Builder
-	for _ = range indent {
-		builder.WriteString(" ")
-	}
-	return builder.String()
-
-}
-
-func printStmt(stmt Stmt, indent int) string {
+func printStmt(stmt Stmt) string {
 	switch v := stmt.(type) {
+	case *Block:
+		return parenthesizeStmts("block", v.statements...)
+	case *Class:
+		name := "class " + v.name.lexeme
+		if v.superclass != nil {
+			name += " < " + v.superclass.name.lexeme
+		}
+		methods := make([]Stmt, len(v.methods))
+		for i, method := range v.methods {
+			methods[i] = method
+		}
+		return parenthesizeStmts(name, methods...)
+	case *ErrorStmt:
+		return "(error " + printLexemes(v.tokens) + ")"
+	case *Expression:
+		return parenthesize(";", v.expression)
+	case *Function:
+		params := make([]string, len(v.params))
+		for i, param := range v.params {
+			params[i] = param.lexeme
+		}
+		name := fmt.Sprintf("fun %v(%v)", v.name.lexeme, strings.Join(params, " "))
+		return parenthesizeStmts(name, v.body...)
 	case *If:
-		return printIndent(indent) + "<if>"
+		if v.elseBranch == nil {
+			return "(if " + printExpr(v.condition) + " " + printStmt(v.thenBranch) + ")"
+		}
+		return "(if-else " + printExpr(v.condition) + " " + printStmt(v.thenBranch) + " " + printStmt(v.elseBranch) + ")"
 	case *Print:
-		return printIndent(indent) + "<print>"
-	case *Expression:
-		return fmt.Sprintf("%v<expr: %v>", printIndent(indent), printExpr(v.expression))
+		return parenthesize("print", v.expression)
+	case *Return:
+		if v.value == nil {
+			return "(return)"
+		}
+		return parenthesize("return", v.value)
 	case *Var:
-		return fmt.Sprintf("%v<var: %v = %v>\n", printIndent(indent), v.name, printExpr(v.initializer))
-	case *Block:
-		return fmt.Sprintf("%v<block: \n%v\n%v>\n", printIndent(indent), printStatements(v.statements, indent+4), printIndent(indent))
+		if v.initializer == nil {
+			return "(var " + v.name.lexeme + ")"
+		}
+		return parenthesize("var "+v.name.lexeme+" =", v.initializer)
 	case *While:
-		return fmt.Sprintf("%v<while: (%v)\n%v\n%v>\n", printIndent(indent), printExpr(v.condition), printStmt(v.body, indent+4), printIndent(indent))
-	case *Function:
-		return printIndent(indent) + "<function>"
-	case *Return:
-		return printIndent(indent) + "<return>"
+		return "(while " + printExpr(v.condition) + " " + printStmt(v.body) + ")"
 	default:
 		panic(fmt.Sprintf("Unreachable. stmt has value %v; its type is %T which we don't know how to handle.", stmt, stmt))
 	}
@@ -48,60 +73,264 @@ func printStmt(stmt Stmt, indent int) string {
 
 func printExpr(expr Expr) string {
 	switch v := expr.(type) {
+	case *Assign:
+		return parenthesize("= "+v.name.lexeme, v.value)
 	case *Binary:
 		return parenthesize(v.operator.lexeme, v.left, v.right)
+	case *Call:
+		return parenthesize("call", append([]Expr{v.callee}, v.arguments...)...)
+	case *Get:
+		return "(. " + printExpr(v.object) + " " + v.name.lexeme + ")"
 	case *Grouping:
 		return parenthesize("group", v.expression)
 	case *Literal:
-		if v.value == nil {
-			return "nil"
-		}
-		return fmt.Sprintf("%v", v.value)
+		return printLiteral(v.value)
+	case *Logical:
+		return parenthesize(v.operator.lexeme, v.left, v.right)
+	case *Set:
+		return "(= " + printExpr(v.object) + " " + v.name.lexeme + " " + printExpr(v.value) + ")"
+	case *Super:
+		return "(super " + v.method.lexeme + ")"
+	case *This:
+		return "this"
 	case *Unary:
 		return parenthesize(v.operator.lexeme, v.right)
 	case *Variable:
-		return "(variable " + v.name.lexeme + " )"
-	case *Assign:
-		return parenthesize(v.name.lexeme, v.value)
+		return v.name.lexeme
 	default:
 		panic(fmt.Sprintf("Unreachable. expr has value %v; its type is %T which we don't know how to handle.", expr, expr))
 	}
 }
 
-/*
-func blockify(name string, stmts ...Stmt) string {
+// printLiteral quotes strings, so that a string literal can't be mistaken
+// for a variable, or "nil" for nil.
+func printLiteral(value any) string {
+	if s, ok := value.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return stringify(value)
+}
+
+func printLexemes(tokens []Token) string {
+	lexemes := make([]string, len(tokens))
+	for i, token := range tokens {
+		lexemes[i] = token.lexeme
+	}
+	return fmt.Sprintf("%q", strings.Join(lexemes, " "))
+}
+
+func parenthesize(name string, exprs ...Expr) string {
 	var builder strings.Builder
-	builder.WriteString("{")
+	builder.WriteString("(")
 	builder.WriteString(name)
 	for _, expr := range exprs {
 		builder.WriteString(" ")
 		builder.WriteString(printExpr(expr))
 	}
-	builder.WriteString("}")
+	builder.WriteString(")")
 	return builder.String()
 }
-*/
 
-func parenthesize(name string, exprs ...Expr) string {
+func parenthesizeStmts(name string, stmts ...Stmt) string {
 	var builder strings.Builder
 	builder.WriteString("(")
 	builder.WriteString(name)
-	for _, expr := range exprs {
+	for _, stmt := range stmts {
 		builder.WriteString(" ")
-		builder.WriteString(printExpr(expr))
+		builder.WriteString(printStmt(stmt))
 	}
 	builder.WriteString(")")
 	return builder.String()
 }
 
+func printTree(statements []Stmt) string {
+	return printAnnotatedTree(statements, nil)
+}
+
+// printAnnotatedTree is printTree with notes added to the ends of the lines
+// for the Function, Variable, Assign, This and Super nodes that have them.
+func printAnnotatedTree(statements []Stmt, notes map[any]string) string {
+	var builder strings.Builder
+	for _, stmt := range statements {
+		treeStmt(&builder, stmt, 0, notes)
+	}
+	return builder.String()
+}
+
+func printIndent(builder *strings.Builder, indent int, line string) {
+	for range indent {
+		builder.WriteString("  ")
+	}
+	builder.WriteString(line)
+	builder.WriteString("\n")
+}
+
+func treeStmt(builder *strings.Builder, stmt Stmt, indent int, notes map[any]string) {
+	switch v := stmt.(type) {
+	case *Block:
+		printIndent(builder, indent, "Block")
+		for _, s := range v.statements {
+			treeStmt(builder, s, indent+1, notes)
+		}
+	case *Class:
+		if v.superclass != nil {
+			printIndent(builder, indent, "Class "+v.name.lexeme+" < "+v.superclass.name.lexeme)
+		} else {
+			printIndent(builder, indent, "Class "+v.name.lexeme)
+		}
+		for _, method := range v.methods {
+			treeStmt(builder, method, indent+1, notes)
+		}
+	case *ErrorStmt:
+		printIndent(builder, indent, "Error "+printLexemes(v.tokens))
+	case *Expression:
+		printIndent(builder, indent, "Expression")
+		treeExpr(builder, v.expression, indent+1, notes)
+	case *Function:
+		params := make([]string, len(v.params))
+		for i, param := range v.params {
+			params[i] = param.lexeme
+		}
+		printIndent(builder, indent, fmt.Sprintf("Function %v(%v)", v.name.lexeme, strings.Join(params, ", "))+notes[v])
+		for _, s := range v.body {
+			treeStmt(builder, s, indent+1, notes)
+		}
+	case *If:
+		printIndent(builder, indent, "If")
+		printIndent(builder, indent+1, "Condition")
+		treeExpr(builder, v.condition, indent+2, notes)
+		printIndent(builder, indent+1, "Then")
+		treeStmt(builder, v.thenBranch, indent+2, notes)
+		if v.elseBranch != nil {
+			printIndent(builder, indent+1, "Else")
+			treeStmt(builder, v.elseBranch, indent+2, notes)
+		}
+	case *Print:
+		printIndent(builder, indent, "Print")
+		treeExpr(builder, v.expression, indent+1, notes)
+	case *Return:
+		printIndent(builder, indent, "Return")
+		if v.value != nil {
+			treeExpr(builder, v.value, indent+1, notes)
+		}
+	case *Var:
+		printIndent(builder, indent, "Var "+v.name.lexeme)
+		if v.initializer != nil {
+			treeExpr(builder, v.initializer, indent+1, notes)
+		}
+	case *While:
+		printIndent(builder, indent, "While")
+		printIndent(builder, indent+1, "Condition")
+		treeExpr(builder, v.condition, indent+2, notes)
+		printIndent(builder, indent+1, "Body")
+		treeStmt(builder, v.body, indent+2, notes)
+	default:
+		panic(fmt.Sprintf("Unreachable. stmt has value %v; its type is %T which we don't know how to handle.", stmt, stmt))
+	}
+}
+
+func treeExpr(builder *strings.Builder, expr Expr, indent int, notes map[any]string) {
+	switch v := expr.(type) {
+	case *Assign:
+		printIndent(builder, indent, "Assign "+v.name.lexeme+notes[v])
+		treeExpr(builder, v.value, indent+1, notes)
+	case *Binary:
+		printIndent(builder, indent, "Binary "+v.operator.lexeme)
+		treeExpr(builder, v.left, indent+1, notes)
+		treeExpr(builder, v.right, indent+1, notes)
+	case *Call:
+		printIndent(builder, indent, "Call")
+		treeExpr(builder, v.callee, indent+1, notes)
+		if len(v.arguments) > 0 {
+			printIndent(builder, indent+1, "Arguments")
+			for _, argument := range v.arguments {
+				treeExpr(builder, argument, indent+2, notes)
+			}
+		}
+	case *Get:
+		printIndent(builder, indent, "Get "+v.name.lexeme)
+		treeExpr(builder, v.object, indent+1, notes)
+	case *Grouping:
+		printIndent(builder, indent, "Grouping")
+		treeExpr(builder, v.expression, indent+1, notes)
+	case *Literal:
+		printIndent(builder, indent, "Literal "+printLiteral(v.value))
+	case *Logical:
+		printIndent(builder, indent, "Logical "+v.operator.lexeme)
+		treeExpr(builder, v.left, indent+1, notes)
+		treeExpr(builder, v.right, indent+1, notes)
+	case *Set:
+		printIndent(builder, indent, "Set "+v.name.lexeme)
+		treeExpr(builder, v.object, indent+1, notes)
+		treeExpr(builder, v.value, indent+1, notes)
+	case *Super:
+		printIndent(builder, indent, "Super "+v.method.lexeme+notes[v])
+	case *This:
+		printIndent(builder, indent, "This"+notes[v])
+	case *Unary:
+		printIndent(builder, indent, "Unary "+v.operator.lexeme)
+		treeExpr(builder, v.right, indent+1, notes)
+	case *Variable:
+		printIndent(builder, indent, "Variable "+v.name.lexeme+notes[v])
+	default:
+		panic(fmt.Sprintf("Unreachable. expr has value %v; its type is %T which we don't know how to handle.", expr, expr))
+	}
+}
+
+// astCommand implements "jlox ast", which prints the AST of a file. It prints
+// whatever the parser managed to make even if there were syntax errors, since
+// the whole point is to debug the parser.
+func astCommand(args []string) {
+	flags := flag.NewFlagSet("ast", flag.ExitOnError)
+	format := flags.String("format", "sexpr", "output `format`: sexpr, tree, or cst (the concrete syntax tree)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox ast [flags] file.lox")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*format != "sexpr" && *format != "tree" && *format != "cst") {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	bytes, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(66)
+	}
+	tokens := NewScanner(string(bytes)).ScanTokens()
+	if *format == "cst" {
+		program, errors := parseCST(tokens)
+		fmt.Print(printCST(program))
+		for _, err := range errors {
+			logParseError(err.token, err.message)
+		}
+		if hadError {
+			os.Exit(65)
+		}
+		return
+	}
+	statements := NewParser(tokens).parse()
+
+	if *format == "tree" {
+		fmt.Print(printTree(statements))
+	} else {
+		fmt.Print(printStatements(statements))
+	}
+
+	if hadError {
+		os.Exit(65)
+	}
+}
+
 func testAstPrinter() {
 	var expression Expr = &Binary{
 		&Unary{
-			Token{MINUS, "-", nil, 1},
-			&Literal{123},
+			Token{MINUS, "-", nil, 1, 1, 0, ""},
+			&Literal{123, Token{}},
 		},
-		Token{STAR, "*", nil, 1},
-		&Grouping{&Literal{45.67}},
+		Token{STAR, "*", nil, 1, 6, 5, " "},
+		&Grouping{&Literal{45.67, Token{}}},
 	}
 	fmt.Println(printExpr(expression))
 }
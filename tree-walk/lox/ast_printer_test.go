@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files instead of checking against them")
+
+// TestAstPrinters parses each program in testdata/ast and checks what each
+// of the printers makes of it against the golden file next to it: foo.lox
+// has foo.sexpr, foo.tree and foo.cst, and foo.resolve, which is the tree
+// annotated with what the resolver decided, as "jlox resolve" prints it.
+// Between them the programs have every kind of node in them, and errors.lox
+// has the ErrorStmts the parser leaves behind for broken code, including
+// code the scanner made ERROR tokens of, which only the concrete syntax tree
+// keeps.
+//
+// After changing a printer on purpose, run
+//
+//	go test -run TestAstPrinters -update
+//
+// and check the differences in the golden files before committing them.
+func TestAstPrinters(t *testing.T) {
+	printers := map[string]func([]Token) string{
+		"sexpr": func(tokens []Token) string {
+			return printStatements(NewParser(tokens).parse())
+		},
+		"tree": func(tokens []Token) string {
+			return printTree(NewParser(tokens).parse())
+		},
+		"cst": func(tokens []Token) string {
+			program, _ := parseCST(tokens)
+			return printCST(program)
+		},
+		"resolve": func(tokens []Token) string {
+			statements := NewParser(tokens).parse()
+			interpreter := NewInterpreter()
+			resolver := NewResolver()
+			resolver.resolveStatements(statements)
+			return printAnnotatedTree(statements, resolutionNotes(resolver, interpreter.globals))
+		},
+	}
+
+	paths, err := filepath.Glob("testdata/ast/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no programs found in testdata/ast")
+	}
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens := NewScanner(string(source)).ScanTokens()
+
+		for format, print := range printers {
+			golden := strings.TrimSuffix(path, ".lox") + "." + format
+			got := print(tokens)
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%v: got\n%v\nwant\n%v", golden, got, string(want))
+			}
+		}
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"fmt"
+
+	"jlox/lox/vm"
+)
+
+// Compiler turns a parsed and resolved program into bytecode for the VM. It's
+// clox's compiler, but walking the syntax tree rather than parsing as it
+// goes, so the resolver has already reported the errors that clox's compiler
+// finds (like reading a local in its own initializer); the only errors left
+// are the VM's limits. It doesn't keep track of the locals' names either:
+// the resolver has worked out where each variable is (see localSlot), and
+// the compiler only has to turn its scopes and upvalues into the VM's slots.
+type Compiler struct {
+	current *functionCompiler
+	// line is the line that emitted code is put down to. It's kept up to
+	// date with the tokens that the tree-walk interpreter reports runtime
+	// errors at, so that the VM reports them on the same lines.
+	line int
+
+	// reportError is called for each error found. It's logParseError
+	// unless someone wants the errors for themselves.
+	reportError func(token Token, message string)
+}
+
+// functionCompiler is the state of the function being compiled (the script
+// counts as a function).
+type functionCompiler struct {
+	enclosing *functionCompiler
+	function  *vm.Function
+	kind      FunctionType
+	// scopes has, for each of the resolver's scopes in the function that
+	// the compiler is inside, the frame slot that its first variable is
+	// in. The scope that a method's "this" is in isn't one of them, since
+	// this is always in slot 0.
+	scopes []int
+	// captured has, for each slot in use, whether a closure has captured
+	// it, so that it has to be closed over rather than popped when its
+	// scope ends.
+	captured []bool
+	// upvalues has, for each of the resolver's upvalues (see
+	// Function.upvalues), which of the closure's upvalues it is, or -1
+	// for the receiver in a method's slot 0.
+	upvalues []int
+}
+
+// The VM's limits, which come from how big its operands are.
+const (
+	maxLocals    = 256
+	maxUpvalues  = 256
+	maxConstants = 1 << 16
+	maxJump      = 1<<16 - 1
+)
+
+func NewCompiler() *Compiler {
+	return &Compiler{
+		reportError: logParseError,
+	}
+}
+
+// compile compiles statements into the function for the script.
+func (c *Compiler) compile(statements []Stmt) *vm.Function {
+	c.beginFunction("", FT_NONE)
+	for _, stmt := range statements {
+		c.compileStmt(stmt)
+	}
+	return c.endFunction()
+}
+
+func (c *Compiler) beginFunction(name string, kind FunctionType) {
+	c.current = &functionCompiler{
+		enclosing: c.current,
+		function:  &vm.Function{Name: name},
+		kind:      kind,
+		// Slot 0 holds the function being called, or in a method the
+		// instance it was called on.
+		captured: []bool{false},
+	}
+}
+
+func (c *Compiler) endFunction() *vm.Function {
+	c.emitReturn()
+	function := c.current.function
+	c.current = c.current.enclosing
+	return function
+}
+
+func (c *Compiler) compileStmt(stmt Stmt) {
+	switch v := stmt.(type) {
+	case *Block:
+		c.compileBlockStmt(v)
+	case *Class:
+		c.compileClassStmt(v)
+	case *ErrorStmt:
+		c.compileErrorStmt(v)
+	case *Expression:
+		c.compileExpr(v.expression)
+		c.emit(vm.OP_POP)
+	case *Function:
+		c.compileFunctionStmt(v)
+	case *If:
+		c.compileIfStmt(v)
+	case *Print:
+		c.compileExpr(v.expression)
+		c.emit(vm.OP_PRINT)
+	case *Return:
+		c.compileReturnStmt(v)
+	case *Var:
+		c.compileVarStmt(v)
+	case *While:
+		c.compileWhileStmt(v)
+	default:
+		panic(fmt.Sprintf("Unreachable. stmt has value %v; its type is %T which we don't know how to handle.", stmt, stmt))
+	}
+}
+
+func (c *Compiler) compileBlockStmt(stmt *Block) {
+	c.beginScope()
+	for _, statement := range stmt.statements {
+		c.compileStmt(statement)
+	}
+	c.endScope()
+}
+
+func (c *Compiler) compileClassStmt(stmt *Class) {
+	c.at(stmt.name)
+	global := len(c.current.scopes) == 0
+	name := c.declareVariable(stmt.name)
+	c.emitConstant(vm.OP_CLASS, c.identifierConstant(stmt.name))
+	c.defineVariable(name)
+	// The class itself isn't a reference that the resolver has found,
+	// but it's just been declared, so it's in the slot (or global) that
+	// declareVariable gave it.
+	getClass := func() {
+		c.at(stmt.name)
+		if global {
+			c.emitConstant(vm.OP_GET_GLOBAL, name)
+		} else {
+			c.emit(vm.OP_GET_LOCAL, byte(name))
+		}
+	}
+
+	if stmt.superclass != nil {
+		c.compileVariableExpr(stmt.superclass)
+		// super is a local in a scope around the methods, so that they
+		// capture it like any other variable.
+		c.beginScope()
+		c.addLocal(Token{IDENTIFIER, "super", nil, stmt.name.line, 0, 0, ""})
+
+		getClass()
+		c.at(stmt.superclass.name)
+		c.emit(vm.OP_INHERIT)
+	}
+
+	getClass()
+	for _, method := range stmt.methods {
+		var kind FunctionType = FT_METHOD
+		if method.name.lexeme == "init" {
+			kind = FT_INITIALIZER
+		}
+		c.compileFunction(method, kind)
+		c.emitConstant(vm.OP_METHOD, c.identifierConstant(method.name))
+	}
+	c.emit(vm.OP_POP)
+
+	if stmt.superclass != nil {
+		c.endScope()
+	}
+}
+
+func (c *Compiler) compileErrorStmt(stmt *ErrorStmt) {
+	token := Token{EOF, "", nil, 0, 0, 0, ""}
+	if len(stmt.tokens) > 0 {
+		token = stmt.tokens[0]
+	}
+	c.reportError(token, "Can't compile a statement with a syntax error.")
+}
+
+func (c *Compiler) compileFunctionStmt(stmt *Function) {
+	c.at(stmt.name)
+	// The function can refer to itself, so it gets its slot before its
+	// body is compiled.
+	name := c.declareVariable(stmt.name)
+	c.compileFunction(stmt, FT_FUNCTION)
+	c.defineVariable(name)
+}
+
+// compileFunction compiles function's body into a function of its own, and
+// emits the code to make a closure of it.
+func (c *Compiler) compileFunction(function *Function, kind FunctionType) {
+	c.beginFunction(function.name.lexeme, kind)
+	c.beginScope()
+	compiled := c.current.function
+	compiled.Arity = len(function.params)
+	for _, source := range function.upvalues {
+		if source.isThis {
+			c.current.upvalues = append(c.current.upvalues, -1)
+			continue
+		}
+		if compiled.UpvalueCount == maxUpvalues {
+			c.reportError(function.name, "Too many closure variables in function.")
+		}
+		c.current.upvalues = append(c.current.upvalues, compiled.UpvalueCount)
+		compiled.UpvalueCount++
+	}
+	for _, param := range function.params {
+		c.declareVariable(param)
+	}
+	for _, stmt := range function.body {
+		c.compileStmt(stmt)
+	}
+	c.endFunction()
+
+	// The upvalues come from where the resolver found them, from the
+	// scope that the function is made in, which is the innermost one:
+	// a method's is outside "this", which the compiler has no scope for.
+	c.at(function.name)
+	c.emitConstant(vm.OP_CLOSURE, c.makeConstant(function.name, compiled))
+	for _, source := range function.upvalues {
+		if source.isThis {
+			continue
+		}
+		index, isLocal := c.current.find(source.from)
+		if isLocal {
+			c.current.captured[index] = true
+			c.emitBytes(1, byte(index))
+		} else {
+			c.emitBytes(0, byte(index))
+		}
+	}
+}
+
+func (c *Compiler) compileIfStmt(stmt *If) {
+	c.compileExpr(stmt.condition)
+	thenJump := c.emitJump(vm.OP_JUMP_IF_FALSE)
+	c.emit(vm.OP_POP)
+	c.compileStmt(stmt.thenBranch)
+	elseJump := c.emitJump(vm.OP_JUMP)
+	c.patchJump(thenJump)
+	c.emit(vm.OP_POP)
+	if stmt.elseBranch != nil {
+		c.compileStmt(stmt.elseBranch)
+	}
+	c.patchJump(elseJump)
+}
+
+func (c *Compiler) compileReturnStmt(stmt *Return) {
+	c.at(stmt.keyword)
+	if stmt.value == nil {
+		c.emitReturn()
+		return
+	}
+	c.compileExpr(stmt.value)
+	c.emit(vm.OP_RETURN)
+}
+
+func (c *Compiler) compileVarStmt(stmt *Var) {
+	c.at(stmt.name)
+	name := c.declareVariable(stmt.name)
+	if stmt.initializer != nil {
+		c.compileExpr(stmt.initializer)
+	} else {
+		c.emit(vm.OP_NIL)
+	}
+	c.defineVariable(name)
+}
+
+func (c *Compiler) compileWhileStmt(stmt *While) {
+	loopStart := len(c.chunk().Code)
+	c.compileExpr(stmt.condition)
+	exitJump := c.emitJump(vm.OP_JUMP_IF_FALSE)
+	c.emit(vm.OP_POP)
+	c.compileStmt(stmt.body)
+	c.emitLoop(loopStart)
+	c.patchJump(exitJump)
+	c.emit(vm.OP_POP)
+}
+
+func (c *Compiler) compileExpr(expr Expr) {
+	switch v := expr.(type) {
+	case *Assign:
+		c.compileExpr(v.value)
+		c.namedVariable(v.name, v.local, true)
+	case *Binary:
+		c.compileBinaryExpr(v)
+	case *Call:
+		c.compileCallExpr(v)
+	case *Get:
+		c.compileExpr(v.object)
+		c.at(v.name)
+		c.emitConstant(vm.OP_GET_PROPERTY, c.identifierConstant(v.name))
+	case *Grouping:
+		c.compileExpr(v.expression)
+	case *Literal:
+		c.compileLiteralExpr(v)
+	case *Logical:
+		c.compileLogicalExpr(v)
+	case *Set:
+		c.compileExpr(v.object)
+		c.compileExpr(v.value)
+		c.at(v.name)
+		c.emitConstant(vm.OP_SET_PROPERTY, c.identifierConstant(v.name))
+	case *Super:
+		c.namedVariable(v.keyword, v.this, false)
+		c.namedVariable(v.keyword, v.local, false)
+		c.at(v.method)
+		c.emitConstant(vm.OP_GET_SUPER, c.identifierConstant(v.method))
+	case *This:
+		c.namedVariable(v.keyword, v.local, false)
+	case *Unary:
+		c.compileExpr(v.right)
+		c.at(v.operator)
+		if v.operator.tokenType == BANG {
+			c.emit(vm.OP_NOT)
+		} else {
+			c.emit(vm.OP_NEGATE)
+		}
+	case *Variable:
+		c.compileVariableExpr(v)
+	default:
+		panic(fmt.Sprintf("Unreachable. expr has value %v; its type is %T which we don't know how to handle.", expr, expr))
+	}
+}
+
+func (c *Compiler) compileBinaryExpr(expr *Binary) {
+	c.compileExpr(expr.left)
+	c.compileExpr(expr.right)
+	c.at(expr.operator)
+	switch expr.operator.tokenType {
+	case BANG_EQUAL:
+		c.emit(vm.OP_EQUAL)
+		c.emit(vm.OP_NOT)
+	case EQUAL_EQUAL:
+		c.emit(vm.OP_EQUAL)
+	case GREATER:
+		c.emit(vm.OP_GREATER)
+	case GREATER_EQUAL:
+		c.emit(vm.OP_GREATER_EQUAL)
+	case LESS:
+		c.emit(vm.OP_LESS)
+	case LESS_EQUAL:
+		c.emit(vm.OP_LESS_EQUAL)
+	case PLUS:
+		c.emit(vm.OP_ADD)
+	case MINUS:
+		c.emit(vm.OP_SUBTRACT)
+	case STAR:
+		c.emit(vm.OP_MULTIPLY)
+	case SLASH:
+		c.emit(vm.OP_DIVIDE)
+	default:
+		panic("Unreachable")
+	}
+}
+
+func (c *Compiler) compileCallExpr(expr *Call) {
+	// Calling a method straight away doesn't need a bound method. The
+	// VM reports errors in finding the method and in calling it on the
+	// same line, though, so only do it when the method's name and the
+	// call's parenthesis (where the tree-walk interpreter reports them)
+	// are on the same line.
+	switch callee := expr.callee.(type) {
+	case *Get:
+		if callee.name.line == expr.paren.line {
+			c.compileExpr(callee.object)
+			c.compileArguments(expr)
+			c.at(expr.paren)
+			c.emitConstant(vm.OP_INVOKE, c.identifierConstant(callee.name), byte(len(expr.arguments)))
+			return
+		}
+	case *Super:
+		if callee.method.line == expr.paren.line {
+			c.namedVariable(callee.keyword, callee.this, false)
+			c.compileArguments(expr)
+			c.namedVariable(callee.keyword, callee.local, false)
+			c.at(expr.paren)
+			c.emitConstant(vm.OP_SUPER_INVOKE, c.identifierConstant(callee.method), byte(len(expr.arguments)))
+			return
+		}
+	}
+	c.compileExpr(expr.callee)
+	c.compileArguments(expr)
+	c.at(expr.paren)
+	c.emit(vm.OP_CALL, byte(len(expr.arguments)))
+}
+
+func (c *Compiler) compileArguments(expr *Call) {
+	for _, argument := range expr.arguments {
+		c.compileExpr(argument)
+	}
+}
+
+func (c *Compiler) compileLiteralExpr(expr *Literal) {
+	c.at(expr.token)
+	switch v := expr.value.(type) {
+	case nil:
+		c.emit(vm.OP_NIL)
+	case bool:
+		if v {
+			c.emit(vm.OP_TRUE)
+		} else {
+			c.emit(vm.OP_FALSE)
+		}
+	default:
+		c.emitConstant(vm.OP_CONSTANT, c.makeConstant(expr.token, v))
+	}
+}
+
+func (c *Compiler) compileLogicalExpr(expr *Logical) {
+	c.compileExpr(expr.left)
+	if expr.operator.tokenType == AND {
+		endJump := c.emitJump(vm.OP_JUMP_IF_FALSE)
+		c.emit(vm.OP_POP)
+		c.compileExpr(expr.right)
+		c.patchJump(endJump)
+		return
+	}
+	elseJump := c.emitJump(vm.OP_JUMP_IF_FALSE)
+	endJump := c.emitJump(vm.OP_JUMP)
+	c.patchJump(elseJump)
+	c.emit(vm.OP_POP)
+	c.compileExpr(expr.right)
+	c.patchJump(endJump)
+}
+
+func (c *Compiler) compileVariableExpr(expr *Variable) {
+	c.namedVariable(expr.name, expr.local, false)
+}
+
+// namedVariable emits the code to get (or, if assign is true, set to the
+// value on top of the stack) the variable called name, which the resolver
+// found at local, or nil if it's a global.
+func (c *Compiler) namedVariable(name Token, local *localSlot, assign bool) {
+	c.at(name)
+	if local == nil {
+		if assign {
+			c.emitConstant(vm.OP_SET_GLOBAL, c.identifierConstant(name))
+		} else {
+			c.emitConstant(vm.OP_GET_GLOBAL, c.identifierConstant(name))
+		}
+		return
+	}
+	index, isLocal := c.current.find(*local)
+	switch {
+	case isLocal && assign:
+		c.emit(vm.OP_SET_LOCAL, byte(index))
+	case isLocal:
+		c.emit(vm.OP_GET_LOCAL, byte(index))
+	case assign:
+		c.emit(vm.OP_SET_UPVALUE, byte(index))
+	default:
+		c.emit(vm.OP_GET_UPVALUE, byte(index))
+	}
+}
+
+// find turns where the resolver found a variable, from the innermost scope,
+// into where the VM finds it: a slot in the frame, if isLocal, or else one of
+// the closure's upvalues.
+func (fc *functionCompiler) find(local localSlot) (index int, isLocal bool) {
+	if !local.upvalue {
+		return fc.scopes[len(fc.scopes)-1-local.depth] + local.index, true
+	}
+	if upvalue := fc.upvalues[local.index]; upvalue != -1 {
+		return upvalue, false
+	}
+	return 0, true
+}
+
+func (c *Compiler) beginScope() {
+	c.current.scopes = append(c.current.scopes, len(c.current.captured))
+}
+
+func (c *Compiler) endScope() {
+	fc := c.current
+	first := fc.scopes[len(fc.scopes)-1]
+	fc.scopes = fc.scopes[:len(fc.scopes)-1]
+	for len(fc.captured) > first {
+		if fc.captured[len(fc.captured)-1] {
+			c.emit(vm.OP_CLOSE_UPVALUE)
+		} else {
+			c.emit(vm.OP_POP)
+		}
+		fc.captured = fc.captured[:len(fc.captured)-1]
+	}
+}
+
+// declareVariable gives name the next slot, and returns it, unless it's a
+// global, in which case it returns the constant with its name for
+// defineVariable.
+func (c *Compiler) declareVariable(name Token) int {
+	if len(c.current.scopes) == 0 {
+		return c.identifierConstant(name)
+	}
+	return c.addLocal(name)
+}
+
+// addLocal gives a local the next slot, in the order that the resolver
+// declared them in, so that a scope's slots are in the order of the
+// resolver's indexes.
+func (c *Compiler) addLocal(name Token) int {
+	slot := len(c.current.captured)
+	if slot >= maxLocals {
+		c.reportError(name, "Too many local variables in function.")
+	}
+	c.current.captured = append(c.current.captured, false)
+	return slot
+}
+
+// defineVariable defines the variable just declared with the value on top of
+// the stack. A local's value is already where it needs to be.
+func (c *Compiler) defineVariable(name int) {
+	if len(c.current.scopes) > 0 {
+		return
+	}
+	c.emitConstant(vm.OP_DEFINE_GLOBAL, name)
+}
+
+func (c *Compiler) identifierConstant(name Token) int {
+	return c.makeConstant(name, name.lexeme)
+}
+
+func (c *Compiler) makeConstant(token Token, value any) int {
+	constant := c.chunk().AddConstant(value)
+	if constant >= maxConstants {
+		c.reportError(token, "Too many constants in one chunk.")
+		return 0
+	}
+	return constant
+}
+
+func (c *Compiler) chunk() *vm.Chunk {
+	return &c.current.function.Chunk
+}
+
+// at puts the code emitted from now on down to token's line. The tokens that
+// the parser makes up have no line, and leave it as it is.
+func (c *Compiler) at(token Token) {
+	if token.line > 0 {
+		c.line = token.line
+	}
+}
+
+func (c *Compiler) emit(op vm.OpCode, operands ...byte) {
+	c.emitBytes(append([]byte{byte(op)}, operands...)...)
+}
+
+func (c *Compiler) emitBytes(bytes ...byte) {
+	for _, b := range bytes {
+		c.chunk().Write(b, c.line)
+	}
+}
+
+// emitConstant emits op with the two-byte index of a constant, followed by
+// any other operands.
+func (c *Compiler) emitConstant(op vm.OpCode, constant int, operands ...byte) {
+	c.emit(op, append([]byte{byte(constant >> 8), byte(constant)}, operands...)...)
+}
+
+func (c *Compiler) emitReturn() {
+	if c.current.kind == FT_INITIALIZER {
+		c.emit(vm.OP_GET_LOCAL, 0)
+	} else {
+		c.emit(vm.OP_NIL)
+	}
+	c.emit(vm.OP_RETURN)
+}
+
+// emitJump emits a jump with a placeholder offset, and returns where the
+// offset is so that patchJump can fill it in.
+func (c *Compiler) emitJump(op vm.OpCode) int {
+	c.emit(op, 0xff, 0xff)
+	return len(c.chunk().Code) - 2
+}
+
+func (c *Compiler) patchJump(offset int) {
+	code := c.chunk().Code
+	jump := len(code) - offset - 2
+	if jump > maxJump {
+		c.reportError(Token{EOF, "", nil, c.line, 0, 0, ""}, "Too much code to jump over.")
+	}
+	code[offset] = byte(jump >> 8)
+	code[offset+1] = byte(jump)
+}
+
+func (c *Compiler) emitLoop(loopStart int) {
+	offset := len(c.chunk().Code) + 3 - loopStart
+	if offset > maxJump {
+		c.reportError(Token{EOF, "", nil, c.line, 0, 0, ""}, "Loop body too large.")
+	}
+	c.emit(vm.OP_LOOP, byte(offset>>8), byte(offset))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The conformance suite is the Lox programs in testdata/conformance, each
+// with a .golden file next to it holding what it should do. The programs in
+// scanning are only scanned, and the golden file lists their tokens; the
+// ones in parsing are only parsed, and it has their syntax tree. The ones in
+// resolver are parsed and resolved, and it has what "jlox resolve -json"
+// prints for them. Everything else is run, on both the tree-walk interpreter
+// and the VM, and it has what the program printed and the errors it
+// reported.
+//
+// After changing what the interpreter does on purpose, run
+//
+//	go test -run TestConformance -update
+//
+// and check the differences in the golden files before committing them.
+func TestConformance(t *testing.T) {
+	paths, err := filepath.Glob("testdata/conformance/*/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no conformance tests found")
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.ToSlash(path), ".lox")
+		name = strings.TrimPrefix(name, "testdata/conformance/")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, gotVM string
+			ran := false
+			switch filepath.Base(filepath.Dir(path)) {
+			case "scanning":
+				got = scanTranscript(string(source))
+			case "parsing":
+				got = parseTranscript(string(source))
+			case "resolver":
+				got = resolveTranscript(string(source))
+			default:
+				got = runTranscript(string(source), engineTreeWalk)
+				gotVM = runTranscript(string(source), engineVM)
+				ran = true
+			}
+
+			golden := strings.TrimSuffix(path, ".lox") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				diff := diffLines(strings.Split(string(want), "\n"), strings.Split(got, "\n"))
+				t.Errorf("%v doesn't match (- expected, + got):\n%v", golden, diff)
+			}
+			if ran && gotVM != string(want) {
+				diff := diffLines(strings.Split(string(want), "\n"), strings.Split(gotVM, "\n"))
+				t.Errorf("%v doesn't match on the VM (- expected, + got):\n%v", golden, diff)
+			}
+		})
+	}
+}
+
+func scanTranscript(source string) string {
+	var b strings.Builder
+	scanner := NewScanner(source)
+	scanner.reportError = func(int, string) {}
+	tokens := scanner.ScanTokens()
+	for _, token := range tokens {
+		fmt.Fprintf(&b, "%v:%v %v %q", token.line, token.column, token.tokenType, token.lexeme)
+		if token.literal != nil {
+			fmt.Fprintf(&b, " %v", printLiteral(token.literal))
+		}
+		b.WriteString("\n")
+	}
+	for _, token := range tokens {
+		if token.tokenType == ERROR {
+			fmt.Fprintf(&b, "error: [line %v] %v (%q)\n", token.line, token.literal, token.lexeme)
+		}
+	}
+	return b.String()
+}
+
+func parseTranscript(source string) string {
+	var b strings.Builder
+	scanner := NewScanner(source)
+	scanner.reportError = func(line int, message string) {
+		fmt.Fprintf(&b, "error: [line %v] Error: %v\n", line, message)
+	}
+	parser := NewParser(scanner.ScanTokens())
+	parser.reportError = func(token Token, message string) {
+		fmt.Fprintf(&b, "error: [line %v] Error at %q: %v\n", token.line, token.lexeme, message)
+	}
+	statements := parser.parse()
+	return b.String() + printTree(statements)
+}
+
+func resolveTranscript(source string) string {
+	var b strings.Builder
+	reportError := func(token Token, message string) {
+		fmt.Fprintf(&b, "error: [line %v] Error at %q: %v\n", token.line, token.lexeme, message)
+	}
+	parser := NewParser(NewScanner(source).ScanTokens())
+	parser.reportError = reportError
+	statements := parser.parse()
+	resolver := NewResolver()
+	resolver.reportError = reportError
+	resolver.resolveStatements(statements)
+	output, err := json.MarshalIndent(resolutionToJSON(resolver), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return b.String() + string(output) + "\n"
+}
+
+func runTranscript(source string, engine string) string {
+	run := runIsolated(source, engine, nil)
+	var b strings.Builder
+	b.WriteString(run.output)
+	for _, e := range run.errors {
+		fmt.Fprintf(&b, "error: %v\n", e)
+	}
+	if run.runtimeError != nil {
+		fmt.Fprintf(&b, "runtime error: %v\n", run.runtimeError.Error())
+	}
+	return b.String()
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// "jlox --coverage=out.lcov" records which lines of the script ran, how often
+// each function was called, and which way each branch went, and adds it to
+// out.lcov, so that several runs add up to the coverage of all of them. It's
+// written in LCOV's tracefile format (see the geninfo(1) man page), which
+// other tools can read too; "jlox coverage" merges tracefiles and turns them
+// into an HTML report.
+//
+// There are two branches for each If and While, and for each Logical:
+//
+//   - branch 0 is the then branch of an If, going round a While again, or
+//     evaluating the right-hand side of a Logical;
+//   - branch 1 is the else branch of an If (whether or not there is one),
+//     leaving a While, or short-circuiting a Logical.
+
+// fileCoverage is the coverage of one source file, which is a record in a
+// tracefile.
+type fileCoverage struct {
+	// lines has how many times each line that has a statement on it ran.
+	lines map[int]int64
+	// branches has how many times each branch was taken.
+	branches  map[branchID]int64
+	functions map[string]*functionCoverage
+}
+
+// branchID is where a branch is: block numbers the conditions on a line, and
+// branch is which way the condition went.
+type branchID struct {
+	line, block, branch int
+}
+
+type functionCoverage struct {
+	line  int
+	calls int64
+}
+
+func newFileCoverage() *fileCoverage {
+	return &fileCoverage{
+		lines:     make(map[int]int64),
+		branches:  make(map[branchID]int64),
+		functions: make(map[string]*functionCoverage),
+	}
+}
+
+// coverage is the hooks that record the coverage of a script as it runs.
+// Everything that could run is found before it starts, so that what didn't
+// run shows up with a count of 0.
+type coverage struct {
+	NoHooks
+	file *fileCoverage
+	// statements has the line of each statement, and conditions the
+	// branches that each condition chooses between.
+	statements map[Stmt]int
+	conditions map[Expr]*condition
+	functions  map[*Function]*functionCoverage
+	// blocks counts the conditions found so far on each line.
+	blocks map[int]int
+}
+
+type condition struct {
+	line, block int
+	// firstWhen is whether it takes branch 0 when its value is truthy.
+	// That's the case for everything but "or".
+	firstWhen bool
+}
+
+func newCoverage(statements []Stmt) *coverage {
+	c := &coverage{
+		file:       newFileCoverage(),
+		statements: make(map[Stmt]int),
+		conditions: make(map[Expr]*condition),
+		functions:  make(map[*Function]*functionCoverage),
+		blocks:     make(map[int]int),
+	}
+	for _, stmt := range statements {
+		c.addStmt(stmt)
+	}
+	return c
+}
+
+// addStmt finds the lines, branches and functions in stmt.
+func (c *coverage) addStmt(stmt Stmt) {
+	if stmt == nil {
+		return
+	}
+	line := 0
+	if _, ok := stmt.(*Block); !ok {
+		line = stmtLine(stmt)
+		c.statements[stmt] = line
+		c.file.lines[line] += 0
+	}
+
+	switch v := stmt.(type) {
+	case *Block:
+		for _, s := range v.statements {
+			c.addStmt(s)
+		}
+	case *Class:
+		c.addExpr(v.superclass)
+		for _, method := range v.methods {
+			c.addFunction(method, v.name.lexeme+"."+method.name.lexeme)
+		}
+	case *Expression:
+		c.addExpr(v.expression)
+	case *Function:
+		c.addFunction(v, v.name.lexeme)
+	case *If:
+		c.addCondition(v.condition, line, true)
+		c.addExpr(v.condition)
+		c.addStmt(v.thenBranch)
+		c.addStmt(v.elseBranch)
+	case *Print:
+		c.addExpr(v.expression)
+	case *Return:
+		c.addExpr(v.value)
+	case *Var:
+		c.addExpr(v.initializer)
+	case *While:
+		c.addCondition(v.condition, line, true)
+		c.addExpr(v.condition)
+		c.addStmt(v.body)
+	}
+}
+
+func (c *coverage) addFunction(function *Function, name string) {
+	// LCOV goes by the names of functions, so two with the same name
+	// have to be told apart.
+	if _, ok := c.file.functions[name]; ok {
+		name = fmt.Sprintf("%v:%v", name, function.name.line)
+	}
+	f := &functionCoverage{function.name.line, 0}
+	c.file.functions[name] = f
+	c.functions[function] = f
+	for _, stmt := range function.body {
+		c.addStmt(stmt)
+	}
+}
+
+func (c *coverage) addExpr(expr Expr) {
+	if expr == nil {
+		return
+	}
+	walkExpr(expr, func(e Expr) {
+		if logical, ok := e.(*Logical); ok {
+			c.addCondition(logical.left, tokenStart(logical.operator).line, logical.operator.tokenType != OR)
+		}
+	})
+}
+
+func (c *coverage) addCondition(expr Expr, line int, firstWhen bool) {
+	cond := &condition{line, c.blocks[line], firstWhen}
+	c.blocks[line]++
+	c.conditions[expr] = cond
+	c.file.branches[branchID{cond.line, cond.block, 0}] += 0
+	c.file.branches[branchID{cond.line, cond.block, 1}] += 0
+}
+
+func (c *coverage) BeforeStatement(i *Interpreter, stmt Stmt) {
+	if line, ok := c.statements[stmt]; ok {
+		c.file.lines[line]++
+	}
+}
+
+func (c *coverage) AfterExpression(i *Interpreter, expr Expr, value any) {
+	cond, ok := c.conditions[expr]
+	if !ok {
+		return
+	}
+	branch := 1
+	if isTruthy(value) == cond.firstWhen {
+		branch = 0
+	}
+	c.file.branches[branchID{cond.line, cond.block, branch}]++
+}
+
+func (c *coverage) BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any) {
+	var declaration *Function
+	switch v := callee.(type) {
+	case *LoxFunction:
+		declaration = v.declaration
+	case *LoxClass:
+		if init := v.findMethod("init"); init != nil {
+			declaration = init.declaration
+		}
+	}
+	if f, ok := c.functions[declaration]; ok {
+		f.calls++
+	}
+}
+
+// writeCoverage adds the coverage of the script at path to the tracefile at
+// output, which is created if it doesn't exist yet.
+func writeCoverage(c *coverage, path string, output string) error {
+	files := map[string]*fileCoverage{}
+	if file, err := os.Open(output); err == nil {
+		files, err = readLCOV(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", output, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	mergeCoverage(files, map[string]*fileCoverage{path: c.file})
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := writeLCOV(file, files); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// mergeCoverage adds the counts in from to the ones in into.
+func mergeCoverage(into map[string]*fileCoverage, from map[string]*fileCoverage) {
+	for path, file := range from {
+		merged, ok := into[path]
+		if !ok {
+			merged = newFileCoverage()
+			into[path] = merged
+		}
+		for line, count := range file.lines {
+			merged.lines[line] += count
+		}
+		for id, count := range file.branches {
+			merged.branches[id] += count
+		}
+		for name, f := range file.functions {
+			if m, ok := merged.functions[name]; ok {
+				m.calls += f.calls
+			} else {
+				merged.functions[name] = &functionCoverage{f.line, f.calls}
+			}
+		}
+	}
+}
+
+// readLCOV reads a tracefile. It only understands the records that
+// writeLCOV writes; anything else is ignored.
+func readLCOV(r io.Reader) (map[string]*fileCoverage, error) {
+	files := make(map[string]*fileCoverage)
+	var file *fileCoverage
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		kind, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		fields := strings.Split(value, ",")
+		if kind == "SF" {
+			if file = files[value]; file == nil {
+				file = newFileCoverage()
+				files[value] = file
+			}
+			continue
+		}
+		if kind == "end_of_record" {
+			file = nil
+			continue
+		}
+
+		var numbers []int64
+		var err error
+		switch kind {
+		case "DA":
+			numbers, err = parseNumbers(fields, 2)
+		case "BRDA":
+			// A taken count of "-" means the condition never
+			// ran, which is the same as 0 here.
+			if len(fields) == 4 && fields[3] == "-" {
+				fields[3] = "0"
+			}
+			numbers, err = parseNumbers(fields, 4)
+		case "FN":
+			if len(fields) < 2 {
+				err = fmt.Errorf("expected a line and a name")
+			} else {
+				numbers, err = parseNumbers(fields[:1], 1)
+			}
+		case "FNDA":
+			if len(fields) < 2 {
+				err = fmt.Errorf("expected a count and a name")
+			} else {
+				numbers, err = parseNumbers(fields[:1], 1)
+			}
+		default:
+			continue
+		}
+		if err == nil && file == nil {
+			err = fmt.Errorf("%v outside a record", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", number, err)
+		}
+
+		switch kind {
+		case "DA":
+			file.lines[int(numbers[0])] += numbers[1]
+		case "BRDA":
+			file.branches[branchID{int(numbers[0]), int(numbers[1]), int(numbers[2])}] += numbers[3]
+		case "FN":
+			name := strings.Join(fields[1:], ",")
+			if f, ok := file.functions[name]; ok {
+				f.line = int(numbers[0])
+			} else {
+				file.functions[name] = &functionCoverage{int(numbers[0]), 0}
+			}
+		case "FNDA":
+			name := strings.Join(fields[1:], ",")
+			if f, ok := file.functions[name]; ok {
+				f.calls += numbers[0]
+			} else {
+				file.functions[name] = &functionCoverage{0, numbers[0]}
+			}
+		}
+	}
+	return files, scanner.Err()
+}
+
+func parseNumbers(fields []string, count int) ([]int64, error) {
+	if len(fields) < count {
+		return nil, fmt.Errorf("expected %v numbers", count)
+	}
+	numbers := make([]int64, count)
+	for i := range numbers {
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number", fields[i])
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+func writeLCOV(w io.Writer, files map[string]*fileCoverage) error {
+	out := bufio.NewWriter(w)
+	for _, path := range sortedKeys(files) {
+		file := files[path]
+		fmt.Fprintf(out, "TN:\nSF:%v\n", path)
+
+		names := sortedKeys(file.functions)
+		sort.SliceStable(names, func(i, j int) bool {
+			return file.functions[names[i]].line < file.functions[names[j]].line
+		})
+		hit := 0
+		for _, name := range names {
+			fmt.Fprintf(out, "FN:%v,%v\n", file.functions[name].line, name)
+		}
+		for _, name := range names {
+			fmt.Fprintf(out, "FNDA:%v,%v\n", file.functions[name].calls, name)
+			if file.functions[name].calls > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "FNF:%v\nFNH:%v\n", len(names), hit)
+
+		branches := file.sortedBranches()
+		hit = 0
+		for _, id := range branches {
+			taken := strconv.FormatInt(file.branches[id], 10)
+			if !file.conditionRan(id) {
+				taken = "-"
+			}
+			fmt.Fprintf(out, "BRDA:%v,%v,%v,%v\n", id.line, id.block, id.branch, taken)
+			if file.branches[id] > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "BRF:%v\nBRH:%v\n", len(branches), hit)
+
+		lines := sortedKeys(file.lines)
+		hit = 0
+		for _, line := range lines {
+			fmt.Fprintf(out, "DA:%v,%v\n", line, file.lines[line])
+			if file.lines[line] > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(out, "LF:%v\nLH:%v\nend_of_record\n", len(lines), hit)
+	}
+	return out.Flush()
+}
+
+func (f *fileCoverage) sortedBranches() []branchID {
+	var branches []branchID
+	for id := range f.branches {
+		branches = append(branches, id)
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		a, b := branches[i], branches[j]
+		if a.line != b.line {
+			return a.line < b.line
+		}
+		if a.block != b.block {
+			return a.block < b.block
+		}
+		return a.branch < b.branch
+	})
+	return branches
+}
+
+// conditionRan is whether the condition that branch belongs to ever ran,
+// which is whether any of its branches were taken.
+func (f *fileCoverage) conditionRan(branch branchID) bool {
+	for _, b := range []int{0, 1} {
+		if f.branches[branchID{branch.line, branch.block, b}] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// coverageCommand implements "jlox coverage", which merges tracefiles and
+// writes the result as a tracefile, an HTML report, or both.
+func coverageCommand(args []string) {
+	flags := flag.NewFlagSet("coverage", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox coverage [flags] file.lcov ...")
+		fmt.Fprintln(flags.Output(), "Merges the tracefiles that \"jlox --coverage\" writes. With neither")
+		fmt.Fprintln(flags.Output(), "-o nor -html, the merged tracefile is written to standard output.")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "write the merged tracefile to `file`")
+	htmlOutput := flags.String("html", "", "write an HTML report, showing the source annotated with its coverage, to `file`")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	files := make(map[string]*fileCoverage)
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(66)
+		}
+		coverage, err := readLCOV(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			os.Exit(65)
+		}
+		mergeCoverage(files, coverage)
+	}
+
+	write := func(path string, write func(io.Writer, map[string]*fileCoverage) error) {
+		file, err := os.Create(path)
+		if err == nil {
+			err = write(file, files)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(74)
+		}
+	}
+	if *output != "" {
+		write(*output, writeLCOV)
+	}
+	if *htmlOutput != "" {
+		write(*htmlOutput, writeCoverageHTML)
+	}
+	if *output == "" && *htmlOutput == "" {
+		writeLCOV(os.Stdout, files)
+	}
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+<style>
+body { font-family: sans-serif; }
+table.source { border-collapse: collapse; font-family: monospace; }
+table.source td { padding: 0 0.5em; white-space: pre; vertical-align: top; }
+td.number, td.count { text-align: right; color: #666; }
+tr.covered td.code { background: #dfd; }
+tr.uncovered td.code { background: #fdd; }
+tr.partial td.code { background: #ffc; }
+td.branches { color: #666; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<table>
+<tr><th>File</th><th>Lines</th><th>Functions</th><th>Branches</th></tr>
+{{range .}}<tr><td><a href="#{{.Path}}">{{.Path}}</a></td><td>{{.Lines}}</td><td>{{.Functions}}</td><td>{{.Branches}}</td></tr>
+{{end}}</table>
+{{range .}}
+<h2 id="{{.Path}}">{{.Path}}</h2>
+{{if .Error}}<p>{{.Error}}</p>{{else}}<table class="source">
+{{range .Source}}<tr class="{{.Class}}"><td class="number">{{.Number}}</td><td class="count">{{.Count}}</td><td class="branches">{{.Branches}}</td><td class="code">{{.Code}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+type coverageReport struct {
+	Path                       string
+	Lines, Functions, Branches string
+	// Error says why the source couldn't be shown, if it couldn't.
+	Error  string
+	Source []coverageLine
+}
+
+type coverageLine struct {
+	Number int
+	// Count is how many times the line ran, or "" for a line without a
+	// statement.
+	Count string
+	// Branches shows the branches that start on the line, as how many
+	// of them were taken out of how many there are.
+	Branches string
+	// Class is "covered", "uncovered" or "partial" (for a line that ran
+	// but didn't take all its branches), or "" for a line without a
+	// statement.
+	Class string
+	Code  string
+}
+
+// writeCoverageHTML writes a report of the coverage of each file, reading
+// the source from the file's path.
+func writeCoverageHTML(w io.Writer, files map[string]*fileCoverage) error {
+	var reports []coverageReport
+	for _, path := range sortedKeys(files) {
+		file := files[path]
+		report := coverageReport{Path: path}
+
+		hit := 0
+		for _, count := range file.lines {
+			if count > 0 {
+				hit++
+			}
+		}
+		report.Lines = percentage(hit, len(file.lines))
+		hit = 0
+		for _, f := range file.functions {
+			if f.calls > 0 {
+				hit++
+			}
+		}
+		report.Functions = percentage(hit, len(file.functions))
+		taken, total := make(map[int]int), make(map[int]int)
+		for id, count := range file.branches {
+			total[id.line]++
+			if count > 0 {
+				taken[id.line]++
+			}
+		}
+		hit = 0
+		for _, n := range taken {
+			hit += n
+		}
+		report.Branches = percentage(hit, len(file.branches))
+
+		source, err := os.ReadFile(path)
+		if err != nil {
+			report.Error = err.Error()
+		}
+		for i, code := range strings.Split(strings.TrimSuffix(string(source), "\n"), "\n") {
+			if err != nil {
+				break
+			}
+			line := coverageLine{Number: i + 1, Code: code}
+			if count, ok := file.lines[i+1]; ok {
+				line.Count = strconv.FormatInt(count, 10)
+				switch {
+				case count == 0:
+					line.Class = "uncovered"
+				case taken[i+1] < total[i+1]:
+					line.Class = "partial"
+				default:
+					line.Class = "covered"
+				}
+			}
+			if total[i+1] > 0 {
+				line.Branches = fmt.Sprintf("%v/%v", taken[i+1], total[i+1])
+			}
+			report.Source = append(report.Source, line)
+		}
+		reports = append(reports, report)
+	}
+	return coverageTemplate.Execute(w, reports)
+}
+
+func percentage(hit, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%% (%v/%v)", 100*float64(hit)/float64(total), hit, total)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCoverage runs each program in testdata/coverage with coverage, and
+// checks the tracefile it writes against the .lcov file next to it, which
+// "go test -run TestCoverage -update" rewrites. Reading the tracefile back has
+// to give the same tracefile, and adding it to itself has to double every
+// count.
+func TestCoverage(t *testing.T) {
+	paths, err := filepath.Glob("testdata/coverage/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no coverage tests found")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			source, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hadError = false
+			interpreter := NewInterpreter()
+			statements := NewParser(NewScanner(string(source)).ScanTokens()).parse()
+			NewResolver().resolveStatements(statements)
+			if hadError {
+				t.Fatal("the program doesn't compile")
+			}
+			interpreter.stdout = io.Discard
+			coverage := newCoverage(statements)
+			interpreter.addHooks(coverage)
+			for _, stmt := range statements {
+				if _, err := interpreter.execute(stmt); err != nil {
+					break
+				}
+			}
+			var lcov bytes.Buffer
+			if err := writeLCOV(&lcov, map[string]*fileCoverage{filepath.ToSlash(path): coverage.file}); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := strings.TrimSuffix(path, ".lox") + ".lcov"
+			if *update {
+				if err := os.WriteFile(golden, lcov.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got := lcov.String(); got != string(want) {
+				t.Errorf("%v doesn't match: got\n%v", golden, got)
+			}
+
+			files, err := readLCOV(bytes.NewReader(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reread bytes.Buffer
+			writeLCOV(&reread, files)
+			if reread.String() != string(want) {
+				t.Errorf("reading %v and writing it again changed it:\n%v", golden, reread.String())
+			}
+			again, _ := readLCOV(bytes.NewReader(want))
+			mergeCoverage(again, files)
+			for name, file := range files {
+				merged := again[name]
+				for line, count := range file.lines {
+					if merged.lines[line] != 2*count {
+						t.Errorf("merged, line %v ran %v times, want %v", line, merged.lines[line], 2*count)
+					}
+				}
+				for id, count := range file.branches {
+					if merged.branches[id] != 2*count {
+						t.Errorf("merged, branch %v was taken %v times, want %v", id, merged.branches[id], 2*count)
+					}
+				}
+				for function, f := range file.functions {
+					if m := merged.functions[function]; m.line != f.line || m.calls != 2*f.calls {
+						t.Errorf("merged, %v is %+v, want it on line %v with %v calls", function, *m, f.line, 2*f.calls)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The concrete syntax tree (CST) is for tools that need to rewrite code
+// without destroying its formatting. Unlike the AST, it keeps every token,
+// including punctuation, ERROR tokens and the EOF token, and each token keeps
+// its trivia, so printing the tree gives back the source byte for byte.
+//
+// Every node has a kind and a list of children in source order, each of which
+// is either another node or a token. Parts that couldn't be parsed end up in
+// SK_ERROR nodes, which hold the tokens they cover and nothing else. Calling
+// lowerProgram turns a CST into the same AST that Parser would have made.
+
+type SyntaxKind int
+
+const (
+	SK_PROGRAM SyntaxKind = iota
+	SK_ERROR
+
+	// Declarations and statements.
+	SK_VAR_DECL
+	SK_FUN_DECL
+	SK_CLASS_DECL
+	SK_FUNCTION
+	SK_PARAMETERS
+	SK_BLOCK
+	SK_EXPR_STMT
+	SK_PRINT_STMT
+	SK_RETURN_STMT
+	SK_IF_STMT
+	SK_WHILE_STMT
+	SK_FOR_STMT
+
+	// Expressions.
+	SK_ASSIGN
+	SK_LOGICAL
+	SK_BINARY
+	SK_UNARY
+	SK_CALL
+	SK_ARGUMENTS
+	SK_GET
+	SK_GROUPING
+	SK_LITERAL
+	SK_VARIABLE
+	SK_THIS
+	SK_SUPER
+)
+
+func (k SyntaxKind) String() string {
+	switch k {
+	case SK_PROGRAM:
+		return "PROGRAM"
+	case SK_ERROR:
+		return "ERROR"
+	case SK_VAR_DECL:
+		return "VAR_DECL"
+	case SK_FUN_DECL:
+		return "FUN_DECL"
+	case SK_CLASS_DECL:
+		return "CLASS_DECL"
+	case SK_FUNCTION:
+		return "FUNCTION"
+	case SK_PARAMETERS:
+		return "PARAMETERS"
+	case SK_BLOCK:
+		return "BLOCK"
+	case SK_EXPR_STMT:
+		return "EXPR_STMT"
+	case SK_PRINT_STMT:
+		return "PRINT_STMT"
+	case SK_RETURN_STMT:
+		return "RETURN_STMT"
+	case SK_IF_STMT:
+		return "IF_STMT"
+	case SK_WHILE_STMT:
+		return "WHILE_STMT"
+	case SK_FOR_STMT:
+		return "FOR_STMT"
+	case SK_ASSIGN:
+		return "ASSIGN"
+	case SK_LOGICAL:
+		return "LOGICAL"
+	case SK_BINARY:
+		return "BINARY"
+	case SK_UNARY:
+		return "UNARY"
+	case SK_CALL:
+		return "CALL"
+	case SK_ARGUMENTS:
+		return "ARGUMENTS"
+	case SK_GET:
+		return "GET"
+	case SK_GROUPING:
+		return "GROUPING"
+	case SK_LITERAL:
+		return "LITERAL"
+	case SK_VARIABLE:
+		return "VARIABLE"
+	case SK_THIS:
+		return "THIS"
+	case SK_SUPER:
+		return "SUPER"
+	default:
+		panic(fmt.Sprintf("Unreachable. The SyntaxKind has value %d, and we don't handle that case.", int(k)))
+	}
+}
+
+type SyntaxNode struct {
+	kind     SyntaxKind
+	children []SyntaxElement
+}
+
+// SyntaxElement is a child of a SyntaxNode: either a *SyntaxNode or a Token.
+type SyntaxElement interface {
+	sealSyntax()
+}
+
+func (n *SyntaxNode) sealSyntax() {}
+func (t Token) sealSyntax()       {}
+
+var _ SyntaxElement = &SyntaxNode{}
+var _ SyntaxElement = Token{}
+
+// String gives back exactly the source the node was parsed from.
+func (n *SyntaxNode) String() string {
+	var builder strings.Builder
+	n.eachToken(func(token Token) {
+		builder.WriteString(token.trivia)
+		builder.WriteString(token.lexeme)
+	})
+	return builder.String()
+}
+
+func (n *SyntaxNode) eachToken(f func(Token)) {
+	for _, child := range n.children {
+		switch v := child.(type) {
+		case *SyntaxNode:
+			v.eachToken(f)
+		case Token:
+			f(v)
+		}
+	}
+}
+
+func (n *SyntaxNode) tokens() []Token {
+	var tokens []Token
+	n.eachToken(func(token Token) { tokens = append(tokens, token) })
+	return tokens
+}
+
+// printCST prints the tree with one child per line, which is what
+// "jlox ast -format=cst" shows.
+func printCST(node *SyntaxNode) string {
+	var builder strings.Builder
+	var walk func(node *SyntaxNode, indent int)
+	walk = func(node *SyntaxNode, indent int) {
+		printIndent(&builder, indent, node.kind.String())
+		for _, child := range node.children {
+			switch v := child.(type) {
+			case *SyntaxNode:
+				walk(v, indent+1)
+			case Token:
+				printIndent(&builder, indent+1, fmt.Sprintf("%v %q %q", v.tokenType, v.trivia, v.lexeme))
+			}
+		}
+	}
+	walk(node, 0)
+	return builder.String()
+}
+
+// cstParser follows the same grammar as Parser, and recovers from errors in
+// the same way, but it builds a CST. Rather than reporting errors, it keeps
+// them in errors. ERROR tokens from the scanner aren't skipped: like any other
+// token that doesn't fit the grammar, they end up inside an SK_ERROR node.
+type cstParser struct {
+	tokens  []Token
+	current int
+	errors  []ParseError
+}
+
+func parseCST(tokens []Token) (*SyntaxNode, []ParseError) {
+	p := &cstParser{tokens: tokens}
+	program := &SyntaxNode{kind: SK_PROGRAM}
+	for !p.isAtEnd() {
+		program.children = append(program.children, p.declaration())
+	}
+	program.children = append(program.children, p.peek())
+	return program, p.errors
+}
+
+func (p *cstParser) declaration() *SyntaxNode {
+	start := p.current
+	node, err := p.declarationOrError()
+	if err != nil {
+		p.synchronize()
+		node = &SyntaxNode{kind: SK_ERROR}
+		for _, token := range p.tokens[start:p.current] {
+			node.children = append(node.children, token)
+		}
+	}
+	return node
+}
+
+func (p *cstParser) declarationOrError() (*SyntaxNode, error) {
+	if p.check(CLASS) {
+		return p.classDeclaration()
+	}
+	if p.check(FUN) {
+		keyword := p.advance()
+		function, err := p.function("function")
+		if err != nil {
+			return nil, err
+		}
+		return &SyntaxNode{SK_FUN_DECL, []SyntaxElement{keyword, function}}, nil
+	}
+	if p.check(VAR) {
+		return p.varDeclaration()
+	}
+	return p.statement()
+}
+
+func (p *cstParser) classDeclaration() (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_CLASS_DECL}
+	node.add(p.advance())
+	if err := p.consumeInto(node, IDENTIFIER, "Expect class name."); err != nil {
+		return nil, err
+	}
+	if p.check(LESS) {
+		node.add(p.advance())
+		if err := p.consumeInto(node, IDENTIFIER, "Expect superclass name."); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consumeInto(node, LEFT_BRACE, "Expect '{' before class body."); err != nil {
+		return nil, err
+	}
+	for !p.check(RIGHT_BRACE) && !p.isAtEnd() {
+		method, err := p.function("method")
+		if err != nil {
+			return nil, err
+		}
+		node.add(method)
+	}
+	if err := p.consumeInto(node, RIGHT_BRACE, "Expect '}' after class body."); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *cstParser) function(kind string) (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_FUNCTION}
+	if err := p.consumeInto(node, IDENTIFIER, fmt.Sprintf("Expect %v name.", kind)); err != nil {
+		return nil, err
+	}
+
+	parameters := &SyntaxNode{kind: SK_PARAMETERS}
+	if err := p.consumeInto(parameters, LEFT_PAREN, fmt.Sprintf("Expect '(' after %v name.", kind)); err != nil {
+		return nil, err
+	}
+	if !p.check(RIGHT_PAREN) {
+		count := 0
+		for {
+			if count >= 255 {
+				p.addError(p.peek(), "Can't have more than 255 parameters.")
+			}
+			if err := p.consumeInto(parameters, IDENTIFIER, "Expect parameters name."); err != nil {
+				return nil, err
+			}
+			count++
+			if !p.check(COMMA) {
+				break
+			}
+			parameters.add(p.advance())
+		}
+	}
+	if err := p.consumeInto(parameters, RIGHT_PAREN, "Expect ')' after parameters."); err != nil {
+		return nil, err
+	}
+	node.add(parameters)
+
+	if !p.check(LEFT_BRACE) {
+		return nil, p.parseError(p.peek(), fmt.Sprintf("Expect '{' before %v body.", kind))
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	node.add(body)
+	return node, nil
+}
+
+func (p *cstParser) varDeclaration() (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_VAR_DECL}
+	node.add(p.advance())
+	if err := p.consumeInto(node, IDENTIFIER, "Expect variable name."); err != nil {
+		return nil, err
+	}
+	if p.check(EQUAL) {
+		node.add(p.advance())
+		initializer, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		node.add(initializer)
+	}
+	if err := p.consumeInto(node, SEMICOLON, "Expect ';' after variable declaration."); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *cstParser) statement() (*SyntaxNode, error) {
+	switch p.peek().tokenType {
+	case FOR:
+		return p.forStatement()
+	case IF:
+		return p.ifStatement()
+	case PRINT:
+		node := &SyntaxNode{kind: SK_PRINT_STMT}
+		node.add(p.advance())
+		return p.finishExpressionStatement(node, "Expect ';' after value.")
+	case RETURN:
+		node := &SyntaxNode{kind: SK_RETURN_STMT}
+		node.add(p.advance())
+		if p.check(SEMICOLON) {
+			node.add(p.advance())
+			return node, nil
+		}
+		return p.finishExpressionStatement(node, "Expect ';' after return value.")
+	case WHILE:
+		return p.whileStatement()
+	case LEFT_BRACE:
+		return p.block()
+	}
+	return p.finishExpressionStatement(&SyntaxNode{kind: SK_EXPR_STMT}, "Expect ';' after expression.")
+}
+
+// finishExpressionStatement parses the expression and semicolon that end
+// print, return and expression statements.
+func (p *cstParser) finishExpressionStatement(node *SyntaxNode, message string) (*SyntaxNode, error) {
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	node.add(expr)
+	if err := p.consumeInto(node, SEMICOLON, message); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *cstParser) forStatement() (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_FOR_STMT}
+	node.add(p.advance())
+	if err := p.consumeInto(node, LEFT_PAREN, "Expect '(' after 'for'."); err != nil {
+		return nil, err
+	}
+
+	if p.check(SEMICOLON) {
+		node.add(p.advance())
+	} else {
+		var initializer *SyntaxNode
+		var err error
+		if p.check(VAR) {
+			initializer, err = p.varDeclaration()
+		} else {
+			initializer, err = p.finishExpressionStatement(&SyntaxNode{kind: SK_EXPR_STMT}, "Expect ';' after expression.")
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.add(initializer)
+	}
+
+	if !p.check(SEMICOLON) {
+		condition, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		node.add(condition)
+	}
+	if err := p.consumeInto(node, SEMICOLON, "Expect ';' after loop condition."); err != nil {
+		return nil, err
+	}
+
+	if !p.check(RIGHT_PAREN) {
+		increment, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		node.add(increment)
+	}
+	if err := p.consumeInto(node, RIGHT_PAREN, "Expect ')' after for clauses."); err != nil {
+		return nil, err
+	}
+
+	body, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	node.add(body)
+	return node, nil
+}
+
+func (p *cstParser) ifStatement() (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_IF_STMT}
+	node.add(p.advance())
+	if err := p.consumeInto(node, LEFT_PAREN, "Expect '(' after 'if'."); err != nil {
+		return nil, err
+	}
+	condition, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	node.add(condition)
+	if err := p.consumeInto(node, RIGHT_PAREN, "Expect ')' after if condition."); err != nil {
+		return nil, err
+	}
+
+	thenBranch, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	node.add(thenBranch)
+	if p.check(ELSE) {
+		node.add(p.advance())
+		elseBranch, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		node.add(elseBranch)
+	}
+	return node, nil
+}
+
+func (p *cstParser) whileStatement() (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_WHILE_STMT}
+	node.add(p.advance())
+	if err := p.consumeInto(node, LEFT_PAREN, "Expect '(' after 'while'."); err != nil {
+		return nil, err
+	}
+	condition, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	node.add(condition)
+	if err := p.consumeInto(node, RIGHT_PAREN, "Expect ')' after condition."); err != nil {
+		return nil, err
+	}
+	body, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	node.add(body)
+	return node, nil
+}
+
+func (p *cstParser) block() (*SyntaxNode, error) {
+	node := &SyntaxNode{kind: SK_BLOCK}
+	node.add(p.advance())
+	for !p.check(RIGHT_BRACE) && !p.isAtEnd() {
+		node.add(p.declaration())
+	}
+	if err := p.consumeInto(node, RIGHT_BRACE, "Expect '}' after block."); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *cstParser) expression() (*SyntaxNode, error) {
+	expr, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.check(EQUAL) {
+		equals := p.advance()
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if expr.kind != SK_VARIABLE && expr.kind != SK_GET {
+			p.addError(equals, "Invalid assignment target.")
+		}
+		return &SyntaxNode{SK_ASSIGN, []SyntaxElement{expr, equals, value}}, nil
+	}
+	return expr, nil
+}
+
+// binaryLevels are the operators of each level of precedence, from lowest
+// to highest, down to (but not including) unary operators.
+var binaryLevels = [][]TokenType{
+	{OR},
+	{AND},
+	{BANG_EQUAL, EQUAL_EQUAL},
+	{GREATER, GREATER_EQUAL, LESS, LESS_EQUAL},
+	{MINUS, PLUS},
+	{SLASH, STAR},
+}
+
+// binary parses all the left-associative binary operators with a
+// precedence of at least binaryLevels[level]. It does the same job as
+// Parser's or(), and(), equality() and so on, just without writing the same
+// function out six times.
+func (p *cstParser) binary(level int) (*SyntaxNode, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+
+	expr, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.check(binaryLevels[level]...) {
+		operator := p.advance()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		kind := SK_BINARY
+		if operator.tokenType == AND || operator.tokenType == OR {
+			kind = SK_LOGICAL
+		}
+		expr = &SyntaxNode{kind, []SyntaxElement{expr, operator, right}}
+	}
+	return expr, nil
+}
+
+func (p *cstParser) unary() (*SyntaxNode, error) {
+	if p.check(BANG, MINUS) {
+		operator := p.advance()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &SyntaxNode{SK_UNARY, []SyntaxElement{operator, right}}, nil
+	}
+	return p.call()
+}
+
+func (p *cstParser) call() (*SyntaxNode, error) {
+	expr, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if p.check(LEFT_PAREN) {
+			arguments := &SyntaxNode{kind: SK_ARGUMENTS}
+			arguments.add(p.advance())
+			if !p.check(RIGHT_PAREN) {
+				count := 0
+				for {
+					if count >= 255 {
+						p.addError(p.peek(), "Can't have more than 255 arguments.")
+					}
+					argument, err := p.expression()
+					if err != nil {
+						return nil, err
+					}
+					arguments.add(argument)
+					count++
+					if !p.check(COMMA) {
+						break
+					}
+					arguments.add(p.advance())
+				}
+			}
+			if err := p.consumeInto(arguments, RIGHT_PAREN, "Expect ')' after arguments."); err != nil {
+				return nil, err
+			}
+			expr = &SyntaxNode{SK_CALL, []SyntaxElement{expr, arguments}}
+		} else if p.check(DOT) {
+			node := &SyntaxNode{SK_GET, []SyntaxElement{expr, p.advance()}}
+			if err := p.consumeInto(node, IDENTIFIER, "Expect property name after '.'."); err != nil {
+				return nil, err
+			}
+			expr = node
+		} else {
+			break
+		}
+	}
+	return expr, nil
+}
+
+func (p *cstParser) primary() (*SyntaxNode, error) {
+	switch p.peek().tokenType {
+	case FALSE, TRUE, NIL, NUMBER, STRING:
+		return &SyntaxNode{SK_LITERAL, []SyntaxElement{p.advance()}}, nil
+	case SUPER:
+		node := &SyntaxNode{SK_SUPER, []SyntaxElement{p.advance()}}
+		if err := p.consumeInto(node, DOT, "Expect '.' after 'super'."); err != nil {
+			return nil, err
+		}
+		if err := p.consumeInto(node, IDENTIFIER, "Expect superclass method name."); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case THIS:
+		return &SyntaxNode{SK_THIS, []SyntaxElement{p.advance()}}, nil
+	case IDENTIFIER:
+		return &SyntaxNode{SK_VARIABLE, []SyntaxElement{p.advance()}}, nil
+	case LEFT_PAREN:
+		node := &SyntaxNode{SK_GROUPING, []SyntaxElement{p.advance()}}
+		expr, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		node.add(expr)
+		if err := p.consumeInto(node, RIGHT_PAREN, "Expect ')' after expression."); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	return nil, p.parseError(p.peek(), "Expect expression.")
+}
+
+func (n *SyntaxNode) add(child SyntaxElement) {
+	n.children = append(n.children, child)
+}
+
+// consumeInto is like Parser.consume, except that the token goes straight
+// into node.
+func (p *cstParser) consumeInto(node *SyntaxNode, tokenType TokenType, message string) error {
+	if !p.check(tokenType) {
+		return p.parseError(p.peek(), message)
+	}
+	node.add(p.advance())
+	return nil
+}
+
+func (p *cstParser) addError(token Token, message string) {
+	p.errors = append(p.errors, ParseError{token, message})
+}
+
+func (p *cstParser) parseError(token Token, message string) error {
+	p.addError(token, message)
+	return p.errors[len(p.errors)-1]
+}
+
+func (p *cstParser) synchronize() {
+	p.advance()
+	for !p.isAtEnd() {
+		if p.previous().tokenType == SEMICOLON {
+			return
+		}
+		switch p.peek().tokenType {
+		case CLASS, FUN, VAR, FOR, IF, WHILE, PRINT, RETURN:
+			return
+		}
+		p.advance()
+	}
+}
+
+func (p *cstParser) check(tokenTypes ...TokenType) bool {
+	if p.isAtEnd() {
+		return false
+	}
+	for _, tokenType := range tokenTypes {
+		if p.peek().tokenType == tokenType {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *cstParser) advance() Token {
+	if !p.isAtEnd() {
+		p.current++
+	}
+	return p.previous()
+}
+
+func (p *cstParser) isAtEnd() bool {
+	return p.peek().tokenType == EOF
+}
+
+func (p *cstParser) peek() Token {
+	return p.tokens[p.current]
+}
+
+func (p *cstParser) previous() Token {
+	return p.tokens[p.current-1]
+}
+
+// lowerProgram turns a CST into the AST that Parser makes from the same
+// tokens. SK_ERROR nodes become ErrorStmts.
+func lowerProgram(program *SyntaxNode) []Stmt {
+	statements := []Stmt{}
+	for _, child := range program.children {
+		if node, ok := child.(*SyntaxNode); ok {
+			statements = append(statements, lowerStmt(node))
+		}
+	}
+	return statements
+}
+
+func lowerStmt(node *SyntaxNode) Stmt {
+	switch node.kind {
+	case SK_ERROR:
+		return &ErrorStmt{node.tokens()}
+	case SK_VAR_DECL:
+		var initializer Expr
+		if len(node.children) == 5 {
+			initializer = lowerExpr(node.children[3].(*SyntaxNode))
+		}
+		return &Var{node.children[1].(Token), initializer}
+	case SK_FUN_DECL:
+		return lowerFunction(node.children[1].(*SyntaxNode))
+	case SK_CLASS_DECL:
+		name := node.children[1].(Token)
+		var superclass *Variable
+		if next, ok := node.children[2].(Token); ok && next.tokenType == LESS {
+			superclass = &Variable{node.children[3].(Token), nil}
+		}
+		methods := []*Function{}
+		for _, child := range node.children {
+			if method, ok := child.(*SyntaxNode); ok {
+				methods = append(methods, lowerFunction(method))
+			}
+		}
+		return &Class{name, superclass, methods}
+	case SK_BLOCK:
+		return &Block{lowerBlock(node), nil}
+	case SK_EXPR_STMT:
+		return &Expression{lowerExpr(node.children[0].(*SyntaxNode))}
+	case SK_PRINT_STMT:
+		return &Print{lowerExpr(node.children[1].(*SyntaxNode))}
+	case SK_RETURN_STMT:
+		var value Expr
+		if expr, ok := node.children[1].(*SyntaxNode); ok {
+			value = lowerExpr(expr)
+		}
+		return &Return{node.children[0].(Token), value}
+	case SK_IF_STMT:
+		var elseBranch Stmt
+		if len(node.children) == 7 {
+			elseBranch = lowerStmt(node.children[6].(*SyntaxNode))
+		}
+		return &If{
+			lowerExpr(node.children[2].(*SyntaxNode)),
+			lowerStmt(node.children[4].(*SyntaxNode)),
+			elseBranch,
+		}
+	case SK_WHILE_STMT:
+		return &While{lowerExpr(node.children[2].(*SyntaxNode)), lowerStmt(node.children[4].(*SyntaxNode))}
+	case SK_FOR_STMT:
+		return lowerFor(node)
+	default:
+		panic(fmt.Sprintf("Unreachable. %v isn't a statement.", node.kind))
+	}
+}
+
+func lowerBlock(node *SyntaxNode) []Stmt {
+	var statements []Stmt
+	for _, child := range node.children {
+		if stmt, ok := child.(*SyntaxNode); ok {
+			statements = append(statements, lowerStmt(stmt))
+		}
+	}
+	return statements
+}
+
+func lowerFunction(node *SyntaxNode) *Function {
+	params := []Token{}
+	for _, child := range node.children[1].(*SyntaxNode).children {
+		if token := child.(Token); token.tokenType == IDENTIFIER {
+			params = append(params, token)
+		}
+	}
+	return &Function{node.children[0].(Token), params, lowerBlock(node.children[2].(*SyntaxNode)), nil, nil}
+}
+
+// lowerFor desugars a for loop into a while loop, just like
+// Parser.forStatement.
+func lowerFor(node *SyntaxNode) Stmt {
+	// The children are: "for", "(", the initializer (a statement, or just
+	// ";"), the condition if there is one, ";", the increment if there is
+	// one, ")", and the body.
+	var initializer Stmt
+	var condition, increment Expr
+	rest := node.children[2:]
+	if stmt, ok := rest[0].(*SyntaxNode); ok {
+		initializer = lowerStmt(stmt)
+	}
+	rest = rest[1:]
+	if expr, ok := rest[0].(*SyntaxNode); ok {
+		condition = lowerExpr(expr)
+		rest = rest[1:]
+	}
+	rest = rest[1:]
+	if expr, ok := rest[0].(*SyntaxNode); ok {
+		increment = lowerExpr(expr)
+		rest = rest[1:]
+	}
+	body := lowerStmt(rest[1].(*SyntaxNode))
+
+	if increment != nil {
+		body = &Block{[]Stmt{body, &Expression{increment}}, nil}
+	}
+	if condition == nil {
+		condition = &Literal{true, Token{}}
+	}
+	body = &While{condition, body}
+	if initializer != nil {
+		body = &Block{[]Stmt{initializer, body}, nil}
+	}
+	return body
+}
+
+func lowerExpr(node *SyntaxNode) Expr {
+	switch node.kind {
+	case SK_ASSIGN:
+		target := lowerExpr(node.children[0].(*SyntaxNode))
+		value := lowerExpr(node.children[2].(*SyntaxNode))
+		switch v := target.(type) {
+		case *Variable:
+			return &Assign{v.name, value, nil}
+		case *Get:
+			return &Set{v.object, v.name, value, nil}
+		}
+		// Like Parser, drop an assignment to an invalid target
+		// (which has already been reported) and keep just the target.
+		return target
+	case SK_LOGICAL:
+		return &Logical{lowerExpr(node.children[0].(*SyntaxNode)), node.children[1].(Token), lowerExpr(node.children[2].(*SyntaxNode))}
+	case SK_BINARY:
+		return &Binary{lowerExpr(node.children[0].(*SyntaxNode)), node.children[1].(Token), lowerExpr(node.children[2].(*SyntaxNode))}
+	case SK_UNARY:
+		return &Unary{node.children[0].(Token), lowerExpr(node.children[1].(*SyntaxNode))}
+	case SK_CALL:
+		arguments := []Expr{}
+		var paren Token
+		for _, child := range node.children[1].(*SyntaxNode).children {
+			switch v := child.(type) {
+			case *SyntaxNode:
+				arguments = append(arguments, lowerExpr(v))
+			case Token:
+				paren = v
+			}
+		}
+		return &Call{lowerExpr(node.children[0].(*SyntaxNode)), paren, arguments}
+	case SK_GET:
+		return &Get{lowerExpr(node.children[0].(*SyntaxNode)), node.children[2].(Token), nil}
+	case SK_GROUPING:
+		return &Grouping{lowerExpr(node.children[1].(*SyntaxNode))}
+	case SK_LITERAL:
+		token := node.children[0].(Token)
+		switch token.tokenType {
+		case FALSE:
+			return &Literal{false, token}
+		case TRUE:
+			return &Literal{true, token}
+		case NIL:
+			return &Literal{nil, token}
+		}
+		return &Literal{token.literal, token}
+	case SK_VARIABLE:
+		return &Variable{node.children[0].(Token), nil}
+	case SK_THIS:
+		return &This{node.children[0].(Token), nil}
+	case SK_SUPER:
+		return &Super{node.children[0].(Token), node.children[2].(Token), nil, nil}
+	default:
+		panic(fmt.Sprintf("Unreachable. %v isn't an expression.", node.kind))
+	}
+}
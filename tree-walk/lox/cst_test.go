@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzCST checks that the CST gives back the source exactly, and that for a
+// program without errors, lowering it gives the same AST as Parser does.
+func FuzzCST(f *testing.F) {
+	examples, err := filepath.Glob("../examples/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, example := range examples {
+		source, err := os.ReadFile(example)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(source))
+	}
+	f.Add("for (var i = 0; i < 3; i = i + 1) print i; for (;;) {} for (a = 1; ; ) a.b = c;")
+	f.Add("var a = ; @ print \"unterminated")
+	f.Add("class A < B { m(a, b) { return super.m(a)(b) or !c and -d; } }")
+
+	f.Fuzz(func(t *testing.T, source string) {
+		scanner := NewScanner(source)
+		scanner.reportError = func(int, string) {}
+		tokens := scanner.ScanTokens()
+		program, errors := parseCST(tokens)
+		if got := program.String(); got != source {
+			t.Fatalf("CST printed as\n%q\ninstead of\n%q", got, source)
+		}
+
+		lowered := lowerProgram(program)
+		if len(errors) > 0 {
+			return
+		}
+		statements, parserErrors := parseWithParser(tokens)
+		if len(parserErrors) > 0 {
+			t.Fatalf("the CST parser found no errors but Parser did in\n%v", source)
+		}
+		if got, want := printStatements(lowered), printStatements(statements); got != want {
+			t.Fatalf("lowering the CST gave\n%v\ninstead of\n%v", got, want)
+		}
+	})
+}
+
+// TestCSTParserAgrees checks that the CST parser and Parser, which implement
+// the same grammar separately, accept and reject the same programs in the
+// conformance suite, and find the same syntax errors in them. A program with
+// scanning errors is rejected either way, and there they're allowed to
+// differ: Parser never sees the ERROR tokens, while the CST parser has to
+// fit them into the tree.
+func TestCSTParserAgrees(t *testing.T) {
+	paths, err := filepath.Glob("testdata/conformance/*/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := 0
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanErrors := 0
+		scanner := NewScanner(string(source))
+		scanner.reportError = func(int, string) { scanErrors++ }
+		tokens := scanner.ScanTokens()
+		_, cstErrors := parseCST(tokens)
+		_, parserErrors := parseWithParser(tokens)
+
+		cstAccepts := scanErrors == 0 && len(cstErrors) == 0
+		parserAccepts := scanErrors == 0 && len(parserErrors) == 0
+		if cstAccepts != parserAccepts {
+			t.Errorf("%v: the CST parser found the errors %v but Parser found %v", path, cstErrors, parserErrors)
+			continue
+		}
+		if !parserAccepts {
+			rejected++
+		}
+		if scanErrors > 0 {
+			continue
+		}
+		if got, want := fmt.Sprint(cstErrors), fmt.Sprint(parserErrors); got != want {
+			t.Errorf("%v: the CST parser found the errors\n%v\nbut Parser found\n%v", path, got, want)
+		}
+	}
+	// Make sure the suite still has programs that should be rejected.
+	if rejected == 0 {
+		t.Error("none of the conformance tests have syntax errors")
+	}
+}
+
+// parseWithParser parses tokens with Parser, and returns the errors it
+// reported instead of logging them.
+func parseWithParser(tokens []Token) ([]Stmt, []ParseError) {
+	var errors []ParseError
+	parser := NewParser(tokens)
+	parser.reportError = func(token Token, message string) {
+		errors = append(errors, ParseError{token, message})
+	}
+	return parser.parse(), errors
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// dapCommand implements "jlox dap", a Debug Adapter Protocol server that
+// talks to an editor over standard input and output. It debugs one script
+// at a time, with line breakpoints (which can have a Lox expression as their
+// condition), stepping, the call stack, and the variables in each frame. See
+// debugger.go for how the program is stopped and inspected.
+func dapCommand(args []string) {
+	flags := flag.NewFlagSet("dap", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox dap")
+		fmt.Fprintln(flags.Output(), "Runs a debug adapter on standard input and output, for editors to start.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	interpreter := NewInterpreter()
+	server := &dapServer{
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stdout,
+		interpreter: &interpreter,
+		debugger:    newDebugger(interpreter.globals, SM_CONTINUE),
+	}
+	interpreter.addHooks(server.debugger)
+	interpreter.stdout = dapOutput{server, "stdout"}
+	os.Exit(server.serve())
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Command    string `json:"command"`
+	Success    bool   `json:"success"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// The protocol lets us pick the IDs of the one thread and of the frames;
+// frame IDs are the frame's index in debugger.frames, plus one since 0
+// isn't allowed.
+const dapThreadID = 1
+
+type dapServer struct {
+	in *bufio.Reader
+
+	// mu guards out and seq, since events come from the program's
+	// goroutine as well as the one answering requests.
+	mu  sync.Mutex
+	out io.Writer
+	seq int
+
+	interpreter *Interpreter
+	debugger    *debugger
+	program     string
+	statements  []Stmt
+	stopOnEntry bool
+	// launched and configured are whether we've had the launch and
+	// configurationDone requests; the program starts once we've had both.
+	launched   bool
+	configured bool
+
+	// state guards stopped and handles, which are set when the program
+	// stops and used by the requests that look at it.
+	state   sync.Mutex
+	stopped bool
+	// handles are what each variablesReference refers to: an
+	// *Environment or a *LoxInstance. They only last until the program
+	// carries on, so they're thrown away each time it stops.
+	handles []any
+}
+
+// serve handles requests until the client disconnects, and returns the exit
+// status.
+func (s *dapServer) serve() int {
+	for {
+		body, err := readFramed(s.in)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return 1
+		}
+		var request dapRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			fmt.Fprintf(os.Stderr, "bad message: %v\n", err)
+			return 1
+		}
+		if request.Command == "disconnect" || request.Command == "terminate" {
+			s.respond(&request, nil)
+			return 0
+		}
+		s.state.Lock()
+		err = s.handle(&request)
+		s.state.Unlock()
+		if err != nil {
+			s.fail(&request, err)
+		}
+	}
+}
+
+func (s *dapServer) send(message any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	switch m := message.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	body, err := json.Marshal(message)
+	if err == nil {
+		err = writeFramed(s.out, body)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (s *dapServer) respond(request *dapRequest, body any) {
+	s.send(&dapResponse{Type: "response", RequestSeq: request.Seq, Command: request.Command, Success: true, Body: body})
+}
+
+func (s *dapServer) fail(request *dapRequest, err error) {
+	s.send(&dapResponse{Type: "response", RequestSeq: request.Seq, Command: request.Command, Success: false, Message: err.Error()})
+}
+
+func (s *dapServer) event(event string, body any) {
+	s.send(&dapEvent{Type: "event", Event: event, Body: body})
+}
+
+// dapOutput sends whatever is written to it to the editor, as output of the
+// given category ("stdout" or "stderr").
+type dapOutput struct {
+	server   *dapServer
+	category string
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.server.event("output", map[string]any{"category": o.category, "output": string(p)})
+	return len(p), nil
+}
+
+// handle answers a request, returning an error if it failed. Requests that
+// let the program carry on answer before they do, so that the client gets
+// the answer before hearing that the program has stopped again.
+func (s *dapServer) handle(request *dapRequest) error {
+	switch request.Command {
+	case "initialize":
+		s.respond(request, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		})
+		s.event("initialized", nil)
+	case "launch":
+		var arguments struct {
+			Program     string `json:"program"`
+			StopOnEntry bool   `json:"stopOnEntry"`
+		}
+		if err := json.Unmarshal(request.Arguments, &arguments); err != nil {
+			return err
+		}
+		if err := s.load(arguments.Program); err != nil {
+			return err
+		}
+		s.stopOnEntry = arguments.StopOnEntry
+		s.launched = true
+		s.respond(request, nil)
+		s.start()
+	case "configurationDone":
+		s.configured = true
+		s.respond(request, nil)
+		s.start()
+	case "setBreakpoints":
+		var arguments struct {
+			Breakpoints []struct {
+				Line      int    `json:"line"`
+				Condition string `json:"condition"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(request.Arguments, &arguments); err != nil {
+			return err
+		}
+		var breakpoints []*breakpoint
+		results := []map[string]any{}
+		for _, b := range arguments.Breakpoints {
+			var condition Expr
+			if b.Condition != "" {
+				var err error
+				if condition, err = parseExpression(b.Condition); err != nil {
+					results = append(results, map[string]any{"verified": false, "line": b.Line, "message": err.Error()})
+					continue
+				}
+			}
+			breakpoints = append(breakpoints, &breakpoint{b.Line, condition})
+			results = append(results, map[string]any{"verified": true, "line": b.Line})
+		}
+		s.debugger.setBreakpoints(breakpoints)
+		s.respond(request, map[string]any{"breakpoints": results})
+	case "threads":
+		s.respond(request, map[string]any{
+			"threads": []map[string]any{{"id": dapThreadID, "name": "main"}},
+		})
+	case "stackTrace":
+		frames := []map[string]any{}
+		if s.stopped {
+			for i := len(s.debugger.frames) - 1; i >= 0; i-- {
+				f := s.debugger.frames[i]
+				frames = append(frames, map[string]any{
+					"id":     i + 1,
+					"name":   f.name,
+					"line":   f.line,
+					"column": 1,
+					"source": map[string]any{"name": filepath.Base(s.program), "path": s.program},
+				})
+			}
+		}
+		s.respond(request, map[string]any{"stackFrames": frames, "totalFrames": len(frames)})
+	case "scopes":
+		f, err := s.frame(request.Arguments)
+		if err != nil {
+			return err
+		}
+		scopes := []map[string]any{}
+		if f.environment != s.interpreter.globals {
+			scopes = append(scopes, map[string]any{"name": "Locals", "variablesReference": s.reference(f.environment), "expensive": false})
+		}
+		scopes = append(scopes, map[string]any{"name": "Globals", "variablesReference": s.reference(s.interpreter.globals), "expensive": false})
+		s.respond(request, map[string]any{"scopes": scopes})
+	case "variables":
+		var arguments struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(request.Arguments, &arguments); err != nil {
+			return err
+		}
+		if !s.stopped || arguments.VariablesReference < 1 || arguments.VariablesReference > len(s.handles) {
+			return errors.New("no such variables")
+		}
+		var variables []variable
+		switch v := s.handles[arguments.VariablesReference-1].(type) {
+		case *Environment:
+			if v == s.interpreter.globals {
+				variables = valuesVariables(v.values)
+			} else {
+				variables = environmentVariables(v, s.interpreter.globals)
+			}
+		case *LoxInstance:
+			variables = instanceVariables(v)
+		}
+		result := []dapVariable{}
+		for _, v := range variables {
+			result = append(result, s.variable(v.name, v.value))
+		}
+		s.respond(request, map[string]any{"variables": result})
+	case "evaluate":
+		var arguments struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		if err := json.Unmarshal(request.Arguments, &arguments); err != nil {
+			return err
+		}
+		if !s.stopped {
+			return errors.New("The program has to be stopped to evaluate expressions.")
+		}
+		index := len(s.debugger.frames) - 1
+		if arguments.FrameID > 0 && arguments.FrameID <= len(s.debugger.frames) {
+			index = arguments.FrameID - 1
+		}
+		expr, err := parseExpression(arguments.Expression)
+		if err != nil {
+			return err
+		}
+		value, err := s.debugger.evaluate(s.interpreter, expr, index)
+		if rte, ok := err.(RuntimeError); ok {
+			// The line would be the expression's own, which isn't
+			// any use.
+			return errors.New(rte.message)
+		} else if err != nil {
+			return err
+		}
+		result := s.variable("", value)
+		s.respond(request, map[string]any{"result": result.Value, "variablesReference": result.VariablesReference})
+	case "continue":
+		s.respond(request, map[string]any{"allThreadsContinued": true})
+		s.carryOn(SM_CONTINUE)
+	case "next":
+		s.respond(request, nil)
+		s.carryOn(SM_NEXT)
+	case "stepIn":
+		s.respond(request, nil)
+		s.carryOn(SM_STEP)
+	case "stepOut":
+		s.respond(request, nil)
+		s.carryOn(SM_FINISH)
+	case "pause":
+		s.debugger.pause()
+		s.respond(request, nil)
+	default:
+		return fmt.Errorf("unsupported request %q", request.Command)
+	}
+	return nil
+}
+
+// load reads, parses and resolves the program, sending any errors to the
+// editor as output.
+func (s *dapServer) load(path string) error {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	failed := false
+	stderr := dapOutput{s, "stderr"}
+	reportError := func(token Token, message string) {
+		failed = true
+		if token.tokenType == EOF {
+			fmt.Fprintf(stderr, "[line %d] Error at end: %v\n", token.line, message)
+		} else {
+			fmt.Fprintf(stderr, "[line %d] Error at '%v': %v\n", token.line, token.lexeme, message)
+		}
+	}
+
+	scanner := NewScanner(string(source))
+	scanner.reportError = func(line int, message string) {
+		failed = true
+		fmt.Fprintf(stderr, "[line %d] Error: %v\n", line, message)
+	}
+	parser := NewParser(scanner.ScanTokens())
+	parser.reportError = reportError
+	statements := parser.parse()
+	if !failed {
+		resolver := NewResolver()
+		resolver.reportError = reportError
+		resolver.resolveStatements(statements)
+	}
+	if failed {
+		return fmt.Errorf("%v has errors, so it can't be run.", path)
+	}
+	s.program = path
+	s.statements = statements
+	return nil
+}
+
+// start runs the program in a goroutine of its own, once it's been launched
+// and the editor has finished setting breakpoints.
+func (s *dapServer) start() {
+	if !s.launched || !s.configured {
+		return
+	}
+	if s.stopOnEntry {
+		s.debugger.pause()
+	}
+
+	go func() {
+		first := true
+		for event := range s.debugger.stops {
+			reason := event.reason
+			if first && s.stopOnEntry {
+				reason = "entry"
+			}
+			first = false
+			s.state.Lock()
+			s.stopped = true
+			s.handles = nil
+			s.state.Unlock()
+			s.event("stopped", map[string]any{"reason": reason, "description": event.description, "threadId": dapThreadID, "allThreadsStopped": true})
+		}
+	}()
+
+	go func() {
+		status := 0
+		for _, statement := range s.statements {
+			if _, err := s.interpreter.execute(statement); err != nil {
+				fmt.Fprintln(dapOutput{s, "stderr"}, err)
+				status = 70
+				break
+			}
+		}
+		s.event("exited", map[string]any{"exitCode": status})
+		s.event("terminated", nil)
+	}()
+}
+
+func (s *dapServer) carryOn(mode stepMode) {
+	if !s.stopped {
+		return
+	}
+	s.stopped = false
+	s.debugger.resume <- mode
+}
+
+// frame finds the frame that a request's frameId refers to.
+func (s *dapServer) frame(data json.RawMessage) (*frame, error) {
+	var arguments struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := json.Unmarshal(data, &arguments); err != nil {
+		return nil, err
+	}
+	if !s.stopped || arguments.FrameID < 1 || arguments.FrameID > len(s.debugger.frames) {
+		return nil, errors.New("no such frame")
+	}
+	return s.debugger.frames[arguments.FrameID-1], nil
+}
+
+// reference returns a variablesReference for an environment or instance.
+func (s *dapServer) reference(value any) int {
+	s.handles = append(s.handles, value)
+	return len(s.handles)
+}
+
+// variable describes a value, giving it a variablesReference if it's an
+// instance, so that the editor can show its fields.
+func (s *dapServer) variable(name string, value any) dapVariable {
+	reference := 0
+	if instance, ok := value.(*LoxInstance); ok {
+		reference = s.reference(instance)
+	}
+	return dapVariable{name, describe(value), reference}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A dapClient is an editor's end of a debugging session.
+type dapClient struct {
+	*framedClient
+	seq int
+	// output is what the program has printed so far.
+	output strings.Builder
+}
+
+// dapMessage is any message from the debug adapter.
+type dapMessage struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Command    string          `json:"command"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// next reads the next message that isn't output, which it adds to c.output.
+func (c *dapClient) next() dapMessage {
+	c.t.Helper()
+	for {
+		var message dapMessage
+		c.receive(&message)
+		if message.Event != "output" {
+			return message
+		}
+		var body struct {
+			Output string `json:"output"`
+		}
+		json.Unmarshal(message.Body, &body)
+		c.output.WriteString(body.Output)
+	}
+}
+
+// request sends a request, and returns the response to it.
+func (c *dapClient) request(command string, arguments string) dapMessage {
+	c.t.Helper()
+	c.seq++
+	c.send(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": json.RawMessage(arguments)})
+	response := c.next()
+	if response.Type != "response" || response.RequestSeq != c.seq {
+		c.t.Fatalf("%v: got %+v, want the response", command, response)
+	}
+	return response
+}
+
+// ok sends a request that has to succeed, and decodes its response's body
+// into body, if it isn't nil.
+func (c *dapClient) ok(command string, arguments string, body any) {
+	c.t.Helper()
+	response := c.request(command, arguments)
+	if !response.Success {
+		c.t.Fatalf("%v failed: %v", command, response.Message)
+	}
+	if body != nil {
+		if err := json.Unmarshal(response.Body, body); err != nil {
+			c.t.Fatalf("%v: %v in %s", command, err, response.Body)
+		}
+	}
+}
+
+// expectEvent reads the next message, which has to be event, and returns its
+// body.
+func (c *dapClient) expectEvent(event string) string {
+	c.t.Helper()
+	message := c.next()
+	if message.Type != "event" || message.Event != event {
+		c.t.Fatalf("got %+v, want the %q event", message, event)
+	}
+	return string(message.Body)
+}
+
+// stopped reads the stopped event, checking why the program stopped, and
+// returns where: the name and line of each frame, innermost first, and the ID
+// of the innermost.
+func (c *dapClient) stopped(reason string) (string, int) {
+	c.t.Helper()
+	var stopped struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal([]byte(c.expectEvent("stopped")), &stopped)
+	if stopped.Reason != reason {
+		c.t.Errorf("stopped because of %q, want %q", stopped.Reason, reason)
+	}
+	var trace struct {
+		StackFrames []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+			Line int    `json:"line"`
+		} `json:"stackFrames"`
+	}
+	c.ok("stackTrace", `{"threadId": 1}`, &trace)
+	var frames []string
+	for _, frame := range trace.StackFrames {
+		frames = append(frames, fmt.Sprintf("%v:%v", frame.Name, frame.Line))
+	}
+	return strings.Join(frames, " "), trace.StackFrames[0].ID
+}
+
+// variables lists the variables that reference refers to.
+func (c *dapClient) variables(reference int) string {
+	c.t.Helper()
+	var body struct {
+		Variables []dapVariable `json:"variables"`
+	}
+	c.ok("variables", fmt.Sprintf(`{"variablesReference": %v}`, reference), &body)
+	var variables []string
+	for _, v := range body.Variables {
+		variables = append(variables, v.Name+" = "+v.Value)
+	}
+	return strings.Join(variables, ", ")
+}
+
+// evaluate evaluates expression in frame, and returns its value and
+// variablesReference.
+func (c *dapClient) evaluate(expression string, frame int) (string, int) {
+	c.t.Helper()
+	var result struct {
+		Result             string `json:"result"`
+		VariablesReference int    `json:"variablesReference"`
+	}
+	c.ok("evaluate", fmt.Sprintf(`{"expression": %q, "frameId": %v}`, expression, frame), &result)
+	return result.Result, result.VariablesReference
+}
+
+func TestDebugAdapter(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "points.lox")
+	source := `fun add(a, b) {
+  var sum = a + b;
+  return sum;
+}
+class Point {
+  init(x, y) {
+    this.x = x;
+    this.y = y;
+  }
+}
+var p = Point(1, 2);
+for (var i = 0; i < 3; i = i + 1) {
+  print add(i, p.x);
+}
+print "done";
+`
+	if err := os.WriteFile(program, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	framed, status := newFramedClient(t, func(in *bufio.Reader, out io.Writer) int {
+		interpreter := NewInterpreter()
+		server := &dapServer{
+			in:          in,
+			out:         out,
+			interpreter: &interpreter,
+			debugger:    newDebugger(interpreter.globals, SM_CONTINUE),
+		}
+		interpreter.addHooks(server.debugger)
+		interpreter.stdout = dapOutput{server, "stdout"}
+		return server.serve()
+	})
+	c := &dapClient{framedClient: framed}
+	check := func(what, got, want string) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%v: got %q, want %q", what, got, want)
+		}
+	}
+
+	c.ok("initialize", `{"adapterID": "jlox"}`, nil)
+	c.expectEvent("initialized")
+	c.ok("launch", fmt.Sprintf(`{"program": %q}`, program), nil)
+	var breakpoints struct {
+		Breakpoints []struct {
+			Verified bool `json:"verified"`
+		} `json:"breakpoints"`
+	}
+	c.ok("setBreakpoints", fmt.Sprintf(`{"source": {"path": %q}, "breakpoints": [{"line": 2, "condition": "a == 2"}, {"line": 15}, {"line": 3, "condition": "a +"}]}`, program), &breakpoints)
+	check("verified breakpoints", fmt.Sprint(breakpoints), "{[{true} {true} {false}]}")
+	c.ok("configurationDone", `{}`, nil)
+
+	// The condition skips the first two calls.
+	frames, top := c.stopped("breakpoint")
+	check("frames", frames, "add:2 script:13")
+	check("output", c.output.String(), "1\n2\n")
+	var scopes struct {
+		Scopes []struct {
+			Name               string `json:"name"`
+			VariablesReference int    `json:"variablesReference"`
+		} `json:"scopes"`
+	}
+	c.ok("scopes", fmt.Sprintf(`{"frameId": %v}`, top), &scopes)
+	check("scopes", fmt.Sprintf("%v %v %v", len(scopes.Scopes), scopes.Scopes[0].Name, scopes.Scopes[1].Name), "2 Locals Globals")
+	check("locals", c.variables(scopes.Scopes[0].VariablesReference), "a = 2, b = 1")
+	check("globals", c.variables(scopes.Scopes[1].VariablesReference), "Point = Point, add = <fn add >, clock = <native fn>, p = Point instance")
+	value, reference := c.evaluate("p", top)
+	check("p", value, "Point instance")
+	check("p's fields", c.variables(reference), "x = 1, y = 2")
+	value, _ = c.evaluate("a * 10 + p.y", top)
+	check("a * 10 + p.y", value, "22")
+	check("evaluating an undefined variable", c.request("evaluate", fmt.Sprintf(`{"expression": "nope", "frameId": %v}`, top)).Message, `Undefined variable "nope".`)
+
+	c.ok("next", `{"threadId": 1}`, nil)
+	frames, top = c.stopped("step")
+	check("frames after next", frames, "add:3 script:13")
+	value, _ = c.evaluate("sum", top)
+	check("sum", value, "3")
+
+	c.ok("stepOut", `{"threadId": 1}`, nil)
+	frames, _ = c.stopped("step")
+	check("frames after stepping out", frames, "script:12")
+	check("output after stepping out", c.output.String(), "1\n2\n3\n")
+
+	c.ok("continue", `{"threadId": 1}`, nil)
+	frames, _ = c.stopped("breakpoint")
+	check("frames at the last breakpoint", frames, "script:15")
+	c.ok("continue", `{"threadId": 1}`, nil)
+	check("exited", c.expectEvent("exited"), `{"exitCode":0}`)
+	c.expectEvent("terminated")
+	check("output at the end", c.output.String(), "1\n2\n3\ndone\n")
+
+	c.ok("disconnect", `{}`, nil)
+	if got := <-status; got != 0 {
+		t.Errorf("the adapter exited with %v, want 0", got)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `Commands:
+  break LINE [if EXPR]  stop at LINE (only when EXPR is true, if given)
+  break                 list the breakpoints and watchpoints
+  clear LINE            remove the breakpoint at LINE
+  watch NAME            stop whenever a variable (or a field, as in p.x) changes
+  step, s               run to the next line, going into function calls
+  next, n               run to the next line, stepping over function calls
+  finish, f             run until the current function returns
+  continue, c           run until a breakpoint or watchpoint
+  print EXPR, p EXPR    evaluate EXPR where the program is stopped
+  locals                list the local variables
+  backtrace, bt         show the call stack
+  quit, q               stop debugging
+An empty line repeats the last command.`
+
+// debugCommand implements "jlox debug", a debugger that works in the
+// terminal. The program stops before its first statement so that
+// breakpoints can be set. See debugger.go for how it's stopped and
+// inspected.
+func debugCommand(args []string) {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox debug file.lox")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	source, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(66)
+	}
+	interpreter := NewInterpreter()
+	statements := NewParser(NewScanner(string(source)).ScanTokens()).parse()
+	if !hadError {
+		NewResolver().resolveStatements(statements)
+	}
+	if hadError {
+		os.Exit(65)
+	}
+
+	console := &debugConsole{
+		interpreter: &interpreter,
+		debugger:    newDebugger(interpreter.globals, SM_PAUSE),
+		lines:       strings.Split(string(source), "\n"),
+		input:       bufio.NewScanner(os.Stdin),
+		out:         os.Stdout,
+		breakpoints: make(map[int]*breakpoint),
+	}
+	interpreter.addHooks(console.debugger)
+
+	interpreter.stdout = console.out
+	os.Exit(console.run(statements))
+}
+
+type debugConsole struct {
+	interpreter *Interpreter
+	debugger    *debugger
+	// lines are the lines of the program's source, for showing where it
+	// stopped.
+	lines       []string
+	input       *bufio.Scanner
+	out         io.Writer
+	breakpoints map[int]*breakpoint
+	// last is the last command, which an empty line repeats.
+	last string
+}
+
+// run runs the program, prompting for commands each time it stops, and
+// returns the exit status.
+func (c *debugConsole) run(statements []Stmt) int {
+	done := make(chan int)
+	go func() {
+		for _, statement := range statements {
+			if _, err := c.interpreter.execute(statement); err != nil {
+				if rte, ok := err.(RuntimeError); ok {
+					runtimeError(rte)
+				}
+				done <- 70
+				return
+			}
+		}
+		done <- 0
+	}()
+
+	for {
+		select {
+		case event := <-c.debugger.stops:
+			c.stopped(event)
+			mode, ok := c.prompt()
+			if !ok {
+				return 0
+			}
+			c.debugger.resume <- mode
+		case status := <-done:
+			fmt.Fprintln(c.out, "The program has finished.")
+			return status
+		}
+	}
+}
+
+func (c *debugConsole) stopped(event stopEvent) {
+	top := c.debugger.frames[len(c.debugger.frames)-1]
+	switch event.reason {
+	case "breakpoint":
+		fmt.Fprintf(c.out, "Breakpoint at line %v.\n", top.line)
+	case "watchpoint":
+		fmt.Fprintf(c.out, "Watchpoint: %v.\n", event.description)
+	}
+	c.showLine(top.line)
+}
+
+func (c *debugConsole) showLine(line int) {
+	if line >= 1 && line <= len(c.lines) {
+		fmt.Fprintf(c.out, "%v\t%v\n", line, c.lines[line-1])
+	}
+}
+
+// prompt reads commands until one of them says how the program should carry
+// on. It returns false if the user quits or the input ends.
+func (c *debugConsole) prompt() (stepMode, bool) {
+	for {
+		fmt.Fprint(c.out, "(jlox) ")
+		if !c.input.Scan() {
+			fmt.Fprintln(c.out)
+			return SM_CONTINUE, false
+		}
+		line := strings.TrimSpace(c.input.Text())
+		if line == "" {
+			line = c.last
+		}
+		c.last = line
+		command, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+
+		switch command {
+		case "":
+		case "step", "s":
+			return SM_STEP, true
+		case "next", "n":
+			return SM_NEXT, true
+		case "finish", "f":
+			if len(c.debugger.frames) == 1 {
+				fmt.Fprintln(c.out, "The script isn't in a function.")
+				continue
+			}
+			return SM_FINISH, true
+		case "continue", "c":
+			return SM_CONTINUE, true
+		case "break", "b":
+			c.setBreakpoint(rest)
+		case "clear":
+			line, err := strconv.Atoi(rest)
+			if _, ok := c.breakpoints[line]; err != nil || !ok {
+				fmt.Fprintf(c.out, "There's no breakpoint at line %q.\n", rest)
+				continue
+			}
+			delete(c.breakpoints, line)
+			c.updateBreakpoints()
+			fmt.Fprintf(c.out, "Cleared the breakpoint at line %v.\n", line)
+		case "watch":
+			w, err := c.debugger.watch(c.interpreter, rest, len(c.debugger.frames)-1)
+			if err != nil {
+				fmt.Fprintln(c.out, err)
+				continue
+			}
+			fmt.Fprintf(c.out, "Watching %v, which is now %v.\n", w.description, describe(w.value))
+		case "print", "p":
+			expr, err := parseExpression(rest)
+			if err != nil {
+				fmt.Fprintln(c.out, err)
+				continue
+			}
+			value, err := c.debugger.evaluate(c.interpreter, expr, len(c.debugger.frames)-1)
+			if rte, ok := err.(RuntimeError); ok {
+				fmt.Fprintln(c.out, rte.message)
+			} else if err != nil {
+				fmt.Fprintln(c.out, err)
+			} else {
+				fmt.Fprintln(c.out, describe(value))
+			}
+		case "locals":
+			top := c.debugger.frames[len(c.debugger.frames)-1]
+			variables := environmentVariables(top.environment, c.interpreter.globals)
+			if len(variables) == 0 {
+				fmt.Fprintln(c.out, "There are no local variables.")
+			}
+			for _, v := range variables {
+				fmt.Fprintf(c.out, "%v = %v\n", v.name, describe(v.value))
+			}
+		case "backtrace", "bt":
+			for i := len(c.debugger.frames) - 1; i >= 0; i-- {
+				f := c.debugger.frames[i]
+				fmt.Fprintf(c.out, "#%v %v at line %v\n", len(c.debugger.frames)-1-i, f.name, f.line)
+			}
+		case "help", "h":
+			fmt.Fprintln(c.out, debugHelp)
+		case "quit", "q":
+			return SM_CONTINUE, false
+		default:
+			fmt.Fprintf(c.out, "Unknown command %q. Type \"help\" for a list.\n", command)
+		}
+	}
+}
+
+// setBreakpoint handles "break", whose arguments are a line and optionally
+// "if" and a condition. With no arguments, it lists what can stop the
+// program.
+func (c *debugConsole) setBreakpoint(arguments string) {
+	if arguments == "" {
+		var lines []int
+		for line := range c.breakpoints {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		for _, line := range lines {
+			fmt.Fprintf(c.out, "Breakpoint at line %v\n", line)
+		}
+		for _, w := range c.debugger.watchpoints {
+			fmt.Fprintf(c.out, "Watchpoint on %v\n", w.description)
+		}
+		return
+	}
+
+	lineText, condition, hasCondition := strings.Cut(arguments, " if ")
+	line, err := strconv.Atoi(strings.TrimSpace(lineText))
+	if err != nil || line < 1 || line > len(c.lines) {
+		fmt.Fprintf(c.out, "%q isn't a line in the program.\n", lineText)
+		return
+	}
+	b := &breakpoint{line, nil}
+	if hasCondition {
+		if b.condition, err = parseExpression(condition); err != nil {
+			fmt.Fprintln(c.out, err)
+			return
+		}
+	}
+	c.breakpoints[line] = b
+	c.updateBreakpoints()
+	fmt.Fprintf(c.out, "Breakpoint at line %v.\n", line)
+}
+
+func (c *debugConsole) updateBreakpoints() {
+	var breakpoints []*breakpoint
+	for _, b := range c.breakpoints {
+		breakpoints = append(breakpoints, b)
+	}
+	c.debugger.setBreakpoints(breakpoints)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// TestDebugConsole runs "jlox debug" on a program with a script of commands,
+// and checks the whole transcript.
+func TestDebugConsole(t *testing.T) {
+	const source = `class Counter {
+  init() {
+    this.count = 0;
+  }
+}
+fun bump(counter, by) {
+  var next = counter.count + by;
+  counter.count = next;
+  return next;
+}
+var c = Counter();
+var total = 0;
+for (var i = 1; i <= 3; i = i + 1) {
+  total = total + bump(c, i);
+}
+print total;`
+	commands := []string{
+		"step",
+		"step",
+		"step",
+		"backtrace",
+		"finish",
+		"break 8 if by == 2",
+		"break 99",
+		"continue",
+		"bt",
+		"locals",
+		"print counter.count * 10",
+		"p nope",
+		"finish",
+		"watch c.count",
+		"watch total",
+		"watch 1 + 2",
+		"break",
+		"clear 8",
+		"clear 8",
+		"continue",
+		"",
+		"next",
+		"n",
+	}
+	const want = `1	class Counter {
+(jlox) 6	fun bump(counter, by) {
+(jlox) 11	var c = Counter();
+(jlox) 3	    this.count = 0;
+(jlox) #0 Counter at line 3
+#1 script at line 11
+(jlox) 12	var total = 0;
+(jlox) Breakpoint at line 8.
+(jlox) "99" isn't a line in the program.
+(jlox) Breakpoint at line 8.
+8	  counter.count = next;
+(jlox) #0 bump at line 8
+#1 script at line 14
+(jlox) by = 2
+counter = Counter instance
+next = 3
+(jlox) 10
+(jlox) Undefined variable "nope".
+(jlox) 13	for (var i = 1; i <= 3; i = i + 1) {
+(jlox) Watching c.count, which is now 3.
+(jlox) Watching total, which is now 4.
+(jlox) Only a variable or a field can be watched.
+(jlox) Breakpoint at line 8
+Watchpoint on c.count
+Watchpoint on total
+(jlox) Cleared the breakpoint at line 8.
+(jlox) There's no breakpoint at line "8".
+(jlox) Watchpoint: c.count changed from 3 to 6.
+9	  return next;
+(jlox) Watchpoint: total changed from 4 to 10.
+13	for (var i = 1; i <= 3; i = i + 1) {
+(jlox) 16	print total;
+(jlox) 10
+The program has finished.
+`
+
+	hadError = false
+	interpreter := NewInterpreter()
+	statements := NewParser(NewScanner(source).ScanTokens()).parse()
+	NewResolver().resolveStatements(statements)
+	if hadError {
+		t.Fatal("the program doesn't compile")
+	}
+	var out strings.Builder
+	console := &debugConsole{
+		interpreter: &interpreter,
+		debugger:    newDebugger(interpreter.globals, SM_PAUSE),
+		lines:       strings.Split(source, "\n"),
+		input:       bufio.NewScanner(strings.NewReader(strings.Join(commands, "\n") + "\n")),
+		out:         &out,
+		breakpoints: make(map[int]*breakpoint),
+	}
+	interpreter.addHooks(console.debugger)
+	interpreter.stdout = console.out
+	if status := console.run(statements); status != 0 {
+		t.Errorf("got the exit status %v, want 0", status)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("got the transcript\n%v\nwant\n%v", got, want)
+	}
+}
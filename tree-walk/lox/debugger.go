@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The debugger is what "jlox dap" and "jlox debug" have in common. The
+// program runs in a goroutine of its own, and the debugger is added to the
+// interpreter's hooks, so that it sees each statement before it runs. When
+// the debugger decides to stop there, it says why on stops and waits to be
+// told how to carry on through resume. While the program is stopped, the
+// front end can look at the call stack and evaluate expressions, since the
+// interpreter isn't doing anything else.
+//
+// The debugger works in lines rather than statements: after stopping on a
+// line, it won't stop again until the frame moves on to a different line (or
+// a different frame starts).
+
+type stepMode int
+
+const (
+	SM_CONTINUE stepMode = iota
+	// SM_STEP stops at the next line, even in a function being called.
+	SM_STEP
+	// SM_NEXT stops at the next line in the current function (or, once
+	// it returns, in its caller).
+	SM_NEXT
+	// SM_FINISH stops once the current function has returned.
+	SM_FINISH
+	// SM_PAUSE stops at the next statement, wherever it is.
+	SM_PAUSE
+)
+
+type frame struct {
+	name string
+	// line is the line of the statement the frame is running, or 0 if
+	// it hasn't started one yet.
+	line        int
+	environment *Environment
+}
+
+type breakpoint struct {
+	line int
+	// condition is nil for a breakpoint that always stops.
+	condition Expr
+}
+
+// watchpoint stops the program whenever a variable or an instance's field
+// changes. Nothing tells the debugger about assignments, so before each
+// statement, read looks the value up again by name (in the globals' map, an
+// environment's slots or a call's upvalues, or the instance's shape, which
+// can change as fields are added) and checkWatchpoints compares it with the
+// last value it saw.
+type watchpoint struct {
+	// description is what the user asked to watch, like "x" or "p.x".
+	description string
+	// read gets the value, and whether it exists.
+	read func() (any, bool)
+	// value is the last value we saw, and exists is whether there was
+	// one: a field doesn't exist until it's first set.
+	value  any
+	exists bool
+}
+
+type stopEvent struct {
+	// reason is "step", "pause", "breakpoint" or "watchpoint".
+	reason string
+	// description says more about why, for a watchpoint.
+	description string
+}
+
+type debugger struct {
+	NoHooks
+	// mu guards breakpoints and mode, which the front end can change
+	// while the program is running.
+	mu          sync.Mutex
+	breakpoints map[int]*breakpoint
+	mode        stepMode
+	// watchpoints are only changed while the program is stopped.
+	watchpoints []*watchpoint
+	// depth is how many frames there were when the program last stopped,
+	// which SM_NEXT and SM_FINISH compare against.
+	depth int
+	// frames is the call stack, with the script itself at the bottom.
+	frames []*frame
+	// lines caches the line each statement starts on.
+	lines  map[Stmt]int
+	stops  chan stopEvent
+	resume chan stepMode
+}
+
+func newDebugger(globals *Environment, mode stepMode) *debugger {
+	return &debugger{
+		breakpoints: make(map[int]*breakpoint),
+		mode:        mode,
+		frames:      []*frame{{"script", 0, globals}},
+		lines:       make(map[Stmt]int),
+		stops:       make(chan stopEvent),
+		resume:      make(chan stepMode),
+	}
+}
+
+func (d *debugger) BeforeStatement(i *Interpreter, stmt Stmt) {
+	// A block isn't a line of its own; we'll stop at the statements
+	// inside it instead.
+	if _, ok := stmt.(*Block); ok {
+		return
+	}
+
+	top := d.frames[len(d.frames)-1]
+	line := d.line(stmt)
+	newLine := line != top.line
+	top.line = line
+	top.environment = i.environment
+
+	event := d.checkWatchpoints()
+	if event.reason == "" {
+		event.reason = d.stopReason(i, line, newLine)
+	}
+	if event.reason == "" {
+		return
+	}
+	d.stops <- event
+	mode := <-d.resume
+
+	d.mu.Lock()
+	d.mode = mode
+	d.depth = len(d.frames)
+	d.mu.Unlock()
+}
+
+// stopReason decides whether to stop at a statement on line, and if so,
+// says why: "step", "pause" or "breakpoint".
+func (d *debugger) stopReason(i *Interpreter, line int, newLine bool) string {
+	d.mu.Lock()
+	mode, depth := d.mode, d.depth
+	b := d.breakpoints[line]
+	d.mu.Unlock()
+
+	if mode == SM_PAUSE {
+		return "pause"
+	}
+	if !newLine {
+		return ""
+	}
+	switch {
+	case mode == SM_STEP,
+		mode == SM_NEXT && len(d.frames) <= depth,
+		mode == SM_FINISH && len(d.frames) < depth:
+		return "step"
+	}
+	if b != nil {
+		if b.condition == nil {
+			return "breakpoint"
+		}
+		// A condition that can't be evaluated stops too, so that
+		// the user gets to find out what's wrong with it.
+		value, err := d.evaluate(i, b.condition, len(d.frames)-1)
+		if err != nil || isTruthy(value) {
+			return "breakpoint"
+		}
+	}
+	return ""
+}
+
+// checkWatchpoints looks for watched values that have changed since the
+// last statement, and describes the changes if there were any.
+func (d *debugger) checkWatchpoints() stopEvent {
+	var changes []string
+	for _, w := range d.watchpoints {
+		value, exists := w.read()
+		if exists == w.exists && isEqual(value, w.value) {
+			continue
+		}
+		old := "(unset)"
+		if w.exists {
+			old = describe(w.value)
+		}
+		changes = append(changes, fmt.Sprintf("%v changed from %v to %v", w.description, old, describe(value)))
+		w.value, w.exists = value, exists
+	}
+	if len(changes) == 0 {
+		return stopEvent{}
+	}
+	return stopEvent{"watchpoint", strings.Join(changes, "; ")}
+}
+
+// watch adds a watchpoint on the variable or field that source names, as
+// seen from the frame at index.
+func (d *debugger) watch(i *Interpreter, source string, index int) (*watchpoint, error) {
+	expr, err := parseExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	var read func() (any, bool)
+	switch v := expr.(type) {
+	case *Variable:
+		name := v.name.lexeme
+		for env := d.frames[index].environment; env != nil; env = env.enclosing {
+			if _, ok := env.lookup(name); ok {
+				read = func() (any, bool) { return env.lookup(name) }
+				break
+			}
+		}
+		if read == nil {
+			return nil, fmt.Errorf("There's no variable called %q here.", name)
+		}
+	case *Get:
+		object, err := d.evaluate(i, v.object, index)
+		if err != nil {
+			return nil, err
+		}
+		instance, ok := object.(*LoxInstance)
+		if !ok {
+			return nil, errors.New("Only instances have fields.")
+		}
+		name := v.name.lexeme
+		read = func() (any, bool) {
+			return instance.field(name)
+		}
+	default:
+		return nil, errors.New("Only a variable or a field can be watched.")
+	}
+	value, exists := read()
+	w := &watchpoint{source, read, value, exists}
+	d.watchpoints = append(d.watchpoints, w)
+	return w, nil
+}
+
+func (d *debugger) line(stmt Stmt) int {
+	if line, ok := d.lines[stmt]; ok {
+		return line
+	}
+	line := stmtLine(stmt)
+	d.lines[stmt] = line
+	return line
+}
+
+// BeforeCall starts a frame for the call. Its environment is filled in when
+// its first statement runs.
+func (d *debugger) BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any) {
+	d.frames = append(d.frames, &frame{callableName(call, callee), 0, nil})
+}
+
+func (d *debugger) AfterCall(i *Interpreter, call *Call, callee LoxCallable, result any, err error) {
+	d.frames = d.frames[:len(d.frames)-1]
+}
+
+// setBreakpoints replaces all the breakpoints.
+func (d *debugger) setBreakpoints(breakpoints []*breakpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints = make(map[int]*breakpoint)
+	for _, b := range breakpoints {
+		d.breakpoints[b.line] = b
+	}
+}
+
+// pause makes the program stop at the next statement it runs.
+func (d *debugger) pause() {
+	d.mu.Lock()
+	d.mode = SM_PAUSE
+	d.mu.Unlock()
+}
+
+// evaluate evaluates expr as if it were part of the statement that the frame
+// at index (counting from the bottom of the stack) is running. Since expr
+// wasn't there when the program was resolved, its variables are resolved here
+// instead, by looking for them in the frame's environments, every time it's
+// evaluated (a breakpoint's condition can be evaluated in many frames). No
+// hooks are called while it runs, so the debugger won't stop in the middle of
+// it.
+func (d *debugger) evaluate(i *Interpreter, expr Expr, index int) (any, error) {
+	environment := d.frames[index].environment
+	var err error
+	walkExpr(expr, func(e Expr) {
+		switch v := e.(type) {
+		case *Variable:
+			v.local = findLocal(environment, i.globals, v.name.lexeme)
+		case *Assign:
+			v.local = findLocal(environment, i.globals, v.name.lexeme)
+		case *This:
+			v.local = findLocal(environment, i.globals, "this")
+		case *Super:
+			v.local = findLocal(environment, i.globals, "super")
+			v.this = findLocal(environment, i.globals, "this")
+			if v.local == nil || v.this == nil {
+				err = RuntimeError{v.keyword, "Can't use 'super' here."}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	previous, hooks := i.environment, i.hooks
+	i.environment, i.hooks = environment, nil
+	defer func() {
+		i.environment, i.hooks = previous, hooks
+	}()
+	return i.evaluate(expr)
+}
+
+// findLocal finds where the local variable called name is, as seen from
+// environment, going by name rather than by what the resolver decided. It's
+// nil if there's no such local.
+func findLocal(environment *Environment, globals *Environment, name string) *localSlot {
+	distance := 0
+	for env := environment; env != nil && env != globals; env = env.enclosing {
+		if index := env.indexOf(name); index >= 0 {
+			return &localSlot{distance, index, false}
+		}
+		if index := env.upvalueIndexOf(name); index >= 0 {
+			return &localSlot{distance, index, true}
+		}
+		distance++
+	}
+	return nil
+}
+
+// walkExpr calls f on expr and every expression inside it.
+func walkExpr(expr Expr, f func(Expr)) {
+	f(expr)
+	switch v := expr.(type) {
+	case *Assign:
+		walkExpr(v.value, f)
+	case *Binary:
+		walkExpr(v.left, f)
+		walkExpr(v.right, f)
+	case *Call:
+		walkExpr(v.callee, f)
+		for _, argument := range v.arguments {
+			walkExpr(argument, f)
+		}
+	case *Get:
+		walkExpr(v.object, f)
+	case *Grouping:
+		walkExpr(v.expression, f)
+	case *Logical:
+		walkExpr(v.left, f)
+		walkExpr(v.right, f)
+	case *Set:
+		walkExpr(v.object, f)
+		walkExpr(v.value, f)
+	case *Unary:
+		walkExpr(v.right, f)
+	}
+}
+
+// parseExpression parses source as a single expression, returning the first
+// syntax error rather than reporting it.
+func parseExpression(source string) (Expr, error) {
+	scanner := NewScanner(source)
+	scanner.reportError = func(int, string) {}
+	tokens := scanner.ScanTokens()
+	for _, token := range tokens {
+		if token.tokenType == ERROR {
+			return nil, fmt.Errorf("Error at '%v': %v", token.lexeme, token.literal)
+		}
+	}
+
+	var errors []string
+	parser := NewParser(tokens)
+	parser.reportError = func(token Token, message string) {
+		if token.tokenType == EOF {
+			errors = append(errors, "Error at end: "+message)
+		} else {
+			errors = append(errors, fmt.Sprintf("Error at '%v': %v", token.lexeme, message))
+		}
+	}
+	expr, _ := parser.expression()
+	if len(errors) == 0 && !parser.isAtEnd() {
+		parser.parseError(parser.peek(), "Expect end of expression.")
+	}
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("%v", errors[0])
+	}
+	return expr, nil
+}
+
+// variable is a name and its value, as shown when inspecting an environment
+// or an instance.
+type variable struct {
+	name  string
+	value any
+}
+
+// environmentVariables lists the variables visible from environment, not
+// counting globals, in alphabetical order. An inner variable hides an outer
+// one with the same name.
+func environmentVariables(environment *Environment, globals *Environment) []variable {
+	seen := make(map[string]bool)
+	var variables []variable
+	for env := environment; env != nil && env != globals; env = env.enclosing {
+		for name, value := range env.variables() {
+			if !seen[name] {
+				seen[name] = true
+				variables = append(variables, variable{name, value})
+			}
+		}
+	}
+	sortVariables(variables)
+	return variables
+}
+
+func valuesVariables(values map[string]any) []variable {
+	var variables []variable
+	for name, value := range values {
+		variables = append(variables, variable{name, value})
+	}
+	sortVariables(variables)
+	return variables
+}
+
+func instanceVariables(instance *LoxInstance) []variable {
+	var variables []variable
+	for i, name := range instance.shape.names {
+		variables = append(variables, variable{name, instance.fields[i]})
+	}
+	sortVariables(variables)
+	return variables
+}
+
+func sortVariables(variables []variable) {
+	sort.Slice(variables, func(i, j int) bool { return variables[i].name < variables[j].name })
+}
+
+// describe shows a value the way a debugger should: like print, except that
+// strings are quoted so that they can't be mistaken for anything else.
+func describe(value any) string {
+	return printLiteral(value)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// "jlox difftest" runs Lox programs on several implementations of Lox and
+// reports where they disagree with the first one: in what they print, their
+// exit codes, or the errors they report.
+//
+//	jlox difftest -impl clox=../cbytecode/main -generate 100 examples
+//
+// The implementations are always the tree-walk interpreter (which the others
+// are compared to) and the VM, run by this jlox, and then each one given with
+// -impl, as a name and a command to run with the program's path after it.
+// The programs are the .lox files in each path, and, with -generate, that
+// many random programs from the grammar (see programGenerator), written to
+// -dir. The ones that the implementations disagree about are left there.
+//
+// Errors are compared by line and message, since implementations report them
+// differently: jlox reports a runtime error as "[line 3] Operand must be a
+// number.", but clox reports the message and then a stack trace, as in
+// "Operand must be a number.\n[line 3] in script". Both become the first one.
+// A "running script" line at the start of what jlox prints is ignored too.
+
+// An implementation is a name and the command that runs a program on it.
+type implementation struct {
+	name    string
+	command []string
+}
+
+// A diffOutcome is what one implementation did with a program.
+type diffOutcome struct {
+	output   string
+	errors   []string
+	exitCode int
+	timedOut bool
+}
+
+// A diffResult is how the implementations disagreed about the program at path,
+// with nothing in differences if they agreed.
+type diffResult struct {
+	path        string
+	differences []string
+}
+
+var (
+	compileErrorLine = regexp.MustCompile(`^\[line \d+\] Error`)
+	stackTraceLine   = regexp.MustCompile(`^\[line (\d+)\] in `)
+)
+
+func difftestCommand(args []string) {
+	flags := flag.NewFlagSet("difftest", flag.ExitOnError)
+	var implementations []implementation
+	flags.Func("impl", "also run the programs on `name=command`, as in clox=../cbytecode/main (repeatable)", func(value string) error {
+		name, command, ok := strings.Cut(value, "=")
+		if !ok || name == "" || len(strings.Fields(command)) == 0 {
+			return errors.New("expected name=command")
+		}
+		implementations = append(implementations, implementation{name, strings.Fields(command)})
+		return nil
+	})
+	generate := flags.Int("generate", 0, "also run this many random programs")
+	seed := flags.Uint64("seed", 0, "generate the random programs from this `seed` onwards (0 means a random one)")
+	dir := flags.String("dir", "", "write the random programs to this `directory` (default a new temporary one)")
+	timeout := flags.Duration("timeout", 10*time.Second, "stop an implementation after it's run a program for this long")
+	parallel := flags.Int("j", runtime.NumCPU(), "run this many programs at a time")
+	verbose := flags.Bool("v", false, "list the programs the implementations agree about too")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox difftest [flags] [path ...]")
+		fmt.Fprintln(flags.Output(), "Runs the .lox files in each path on jlox's tree-walk interpreter, on")
+		fmt.Fprintln(flags.Output(), "its VM, and on each -impl, and reports where they disagree.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *parallel < 1 || *generate < 0 || (flags.NArg() == 0 && *generate == 0) {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(70)
+	}
+	implementations = append([]implementation{
+		{"jlox", []string{self}},
+		{"jlox-vm", []string{self, "-engine=vm"}},
+	}, implementations...)
+	for _, implementation := range implementations {
+		if _, err := exec.LookPath(implementation.command[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", implementation.name, err)
+			os.Exit(66)
+		}
+	}
+
+	var programs []string
+	for _, path := range flags.Args() {
+		err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && filepath.Ext(path) == ".lox" {
+				programs = append(programs, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(66)
+		}
+	}
+	sort.Strings(programs)
+
+	var generated []string
+	temporary := false
+	if *generate > 0 {
+		if *dir == "" {
+			temporary = true
+			if *dir, err = os.MkdirTemp("", "lox-difftest-"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(74)
+			}
+		} else if err := os.MkdirAll(*dir, 0o777); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(74)
+		}
+		if *seed == 0 {
+			*seed = uint64(time.Now().UnixNano())
+		}
+		fmt.Printf("generating %v programs from seed %v in %v\n", *generate, *seed, *dir)
+		for i := range uint64(*generate) {
+			path := filepath.Join(*dir, fmt.Sprintf("random-%v.lox", *seed+i))
+			if err := os.WriteFile(path, []byte(generateProgram(*seed+i)), 0o666); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(74)
+			}
+			generated = append(generated, path)
+		}
+		programs = append(programs, generated...)
+	}
+
+	start := time.Now()
+	results := make([]diffResult, len(programs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range *parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = runDifferential(programs[i], implementations, *timeout)
+			}
+		}()
+	}
+	for i := range programs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	differed := 0
+	for _, result := range results {
+		if len(result.differences) > 0 {
+			differed++
+			fmt.Printf("DIFF %v\n", result.path)
+			for _, difference := range result.differences {
+				fmt.Println(indent(difference, "    "))
+			}
+		} else if *verbose {
+			fmt.Printf("SAME %v\n", result.path)
+		}
+	}
+	fmt.Printf("%v agreed, %v differed (%.2fs)\n", len(results)-differed, differed, elapsed.Seconds())
+
+	// Only keep the random programs worth looking at.
+	for i, path := range generated {
+		if len(results[len(results)-len(generated)+i].differences) == 0 {
+			os.Remove(path)
+		}
+	}
+	if temporary {
+		// Which only works if it's empty.
+		os.Remove(*dir)
+	}
+	if differed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runDifferential runs the program at path on each implementation, and
+// compares what the others do to what the first one does.
+func runDifferential(path string, implementations []implementation, timeout time.Duration) diffResult {
+	result := diffResult{path: path}
+	var expected diffOutcome
+	for i, implementation := range implementations {
+		outcome, err := runImplementation(implementation, path, timeout)
+		if err != nil {
+			result.differences = append(result.differences, fmt.Sprintf("%v: %v", implementation.name, err))
+			continue
+		}
+		if i == 0 {
+			expected = outcome
+			continue
+		}
+		for _, difference := range compareOutcomes(expected, outcome, implementations[0].name) {
+			result.differences = append(result.differences, implementation.name+": "+difference)
+		}
+	}
+	return result
+}
+
+func runImplementation(implementation implementation, path string, timeout time.Duration) (diffOutcome, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := slices.Concat(implementation.command[1:], []string{path})
+	cmd := exec.CommandContext(ctx, implementation.command[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	var outcome diffOutcome
+	err := cmd.Run()
+	var exitError *exec.ExitError
+	if ctx.Err() != nil {
+		outcome.timedOut = true
+	} else if errors.As(err, &exitError) {
+		outcome.exitCode = exitError.ExitCode()
+	} else if err != nil {
+		return outcome, err
+	}
+	outcome.output = strings.TrimPrefix(stdout.String(), fmt.Sprintf("running script %v\n", path))
+	outcome.errors = normalizeErrors(stderr.String())
+	return outcome, nil
+}
+
+// normalizeErrors turns what an implementation wrote to standard error into
+// a list of errors in the form jlox reports them. Lines it doesn't recognize
+// are kept as they are.
+func normalizeErrors(stderr string) []string {
+	var errors []string
+	lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		if compileErrorLine.MatchString(line) {
+			errors = append(errors, line)
+		} else if i+1 < len(lines) && stackTraceLine.MatchString(lines[i+1]) {
+			// The message of a runtime error, then a stack trace, with
+			// the line the error happened on first.
+			errors = append(errors, fmt.Sprintf("[line %v] %v", stackTraceLine.FindStringSubmatch(lines[i+1])[1], line))
+			for i+1 < len(lines) && stackTraceLine.MatchString(lines[i+1]) {
+				i++
+			}
+		} else {
+			errors = append(errors, line)
+		}
+	}
+	return errors
+}
+
+// compareOutcomes says how got differs from expected, which is what the
+// implementation called reference did.
+func compareOutcomes(expected, got diffOutcome, reference string) []string {
+	var differences []string
+	describeExit := func(o diffOutcome) string {
+		if o.timedOut {
+			return "timed out"
+		}
+		return fmt.Sprintf("exited with %v", o.exitCode)
+	}
+	if describeExit(expected) != describeExit(got) {
+		differences = append(differences, fmt.Sprintf("%v, but %v %v", describeExit(got), reference, describeExit(expected)))
+	}
+
+	expectedLines := outputLines(expected.output)
+	gotLines := outputLines(got.output)
+	for i := 0; i < len(expectedLines) || i < len(gotLines); i++ {
+		if i >= len(gotLines) {
+			differences = append(differences, fmt.Sprintf("stopped printing after %v lines, but %v printed %q next", len(gotLines), reference, expectedLines[i]))
+			break
+		}
+		if i >= len(expectedLines) {
+			differences = append(differences, fmt.Sprintf("printed %q after %v's %v lines", gotLines[i], reference, len(expectedLines)))
+			break
+		}
+		if expectedLines[i] != gotLines[i] {
+			differences = append(differences, fmt.Sprintf("printed %q on line %v of the output, but %v printed %q", gotLines[i], i+1, reference, expectedLines[i]))
+			break
+		}
+	}
+
+	for _, e := range got.errors {
+		if !slices.Contains(expected.errors, e) {
+			differences = append(differences, fmt.Sprintf("reported %q, but %v didn't", e, reference))
+		}
+	}
+	for _, e := range expected.errors {
+		if !slices.Contains(got.errors, e) {
+			differences = append(differences, fmt.Sprintf("didn't report %q, but %v did", e, reference))
+		}
+	}
+	return differences
+}
+
+func outputLines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestGeneratedPrograms checks that the random programs are valid, and that
+// both engines agree about them.
+func TestGeneratedPrograms(t *testing.T) {
+	for seed := uint64(1); seed <= 100; seed++ {
+		source := generateProgram(seed)
+		run := runIsolated(source, engineTreeWalk, nil)
+		if len(run.errors) > 0 {
+			t.Errorf("program %v has errors: %v\n%v", seed, run.errors, source)
+			continue
+		}
+		treeWalk, vm := runTranscript(source, engineTreeWalk), runTranscript(source, engineVM)
+		if treeWalk != vm {
+			t.Errorf("program %v runs differently on the VM:\n%v\ntree-walk:\n%v\nvm:\n%v", seed, source, treeWalk, vm)
+		}
+	}
+}
+
+func TestGeneratedProgramsAreReproducible(t *testing.T) {
+	if generateProgram(42) != generateProgram(42) {
+		t.Error("the same seed generated two different programs")
+	}
+	if generateProgram(42) == generateProgram(43) {
+		t.Error("different seeds generated the same program")
+	}
+}
+
+func TestNormalizeErrors(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   []string
+	}{
+		{"", nil},
+		{"[line 1] Error at 'print': Expect expression.\n", []string{"[line 1] Error at 'print': Expect expression."}},
+		{"[line 3] Operand must be a number.\n", []string{"[line 3] Operand must be a number."}},
+		{"Operand must be a number.\n[line 3] in script\n", []string{"[line 3] Operand must be a number."}},
+		{"Expected 1 arguments but got 2.\n[line 7] in f()\n[line 9] in script\n", []string{"[line 7] Expected 1 arguments but got 2."}},
+		{"thread 'main' panicked\n", []string{"thread 'main' panicked"}},
+	}
+	for _, test := range tests {
+		if got := normalizeErrors(test.stderr); !slices.Equal(got, test.want) {
+			t.Errorf("normalizeErrors(%q) = %q, want %q", test.stderr, got, test.want)
+		}
+	}
+}
+
+func TestCompareOutcomes(t *testing.T) {
+	expected := diffOutcome{output: "1\n2\n", errors: []string{"[line 2] Oops."}, exitCode: 70}
+	if differences := compareOutcomes(expected, expected, "jlox"); len(differences) > 0 {
+		t.Errorf("the same outcome differs: %q", differences)
+	}
+	got := diffOutcome{output: "1\n", exitCode: 0}
+	want := []string{
+		"exited with 0, but jlox exited with 70",
+		`stopped printing after 1 lines, but jlox printed "2" next`,
+		`didn't report "[line 2] Oops.", but jlox did`,
+	}
+	if differences := compareOutcomes(expected, got, "jlox"); !slices.Equal(differences, want) {
+		t.Errorf("differences = %q, want %q", differences, want)
+	}
+}
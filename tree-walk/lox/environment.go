@@ -4,9 +4,54 @@ import (
 	"fmt"
 )
 
+// An Environment is either the globals, which are looked up by name, or the
+// local variables of a block or a call, which are looked up by where the
+// resolver found them (see localSlot). A local is defined by appending it to
+// slots: each one's index is the order it's declared in its scope, and the
+// declarations in a scope run in that order, so the two always agree.
+//
+// A call's environment doesn't enclose the one its function was declared in.
+// Instead, the function has a box for each variable it uses from around it
+// (its upvalues, as clox calls them), and the call's environment has those.
+// A local is moved into a box the first time a function captures it, so the
+// box is shared by every function that captures it and by the environment.
 type Environment struct {
 	enclosing *Environment
-	values    map[string]any
+	// values are the globals. Only the global environment has them.
+	values map[string]any
+	// slots are the locals, and names are what they're called, for the
+	// debugger and the like. names has the whole scope's names, even
+	// the ones that haven't been defined yet. A slot holds a *box once
+	// its local has been captured.
+	slots []any
+	names []string
+	// upvalues are the boxes of the function being called, for a call's
+	// environment. A method's this is left out, as nil, and is this
+	// instead, so that calling a method doesn't need a box for it.
+	upvalues []*box
+	this     *LoxInstance
+}
+
+// A box holds a local variable that a function has captured.
+type box struct {
+	name  string
+	value any
+}
+
+// localSlot is where the resolver found a local variable: depth environments
+// out from the one where it's used, at index in that environment's slots, or
+// if upvalue, its upvalues.
+type localSlot struct {
+	depth, index int
+	upvalue      bool
+}
+
+// An upvalueSource is where a function gets one of its upvalues from when
+// it's made: a local (or upvalue) found from the environment it's made in,
+// or for a method, the instance it's called with.
+type upvalueSource struct {
+	from   localSlot
+	isThis bool
 }
 
 func NewEnvironment() *Environment {
@@ -16,8 +61,21 @@ func NewEnvironment() *Environment {
 	}
 }
 
+// NewLocalEnvironment makes the environment for a scope that declares names.
+func NewLocalEnvironment(enclosing *Environment, names []string) *Environment {
+	return &Environment{
+		enclosing: enclosing,
+		slots:     make([]any, 0, len(names)),
+		names:     names,
+	}
+}
+
 func (e *Environment) define(name string, value any) {
-	e.values[name] = value
+	if e.values != nil {
+		e.values[name] = value
+		return
+	}
+	e.slots = append(e.slots, value)
 }
 
 func (e *Environment) ancestor(distance int) *Environment {
@@ -28,12 +86,69 @@ func (e *Environment) ancestor(distance int) *Environment {
 	return environment
 }
 
-func (e *Environment) getAt(distance int, name string) any {
-	return e.ancestor(distance).values[name]
+func (e *Environment) getAt(distance int, index int) any {
+	value := e.ancestor(distance).slots[index]
+	if b, ok := value.(*box); ok {
+		return b.value
+	}
+	return value
+}
+
+func (e *Environment) assignAt(distance int, index int, value any) {
+	environment := e.ancestor(distance)
+	if b, ok := environment.slots[index].(*box); ok {
+		b.value = value
+	} else {
+		environment.slots[index] = value
+	}
 }
 
-func (e *Environment) assignAt(distance int, name Token, value any) {
-	e.ancestor(distance).values[name.lexeme] = value
+func (e *Environment) getLocal(local localSlot) any {
+	if local.upvalue {
+		environment := e.ancestor(local.depth)
+		if upvalue := environment.upvalues[local.index]; upvalue != nil {
+			return upvalue.value
+		}
+		return environment.this
+	}
+	return e.getAt(local.depth, local.index)
+}
+
+func (e *Environment) assignLocal(local localSlot, value any) {
+	if local.upvalue {
+		e.ancestor(local.depth).upvalues[local.index].value = value
+	} else {
+		e.assignAt(local.depth, local.index, value)
+	}
+}
+
+// initialize gives a value to the variable called name that was defined last.
+// A function or class is defined first and made second, since it can capture
+// its own variable.
+func (e *Environment) initialize(name string, value any) {
+	if e.values != nil {
+		e.values[name] = value
+	} else {
+		e.assignAt(0, len(e.slots)-1, value)
+	}
+}
+
+// capture finds the box for a local, or moves the local into a new box, for a
+// function that uses it to hold on to.
+func (e *Environment) capture(local localSlot) *box {
+	environment := e.ancestor(local.depth)
+	if local.upvalue {
+		if upvalue := environment.upvalues[local.index]; upvalue != nil {
+			return upvalue
+		}
+		return &box{"this", environment.this}
+	}
+	if b, ok := environment.slots[local.index].(*box); ok {
+		return b
+	}
+	b := &box{environment.names[local.index], environment.slots[local.index]}
+	environment.slots[local.index] = b
+	return b
 }
 
 func (e *Environment) get(name Token) (any, error) {
@@ -48,3 +163,65 @@ func (e *Environment) get(name Token) (any, error) {
 
 	return nil, RuntimeError{name, fmt.Sprintf("Undefined variable %q.", name.lexeme)}
 }
+
+// lookup finds the variable called name in this environment alone (not the
+// ones around it, though including a call's upvalues), for the debugger,
+// which only has names to go on.
+func (e *Environment) lookup(name string) (any, bool) {
+	if e.values != nil {
+		value, ok := e.values[name]
+		return value, ok
+	}
+	if index := e.indexOf(name); index >= 0 {
+		return e.getAt(0, index), true
+	}
+	if index := e.upvalueIndexOf(name); index >= 0 {
+		return e.getLocal(localSlot{0, index, true}), true
+	}
+	return nil, false
+}
+
+// indexOf is the slot of the local called name that's been defined, or -1.
+func (e *Environment) indexOf(name string) int {
+	for i := len(e.slots) - 1; i >= 0; i-- {
+		if i < len(e.names) && e.names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// upvalueIndexOf is the index of the call's upvalue called name, or -1.
+func (e *Environment) upvalueIndexOf(name string) int {
+	for i, upvalue := range e.upvalues {
+		if (upvalue != nil && upvalue.name == name) || (upvalue == nil && name == "this") {
+			return i
+		}
+	}
+	return -1
+}
+
+// variables are what's been defined in this environment alone, by name,
+// including a call's upvalues unless a local hides them.
+func (e *Environment) variables() map[string]any {
+	if e.values != nil {
+		return e.values
+	}
+	variables := make(map[string]any, len(e.slots)+len(e.upvalues))
+	for _, upvalue := range e.upvalues {
+		if upvalue != nil {
+			variables[upvalue.name] = upvalue.value
+		} else {
+			variables["this"] = e.this
+		}
+	}
+	for i := range e.slots {
+		if i < len(e.names) {
+			variables[e.names[i]] = e.getAt(0, i)
+		}
+	}
+	return variables
+}
+
+// The names in the environment that holds a subclass's "super".
+var superNames = []string{"super"}
@@ -16,6 +16,9 @@ type Expr interface {
 type Assign struct {
 	name  Token
 	value Expr
+	// local is where the resolver found the variable, or nil if it's a
+	// global.
+	local *localSlot
 }
 
 type Binary struct {
@@ -33,6 +36,9 @@ type Call struct {
 type Get struct {
 	object Expr
 	name   Token
+	// cache is what the Get found last time it ran, for the next time
+	// it gets a property from an instance of the same shape.
+	cache *propertyCache
 }
 
 type Grouping struct {
@@ -41,6 +47,10 @@ type Grouping struct {
 
 type Literal struct {
 	value any
+	// token is the literal in the source. It's the zero Token for the
+	// literals the parser makes up itself, like the "true" condition of a
+	// for loop with no condition.
+	token Token
 }
 
 type Logical struct {
@@ -53,15 +63,22 @@ type Set struct {
 	object Expr
 	name   Token
 	value  Expr
+	// cache is where the Set put the field last time it ran, like Get's.
+	cache *fieldCache
 }
 
 type Super struct {
 	keyword Token
 	method  Token
+	// local is where the resolver found "super", and this is where it
+	// found the instance to bind the method to.
+	local *localSlot
+	this  *localSlot
 }
 
 type This struct {
 	keyword Token
+	local   *localSlot
 }
 
 type Unary struct {
@@ -71,6 +88,9 @@ type Unary struct {
 
 type Variable struct {
 	name Token
+	// local is where the resolver found the variable, or nil if it's a
+	// global.
+	local *localSlot
 }
 
 func (b *Binary) sealExpr()   {}
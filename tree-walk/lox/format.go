@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The formatter works on the token stream rather than on the AST, because
+// the AST throws away most of the punctuation and keywords, and with them the
+// comments in their trivia. Lox's grammar is simple enough that looking at
+// each pair of adjacent tokens (and keeping count of open parentheses) is
+// enough to decide where the line breaks and spaces go:
+//
+//   - A line break comes after '{', before and after '}' (except for
+//     "} else"), and after a ';' that isn't inside a for loop's parentheses.
+//   - Blocks are indented by two spaces.
+//   - Binary operators get a space on each side, while unary operators,
+//     '.', calls and the insides of parentheses don't.
+//   - At most one blank line is kept between statements.
+//   - Comments stay where they were: either at the end of the line they were
+//     on, or on their own line.
+
+var errSyntax = errors.New("can't format a program with syntax errors")
+
+// formatSource returns source in the canonical style, or if it has syntax
+// errors, an error listing them. As a safety net, it checks that the result
+// parses back into the same AST, and returns an error rather than risk
+// changing the meaning of the program.
+func formatSource(source string) (string, error) {
+	tokens, statements, errs := parseForFormat(source)
+	if len(errs) > 0 {
+		return "", fmt.Errorf("%w:\n%v", errSyntax, strings.Join(errs, "\n"))
+	}
+
+	f := &formatter{lineStart: true}
+	for _, token := range tokens {
+		f.writeToken(token)
+	}
+	result := f.out.String()
+
+	_, formatted, errs := parseForFormat(result)
+	if len(errs) > 0 || printStatements(formatted) != printStatements(statements) {
+		return "", errors.New("formatting would change the program; this is a bug in the formatter")
+	}
+	return result, nil
+}
+
+// parseForFormat scans and parses source, and returns the syntax errors in
+// it, one "[line N] Error ..." line each, instead of reporting them.
+func parseForFormat(source string) ([]Token, []Stmt, []string) {
+	var errs []string
+	scanner := NewScanner(source)
+	scanner.reportError = func(line int, message string) {
+		errs = append(errs, fmt.Sprintf("[line %v] Error: %v", line, message))
+	}
+	tokens := scanner.ScanTokens()
+	parser := NewParser(tokens)
+	parser.reportError = func(token Token, message string) {
+		where := " at '" + token.lexeme + "'"
+		if token.tokenType == EOF {
+			where = " at end"
+		}
+		errs = append(errs, fmt.Sprintf("[line %v] Error%v: %v", token.line, where, message))
+	}
+	statements := parser.parse()
+	return tokens, statements, errs
+}
+
+type formatter struct {
+	out    strings.Builder
+	indent int
+	// parens is how many parentheses are open, so that we can tell the
+	// semicolons in a for loop's clauses from the ones ending statements.
+	parens int
+	// lineStart is whether nothing has been written on the current line.
+	lineStart bool
+	// previous is the last token written, or the zero Token (whose line is
+	// 0) at the start.
+	previous Token
+	// previousUnary is whether previous was a unary operator.
+	previousUnary bool
+	// afterOpenBrace is whether the last thing written was a '{', in which
+	// case we don't want a blank line.
+	afterOpenBrace bool
+}
+
+// comment is a comment found in a token's trivia.
+type comment struct {
+	text string
+	// newlines is how many line breaks came between the comment and
+	// whatever was before it.
+	newlines int
+}
+
+// splitTrivia picks the comments out of trivia, and counts the line breaks
+// between the last of them (or the start) and the end of the trivia.
+func splitTrivia(trivia string) ([]comment, int) {
+	var comments []comment
+	newlines := 0
+	for i := 0; i < len(trivia); i++ {
+		switch trivia[i] {
+		case '\n':
+			newlines++
+		case '/':
+			end := strings.IndexByte(trivia[i:], '\n')
+			if end < 0 {
+				end = len(trivia) - i
+			}
+			text := strings.TrimRight(trivia[i:i+end], " \t\r")
+			comments = append(comments, comment{text, newlines})
+			newlines = 0
+			i += end - 1
+		}
+	}
+	return comments, newlines
+}
+
+func (f *formatter) writeToken(token Token) {
+	comments, newlines := splitTrivia(token.trivia)
+	for _, c := range comments {
+		f.writeComment(c)
+	}
+
+	if token.tokenType == EOF {
+		if !f.lineStart {
+			f.newline()
+		}
+		return
+	}
+
+	if token.tokenType == RIGHT_BRACE {
+		f.indent--
+	}
+
+	if f.previous.line == 0 || f.breakBetween(f.previous, token) {
+		if !f.lineStart {
+			f.newline()
+		}
+		if newlines > 1 && f.out.Len() > 0 && !f.afterOpenBrace && token.tokenType != RIGHT_BRACE {
+			f.newline()
+		}
+	} else if f.lineStart && !endsLine(f.previous) {
+		// A comment forced a line break in the middle of a
+		// statement, so indent the rest of it a bit more.
+		f.indent++
+		f.writeIndent()
+		f.indent--
+	} else if !f.lineStart && f.spaceBetween(f.previous, token) {
+		f.out.WriteString(" ")
+	}
+	if f.lineStart {
+		f.writeIndent()
+	}
+
+	f.out.WriteString(token.lexeme)
+	f.lineStart = false
+
+	switch token.tokenType {
+	case LEFT_BRACE:
+		f.indent++
+	case LEFT_PAREN:
+		f.parens++
+	case RIGHT_PAREN:
+		f.parens--
+	}
+	f.previousUnary = token.tokenType == BANG ||
+		(token.tokenType == MINUS && !endsOperand(f.previous))
+	f.previous = token
+	f.afterOpenBrace = token.tokenType == LEFT_BRACE
+}
+
+func (f *formatter) writeComment(c comment) {
+	if c.newlines == 0 && !f.lineStart {
+		// A comment at the end of a line stays there.
+		f.out.WriteString(" ")
+		f.out.WriteString(c.text)
+		f.newline()
+		return
+	}
+	if !f.lineStart {
+		f.newline()
+	}
+	if c.newlines > 1 && f.out.Len() > 0 && !f.afterOpenBrace {
+		f.newline()
+	}
+	f.writeIndent()
+	f.out.WriteString(c.text)
+	f.newline()
+	f.afterOpenBrace = false
+}
+
+func (f *formatter) newline() {
+	f.out.WriteString("\n")
+	f.lineStart = true
+}
+
+func (f *formatter) writeIndent() {
+	f.out.WriteString(strings.Repeat("  ", f.indent))
+}
+
+func (f *formatter) breakBetween(previous Token, next Token) bool {
+	switch previous.tokenType {
+	case LEFT_BRACE:
+		return next.tokenType != RIGHT_BRACE
+	case RIGHT_BRACE:
+		return next.tokenType != ELSE
+	case SEMICOLON:
+		return f.parens == 0
+	}
+	return next.tokenType == RIGHT_BRACE && previous.tokenType != LEFT_BRACE
+}
+
+func (f *formatter) spaceBetween(previous Token, next Token) bool {
+	switch previous.tokenType {
+	case LEFT_PAREN, DOT:
+		return false
+	}
+	if f.previousUnary {
+		return false
+	}
+	switch next.tokenType {
+	case RIGHT_PAREN, COMMA, SEMICOLON, DOT:
+		return false
+	case LEFT_PAREN:
+		// A call, as opposed to "if (" or "print (".
+		return !endsOperand(previous)
+	case RIGHT_BRACE:
+		return previous.tokenType != LEFT_BRACE
+	}
+	return true
+}
+
+// endsLine is whether token is one that a line break usually comes after.
+func endsLine(token Token) bool {
+	switch token.tokenType {
+	case LEFT_BRACE, RIGHT_BRACE, SEMICOLON:
+		return true
+	}
+	return false
+}
+
+// endsOperand is whether token can be the last token of an operand, which
+// is how we tell a binary minus from a unary one, and a call's parenthesis
+// from any other.
+func endsOperand(token Token) bool {
+	switch token.tokenType {
+	case IDENTIFIER, STRING, NUMBER, RIGHT_PAREN, TRUE, FALSE, NIL, THIS:
+		return true
+	}
+	return false
+}
+
+// fmtCommand implements "jlox fmt". With no paths, it formats standard input
+// to standard output. Otherwise it rewrites each file (or each .lox file in
+// each directory) in place, or with -check, just lists the ones that aren't
+// formatted.
+func fmtCommand(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "list files that aren't formatted, and exit with status 1 if there are any, instead of rewriting them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox fmt [flags] [path ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		source, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(66)
+		}
+		result, err := formatSource(string(source))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(65)
+		}
+		fmt.Print(result)
+		return
+	}
+
+	failed := false
+	unformatted := false
+	for _, root := range flags.Args() {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Files named on the command line get formatted whatever
+			// they're called; files found in directories have to end
+			// in ".lox".
+			if entry.IsDir() || (filepath.Ext(path) != ".lox" && path != root) {
+				return nil
+			}
+
+			source, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			result, err := formatSource(string(source))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+				failed = true
+				return nil
+			}
+			if result == string(source) {
+				return nil
+			}
+			if *check {
+				fmt.Println(path)
+				unformatted = true
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, []byte(result), info.Mode().Perm())
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(65)
+	}
+	if unformatted {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzFormat checks that formatting never changes a program (formatSource
+// checks that itself, and reports it as an error) and that formatted code
+// stays the same when it's formatted again.
+func FuzzFormat(f *testing.F) {
+	examples, err := filepath.Glob("../examples/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, example := range examples {
+		source, err := os.ReadFile(example)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(source))
+	}
+	f.Add("// header\n\n\nvar a=1+-2 ;   // trailing\nfun   f(x,y){return x*(y-1);}\n")
+	f.Add("if(a>1)print a;else{print \"no\";}\nfor(;;){}\n{\n  // inside\n\n\n  print f(1, 2) ; // t2\n}\n")
+	f.Add("print s + // why\n  \"x\";\nif (a) {\n}\n// between\nelse print -(-a);")
+
+	f.Fuzz(func(t *testing.T, source string) {
+		formatted, err := formatSource(source)
+		if errors.Is(err, errSyntax) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("%v:\n%v", err, source)
+		}
+		again, err := formatSource(formatted)
+		if err != nil {
+			t.Fatalf("%v:\n%v", err, formatted)
+		}
+		if again != formatted {
+			t.Fatalf("formatting isn't stable:\n%v\nbecame\n%v", formatted, again)
+		}
+	})
+}
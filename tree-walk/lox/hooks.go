@@ -0,0 +1,77 @@
+package main
+
+// Hooks let tools like debuggers, profilers and tracers watch a program run
+// without changing the interpreter. Each hook is called on the goroutine
+// running the program, so it can look at the interpreter's state (like
+// i.environment) while it's called, but shouldn't hang on to it.
+//
+// When no hooks are added, the interpreter only pays for checking that
+// i.hooks is nil at each statement, expression and call.
+type Hooks interface {
+	// BeforeStatement is called before each statement runs.
+	BeforeStatement(i *Interpreter, stmt Stmt)
+	// AfterExpression is called after each expression has been
+	// evaluated, unless evaluating it failed.
+	AfterExpression(i *Interpreter, expr Expr, value any)
+	// BeforeCall is called after a call's arguments have been
+	// evaluated and checked, just before the call.
+	BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any)
+	// AfterCall is called once a call has finished, with its result or
+	// the error that it failed with. Every BeforeCall has an AfterCall.
+	AfterCall(i *Interpreter, call *Call, callee LoxCallable, result any, err error)
+	// OnRuntimeError is called when a runtime error happens, once, from
+	// the statement it happened in, before it unwinds the stack.
+	OnRuntimeError(i *Interpreter, err RuntimeError)
+}
+
+// NoHooks does nothing for each hook. Embedding it in a struct makes it
+// easy to implement just the hooks that are needed.
+type NoHooks struct{}
+
+func (NoHooks) BeforeStatement(i *Interpreter, stmt Stmt)            {}
+func (NoHooks) AfterExpression(i *Interpreter, expr Expr, value any) {}
+func (NoHooks) BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any) {
+}
+func (NoHooks) AfterCall(i *Interpreter, call *Call, callee LoxCallable, result any, err error) {
+}
+func (NoHooks) OnRuntimeError(i *Interpreter, err RuntimeError) {}
+
+var _ Hooks = NoHooks{}
+
+// addHooks adds hooks to the ones called as the program runs. Hooks are
+// called in the order they were added.
+func (i *Interpreter) addHooks(hooks Hooks) {
+	i.hooks = append(i.hooks, hooks)
+}
+
+// callableName is the name to show for what call is calling, as in a stack
+// trace or a profile: a function's or class's own name, rather than how it
+// prints. Native functions don't know their names, so they go by the
+// variable they were called through.
+func callableName(call *Call, callee LoxCallable) string {
+	switch v := callee.(type) {
+	case *LoxFunction:
+		return v.declaration.name.lexeme
+	case *LoxClass:
+		return v.name
+	}
+	if variable, ok := call.callee.(*Variable); ok {
+		return variable.name.lexeme
+	}
+	return callee.String()
+}
+
+// stmtLine finds the line stmt starts on, which is the line of its first
+// token. It has to look through all of stmt's tokens, so hooks that want it
+// for each statement should keep the answers.
+func stmtLine(stmt Stmt) int {
+	line, offset := 0, -1
+	stmtTokens(stmt, func(token Token) {
+		// Tokens on line 0 were made up by the parser, like the
+		// "true" in "for (;;)".
+		if token.line != 0 && (offset < 0 || token.offset < offset) {
+			line, offset = tokenStart(token).line, token.offset
+		}
+	})
+	return line
+}
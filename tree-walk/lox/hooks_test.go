@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recordingHooks writes down each hook that's called, one line each.
+type recordingHooks struct {
+	events []string
+}
+
+func (r *recordingHooks) record(format string, args ...any) {
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+// nodeName is the name of stmt's or expr's type, like "Print".
+func nodeName(node any) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*main.")
+}
+
+func (r *recordingHooks) BeforeStatement(i *Interpreter, stmt Stmt) {
+	r.record("statement %v on line %v", nodeName(stmt), stmtLine(stmt))
+}
+
+func (r *recordingHooks) AfterExpression(i *Interpreter, expr Expr, value any) {
+	r.record("  %v is %v", nodeName(expr), describe(value))
+}
+
+func (r *recordingHooks) BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any) {
+	r.record("  call %v with %v arguments", callableName(call, callee), len(arguments))
+}
+
+func (r *recordingHooks) AfterCall(i *Interpreter, call *Call, callee LoxCallable, result any, err error) {
+	if err != nil {
+		r.record("  %v failed", callableName(call, callee))
+	} else {
+		r.record("  %v returned %v", callableName(call, callee), describe(result))
+	}
+}
+
+func (r *recordingHooks) OnRuntimeError(i *Interpreter, err RuntimeError) {
+	r.record("runtime error on line %v: %v", err.token.line, err.message)
+}
+
+// TestHookOrder checks the order the hooks are called in as a program runs,
+// and fails.
+func TestHookOrder(t *testing.T) {
+	const source = `class A {
+  init(x) { this.x = x; }
+  get() { return this.x; }
+}
+var a = A(1);
+print a.get() + 1;
+fun boom() { return a.nope(); }
+boom();
+print "unreachable";`
+	hadError = false
+	interpreter := NewInterpreter()
+	statements := NewParser(NewScanner(source).ScanTokens()).parse()
+	NewResolver().resolveStatements(statements)
+	if hadError {
+		t.Fatal("the program doesn't compile")
+	}
+	var output strings.Builder
+	interpreter.stdout = &output
+	hooks := &recordingHooks{}
+	interpreter.addHooks(hooks)
+	for _, stmt := range statements {
+		if _, err := interpreter.execute(stmt); err != nil {
+			break
+		}
+	}
+
+	want := []string{
+		"statement Class on line 1",
+		"statement Var on line 5",
+		"  Variable is A",
+		"  Literal is 1",
+		"  call A with 1 arguments",
+		"statement Expression on line 2",
+		"  This is A instance",
+		"  Variable is 1",
+		"  Set is 1",
+		"  A returned A instance",
+		"  Call is A instance",
+		"statement Print on line 6",
+		"  Variable is A instance",
+		"  Get is <fn get >",
+		"  call get with 0 arguments",
+		"statement Return on line 3",
+		"  This is A instance",
+		"  Get is 1",
+		"  get returned 1",
+		"  Call is 1",
+		"  Literal is 1",
+		"  Binary is 2",
+		"statement Function on line 7",
+		"statement Expression on line 8",
+		"  Variable is <fn boom >",
+		"  call boom with 0 arguments",
+		"statement Return on line 7",
+		"  Variable is A instance",
+		"runtime error on line 7: Undefined property \"nope\".",
+		"  boom failed",
+	}
+	if got := strings.Join(hooks.events, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("the hooks were called in the wrong order: got\n%v\nwant\n%v", got, strings.Join(want, "\n"))
+	}
+	if got := output.String(); got != "2\n" {
+		t.Errorf("got the output %q, want %q", got, "2\n")
+	}
+}
+
+// TestMethodCallsWithHooks checks that method calls do the same with hooks as
+// without them, when the interpreter calls methods without binding them first.
+func TestMethodCallsWithHooks(t *testing.T) {
+	const classes = `
+		class Base {
+			init(x) { this.x = x; }
+			get() { return this.x; }
+			twice() { return this.get() * 2; }
+		}
+		class Derived < Base {
+			get() { return super.get() + 100; }
+		}
+		fun shout() { return "shout"; }
+		var b = Base(1);
+		var d = Derived(2);
+	`
+	for _, test := range []struct {
+		source, want string
+	}{
+		{"print b.get(); print b.twice(); print d.get(); print d.twice();", "1\n2\n102\n204\n"},
+		{"print b.init(3).get(); print b.x;", "3\n3\n"},
+		{"b.f = shout; print b.f();", "shout\n"},
+		{"var get = d.get; d.x = 5; print get();", "105\n"},
+		{"b.get = 1; b.get();", "runtime error: Can only call functions and classes."},
+		{"b.get(1);", "runtime error: Expected 0 arguments but got 1."},
+		{"b.nope();", "runtime error: Undefined property \"nope\"."},
+		{"var n = 1; n.get();", "runtime error: Only instances have properties."},
+	} {
+		var got [2]string
+		for j, hooks := range []Hooks{nil, NoHooks{}} {
+			hadError = false
+			interpreter := NewInterpreter()
+			statements := NewParser(NewScanner(classes + test.source).ScanTokens()).parse()
+			NewResolver().resolveStatements(statements)
+			if hadError {
+				t.Fatalf("%q doesn't compile", test.source)
+			}
+			var output strings.Builder
+			interpreter.stdout = &output
+			if hooks != nil {
+				interpreter.addHooks(hooks)
+			}
+			for _, stmt := range statements {
+				if _, err := interpreter.execute(stmt); err != nil {
+					output.WriteString("runtime error: " + err.(RuntimeError).message)
+					break
+				}
+			}
+			got[j] = output.String()
+		}
+		if got[0] != test.want {
+			t.Errorf("%q without hooks: got %q, want %q", test.source, got[0], test.want)
+		}
+		if got[1] != test.want {
+			t.Errorf("%q with hooks: got %q, want %q", test.source, got[1], test.want)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"time"
 )
@@ -9,11 +11,15 @@ import (
 type Interpreter struct {
 	globals     *Environment
 	environment *Environment
-	// I would like to make the map keys *Expr, however, this seems to be disallowed
-	// by Go. Even if I implement each concrete struct of Expr as pointer
-	// receivers, that only makes e.g. *Assign be able to pass as Expr,
-	// rather than a *Assign being able to pass as *Expr.
-	locals map[Expr]int
+	memory      memoryLimiter
+	// stdout is where print writes to.
+	stdout io.Writer
+	// hooks are called as the program runs; see hooks.go.
+	hooks []Hooks
+	// unwinding is whether a runtime error has been passed to the hooks
+	// and is on its way up through the statements that contain the one
+	// where it happened.
+	unwinding bool
 }
 
 type ReturnedValue struct {
@@ -27,24 +33,43 @@ func NewInterpreter() Interpreter {
 	result := Interpreter{
 		globals:     environment,
 		environment: environment,
-		locals:      make(map[Expr]int),
+		stdout:      os.Stdout,
 	}
 
-	result.globals.define("clock", &LoxNativeFunction{
-		arity: 0,
-		fn: func(interpreter *Interpreter, arguments []any) any {
-			return float64(time.Now().UnixMilli()) / 1000.0
-		},
-		name: "<native fn>",
-	})
+	result.globals.define("clock", clockNative)
 
 	return result
 }
 
+var clockNative = &LoxNativeFunction{
+	arity: 0,
+	fn: func(interpreter *Interpreter, arguments []any) (any, error) {
+		return float64(time.Now().UnixMilli()) / 1000.0, nil
+	},
+	name: "<native fn>",
+}
+
 func (i *Interpreter) interpretFunctionStmt(stmt *Function) error {
-	function := &LoxFunction{stmt, i.environment, false}
-	i.environment.define(stmt.name.lexeme, function)
-	return nil
+	if err := i.allocateDefinition(stmt.name); err != nil {
+		return err
+	}
+	i.environment.define(stmt.name.lexeme, nil)
+	i.environment.initialize(stmt.name.lexeme, i.closure(stmt, false))
+	return i.checkMemory(stmt.name)
+}
+
+// closure makes the function that declaration declares, capturing the
+// variables it uses from around it. A method's this is left out, as nil: it's
+// whichever instance the method is called with.
+func (i *Interpreter) closure(declaration *Function, isInitializer bool) *LoxFunction {
+	i.reserve(closureSize + len(declaration.upvalues)*slotSize)
+	upvalues := make([]*box, len(declaration.upvalues))
+	for j, source := range declaration.upvalues {
+		if !source.isThis {
+			upvalues[j] = i.environment.capture(source.from)
+		}
+	}
+	return &LoxFunction{declaration, upvalues, isInitializer, nil}
 }
 
 func (i *Interpreter) interpret(statements []Stmt) {
@@ -54,24 +79,80 @@ func (i *Interpreter) interpret(statements []Stmt) {
 			if rte, ok := err.(RuntimeError); ok {
 				runtimeError(rte)
 			}
+			// Like the book, stop at the first runtime error. Carrying
+			// on would be especially bad for errors like running out
+			// of memory, whose whole point is to stop the script.
+			return
 		}
 	}
 }
 
 func (i *Interpreter) interpretCallExpr(expr *Call) (any, error) {
+	if get, ok := expr.callee.(*Get); ok && i.hooks == nil {
+		return i.invoke(expr, get)
+	}
 	callee, err := i.evaluate(expr.callee)
 	if err != nil {
 		return nil, err
 	}
-	arguments := []any{}
-	for _, argument := range expr.arguments {
-		res, err := i.evaluate(argument)
+	arguments, err := i.evaluateArguments(expr)
+	if err != nil {
+		return nil, err
+	}
+	return i.callValue(expr, callee, arguments)
+}
+
+// invoke calls the property that get gets, which for a method means calling
+// it with the instance rather than binding it first. The hooks need to see
+// the bound method, so it's only for when there aren't any.
+func (i *Interpreter) invoke(expr *Call, get *Get) (any, error) {
+	object, err := i.evaluate(get.object)
+	if err != nil {
+		return nil, err
+	}
+	instance, ok := object.(*LoxInstance)
+	if !ok {
+		return nil, RuntimeError{get.name, "Only instances have properties."}
+	}
+	field, method, err := instance.property(get)
+	if err != nil {
+		return nil, err
+	}
+	arguments, err := i.evaluateArguments(expr)
+	if err != nil {
+		return nil, err
+	}
+	if method == nil {
+		return i.callValue(expr, field, arguments)
+	}
+
+	if len(arguments) != method.Arity() {
+		return nil, RuntimeError{expr.paren, fmt.Sprintf(
+			"Expected %d arguments but got %d.",
+			method.Arity(),
+			len(arguments),
+		)}
+	}
+	if err := i.checkMemory(expr.paren); err != nil {
+		return nil, err
+	}
+	return method.call(i, arguments, instance)
+}
+
+func (i *Interpreter) evaluateArguments(expr *Call) ([]any, error) {
+	arguments := make([]any, len(expr.arguments))
+	for j, argument := range expr.arguments {
+		value, err := i.evaluate(argument)
 		if err != nil {
 			return nil, err
 		}
-		arguments = append(arguments, res)
+		arguments[j] = value
 	}
+	return arguments, nil
+}
 
+// callValue calls callee, if it can be called, with arguments.
+func (i *Interpreter) callValue(expr *Call, callee any, arguments []any) (any, error) {
 	function, ok := callee.(LoxCallable)
 	if !ok {
 		return nil, RuntimeError{expr.paren, "Can only call functions and classes."}
@@ -85,7 +166,35 @@ func (i *Interpreter) interpretCallExpr(expr *Call) (any, error) {
 		)}
 	}
 
-	return function.Call(i, arguments)
+	// Calls reserve memory for their environments without checking the
+	// limit, so check it here before we go any deeper.
+	if err := i.checkMemory(expr.paren); err != nil {
+		return nil, err
+	}
+
+	if i.hooks == nil {
+		return i.call(expr, function, arguments)
+	}
+	for _, h := range i.hooks {
+		h.BeforeCall(i, expr, function, arguments)
+	}
+	result, err := i.call(expr, function, arguments)
+	for _, h := range i.hooks {
+		h.AfterCall(i, expr, function, result, err)
+	}
+	return result, err
+}
+
+// call calls function. Native functions don't know where they were called
+// from, so their errors are turned into runtime errors at the call here.
+func (i *Interpreter) call(expr *Call, function LoxCallable, arguments []any) (any, error) {
+	result, err := function.Call(i, arguments)
+	if err != nil {
+		if _, ok := err.(RuntimeError); !ok {
+			return nil, RuntimeError{expr.paren, err.Error()}
+		}
+	}
+	return result, err
 }
 
 func (i *Interpreter) interpretLogicalExpr(expr *Logical) (any, error) {
@@ -108,6 +217,24 @@ func (i *Interpreter) interpretLogicalExpr(expr *Logical) (any, error) {
 }
 
 func (i *Interpreter) execute(stmt Stmt) (*ReturnedValue, error) {
+	if i.hooks == nil {
+		return i.executeStmt(stmt)
+	}
+	i.unwinding = false
+	for _, h := range i.hooks {
+		h.BeforeStatement(i, stmt)
+	}
+	res, err := i.executeStmt(stmt)
+	if rte, ok := err.(RuntimeError); ok && !i.unwinding {
+		i.unwinding = true
+		for _, h := range i.hooks {
+			h.OnRuntimeError(i, rte)
+		}
+	}
+	return res, err
+}
+
+func (i *Interpreter) executeStmt(stmt Stmt) (*ReturnedValue, error) {
 	switch v := stmt.(type) {
 	case *If:
 		return i.interpretIfStmt(v)
@@ -127,13 +254,37 @@ func (i *Interpreter) execute(stmt Stmt) (*ReturnedValue, error) {
 		return i.interpretReturnStmt(v) // This one actually returns a value
 	case *Class:
 		return nil, i.interpretClassStmt(v)
+	case *ErrorStmt:
+		return nil, i.interpretErrorStmt(v)
 	default:
 		panic(fmt.Sprintf("Unreachable. stmt has value %v; its type is %T which we don't know how to handle.", stmt, stmt))
 	}
 }
 
-func (r *Resolver) resolve(expr Expr, depth int) {
-	r.interpreter.locals[expr] = depth
+func (r *Resolver) resolve(expr Expr, local localSlot) {
+	switch v := expr.(type) {
+	case *Assign:
+		v.local = &local
+	case *Super:
+		v.local = &local
+	case *This:
+		v.local = &local
+	case *Variable:
+		v.local = &local
+	default:
+		panic(fmt.Sprintf("Unreachable. expr has value %v; its type is %T, which doesn't refer to a variable.", expr, expr))
+	}
+}
+
+func (i *Interpreter) interpretErrorStmt(stmt *ErrorStmt) error {
+	// runFile() never gets here, since it doesn't run programs that had
+	// syntax errors, but anything else that gets hold of a parsed
+	// program had better get an error rather than a panic.
+	token := Token{EOF, "", nil, 0, 0, 0, ""}
+	if len(stmt.tokens) > 0 {
+		token = stmt.tokens[0]
+	}
+	return RuntimeError{token, "Can't run a statement with a syntax error."}
 }
 
 func (i *Interpreter) interpretWhileStmt(stmt *While) (*ReturnedValue, error) {
@@ -158,9 +309,10 @@ func (i *Interpreter) interpretWhileStmt(stmt *While) (*ReturnedValue, error) {
 }
 
 func (i *Interpreter) interpretBlockStmt(stmt *Block) (*ReturnedValue, error) {
-	innerEnv := NewEnvironment()
-	innerEnv.enclosing = i.environment
+	innerEnv := NewLocalEnvironment(i.environment, stmt.slots)
+	i.reserve(environmentSizeOf(innerEnv))
 	res, err := i.executeBlock(stmt.statements, innerEnv)
+	i.free(environmentSizeOf(innerEnv))
 	return res, err
 }
 
@@ -178,31 +330,28 @@ func (i *Interpreter) interpretClassStmt(stmt *Class) error {
 		}
 	}
 
+	if err := i.allocateDefinition(stmt.name); err != nil {
+		return err
+	}
 	i.environment.define(stmt.name.lexeme, nil)
 
 	if stmt.superclass != nil {
-		environment := NewEnvironment()
-		environment.enclosing = i.environment
-		i.environment = environment
+		i.environment = NewLocalEnvironment(i.environment, superNames)
 		i.environment.define("super", superclass)
 	}
 
 	methods := make(map[string]*LoxFunction)
 	for _, method := range stmt.methods {
-		function := &LoxFunction{method, i.environment, method.name.lexeme == "init"}
-		methods[method.name.lexeme] = function
+		methods[method.name.lexeme] = i.closure(method, method.name.lexeme == "init")
 	}
 
-	klass := &LoxClass{stmt.name.lexeme, superclass, methods}
+	klass := &LoxClass{stmt.name.lexeme, superclass, methods, newShape()}
 
 	if superclass != nil {
 		i.environment = i.environment.enclosing
 	}
 
-	err := i.environment.assign(stmt.name, klass)
-	if err != nil {
-		return err
-	}
+	i.environment.initialize(stmt.name.lexeme, klass)
 	return nil
 }
 
@@ -261,20 +410,34 @@ func (i *Interpreter) interpretVarStmt(stmt *Var) error {
 		}
 	}
 
+	if err := i.allocateDefinition(stmt.name); err != nil {
+		return err
+	}
 	e := i.environment
 	e.define(stmt.name.lexeme, value)
 	return nil
 }
 
+// allocateDefinition accounts for defining name in the current environment.
+// Redefining a name (which is allowed for globals) reuses its entry.
+func (i *Interpreter) allocateDefinition(name Token) error {
+	if i.environment.values == nil {
+		return i.allocate(name, slotSize)
+	}
+	if _, ok := i.environment.values[name.lexeme]; ok {
+		return nil
+	}
+	return i.allocate(name, mapEntrySize+len(name.lexeme))
+}
+
 func (i *Interpreter) interpretAssignExpr(expr *Assign) (any, error) {
 	value, err := i.evaluate(expr.value)
 	if err != nil {
 		return nil, err
 	}
 
-	distance, ok := i.locals[expr]
-	if ok {
-		i.environment.assignAt(distance, expr.name, value)
+	if expr.local != nil {
+		i.environment.assignLocal(*expr.local, value)
 	} else {
 		err = i.globals.assign(expr.name, value)
 	}
@@ -297,19 +460,31 @@ func (e *Environment) assign(name Token, value any) error {
 }
 
 func (i *Interpreter) interpretVariableExpr(expr *Variable) (any, error) {
-	return i.lookUpVariable(expr.name, expr)
+	return i.lookUpVariable(expr.name, expr.local)
 }
 
-func (i *Interpreter) lookUpVariable(name Token, expr Expr) (any, error) {
-	distance, ok := i.locals[expr]
-	if ok {
-		return i.environment.getAt(distance, name.lexeme), nil
+func (i *Interpreter) lookUpVariable(name Token, local *localSlot) (any, error) {
+	if local != nil {
+		return i.environment.getLocal(*local), nil
 	} else {
 		return i.globals.get(name)
 	}
 }
 
 func (i *Interpreter) evaluate(expr Expr) (any, error) {
+	if i.hooks == nil {
+		return i.evaluateExpr(expr)
+	}
+	value, err := i.evaluateExpr(expr)
+	if err == nil {
+		for _, h := range i.hooks {
+			h.AfterExpression(i, expr, value)
+		}
+	}
+	return value, err
+}
+
+func (i *Interpreter) evaluateExpr(expr Expr) (any, error) {
 	switch v := expr.(type) {
 	case *Get:
 		return i.interpretGetExpr(v)
@@ -353,19 +528,25 @@ func (i *Interpreter) interpretSetExpr(expr *Set) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		inst.set(expr.name, value)
+		field := inst.fieldFor(expr)
+		if field.to != inst.shape {
+			err = i.allocate(expr.name, slotSize)
+			if err != nil {
+				return nil, err
+			}
+		}
+		inst.setField(field, value)
 		return value, nil
 	}
 }
 
 func (i *Interpreter) interpretSuperExpr(expr *Super) (any, error) {
-	distance := i.locals[expr]
-	superclass, ok := i.environment.getAt(distance, "super").(*LoxClass)
+	superclass, ok := i.environment.getLocal(*expr.local).(*LoxClass)
 	if !ok {
 		return nil, RuntimeError{expr.keyword, "We tried to get the super of this expr, but it wasn't a *LoxClass."}
 	}
 
-	object, ok := i.environment.getAt(distance-1, "this").(*LoxInstance)
+	object, ok := i.environment.getLocal(*expr.this).(*LoxInstance)
 	if !ok {
 		return nil, RuntimeError{expr.keyword, "We tried to get the 'this' here, but it wasn't a *LoxInstance."}
 	}
@@ -378,7 +559,7 @@ func (i *Interpreter) interpretSuperExpr(expr *Super) (any, error) {
 }
 
 func (i *Interpreter) interpretThisExpr(expr *This) (any, error) {
-	return i.lookUpVariable(expr.keyword, expr)
+	return i.lookUpVariable(expr.keyword, expr.local)
 }
 
 func (i *Interpreter) interpretGetExpr(expr *Get) (any, error) {
@@ -387,11 +568,14 @@ func (i *Interpreter) interpretGetExpr(expr *Get) (any, error) {
 		return nil, err
 	}
 	if inst, ok := object.(*LoxInstance); ok {
-		val, err := inst.get(expr.name)
+		field, method, err := inst.property(expr)
 		if err != nil {
 			return nil, err
 		}
-		return val, nil
+		if method != nil {
+			return method.bind(inst), nil
+		}
+		return field, nil
 	}
 
 	return nil, RuntimeError{expr.name, "Only instances have properties."}
@@ -417,13 +601,18 @@ func (i *Interpreter) interpretBinaryExpr(expr *Binary) (any, error) {
 	}
 
 	switch expr.operator.tokenType {
-	// TODO: fix the rest of these to return the error early if checkNumberOperands fails. If we return the err on the same line as the result, then we actually panic if left/right are not numbers, which is not what we want.
 	case GREATER:
 		err := checkNumberOperands(expr.operator, left, right)
-		return left.(float64) > right.(float64), err
+		if err != nil {
+			return nil, err
+		}
+		return left.(float64) > right.(float64), nil
 	case GREATER_EQUAL:
 		err := checkNumberOperands(expr.operator, left, right)
-		return left.(float64) >= right.(float64), err
+		if err != nil {
+			return nil, err
+		}
+		return left.(float64) >= right.(float64), nil
 	case LESS:
 		err := checkNumberOperands(expr.operator, left, right)
 		if err != nil {
@@ -442,7 +631,10 @@ func (i *Interpreter) interpretBinaryExpr(expr *Binary) (any, error) {
 		return isEqual(left, right), nil
 	case MINUS:
 		err := checkNumberOperands(expr.operator, left, right)
-		return left.(float64) - right.(float64), err
+		if err != nil {
+			return nil, err
+		}
+		return left.(float64) - right.(float64), nil
 	case PLUS:
 		leftFloat, leftIsFloat := left.(float64)
 		rightFloat, rightIsFloat := right.(float64)
@@ -453,16 +645,26 @@ func (i *Interpreter) interpretBinaryExpr(expr *Binary) (any, error) {
 		leftString, leftIsString := left.(string)
 		rightString, rightIsString := right.(string)
 		if leftIsString && rightIsString {
-			return leftString + rightString, nil
+			result := leftString + rightString
+			if err := i.allocate(expr.operator, stringSize(result)); err != nil {
+				return nil, err
+			}
+			return result, nil
 		}
 
 		return nil, RuntimeError{expr.operator, "Operands must be two numbers or two strings."}
 	case SLASH:
 		err := checkNumberOperands(expr.operator, left, right)
-		return left.(float64) / right.(float64), err
+		if err != nil {
+			return nil, err
+		}
+		return left.(float64) / right.(float64), nil
 	case STAR:
 		err := checkNumberOperands(expr.operator, left, right)
-		return left.(float64) * right.(float64), err
+		if err != nil {
+			return nil, err
+		}
+		return left.(float64) * right.(float64), nil
 	}
 
 	panic("Unreachable")
@@ -488,7 +690,10 @@ func (i *Interpreter) interpretUnaryExpr(expr *Unary) (any, error) {
 		return !isTruthy(right), nil
 	case MINUS:
 		err := checkNumberOperand(expr.operator, right)
-		return -(right.(float64)), err
+		if err != nil {
+			return nil, err
+		}
+		return -(right.(float64)), nil
 	}
 
 	panic("Unreachable")
@@ -504,7 +709,7 @@ func (i *Interpreter) interpretPrintStmt(stmt *Print) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(stringify(value))
+	fmt.Fprintln(i.stdout, stringify(value))
 	return nil
 }
 
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is what readLine returns when the user presses Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// maxHistory is how many lines of history we keep, in memory and on disk.
+const maxHistory = 1000
+
+// lineReader reads lines for the REPL. On a terminal, the line being typed
+// can be edited, and the up and down arrows go through the lines typed before,
+// in this session or earlier ones. Anywhere else, it just reads lines.
+type lineReader struct {
+	in  *bufio.Reader
+	out io.Writer
+	// fd is the file descriptor of the terminal, or -1 if we aren't
+	// reading from one.
+	fd      int
+	history []string
+	// historyPath is the file the history is kept in between sessions,
+	// or "" if there isn't one.
+	historyPath string
+}
+
+func newLineReader(in *os.File, out io.Writer, historyPath string) *lineReader {
+	r := &lineReader{in: bufio.NewReader(in), out: out, fd: -1, historyPath: historyPath}
+	if isTerminal(int(in.Fd())) {
+		r.fd = int(in.Fd())
+	}
+	if historyPath != "" {
+		if data, err := os.ReadFile(historyPath); err == nil {
+			r.history = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if len(r.history) > maxHistory {
+				// Trim the file too, so that it doesn't grow forever.
+				r.history = r.history[len(r.history)-maxHistory:]
+				os.WriteFile(historyPath, []byte(strings.Join(r.history, "\n")+"\n"), 0o600)
+			}
+		}
+	}
+	return r
+}
+
+// readLine shows prompt and reads a line, without its line break. It returns
+// io.EOF at the end of the input, and errInterrupted if the user pressed
+// Ctrl-C.
+func (r *lineReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	if r.fd < 0 {
+		line, err := r.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	restore, err := makeRaw(r.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	line, err := r.edit(prompt)
+	if err == nil {
+		r.addHistory(line)
+	}
+	return line, err
+}
+
+// edit reads keys until the line is finished, redrawing it as it changes.
+func (r *lineReader) edit(prompt string) (string, error) {
+	var line []rune
+	cursor := 0
+	// index is the line of history being shown, and draft is what was
+	// typed before going back through the history.
+	index := len(r.history)
+	var draft []rune
+
+	redraw := func() {
+		fmt.Fprintf(r.out, "\r%v%v\x1b[K", prompt, string(line))
+		if back := len(line) - cursor; back > 0 {
+			fmt.Fprintf(r.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if i < 0 || i > len(r.history) {
+			return
+		}
+		if index == len(r.history) {
+			draft = line
+		}
+		index = i
+		if index == len(r.history) {
+			line = draft
+		} else {
+			line = []rune(r.history[index])
+		}
+		cursor = len(line)
+		redraw()
+	}
+
+	for {
+		key, _, err := r.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if key == 27 {
+			key = r.escape()
+		}
+		switch key {
+		case '\r', '\n':
+			fmt.Fprint(r.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(r.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(r.out, "\r\n")
+				return "", io.EOF
+			}
+			fallthrough
+		case keyDelete:
+			if cursor < len(line) {
+				line = append(line[:cursor], line[cursor+1:]...)
+			}
+		case 127, 8: // Backspace
+			if cursor > 0 {
+				line = append(line[:cursor-1], line[cursor:]...)
+				cursor--
+			}
+		case 1: // Ctrl-A
+			cursor = 0
+		case 5: // Ctrl-E
+			cursor = len(line)
+		case 2: // Ctrl-B
+			cursor = max(cursor-1, 0)
+		case 6: // Ctrl-F
+			cursor = min(cursor+1, len(line))
+		case 11: // Ctrl-K
+			line = line[:cursor]
+		case 21: // Ctrl-U
+			line = line[cursor:]
+			cursor = 0
+		case 16: // Ctrl-P
+			recall(index - 1)
+		case 14: // Ctrl-N
+			recall(index + 1)
+		default:
+			if unicode.IsPrint(key) || key == '\t' {
+				line = append(line[:cursor], append([]rune{key}, line[cursor:]...)...)
+				cursor++
+			}
+		}
+		redraw()
+	}
+}
+
+// keyDelete is what escape returns for the Delete key, which has no control
+// character of its own.
+const keyDelete rune = -1
+
+// escape reads the rest of an escape sequence, which is how terminals send
+// the arrow, Home, End and Delete keys, and returns the control character
+// that does the same thing. It returns 0 for sequences it doesn't know.
+func (r *lineReader) escape() rune {
+	if next, _ := r.in.ReadByte(); next != '[' && next != 'O' {
+		return 0
+	}
+	code, _ := r.in.ReadByte()
+	switch code {
+	case 'A':
+		return 16 // Ctrl-P
+	case 'B':
+		return 14 // Ctrl-N
+	case 'C':
+		return 6 // Ctrl-F
+	case 'D':
+		return 2 // Ctrl-B
+	case 'H':
+		return 1 // Ctrl-A
+	case 'F':
+		return 5 // Ctrl-E
+	case '3':
+		if tilde, _ := r.in.ReadByte(); tilde == '~' {
+			return keyDelete
+		}
+	}
+	return 0
+}
+
+// addHistory remembers line, unless it's blank or the same as the last one,
+// and appends it to the history file.
+func (r *lineReader) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(r.history) > 0 && r.history[len(r.history)-1] == line) {
+		return
+	}
+	r.history = append(r.history, line)
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+	if r.historyPath == "" {
+		return
+	}
+	// The history is only a convenience, so there's nothing to do if it
+	// can't be saved.
+	file, err := os.OpenFile(r.historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, line)
+}
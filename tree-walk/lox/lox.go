@@ -1,29 +1,128 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+
+	"jlox/lox/vm"
 )
 
 var hadError = false
 var hadRuntimeError = false
 
+// profilePath is where to write a profile of the script, and coveragePath
+// the tracefile to add its coverage to, if anywhere.
+var profilePath string
+var coveragePath string
+
+// The --trace flags, which say whether and how to trace the script.
+var tracing, traceJSON bool
+var traceFunctions, traceLines string
+
+// engine is what runs the script: the tree-walk interpreter, or the bytecode
+// compiler and VM. disassemble is whether to print the bytecode instead.
+var engine string
+var disassemble bool
+
+const (
+	engineTreeWalk = "tree-walk"
+	engineVM       = "vm"
+)
+
+func isEngine(name string) bool {
+	return name == engineTreeWalk || name == engineVM
+}
+
 type RuntimeError struct {
 	token   Token
 	message string
 }
 
+// commands are the things jlox can do other than run a script, as in
+// "jlox ast file.lox". Each one parses the rest of the arguments itself.
+var commands = map[string]func(args []string){
+	"ast":      astCommand,
+	"compile":  compileCommand,
+	"coverage": coverageCommand,
+	"dap":      dapCommand,
+	"debug":    debugCommand,
+	"difftest": difftestCommand,
+	"fmt":      fmtCommand,
+	"lsp":      lspCommand,
+	"parse":    parseCommand,
+	"resolve":  resolveCommand,
+	"test":     testCommand,
+}
+
 func main() {
-	if len(os.Args) > 2 {
-		fmt.Println("Usage: jlox [script]")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: jlox [flags] [script]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox ast [flags] file.lox")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox parse [flags] file.lox")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox resolve [flags] file.lox")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox compile [flags] file.lox")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox fmt [flags] [path ...]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox lsp")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox dap")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox debug file.lox")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox coverage [flags] file.lcov ...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox test [flags] [path ...]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       jlox difftest [flags] [path ...]")
+		fmt.Fprintln(flag.CommandLine.Output(), "The script can also be a program's AST in the JSON form that")
+		fmt.Fprintln(flag.CommandLine.Output(), "\"jlox parse -json\" prints, if its name ends in \".json\", or a")
+		fmt.Fprintln(flag.CommandLine.Output(), "program that \"jlox compile\" saved, if its name ends in \".loxc\".")
+		flag.PrintDefaults()
+	}
+	flag.IntVar(&interpreter.memory.limit, "max-memory", 0,
+		"stop the script once it has allocated roughly this many `bytes` (0 means no limit);\n"+
+			"strings, instances and closures are never freed, so they count for the rest of the run")
+	flag.StringVar(&profilePath, "profile", "",
+		"write a pprof profile of where the script spends its time to `file`")
+	flag.StringVar(&coveragePath, "coverage", "",
+		"add the script's line, function and branch coverage to the LCOV tracefile `file`")
+	flag.BoolVar(&tracing, "trace", false, "log each statement, value, call and return to standard error")
+	flag.BoolVar(&traceJSON, "trace-json", false, "write the trace as JSON lines (implies -trace)")
+	flag.StringVar(&traceFunctions, "trace-func", "",
+		"only trace what happens in, and calls to, these comma-separated `functions` (\"script\" is the top level)")
+	flag.StringVar(&traceLines, "trace-lines", "", "only trace these `lines`, as in 10-20")
+	flag.StringVar(&engine, "engine", engineTreeWalk, "run the script on this `engine`: tree-walk or vm")
+	flag.BoolVar(&disassemble, "disassemble", false, "print the script's bytecode instead of running it (implies -engine=vm)")
+	flag.Parse()
+	if disassemble {
+		engine = engineVM
+	}
+	if !isEngine(engine) {
+		flag.Usage()
+		os.Exit(64)
+	}
+
+	args := flag.Args()
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			command(args[1:])
+			return
+		}
+	}
+
+	if engine == engineVM {
+		// The VM has none of the tree-walk interpreter's hooks, and
+		// doesn't keep track of memory.
+		if len(args) == 0 || interpreter.memory.limit != 0 || profilePath != "" || coveragePath != "" || tracing || traceJSON {
+			fmt.Fprintln(os.Stderr, "-engine=vm only runs scripts, without -max-memory, -profile, -coverage or -trace.")
+			os.Exit(64)
+		}
+	}
+
+	if len(args) > 1 {
+		flag.Usage()
 		os.Exit(64)
-	} else if len(os.Args) == 2 {
-		fmt.Printf("running script %v\n", os.Args[1])
-		runFile(os.Args[1])
+	} else if len(args) == 1 {
+		fmt.Printf("running script %v\n", args[0])
+		runFile(args[0])
 	} else {
-		fmt.Println("doing runPrompt()")
 		runPrompt()
 	}
 }
@@ -33,66 +132,141 @@ func runFile(path string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	run(string(bytes))
+	var statements []Stmt
+	// resolved is whether the program has already been resolved.
+	resolved := false
+	if strings.HasSuffix(path, ".json") {
+		statements, err = astFromJSON(bytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			os.Exit(65)
+		}
+	} else if strings.HasSuffix(path, ".loxc") {
+		statements, err = decodeProgram(bytes)
+		resolved = true
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			os.Exit(65)
+		}
+	} else {
+		statements = NewParser(NewScanner(string(bytes)).ScanTokens()).parse()
+	}
+
+	if engine == engineVM {
+		if !hadError {
+			runStatementsVM(statements, resolved)
+		}
+		if hadError {
+			os.Exit(65)
+		}
+		if hadRuntimeError {
+			os.Exit(70)
+		}
+		return
+	}
+
+	var profiler *profiler
+	var coverage *coverage
+	var tracer *tracer
+	if !hadError {
+		if profilePath != "" {
+			profiler = newProfiler(path)
+			interpreter.addHooks(profiler)
+		}
+		if coveragePath != "" {
+			coverage = newCoverage(statements)
+			interpreter.addHooks(coverage)
+		}
+		if tracing || traceJSON {
+			source := ""
+			if !strings.HasSuffix(path, ".json") {
+				source = string(bytes)
+			}
+			tracer = newTracer(os.Stderr, source)
+			tracer.json = traceJSON
+			if err := tracer.setFilters(traceFunctions, traceLines); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(64)
+			}
+			interpreter.addHooks(tracer)
+		}
+		runStatements(statements, resolved)
+	}
+	if tracer != nil {
+		tracer.out.Flush()
+	}
 
 	if hadError {
 		os.Exit(65)
 	}
 
+	if profiler != nil {
+		if err := writeProfile(profiler, profilePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(74)
+		}
+	}
+	if coverage != nil {
+		if err := writeCoverage(coverage, path, coveragePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(74)
+		}
+	}
+
 	if hadRuntimeError {
 		os.Exit(70)
 	}
 }
 
-func runPrompt() {
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Print("> ")
-		if scanner.Scan() {
-			line := scanner.Text()
-			run(line)
-			hadError = false
-		} else {
-			// encountered EOF?
-			fmt.Println("EOF detected??")
-			break
-		}
-		// not sure if the following is needed...
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
+// runStatements resolves and runs statements, or if they've already been
+// resolved, just runs them.
+func runStatements(statements []Stmt, resolved bool) {
+	if !resolved {
+		resolver := NewResolver()
+		resolver.resolveStatements(statements)
 	}
-}
-
-func run(source string) {
-	// fmt.Println(source)
-	scanner := NewScanner(source)
-	tokens := scanner.ScanTokens()
-	// for index, tok := range tokens {
-	// 	fmt.Println(index, tok)
-	// }
-	// os.Exit(0)
-
-	parser := Parser{tokens: tokens}
-	statements := parser.parse()
-
-	// fmt.Print(printStatements(statements, 0))
 
+	// Stop if there was a resolution error.
 	if hadError {
 		return
 	}
 
-	resolver := NewResolver(&interpreter)
-	resolver.resolveStatements(statements)
+	interpreter.interpret(statements)
+	// fmt.Println(printExpr(expression))
 
-	// Stop if there was a resolution error.
+}
+
+// runStatementsVM is runStatements for the VM. The compiler finds variables
+// where the resolver put them, so unless the statements have already been
+// resolved, it resolves them first.
+func runStatementsVM(statements []Stmt, resolved bool) {
+	if !resolved {
+		resolver := NewResolver()
+		resolver.resolveStatements(statements)
+		if hadError {
+			return
+		}
+	}
+
+	function := NewCompiler().compile(statements)
 	if hadError {
 		return
 	}
+	if disassemble {
+		fmt.Print(function.Chunk.Disassemble(function.String()))
+		return
+	}
 
-	interpreter.interpret(statements)
-	// fmt.Println(printExpr(expression))
+	if err := vm.New().Interpret(function); err != nil {
+		runtimeError(vmRuntimeError(err))
+	}
+}
 
+// vmRuntimeError turns the VM's runtime error into the tree-walk
+// interpreter's, to be reported the same way.
+func vmRuntimeError(err error) RuntimeError {
+	rte := err.(vm.RuntimeError)
+	return RuntimeError{Token{EOF, "", nil, rte.Line, 0, 0, ""}, rte.Message}
 }
 
 func logError(line int, message string) {
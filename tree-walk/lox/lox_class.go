@@ -4,6 +4,9 @@ type LoxClass struct {
 	name       string
 	superclass *LoxClass
 	methods    map[string]*LoxFunction
+	// shape is the shape its instances start out with, before they have
+	// any fields.
+	shape *shape
 }
 
 func (l *LoxClass) findMethod(name string) *LoxFunction {
@@ -29,10 +32,14 @@ func (l *LoxClass) Arity() int {
 }
 
 func (l *LoxClass) Call(interpreter *Interpreter, arguments []any) (any, error) {
+	interpreter.reserve(instanceSize)
 	instance := NewLoxInstance(l)
 	initializer := l.findMethod("init")
 	if initializer != nil {
-		initializer.bind(instance).Call(interpreter, arguments)
+		_, err := initializer.call(interpreter, arguments, instance)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return instance, nil
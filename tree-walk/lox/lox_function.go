@@ -2,12 +2,18 @@ package main
 
 import (
 	"fmt"
+
+	"jlox/lox/vm"
 )
 
 type LoxFunction struct {
-	declaration   *Function
-	closure       *Environment
+	declaration *Function
+	// upvalues hold the variables the function uses from around it, in
+	// the order the resolver found them; see Interpreter.closure.
+	upvalues      []*box
 	isInitializer bool
+	// this is the instance a method is bound to.
+	this *LoxInstance
 }
 
 func (f *LoxFunction) Arity() int {
@@ -19,20 +25,31 @@ func (f *LoxFunction) String() string {
 }
 
 func (f *LoxFunction) Call(interpreter *Interpreter, arguments []any) (any, error) {
-	environment := NewEnvironment()
-	environment.enclosing = f.closure
+	return f.call(interpreter, arguments, f.this)
+}
+
+// call calls the function with this as the instance, for a method, which
+// saves binding it first.
+func (f *LoxFunction) call(interpreter *Interpreter, arguments []any, this *LoxInstance) (any, error) {
+	environment := NewLocalEnvironment(nil, f.declaration.slots)
+	environment.upvalues = f.upvalues
+	environment.this = this
 	for i := range f.declaration.params {
 		environment.define(f.declaration.params[i].lexeme, arguments[i])
 	}
 
+	interpreter.reserve(environmentSizeOf(environment))
 	result, err := interpreter.executeBlock(f.declaration.body, environment)
+	interpreter.free(environmentSizeOf(environment))
 	if err != nil {
 		return nil, err
 	}
+	// An initializer returns the instance, whether or not it has a return
+	// statement.
+	if f.isInitializer {
+		return this, nil
+	}
 	if result != nil {
-		if f.isInitializer {
-			return f.closure.getAt(0, "this"), nil
-		}
 		return result.value, nil
 	}
 
@@ -40,16 +57,16 @@ func (f *LoxFunction) Call(interpreter *Interpreter, arguments []any) (any, erro
 }
 
 func (l *LoxFunction) bind(instance *LoxInstance) *LoxFunction {
-	environment := NewEnvironment()
-	environment.enclosing = l.closure
-	environment.define("this", instance)
-	return &LoxFunction{l.declaration, environment, l.isInitializer}
+	return &LoxFunction{l.declaration, l.upvalues, l.isInitializer, instance}
 }
 
 type LoxNativeFunction struct {
 	arity int
-	fn    func(*Interpreter, []any) any
-	name  string
+	// fn can fail with any error, which is reported as a runtime error
+	// at the call. The bytecode VM calls it with a nil *Interpreter (see
+	// forVM).
+	fn   func(*Interpreter, []any) (any, error)
+	name string
 }
 
 func (n *LoxNativeFunction) Arity() int {
@@ -57,13 +74,24 @@ func (n *LoxNativeFunction) Arity() int {
 }
 
 func (n *LoxNativeFunction) Call(interpreter *Interpreter, arguments []any) (any, error) {
-	return n.fn(interpreter, arguments), nil
+	return n.fn(interpreter, arguments)
 }
 
 func (n *LoxNativeFunction) String() string {
 	return n.name
 }
 
+// forVM is the native for the bytecode VM, which has no interpreter to give
+// it.
+func (n *LoxNativeFunction) forVM() *vm.Native {
+	return &vm.Native{
+		Arity: n.arity,
+		Fn: func(arguments []any) (any, error) {
+			return n.fn(nil, arguments)
+		},
+	}
+}
+
 // Assert that LoxFunction and LoxNativeFunction implement the LoxCallable
 // interface; perhaps this should go in separate testing code so it doesn't
 // happen every time we compile the code, but since the point of this project
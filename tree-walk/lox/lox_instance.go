@@ -5,32 +5,137 @@ import (
 )
 
 type LoxInstance struct {
-	klass  *LoxClass
-	fields map[string]any
+	klass *LoxClass
+	// shape says which field is at each index of fields.
+	shape  *shape
+	fields []any
+}
+
+// A shape is the layout of an instance's fields: the index each one is at.
+// An instance starts out with its class's empty shape, and setting a field it
+// doesn't have yet moves it on to the shape with that field added at the end,
+// which is shared by every instance of the class that has had the same fields
+// added in the same order. So a shape is enough for a Get or Set to tell where
+// a field is, without looking it up by name.
+type shape struct {
+	names   []string
+	indexes map[string]int
+	// next are the shapes with another field, by that field's name, as
+	// they're needed.
+	next map[string]*shape
+}
+
+// A propertyCache is what a Get found on the last instance it got a property
+// from, for the next one of the same shape: the index of a field, or if field
+// is -1, a method (the class's, since the shapes of different classes are
+// different).
+type propertyCache struct {
+	shape  *shape
+	field  int
+	method *LoxFunction
+}
+
+// A fieldCache is where a Set put a field on the last instance it set one on,
+// for the next one of the same shape: at index, moving the instance on to the
+// shape to, if that's a different one.
+type fieldCache struct {
+	from, to *shape
+	index    int
+}
+
+func newShape() *shape {
+	return &shape{indexes: make(map[string]int)}
+}
+
+// indexOf is the index of the field called name, or -1.
+func (s *shape) indexOf(name string) int {
+	if index, ok := s.indexes[name]; ok {
+		return index
+	}
+	return -1
+}
+
+// with is the shape with a field called name added.
+func (s *shape) with(name string) *shape {
+	if next, ok := s.next[name]; ok {
+		return next
+	}
+	next := &shape{
+		names:   append(s.names[:len(s.names):len(s.names)], name),
+		indexes: make(map[string]int, len(s.indexes)+1),
+	}
+	for field, index := range s.indexes {
+		next.indexes[field] = index
+	}
+	next.indexes[name] = len(s.names)
+	if s.next == nil {
+		s.next = make(map[string]*shape)
+	}
+	s.next[name] = next
+	return next
 }
 
 func NewLoxInstance(klass *LoxClass) *LoxInstance {
 	return &LoxInstance{
-		klass:  klass,
-		fields: make(map[string]any),
+		klass: klass,
+		shape: klass.shape,
 	}
 }
 
-func (l *LoxInstance) get(name Token) (any, error) {
-	if val, ok := l.fields[name.lexeme]; ok {
-		return val, nil
+// field is the value of the field called name, if the instance has it.
+func (l *LoxInstance) field(name string) (any, bool) {
+	if index := l.shape.indexOf(name); index >= 0 {
+		return l.fields[index], true
 	}
+	return nil, false
+}
 
-	method := l.klass.findMethod(name.lexeme)
-	if method != nil {
-		return method.bind(l), nil
+// property finds what expr gets from the instance: the value of a field, or
+// if it's a method, the method, unbound, for the caller to bind or call with
+// the instance. What it finds is cached on expr for the next instance of the
+// same shape.
+func (l *LoxInstance) property(expr *Get) (any, *LoxFunction, error) {
+	cache := expr.cache
+	if cache == nil || cache.shape != l.shape {
+		cache = &propertyCache{l.shape, l.shape.indexOf(expr.name.lexeme), nil}
+		if cache.field < 0 {
+			cache.method = l.klass.findMethod(expr.name.lexeme)
+			if cache.method == nil {
+				return nil, nil, RuntimeError{expr.name, fmt.Sprintf("Undefined property %q.", expr.name.lexeme)}
+			}
+		}
+		expr.cache = cache
+	}
+	if cache.field >= 0 {
+		return l.fields[cache.field], nil, nil
 	}
+	return nil, cache.method, nil
+}
 
-	return nil, RuntimeError{name, fmt.Sprintf("Undefined property %q.", name.lexeme)}
+// fieldFor finds where expr sets its field on the instance, which is cached on
+// expr for the next instance of the same shape. The field is new if the cache's
+// shapes are different.
+func (l *LoxInstance) fieldFor(expr *Set) *fieldCache {
+	cache := expr.cache
+	if cache == nil || cache.from != l.shape {
+		cache = &fieldCache{l.shape, l.shape, l.shape.indexOf(expr.name.lexeme)}
+		if cache.index < 0 {
+			cache.to = l.shape.with(expr.name.lexeme)
+			cache.index = len(l.shape.names)
+		}
+		expr.cache = cache
+	}
+	return cache
 }
 
-func (l *LoxInstance) set(name Token, value any) {
-	l.fields[name.lexeme] = value
+// setField sets the field that cache, from fieldFor, says where to put.
+func (l *LoxInstance) setField(cache *fieldCache, value any) {
+	if cache.to != l.shape {
+		l.shape = cache.to
+		l.fields = append(l.fields, value)
+	} else {
+		l.fields[cache.index] = value
+	}
 }
 
 func (l *LoxInstance) String() string {
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// "jlox compile file.lox" saves the parsed and resolved program in a .loxc
+// file, which "jlox file.loxc" runs without scanning, parsing or resolving it
+// again. A .loxc file is:
+//
+//	"LOXC"             magic
+//	version            2 bytes, big-endian; see loxcVersion
+//	source hash        the SHA-256 of the source it was compiled from
+//	strings            every string in the program, once each
+//	tokens             every token in the program, once each
+//	statements         the syntax tree
+//	checksum           4 bytes, big-endian: the CRC-32 of everything before it
+//
+// Numbers are unsigned varints (or signed, for the differences between lines)
+// unless it says otherwise. The strings are a count, then the length and bytes
+// of each; everything after them refers to strings by their index. The tokens
+// are a count, then each one's type, lexeme, literal, line (as the difference
+// from the previous token's, which makes them a compact line table), column
+// and offset; the tree refers to tokens by their index. Tokens don't keep
+// their trivia, since nothing that runs a program needs it.
+//
+// Each node in the tree starts with one of the CP_ tags below, and then has
+// its fields in the order they're declared in expr.go and stmt.go. A Variable,
+// Assign, This or Super also has what the resolver decided about it: 0 for a
+// global, or 1 for a local or 2 for an upvalue, then the number of
+// environments to it and its index (see localSlot). A Super then has where
+// its this is, in the same way. A Function ends with its upvalues' sources:
+// a count, then 0 for a method's this, or where each is found as above. A
+// Block, and a Function after that, ends with the names of the slots in its
+// environment: a count, then each one's string.
+
+// loxcVersion is the version of the format. Change it whenever the format, or
+// anything it depends on (like the numbering of TokenType), changes, so that
+// old .loxc files are rejected rather than misread.
+const loxcVersion = 4
+
+const loxcMagic = "LOXC"
+
+const (
+	CP_NIL byte = iota
+	CP_BLOCK
+	CP_CLASS
+	CP_ERROR
+	CP_EXPRESSION
+	CP_FUNCTION
+	CP_IF
+	CP_PRINT
+	CP_RETURN
+	CP_VAR
+	CP_WHILE
+	CP_ASSIGN
+	CP_BINARY
+	CP_CALL
+	CP_GET
+	CP_GROUPING
+	CP_LITERAL
+	CP_LOGICAL
+	CP_SET
+	CP_SUPER
+	CP_THIS
+	CP_UNARY
+	CP_VARIABLE
+)
+
+// The kinds of literal value.
+const (
+	CP_VALUE_NIL byte = iota
+	CP_VALUE_FALSE
+	CP_VALUE_TRUE
+	CP_VALUE_NUMBER
+	CP_VALUE_STRING
+)
+
+func compileCommand(args []string) {
+	flags := flag.NewFlagSet("compile", flag.ExitOnError)
+	output := flags.String("o", "", "write the compiled program to `file` (default: the source's name, ending in .loxc)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox compile [flags] file.lox")
+		fmt.Fprintln(flags.Output(), "Saves the parsed and resolved program, for \"jlox file.loxc\" to run.")
+		flags.PrintDefaults()
+	}
+	// Let the flags come after the file too, as in "jlox compile a.lox -o b.loxc".
+	flags.Parse(args)
+	var paths []string
+	for flags.NArg() > 0 {
+		paths = append(paths, flags.Arg(0))
+		flags.Parse(flags.Args()[1:])
+	}
+	if len(paths) != 1 {
+		flags.Usage()
+		os.Exit(64)
+	}
+	path := paths[0]
+	if *output == "" {
+		*output = strings.TrimSuffix(path, ".lox") + ".loxc"
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(66)
+	}
+	statements := NewParser(NewScanner(string(source)).ScanTokens()).parse()
+	if hadError {
+		os.Exit(65)
+	}
+	NewResolver().resolveStatements(statements)
+	if hadError {
+		os.Exit(65)
+	}
+
+	if err := os.WriteFile(*output, encodeProgram(source, statements), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(74)
+	}
+}
+
+// programEncoder writes the tree, collecting the strings and tokens as it
+// goes, since they have to come before it in the file.
+type programEncoder struct {
+	tree    []byte
+	strings map[string]int
+	// stringList and tokenList are the strings and tokens in the order
+	// they were first used.
+	stringList []string
+	tokens     map[tokenKey]int
+	tokenList  []Token
+}
+
+// tokenKey is what makes two tokens the same, for the token table.
+type tokenKey struct {
+	tokenType TokenType
+	lexeme    string
+	line      int
+	column    int
+	offset    int
+}
+
+// encodeProgram makes a .loxc file of statements, which were parsed from
+// source and resolved.
+func encodeProgram(source []byte, statements []Stmt) []byte {
+	e := &programEncoder{
+		strings: make(map[string]int),
+		tokens:  make(map[tokenKey]int),
+	}
+	e.stmts(statements)
+	tree := e.tree
+
+	// The token table adds strings of its own, so it has to be encoded
+	// before the string table.
+	e.tree = nil
+	e.uvarint(len(e.tokenList))
+	previousLine := 0
+	for _, token := range e.tokenList {
+		e.uvarint(int(token.tokenType))
+		e.string(token.lexeme)
+		e.value(token.literal)
+		e.tree = binary.AppendVarint(e.tree, int64(token.line-previousLine))
+		previousLine = token.line
+		e.uvarint(token.column)
+		e.uvarint(token.offset)
+	}
+	tokens := e.tree
+
+	file := []byte(loxcMagic)
+	file = binary.BigEndian.AppendUint16(file, loxcVersion)
+	hash := sha256.Sum256(source)
+	file = append(file, hash[:]...)
+	file = binary.AppendUvarint(file, uint64(len(e.stringList)))
+	for _, s := range e.stringList {
+		file = binary.AppendUvarint(file, uint64(len(s)))
+		file = append(file, s...)
+	}
+	file = append(file, tokens...)
+	file = append(file, tree...)
+	return binary.BigEndian.AppendUint32(file, crc32.ChecksumIEEE(file))
+}
+
+func (e *programEncoder) uvarint(n int) {
+	e.tree = binary.AppendUvarint(e.tree, uint64(n))
+}
+
+func (e *programEncoder) string(s string) {
+	index, ok := e.strings[s]
+	if !ok {
+		index = len(e.stringList)
+		e.strings[s] = index
+		e.stringList = append(e.stringList, s)
+	}
+	e.uvarint(index)
+}
+
+// names writes a count, then each of names.
+func (e *programEncoder) names(names []string) {
+	e.uvarint(len(names))
+	for _, name := range names {
+		e.string(name)
+	}
+}
+
+func (e *programEncoder) token(token Token) {
+	key := tokenKey{token.tokenType, token.lexeme, token.line, token.column, token.offset}
+	index, ok := e.tokens[key]
+	if !ok {
+		index = len(e.tokenList)
+		e.tokens[key] = index
+		e.tokenList = append(e.tokenList, token)
+	}
+	e.uvarint(index)
+}
+
+func (e *programEncoder) value(value any) {
+	switch v := value.(type) {
+	case nil:
+		e.tree = append(e.tree, CP_VALUE_NIL)
+	case bool:
+		if v {
+			e.tree = append(e.tree, CP_VALUE_TRUE)
+		} else {
+			e.tree = append(e.tree, CP_VALUE_FALSE)
+		}
+	case float64:
+		e.tree = append(e.tree, CP_VALUE_NUMBER)
+		e.tree = binary.BigEndian.AppendUint64(e.tree, math.Float64bits(v))
+	case string:
+		e.tree = append(e.tree, CP_VALUE_STRING)
+		e.string(v)
+	default:
+		panic(fmt.Sprintf("Unreachable. The literal has value %v; its type is %T which we don't know how to handle.", value, value))
+	}
+}
+
+// slot writes where a local is, or if it's nil, that it's a global.
+func (e *programEncoder) slot(local *localSlot) {
+	switch {
+	case local == nil:
+		e.uvarint(0)
+		return
+	case local.upvalue:
+		e.uvarint(2)
+	default:
+		e.uvarint(1)
+	}
+	e.uvarint(local.depth)
+	e.uvarint(local.index)
+}
+
+func (e *programEncoder) stmts(statements []Stmt) {
+	e.uvarint(len(statements))
+	for _, stmt := range statements {
+		e.stmt(stmt)
+	}
+}
+
+// stmt writes stmt, which may be nil.
+func (e *programEncoder) stmt(stmt Stmt) {
+	switch v := stmt.(type) {
+	case nil:
+		e.tree = append(e.tree, CP_NIL)
+	case *Block:
+		e.tree = append(e.tree, CP_BLOCK)
+		e.stmts(v.statements)
+		e.names(v.slots)
+	case *Class:
+		e.tree = append(e.tree, CP_CLASS)
+		e.token(v.name)
+		if v.superclass == nil {
+			e.expr(nil)
+		} else {
+			e.expr(v.superclass)
+		}
+		e.uvarint(len(v.methods))
+		for _, method := range v.methods {
+			e.function(method)
+		}
+	case *ErrorStmt:
+		e.tree = append(e.tree, CP_ERROR)
+		e.uvarint(len(v.tokens))
+		for _, token := range v.tokens {
+			e.token(token)
+		}
+	case *Expression:
+		e.tree = append(e.tree, CP_EXPRESSION)
+		e.expr(v.expression)
+	case *Function:
+		e.tree = append(e.tree, CP_FUNCTION)
+		e.function(v)
+	case *If:
+		e.tree = append(e.tree, CP_IF)
+		e.expr(v.condition)
+		e.stmt(v.thenBranch)
+		e.stmt(v.elseBranch)
+	case *Print:
+		e.tree = append(e.tree, CP_PRINT)
+		e.expr(v.expression)
+	case *Return:
+		e.tree = append(e.tree, CP_RETURN)
+		e.token(v.keyword)
+		e.expr(v.value)
+	case *Var:
+		e.tree = append(e.tree, CP_VAR)
+		e.token(v.name)
+		e.expr(v.initializer)
+	case *While:
+		e.tree = append(e.tree, CP_WHILE)
+		e.expr(v.condition)
+		e.stmt(v.body)
+	default:
+		panic(fmt.Sprintf("Unreachable. stmt has value %v; its type is %T which we don't know how to handle.", stmt, stmt))
+	}
+}
+
+func (e *programEncoder) function(function *Function) {
+	e.token(function.name)
+	e.uvarint(len(function.params))
+	for _, param := range function.params {
+		e.token(param)
+	}
+	e.stmts(function.body)
+	e.uvarint(len(function.upvalues))
+	for _, source := range function.upvalues {
+		if source.isThis {
+			e.slot(nil)
+		} else {
+			e.slot(&source.from)
+		}
+	}
+	e.names(function.slots)
+}
+
+// expr writes expr, which may be nil.
+func (e *programEncoder) expr(expr Expr) {
+	switch v := expr.(type) {
+	case nil:
+		e.tree = append(e.tree, CP_NIL)
+	case *Assign:
+		e.tree = append(e.tree, CP_ASSIGN)
+		e.token(v.name)
+		e.expr(v.value)
+		e.slot(v.local)
+	case *Binary:
+		e.tree = append(e.tree, CP_BINARY)
+		e.expr(v.left)
+		e.token(v.operator)
+		e.expr(v.right)
+	case *Call:
+		e.tree = append(e.tree, CP_CALL)
+		e.expr(v.callee)
+		e.token(v.paren)
+		e.uvarint(len(v.arguments))
+		for _, argument := range v.arguments {
+			e.expr(argument)
+		}
+	case *Get:
+		e.tree = append(e.tree, CP_GET)
+		e.expr(v.object)
+		e.token(v.name)
+	case *Grouping:
+		e.tree = append(e.tree, CP_GROUPING)
+		e.expr(v.expression)
+	case *Literal:
+		e.tree = append(e.tree, CP_LITERAL)
+		e.value(v.value)
+		e.token(v.token)
+	case *Logical:
+		e.tree = append(e.tree, CP_LOGICAL)
+		e.expr(v.left)
+		e.token(v.operator)
+		e.expr(v.right)
+	case *Set:
+		e.tree = append(e.tree, CP_SET)
+		e.expr(v.object)
+		e.token(v.name)
+		e.expr(v.value)
+	case *Super:
+		e.tree = append(e.tree, CP_SUPER)
+		e.token(v.keyword)
+		e.token(v.method)
+		e.slot(v.local)
+		e.slot(v.this)
+	case *This:
+		e.tree = append(e.tree, CP_THIS)
+		e.token(v.keyword)
+		e.slot(v.local)
+	case *Unary:
+		e.tree = append(e.tree, CP_UNARY)
+		e.token(v.operator)
+		e.expr(v.right)
+	case *Variable:
+		e.tree = append(e.tree, CP_VARIABLE)
+		e.token(v.name)
+		e.slot(v.local)
+	default:
+		panic(fmt.Sprintf("Unreachable. expr has value %v; its type is %T which we don't know how to handle.", expr, expr))
+	}
+}
+
+// programDecoder reads a .loxc file back in. Like astDecoder, it remembers the
+// first error it runs into and makes every later call a no-op, so the caller
+// only has to check err once at the end.
+type programDecoder struct {
+	data    []byte
+	strings []string
+	tokens  []Token
+	err     error
+}
+
+// decodeProgram reads a .loxc file, returning the program, already resolved.
+func decodeProgram(data []byte) ([]Stmt, error) {
+	if !bytes.HasPrefix(data, []byte(loxcMagic)) {
+		return nil, errors.New("not a compiled Lox program")
+	}
+	headerSize := len(loxcMagic) + 2 + sha256.Size
+	if len(data) < headerSize+4 {
+		return nil, errors.New("the compiled program is corrupted: it's too short")
+	}
+	if version := binary.BigEndian.Uint16(data[len(loxcMagic):]); version != loxcVersion {
+		return nil, fmt.Errorf(
+			"the program was compiled into version %v of the .loxc format, but this jlox only reads version %v; compile it again",
+			version, loxcVersion)
+	}
+	contents, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(contents) != checksum {
+		return nil, errors.New("the compiled program is corrupted: its checksum doesn't match")
+	}
+
+	d := &programDecoder{data: contents[headerSize:]}
+	d.strings = make([]string, d.count())
+	for i := range d.strings {
+		length := d.count()
+		if d.err == nil {
+			d.strings[i] = string(d.data[:length])
+			d.data = d.data[length:]
+		}
+	}
+	d.tokens = make([]Token, d.count())
+	line := 0
+	for i := range d.tokens {
+		tokenType := TokenType(d.uvarint())
+		if tokenType > EOF {
+			d.fail("unknown token type %d", tokenType)
+		}
+		lexeme := d.string()
+		literal := d.value()
+		line += d.varint()
+		d.tokens[i] = Token{tokenType, lexeme, literal, line, d.uvarint(), d.uvarint(), ""}
+	}
+	statements := d.stmts()
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%v bytes left over after the program", len(d.data))
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("the compiled program is corrupted: %v", d.err)
+	}
+	return statements, nil
+}
+
+func (d *programDecoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (d *programDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) == 0 {
+		d.fail("it ends too soon")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *programDecoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 || n > math.MaxInt32 {
+		d.fail("bad number")
+		return 0
+	}
+	d.data = d.data[size:]
+	return int(n)
+}
+
+func (d *programDecoder) varint() int {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Varint(d.data)
+	if size <= 0 || n > math.MaxInt32 || n < math.MinInt32 {
+		d.fail("bad number")
+		return 0
+	}
+	d.data = d.data[size:]
+	return int(n)
+}
+
+// count reads how many of something there are. Each of them takes at least
+// a byte, so there can't be more than there are bytes left, and checking that
+// stops a corrupted count from making us allocate a huge slice.
+func (d *programDecoder) count() int {
+	n := d.uvarint()
+	if n > len(d.data) {
+		d.fail("a count of %v is more than there's room for", n)
+		return 0
+	}
+	return n
+}
+
+func (d *programDecoder) string() string {
+	index := d.uvarint()
+	if index >= len(d.strings) {
+		d.fail("there's no string %v", index)
+		return ""
+	}
+	return d.strings[index]
+}
+
+// names reads a count, then that many strings.
+func (d *programDecoder) names() []string {
+	names := make([]string, d.count())
+	for i := range names {
+		names[i] = d.string()
+	}
+	return names
+}
+
+func (d *programDecoder) token() Token {
+	index := d.uvarint()
+	if index >= len(d.tokens) {
+		d.fail("there's no token %v", index)
+		return Token{}
+	}
+	return d.tokens[index]
+}
+
+// operator reads the token for an operator, which the interpreter relies on
+// being one of types.
+func (d *programDecoder) operator(types ...TokenType) Token {
+	token := d.token()
+	if d.err == nil && !slices.Contains(types, token.tokenType) {
+		d.fail("%v isn't an operator here", token.tokenType)
+	}
+	return token
+}
+
+func (d *programDecoder) value() any {
+	switch kind := d.byte(); kind {
+	case CP_VALUE_NIL:
+		return nil
+	case CP_VALUE_FALSE:
+		return false
+	case CP_VALUE_TRUE:
+		return true
+	case CP_VALUE_NUMBER:
+		if len(d.data) < 8 {
+			d.fail("it ends too soon")
+			return nil
+		}
+		bits := binary.BigEndian.Uint64(d.data)
+		d.data = d.data[8:]
+		return math.Float64frombits(bits)
+	case CP_VALUE_STRING:
+		return d.string()
+	default:
+		d.fail("unknown kind of value %d", kind)
+		return nil
+	}
+}
+
+// slot reads where a local is, or nil if it's a global.
+func (d *programDecoder) slot() *localSlot {
+	switch kind := d.uvarint(); kind {
+	case 0:
+		return nil
+	case 1, 2:
+		return &localSlot{d.uvarint(), d.uvarint(), kind == 2}
+	default:
+		d.fail("unknown kind of variable %d", kind)
+		return nil
+	}
+}
+
+func (d *programDecoder) stmts() []Stmt {
+	statements := make([]Stmt, d.count())
+	for i := range statements {
+		statements[i] = d.stmt()
+	}
+	return statements
+}
+
+func (d *programDecoder) stmt() Stmt {
+	stmt := d.optionalStmt()
+	if stmt == nil {
+		d.fail("missing statement")
+	}
+	return stmt
+}
+
+func (d *programDecoder) optionalStmt() Stmt {
+	switch tag := d.byte(); {
+	case d.err != nil:
+		return nil
+	case tag == CP_NIL:
+		return nil
+	case tag == CP_BLOCK:
+		return &Block{d.stmts(), d.names()}
+	case tag == CP_CLASS:
+		name := d.token()
+		var superclass *Variable
+		if expr := d.optionalExpr(); expr != nil {
+			var ok bool
+			if superclass, ok = expr.(*Variable); !ok {
+				d.fail("a class's superclass isn't a variable")
+			}
+		}
+		methods := make([]*Function, d.count())
+		for i := range methods {
+			methods[i] = d.function()
+		}
+		return &Class{name, superclass, methods}
+	case tag == CP_ERROR:
+		tokens := make([]Token, d.count())
+		for i := range tokens {
+			tokens[i] = d.token()
+		}
+		return &ErrorStmt{tokens}
+	case tag == CP_EXPRESSION:
+		return &Expression{d.expr()}
+	case tag == CP_FUNCTION:
+		return d.function()
+	case tag == CP_IF:
+		return &If{d.expr(), d.stmt(), d.optionalStmt()}
+	case tag == CP_PRINT:
+		return &Print{d.expr()}
+	case tag == CP_RETURN:
+		return &Return{d.token(), d.optionalExpr()}
+	case tag == CP_VAR:
+		return &Var{d.token(), d.optionalExpr()}
+	case tag == CP_WHILE:
+		return &While{d.expr(), d.stmt()}
+	default:
+		d.fail("unknown statement %d", tag)
+		return nil
+	}
+}
+
+func (d *programDecoder) function() *Function {
+	name := d.token()
+	params := make([]Token, d.count())
+	for i := range params {
+		params[i] = d.token()
+	}
+	function := &Function{name, params, d.stmts(), nil, nil}
+	sources := make([]upvalueSource, d.count())
+	for i := range sources {
+		if local := d.slot(); local != nil {
+			sources[i] = upvalueSource{*local, false}
+		} else {
+			sources[i].isThis = true
+		}
+	}
+	if len(sources) > 0 {
+		function.upvalues = sources
+	}
+	function.slots = d.names()
+	return function
+}
+
+func (d *programDecoder) expr() Expr {
+	expr := d.optionalExpr()
+	if expr == nil {
+		d.fail("missing expression")
+	}
+	return expr
+}
+
+func (d *programDecoder) optionalExpr() Expr {
+	switch tag := d.byte(); {
+	case d.err != nil:
+		return nil
+	case tag == CP_NIL:
+		return nil
+	case tag == CP_ASSIGN:
+		return &Assign{d.token(), d.expr(), d.slot()}
+	case tag == CP_BINARY:
+		return &Binary{d.expr(), d.operator(BANG_EQUAL, EQUAL_EQUAL, GREATER, GREATER_EQUAL, LESS, LESS_EQUAL, MINUS, PLUS, SLASH, STAR), d.expr()}
+	case tag == CP_CALL:
+		callee := d.expr()
+		paren := d.token()
+		arguments := make([]Expr, d.count())
+		for i := range arguments {
+			arguments[i] = d.expr()
+		}
+		return &Call{callee, paren, arguments}
+	case tag == CP_GET:
+		return &Get{d.expr(), d.token(), nil}
+	case tag == CP_GROUPING:
+		return &Grouping{d.expr()}
+	case tag == CP_LITERAL:
+		return &Literal{d.value(), d.token()}
+	case tag == CP_LOGICAL:
+		return &Logical{d.expr(), d.operator(AND, OR), d.expr()}
+	case tag == CP_SET:
+		return &Set{d.expr(), d.token(), d.expr(), nil}
+	case tag == CP_SUPER:
+		return &Super{d.token(), d.token(), d.slot(), d.slot()}
+	case tag == CP_THIS:
+		return &This{d.token(), d.slot()}
+	case tag == CP_UNARY:
+		return &Unary{d.operator(BANG, MINUS), d.expr()}
+	case tag == CP_VARIABLE:
+		return &Variable{d.token(), d.slot()}
+	default:
+		d.fail("unknown expression %d", tag)
+		return nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCompiledPrograms checks that compiling each of the conformance suite's
+// programs and loading it back gives the same syntax tree, resolved the same
+// way, and that it runs the same, however many times it's run.
+func TestCompiledPrograms(t *testing.T) {
+	paths, err := filepath.Glob("testdata/conformance/*/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		category := filepath.Base(filepath.Dir(path))
+		if category == "scanning" || category == "parsing" {
+			continue
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statements, ok := parseAndResolve(string(source))
+		if !ok {
+			// jlox compile refuses programs with errors.
+			continue
+		}
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".lox"), func(t *testing.T) {
+			compiled := encodeProgram(source, statements)
+			loaded, err := decodeProgram(compiled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := printTree(loaded), printTree(statements); got != want {
+				t.Errorf("the loaded tree is\n%v\ninstead of\n%v", got, want)
+			}
+			// The resolution is only in the nodes, so compiling the
+			// loaded program again checks it was all loaded.
+			if !bytes.Equal(encodeProgram(source, loaded), compiled) {
+				t.Error("the loaded program compiles differently")
+			}
+			want := runTranscript(string(source), engineTreeWalk)
+			for range 2 {
+				if got := runResolved(loaded); got != want {
+					t.Errorf("the loaded program did\n%v\ninstead of\n%v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCorruptedPrograms(t *testing.T) {
+	source := []byte("var a = 1;\nfun f(b) { return a + b; }\nprint f(2);\n")
+	statements, _ := parseAndResolve(string(source))
+	compiled := encodeProgram(source, statements)
+
+	flipped := bytes.Clone(compiled)
+	flipped[len(flipped)/2] ^= 0x10
+	wrongVersion := bytes.Clone(compiled)
+	wrongVersion[len(loxcMagic)+1]++
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "not a compiled Lox program"},
+		{"source", source, "not a compiled Lox program"},
+		{"truncated header", compiled[:10], "corrupted: it's too short"},
+		{"truncated", compiled[:len(compiled)-10], "corrupted: its checksum doesn't match"},
+		{"flipped bit", flipped, "corrupted: its checksum doesn't match"},
+		{"other version", wrongVersion, "compile it again"},
+	} {
+		_, err := decodeProgram(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got the error %v, want one saying %q", test.name, err, test.want)
+		}
+	}
+}
+
+func parseAndResolve(source string) ([]Stmt, bool) {
+	failed := false
+	reportError := func(Token, string) { failed = true }
+	scanner := NewScanner(source)
+	scanner.reportError = func(int, string) { failed = true }
+	parser := NewParser(scanner.ScanTokens())
+	parser.reportError = reportError
+	statements := parser.parse()
+	resolver := NewResolver()
+	resolver.reportError = reportError
+	resolver.resolveStatements(statements)
+	return statements, !failed
+}
+
+// runResolved is runTranscript for a program that's already been resolved.
+func runResolved(statements []Stmt) string {
+	interpreter := NewInterpreter()
+	var output bytes.Buffer
+	interpreter.stdout = &output
+	for _, stmt := range statements {
+		if _, err := interpreter.execute(stmt); err != nil {
+			output.WriteString("runtime error: " + err.Error() + "\n")
+			break
+		}
+	}
+	return output.String()
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"strconv"
+)
+
+// lspCommand implements "jlox lsp", a Language Server Protocol server that
+// talks to an editor over standard input and output. It supports
+// diagnostics, go to definition, find references, hover, document symbols
+// and completion. See lsp_analysis.go for where the answers come from.
+func lspCommand(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox lsp")
+		fmt.Fprintln(flags.Output(), "Runs a language server on standard input and output, for editors to start.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	server := &lspServer{
+		in:        bufio.NewReader(os.Stdin),
+		out:       os.Stdout,
+		documents: make(map[string]*document),
+	}
+	os.Exit(server.serve())
+}
+
+// These are the parts of the protocol that we use. The field names have to
+// be exported for encoding/json, which is the only reason they are.
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children"`
+}
+
+type lspCompletionItem struct {
+	Label string `json:"label"`
+	Kind  int    `json:"kind"`
+}
+
+// Symbol kinds, from the protocol's SymbolKind.
+const (
+	LSK_CLASS    = 5
+	LSK_METHOD   = 6
+	LSK_FUNCTION = 12
+)
+
+// Completion item kinds, from the protocol's CompletionItemKind.
+const (
+	LCK_METHOD   = 2
+	LCK_FUNCTION = 3
+	LCK_VARIABLE = 6
+	LCK_CLASS    = 7
+	LCK_KEYWORD  = 14
+)
+
+type textDocumentPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// rpcMessage is a JSON-RPC request, notification (which has no ID) or
+// response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+const (
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+	rpcInvalidRequest = -32600
+)
+
+type lspServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]*document
+	// shutdown is whether the client has asked us to shut down, after
+	// which exiting is a success.
+	shutdown bool
+}
+
+// serve handles messages until the client says to exit or closes the
+// connection, and returns the exit status.
+func (s *lspServer) serve() int {
+	for {
+		message, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return 1
+		}
+		if message.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+
+		result, err := s.handle(message)
+		if message.ID == nil {
+			// A notification, which doesn't get a response even if
+			// it failed.
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", message.Method, err)
+			}
+			continue
+		}
+		response := rpcMessage{JSONRPC: "2.0", ID: message.ID}
+		if err != nil {
+			rpcErr, ok := err.(*rpcError)
+			if !ok {
+				rpcErr = &rpcError{rpcInvalidParams, err.Error()}
+			}
+			response.Error = rpcErr
+		} else if response.Result, err = json.Marshal(result); err != nil {
+			response.Result = nil
+			response.Error = &rpcError{rpcInvalidRequest, err.Error()}
+		}
+		if err := s.write(response); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+}
+
+// read reads one message.
+func (s *lspServer) read() (*rpcMessage, error) {
+	body, err := readFramed(s.in)
+	if err != nil {
+		return nil, err
+	}
+	var message rpcMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, fmt.Errorf("bad message: %w", err)
+	}
+	return &message, nil
+}
+
+func (s *lspServer) write(message rpcMessage) error {
+	message.JSONRPC = "2.0"
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return writeFramed(s.out, body)
+}
+
+// readFramed reads a message that comes after a header giving its length,
+// which is how both LSP and DAP messages are sent.
+func readFramed(in *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %w", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeFramed(out io.Writer, body []byte) error {
+	_, err := fmt.Fprintf(out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *lspServer) notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.write(rpcMessage{Method: method, Params: data})
+}
+
+func (s *lspServer) handle(message *rpcMessage) (any, error) {
+	switch message.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				// 1 means the client sends the whole document
+				// each time it changes.
+				"textDocumentSync":       1,
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]any{"triggerCharacters": []string{}},
+			},
+			"serverInfo": map[string]any{"name": "jlox"},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.URI)
+		// Clear the diagnostics, since the editor won't ask about
+		// the document again.
+		return nil, s.notify("textDocument/publishDiagnostics", map[string]any{
+			"uri":         params.TextDocument.URI,
+			"diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/definition":
+		uri, d, offset, err := s.position(message.Params)
+		if err != nil {
+			return nil, err
+		}
+		declaration := d.declarationAt(offset)
+		if declaration == nil {
+			return nil, nil
+		}
+		return lspLocation{uri, d.tokenRange(declaration.name)}, nil
+	case "textDocument/references":
+		uri, d, offset, err := s.position(message.Params)
+		if err != nil {
+			return nil, err
+		}
+		var params struct {
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, err
+		}
+		declaration := d.declarationAt(offset)
+		if declaration == nil {
+			return nil, nil
+		}
+		locations := []lspLocation{}
+		for _, token := range d.references(declaration, params.Context.IncludeDeclaration) {
+			locations = append(locations, lspLocation{uri, d.tokenRange(token)})
+		}
+		return locations, nil
+	case "textDocument/hover":
+		_, d, offset, err := s.position(message.Params)
+		if err != nil {
+			return nil, err
+		}
+		declaration := d.declarationAt(offset)
+		if declaration == nil {
+			return nil, nil
+		}
+		return map[string]any{
+			"contents": map[string]any{"kind": "plaintext", "value": hover(declaration)},
+		}, nil
+	case "textDocument/documentSymbol":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, err
+		}
+		d, ok := s.documents[params.TextDocument.URI]
+		if !ok {
+			return nil, &rpcError{rpcInvalidParams, "unknown document " + params.TextDocument.URI}
+		}
+		return d.symbols(d.program), nil
+	case "textDocument/completion":
+		_, d, offset, err := s.position(message.Params)
+		if err != nil {
+			return nil, err
+		}
+		return d.completions(offset), nil
+	default:
+		if message.ID == nil {
+			// Notifications we don't know about (like
+			// "$/cancelRequest") can be ignored.
+			return nil, nil
+		}
+		return nil, &rpcError{rpcMethodNotFound, "method not supported: " + message.Method}
+	}
+}
+
+// update analyzes the new text of a document and publishes its diagnostics.
+func (s *lspServer) update(uri string, text string) error {
+	d := analyze(text)
+	s.documents[uri] = d
+	diagnostics := d.diagnostics
+	if diagnostics == nil {
+		diagnostics = []lspDiagnostic{}
+	}
+	return s.notify("textDocument/publishDiagnostics", map[string]any{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+// position decodes the parameters of a request about a position in a
+// document.
+func (s *lspServer) position(data json.RawMessage) (string, *document, int, error) {
+	var params textDocumentPositionParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return "", nil, 0, err
+	}
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return "", nil, 0, &rpcError{rpcInvalidParams, "unknown document " + params.TextDocument.URI}
+	}
+	return params.TextDocument.URI, d, d.offset(params.Position), nil
+}
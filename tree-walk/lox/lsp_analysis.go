@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The language server keeps an analysis of each open document, made from
+// scratch every time the document changes: Lox programs are small enough
+// that there's no point in doing anything cleverer. The analysis reuses the
+// rest of jlox: the scanner and the CST parser (which, unlike Parser, hands
+// back its errors rather than printing them), and the resolver, which records
+// every declaration and which one each name refers to.
+
+type document struct {
+	text string
+	// lineStarts are the byte offsets at which each line starts.
+	lineStarts  []int
+	program     *SyntaxNode
+	resolver    *Resolver
+	natives     []string
+	diagnostics []lspDiagnostic
+}
+
+func analyze(text string) *document {
+	d := &document{text: text, lineStarts: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lineStarts = append(d.lineStarts, i+1)
+		}
+	}
+
+	// Parse without the ERROR tokens, as Parser does, so that each
+	// scanner error is reported once rather than again by the parser.
+	var tokens []Token
+	scanner := NewScanner(text)
+	scanner.reportError = func(int, string) {}
+	for _, token := range scanner.ScanTokens() {
+		if token.tokenType == ERROR {
+			d.addDiagnostic(token, token.literal.(string))
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	program, errors := parseCST(tokens)
+	for _, err := range errors {
+		d.addDiagnostic(err.token, err.message)
+	}
+	d.program = program
+
+	interpreter := NewInterpreter()
+	for name := range interpreter.globals.values {
+		d.natives = append(d.natives, name)
+	}
+	sort.Strings(d.natives)
+	d.resolver = NewResolver()
+	d.resolver.reportError = func(token Token, message string) {
+		d.addDiagnostic(token, message)
+	}
+	d.resolver.resolveStatements(lowerProgram(program))
+	return d
+}
+
+func (d *document) addDiagnostic(token Token, message string) {
+	d.diagnostics = append(d.diagnostics, lspDiagnostic{d.tokenRange(token), 1, "jlox", message})
+}
+
+// position converts a byte offset into an LSP position, whose character
+// counts UTF-16 code units.
+func (d *document) position(offset int) lspPosition {
+	line := sort.Search(len(d.lineStarts), func(i int) bool { return d.lineStarts[i] > offset }) - 1
+	character := 0
+	for _, r := range d.text[d.lineStarts[line]:offset] {
+		character += utf16Length(r)
+	}
+	return lspPosition{line, character}
+}
+
+// offset converts an LSP position back into a byte offset. Positions past
+// the end of a line (or of the document) are clamped to it.
+func (d *document) offset(position lspPosition) int {
+	if position.Line < 0 {
+		return 0
+	}
+	if position.Line >= len(d.lineStarts) {
+		return len(d.text)
+	}
+	offset := d.lineStarts[position.Line]
+	character := 0
+	for offset < len(d.text) && d.text[offset] != '\n' && character < position.Character {
+		r, size := utf8.DecodeRuneInString(d.text[offset:])
+		character += utf16Length(r)
+		offset += size
+	}
+	return offset
+}
+
+func utf16Length(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func (d *document) tokenRange(token Token) lspRange {
+	return lspRange{d.position(token.offset), d.position(token.offset + len(token.lexeme))}
+}
+
+func (d *document) nodeRange(node *SyntaxNode) lspRange {
+	tokens := node.tokens()
+	return lspRange{d.tokenRange(tokens[0]).Start, d.tokenRange(tokens[len(tokens)-1]).End}
+}
+
+// touches is whether the cursor at offset is on token, counting the
+// position just after its last character, which is where the cursor usually
+// is after typing a name.
+func touches(token Token, offset int) bool {
+	return token.offset <= offset && offset <= token.offset+len(token.lexeme)
+}
+
+// declarationAt finds the declaration of the name at offset, whether the
+// name there is a use of it or the declaration itself.
+func (d *document) declarationAt(offset int) *Declaration {
+	for _, reference := range d.resolver.references {
+		if touches(reference.token, offset) {
+			return d.resolver.declarationOf(reference)
+		}
+	}
+	for _, declaration := range d.resolver.declarations {
+		// "this" and "super" are named after their class, but that
+		// name belongs to the class's own declaration.
+		if declaration.kind != DK_THIS && declaration.kind != DK_SUPER && touches(declaration.name, offset) {
+			return d.canonical(declaration)
+		}
+	}
+	return nil
+}
+
+// canonical maps a global declaration to the first declaration of the same
+// name, which is the one that references to it resolve to.
+func (d *document) canonical(declaration *Declaration) *Declaration {
+	if declaration.global {
+		return d.resolver.globals[declaration.name.lexeme]
+	}
+	return declaration
+}
+
+// references finds the names referring to declaration, in source order.
+func (d *document) references(declaration *Declaration, includeDeclaration bool) []Token {
+	var tokens []Token
+	if includeDeclaration && declaration.kind != DK_THIS && declaration.kind != DK_SUPER {
+		tokens = append(tokens, declaration.name)
+	}
+	for _, reference := range d.resolver.references {
+		if d.resolver.declarationOf(reference) == declaration {
+			tokens = append(tokens, reference.token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].offset < tokens[j].offset })
+	return tokens
+}
+
+// hover describes a declaration the way it's written, e.g.
+// "(function) add(a, b)" or "(class) Bagel < Pastry".
+func hover(declaration *Declaration) string {
+	switch node := declaration.node.(type) {
+	case *Function:
+		params := make([]string, len(node.params))
+		for i, param := range node.params {
+			params[i] = param.lexeme
+		}
+		if declaration.kind == DK_PARAMETER {
+			return fmt.Sprintf("(parameter) %v of %v(%v)", declaration.name.lexeme, node.name.lexeme, strings.Join(params, ", "))
+		}
+		return fmt.Sprintf("(%v) %v(%v)", declaration.kind, node.name.lexeme, strings.Join(params, ", "))
+	case *Class:
+		description := node.name.lexeme
+		if node.superclass != nil {
+			description += " < " + node.superclass.name.lexeme
+		}
+		switch declaration.kind {
+		case DK_THIS:
+			return "(this) instance of " + description
+		case DK_SUPER:
+			return "(super) superclass of " + description
+		}
+		return "(class) " + description
+	}
+	if declaration.global {
+		return "(global variable) " + declaration.name.lexeme
+	}
+	return "(local variable) " + declaration.name.lexeme
+}
+
+// symbols lists the classes, methods and functions declared in node, with
+// the ones declared inside each of them as its children.
+func (d *document) symbols(node *SyntaxNode) []lspDocumentSymbol {
+	symbols := []lspDocumentSymbol{}
+	for _, child := range node.children {
+		child, ok := child.(*SyntaxNode)
+		if !ok {
+			continue
+		}
+		switch child.kind {
+		case SK_CLASS_DECL:
+			name := child.children[1].(Token)
+			methods := []lspDocumentSymbol{}
+			for _, element := range child.children {
+				if method, ok := element.(*SyntaxNode); ok {
+					methods = append(methods, d.functionSymbol(method, method, LSK_METHOD))
+				}
+			}
+			symbols = append(symbols, lspDocumentSymbol{name.lexeme, LSK_CLASS, d.nodeRange(child), d.tokenRange(name), methods})
+		case SK_FUN_DECL:
+			symbols = append(symbols, d.functionSymbol(child, child.children[1].(*SyntaxNode), LSK_FUNCTION))
+		default:
+			symbols = append(symbols, d.symbols(child)...)
+		}
+	}
+	return symbols
+}
+
+// functionSymbol makes the symbol for a function or method. declaration is
+// the node covering the whole declaration (including "fun", for a function),
+// and function is its SK_FUNCTION node.
+func (d *document) functionSymbol(declaration *SyntaxNode, function *SyntaxNode, kind int) lspDocumentSymbol {
+	name := function.children[0].(Token)
+	return lspDocumentSymbol{name.lexeme, kind, d.nodeRange(declaration), d.tokenRange(name), d.symbols(function)}
+}
+
+// completions lists the names that are in scope at offset: the locals
+// declared before it in the scopes around it, every global (since a function
+// can use a global declared after it), the native functions and the
+// keywords.
+func (d *document) completions(offset int) []lspCompletionItem {
+	kinds := make(map[string]int)
+	for _, name := range d.natives {
+		kinds[name] = LCK_FUNCTION
+	}
+	for name, declaration := range d.resolver.globals {
+		kinds[name] = completionKind(declaration.kind)
+	}
+	d.scopeNames(d.program, offset, kinds)
+
+	items := []lspCompletionItem{}
+	for name, kind := range kinds {
+		items = append(items, lspCompletionItem{name, kind})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	for _, keyword := range sortedKeywords() {
+		items = append(items, lspCompletionItem{keyword, LCK_KEYWORD})
+	}
+	return items
+}
+
+// scopeNames adds the names declared in node before offset to kinds, then
+// does the same for whichever child of node the offset is in, so that inner
+// declarations replace outer ones.
+func (d *document) scopeNames(node *SyntaxNode, offset int, kinds map[string]int) {
+	if node.kind == SK_FUNCTION {
+		for _, element := range node.children[1].(*SyntaxNode).children {
+			if param := element.(Token); param.tokenType == IDENTIFIER {
+				kinds[param.lexeme] = LCK_VARIABLE
+			}
+		}
+	}
+
+	var inside *SyntaxNode
+	for _, child := range node.children {
+		child, ok := child.(*SyntaxNode)
+		if !ok {
+			continue
+		}
+		tokens := child.tokens()
+		if len(tokens) == 0 || tokens[0].offset >= offset {
+			break
+		}
+		switch child.kind {
+		case SK_VAR_DECL:
+			kinds[child.children[1].(Token).lexeme] = LCK_VARIABLE
+		case SK_FUN_DECL:
+			kinds[child.children[1].(*SyntaxNode).children[0].(Token).lexeme] = LCK_FUNCTION
+		case SK_CLASS_DECL:
+			kinds[child.children[1].(Token).lexeme] = LCK_CLASS
+		}
+		last := tokens[len(tokens)-1]
+		if offset <= last.offset+len(last.lexeme) {
+			inside = child
+		}
+	}
+	if inside != nil {
+		d.scopeNames(inside, offset, kinds)
+	}
+}
+
+func completionKind(kind DeclarationKind) int {
+	switch kind {
+	case DK_FUNCTION:
+		return LCK_FUNCTION
+	case DK_CLASS:
+		return LCK_CLASS
+	case DK_METHOD:
+		return LCK_METHOD
+	default:
+		return LCK_VARIABLE
+	}
+}
+
+func sortedKeywords() []string {
+	var result []string
+	for keyword := range keywords {
+		result = append(result, keyword)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// A framedClient talks to a language server or debug adapter the way an
+// editor does, with messages framed by a Content-Length header.
+type framedClient struct {
+	t   *testing.T
+	in  io.Writer
+	out *bufio.Reader
+}
+
+// newFramedClient starts serve, which reads from in and writes to out, and
+// returns a client for it and a channel that gets what serve returns.
+func newFramedClient(t *testing.T, serve func(in *bufio.Reader, out io.Writer) int) (*framedClient, <-chan int) {
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		status <- serve(bufio.NewReader(serverIn), serverOut)
+		serverOut.Close()
+	}()
+	t.Cleanup(func() { clientOut.Close() })
+	return &framedClient{t, clientOut, bufio.NewReader(clientIn)}, status
+}
+
+func (c *framedClient) send(message any) {
+	c.t.Helper()
+	body, err := json.Marshal(message)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := writeFramed(c.in, body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive reads the next message into message.
+func (c *framedClient) receive(message any) {
+	c.t.Helper()
+	body, err := readFramed(c.out)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := json.Unmarshal(body, message); err != nil {
+		c.t.Fatalf("%v in %s", err, body)
+	}
+}
+
+// request sends a request to the language server (or a notification, if id
+// is 0).
+func (c *framedClient) request(id int, method string, params string) {
+	c.t.Helper()
+	message := rpcMessage{JSONRPC: "2.0", Method: method, Params: json.RawMessage(params)}
+	if id != 0 {
+		message.ID = json.RawMessage(fmt.Sprint(id))
+	}
+	c.send(message)
+}
+
+// expect reads the next message from the language server and checks that it
+// is the response to request id with the result want, or if id is 0, the
+// notification method with the parameters want.
+func (c *framedClient) expect(id int, method string, want string) {
+	c.t.Helper()
+	var message rpcMessage
+	c.receive(&message)
+	got := message.Result
+	if id == 0 {
+		got = message.Params
+		if message.Method != method {
+			c.t.Fatalf("got a %q notification, want %q", message.Method, method)
+		}
+	} else if string(message.ID) != fmt.Sprint(id) || message.Error != nil {
+		c.t.Fatalf("got the response %s to %s with the error %v, want the response to %v", got, message.ID, message.Error, id)
+	}
+	if string(got) != want {
+		c.t.Errorf("%v: got\n%s\nwant\n%s", method, got, want)
+	}
+}
+
+func TestLanguageServer(t *testing.T) {
+	client, status := newFramedClient(t, func(in *bufio.Reader, out io.Writer) int {
+		server := &lspServer{in: in, out: out, documents: make(map[string]*document)}
+		return server.serve()
+	})
+	const uri = `"file:///greet.lox"`
+	const source = `fun greet(name) {\n  print \"Hello, \" + name;\n}\ngreet(\"world\")\n`
+	position := func(line, character int) string {
+		return fmt.Sprintf(`{"textDocument": {"uri": %v}, "position": {"line": %v, "character": %v}}`, uri, line, character)
+	}
+
+	client.request(1, "initialize", `{"capabilities": {}}`)
+	client.expect(1, "initialize", `{"capabilities":{"completionProvider":{"triggerCharacters":[]},"definitionProvider":true,"documentSymbolProvider":true,"hoverProvider":true,"referencesProvider":true,"textDocumentSync":1},"serverInfo":{"name":"jlox"}}`)
+	client.request(0, "initialized", `{}`)
+
+	client.request(0, "textDocument/didOpen", fmt.Sprintf(`{"textDocument": {"uri": %v, "languageId": "lox", "version": 1, "text": "%v"}}`, uri, source))
+	client.expect(0, "textDocument/publishDiagnostics", `{"diagnostics":[{"range":{"start":{"line":4,"character":0},"end":{"line":4,"character":0}},"severity":1,"source":"jlox","message":"Expect ';' after expression."}],"uri":"file:///greet.lox"}`)
+	fixed := strings.Replace(source, `(\"world\")`, `(\"world\");`, 1)
+	client.request(0, "textDocument/didChange", fmt.Sprintf(`{"textDocument": {"uri": %v, "version": 2}, "contentChanges": [{"text": "%v"}]}`, uri, fixed))
+	client.expect(0, "textDocument/publishDiagnostics", `{"diagnostics":[],"uri":"file:///greet.lox"}`)
+
+	// The call to greet, the use of name, and greet's declaration.
+	client.request(2, "textDocument/hover", position(3, 1))
+	client.expect(2, "textDocument/hover", `{"contents":{"kind":"plaintext","value":"(function) greet(name)"}}`)
+	client.request(3, "textDocument/definition", position(1, 22))
+	client.expect(3, "textDocument/definition", `{"uri":"file:///greet.lox","range":{"start":{"line":0,"character":10},"end":{"line":0,"character":14}}}`)
+	client.request(4, "textDocument/references", fmt.Sprintf(`{"textDocument": {"uri": %v}, "position": {"line": 0, "character": 5}, "context": {"includeDeclaration": true}}`, uri))
+	client.expect(4, "textDocument/references", `[{"uri":"file:///greet.lox","range":{"start":{"line":0,"character":4},"end":{"line":0,"character":9}}},{"uri":"file:///greet.lox","range":{"start":{"line":3,"character":0},"end":{"line":3,"character":5}}}]`)
+	// Somewhere that isn't a name.
+	client.request(5, "textDocument/hover", position(1, 10))
+	client.expect(5, "textDocument/hover", `null`)
+
+	client.request(6, "shutdown", ``)
+	client.expect(6, "shutdown", `null`)
+	client.request(0, "exit", ``)
+	if got := <-status; got != 0 {
+		t.Errorf("the server exited with %v, want 0", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// Rough sizes, in bytes, of the things a Lox script can make the interpreter
+// allocate. These don't need to be exact; they only need to be in the right
+// ballpark so that a script which keeps allocating eventually runs into the
+// limit.
+const (
+	stringHeaderSize = 16 // the header of a Go string
+	environmentSize  = 64 // an Environment plus its (empty) values map or slots
+	instanceSize     = 64 // a LoxInstance with no fields
+	closureSize      = 48 // a LoxFunction with no upvalues
+	mapEntrySize     = 48 // one entry in the globals' values map
+	slotSize         = 16 // one local variable in an environment's slots, one field, or one upvalue
+)
+
+// The memory limit is an allocation budget rather than a measurement of the
+// live heap: Go's garbage collector doesn't tell us when a Lox value dies,
+// so strings, instances, fields and closures count against the limit for the
+// rest of the run. Environments for blocks and calls are the exception. They
+// are given back when the block or call finishes, because otherwise every
+// loop iteration and every recursive call would eat into the budget even
+// though almost all of those environments are garbage as soon as they are
+// popped. (A closure can keep the variables it captures alive, in which case
+// we undercount, which is fine.)
+type memoryLimiter struct {
+	// limit is the number of bytes a script may allocate; 0 means no limit.
+	limit int
+	used  int
+}
+
+// allocate records size bytes against the limit, and reports a runtime error
+// at token if that takes the script over it.
+func (i *Interpreter) allocate(token Token, size int) error {
+	i.reserve(size)
+	return i.checkMemory(token)
+}
+
+// reserve records size bytes without checking the limit, for allocations that
+// happen somewhere we have no token to blame. The next allocate or
+// checkMemory will notice if we've gone over.
+func (i *Interpreter) reserve(size int) {
+	i.memory.used += size
+}
+
+func (i *Interpreter) checkMemory(token Token) error {
+	if i.memory.limit > 0 && i.memory.used > i.memory.limit {
+		return RuntimeError{token, "Memory limit exceeded."}
+	}
+	return nil
+}
+
+func (i *Interpreter) free(size int) {
+	i.memory.used -= size
+}
+
+func stringSize(s string) int {
+	return stringHeaderSize + len(s)
+}
+
+func environmentSizeOf(environment *Environment) int {
+	size := environmentSize
+	for name := range environment.values {
+		size += mapEntrySize + len(name)
+	}
+	return size + len(environment.slots)*slotSize
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+// runWithMemoryLimit runs source in an interpreter of its own that may
+// allocate limit bytes, and returns the interpreter and the runtime error it
+// stopped with, if any.
+func runWithMemoryLimit(t *testing.T, source string, limit int) (*Interpreter, error) {
+	t.Helper()
+	hadError = false
+	parser := Parser{tokens: NewScanner(source).ScanTokens()}
+	statements := parser.parse()
+	interpreter := NewInterpreter()
+	resolver := NewResolver()
+	resolver.resolveStatements(statements)
+	if hadError {
+		t.Fatalf("%q doesn't compile", source)
+	}
+	interpreter.memory.limit = limit
+	for _, stmt := range statements {
+		if _, err := interpreter.execute(stmt); err != nil {
+			return &interpreter, err
+		}
+	}
+	return &interpreter, nil
+}
+
+// TestMemoryLimitExceeded checks that programs which keep allocating are
+// stopped, whatever it is they keep allocating.
+func TestMemoryLimitExceeded(t *testing.T) {
+	for _, test := range []struct {
+		name, source string
+	}{
+		{"strings", `
+			var s = "x";
+			while (true) s = s + "x";`},
+		{"strings thrown away", `
+			while (true) { var s = "a" + "b"; }`},
+		{"instances", `
+			class Node { init(next) { this.next = next; } }
+			var list = nil;
+			while (true) list = Node(list);`},
+		{"fields", `
+			class Bag {}
+			var bag = Bag();
+			var name = "f";
+			while (true) { name = name + "f"; bag.x = name; }`},
+		{"closures", `
+			var last = nil;
+			while (true) {
+				var previous = last;
+				fun next() { return previous; }
+				last = next;
+			}`},
+		{"methods", `
+			class A {}
+			while (true) {
+				class B < A { method() { return super.method; } }
+			}`},
+		{"recursion", `
+			fun f(n) { return f(n + 1); }
+			f(0);`},
+	} {
+		_, err := runWithMemoryLimit(t, test.source, 100_000)
+		if rte, ok := err.(RuntimeError); !ok || rte.message != "Memory limit exceeded." {
+			t.Errorf("%v: got the error %v, want the memory limit to be exceeded", test.name, err)
+		}
+	}
+}
+
+// TestWithinMemoryLimit checks that a program that keeps its memory in use
+// small can run for as long as it likes: blocks and calls give back their
+// environments when they finish.
+func TestWithinMemoryLimit(t *testing.T) {
+	const source = `
+		class Counter {
+			init() { this.count = 0; }
+			add(n) { this.count = this.count + n; }
+		}
+		fun fib(n) {
+			if (n < 2) return n;
+			return fib(n - 1) + fib(n - 2);
+		}
+		fun adder(n) {
+			fun add(x) { return x + n; }
+			return add;
+		}
+		var counter = Counter();
+		var add = adder(1);
+		for (var i = 0; i < 20000; i = i + 1) {
+			var j = add(i);
+			{
+				var k = j * 2;
+				counter.add(k - j - i);
+			}
+		}
+		var count = counter.count;
+		var fib15 = fib(15);`
+	interpreter, err := runWithMemoryLimit(t, source, 5_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]float64{"count": 20000, "fib15": 610} {
+		if got := interpreter.globals.values[name]; got != want {
+			t.Errorf("got %v = %v, want %v", name, got, want)
+		}
+	}
+}
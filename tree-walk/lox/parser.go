@@ -1,23 +1,49 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 )
 
 type Parser struct {
 	tokens  []Token
 	current int
+	// reportError is called for each syntax error. It's logParseError
+	// unless the caller wants to deal with the errors itself.
+	reportError func(token Token, message string)
 }
 
+// NewParser makes a parser for tokens. The scanner has already reported the
+// errors behind any ERROR tokens, so the parser doesn't get to see them.
+func NewParser(tokens []Token) *Parser {
+	parser := &Parser{reportError: logParseError}
+	for _, token := range tokens {
+		if token.tokenType != ERROR {
+			parser.tokens = append(parser.tokens, token)
+		}
+	}
+	return parser
+}
+
+// ParseError is what the parsing methods return when they give up on the
+// current declaration. By the time one is returned, it has already been
+// reported, so all the caller has to do is unwind to declaration(), which
+// synchronizes and carries on with the next declaration.
+type ParseError struct {
+	token   Token
+	message string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("[line %v] %v", e.token.line, e.message)
+}
+
+// parse always returns a complete AST: no statement or expression in it is
+// nil. Any declaration that had a syntax error is replaced by an ErrorStmt,
+// so the caller has to check hadError before running the program.
 func (p *Parser) parse() []Stmt {
 	statements := []Stmt{}
 	for !p.isAtEnd() {
-		stmt, err := p.declaration()
-		if err != nil {
-			fmt.Printf("error in parse(): %v", err)
-		}
-		statements = append(statements, stmt)
+		statements = append(statements, p.declaration())
 	}
 	return statements
 }
@@ -43,7 +69,7 @@ func (p *Parser) statement() (Stmt, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &Block{b}, nil
+		return &Block{b, nil}, nil
 	}
 	return p.expressionStatement()
 }
@@ -119,17 +145,19 @@ func (p *Parser) forStatement() (Stmt, error) {
 	if increment != nil {
 		body = &Block{
 			[]Stmt{body, &Expression{increment}},
+			nil,
 		}
 	}
 
 	if condition == nil {
-		condition = &Literal{true}
+		condition = &Literal{true, Token{}}
 	}
 	body = &While{condition, body}
 
 	if initializer != nil {
 		body = &Block{
 			[]Stmt{initializer, body},
+			nil,
 		}
 	}
 
@@ -157,23 +185,29 @@ func (p *Parser) whileStatement() (Stmt, error) {
 	return &While{condition, body}, nil
 }
 
-func (p *Parser) ifStatement() (*If, error) {
-	p.consume(LEFT_PAREN, "Expect '(' after 'if'.")
+func (p *Parser) ifStatement() (Stmt, error) {
+	_, err := p.consume(LEFT_PAREN, "Expect '(' after 'if'.")
+	if err != nil {
+		return nil, err
+	}
 	condition, err := p.expression()
 	if err != nil {
-		return &If{}, err
+		return nil, err
+	}
+	_, err = p.consume(RIGHT_PAREN, "Expect ')' after if condition.")
+	if err != nil {
+		return nil, err
 	}
-	p.consume(RIGHT_PAREN, "Expect ')' after if condition.")
 
 	thenBranch, err := p.statement()
 	if err != nil {
-		return &If{}, err
+		return nil, err
 	}
 	var elseBranch Stmt = nil
 	if p.match(ELSE) {
 		elseBranch, err = p.statement()
 		if err != nil {
-			return &If{}, err
+			return nil, err
 		}
 	}
 
@@ -184,11 +218,7 @@ func (p *Parser) block() ([]Stmt, error) {
 	var statements []Stmt
 
 	for !p.check(RIGHT_BRACE) && !p.isAtEnd() {
-		decl, err := p.declaration()
-		if err != nil {
-			return nil, err
-		}
-		statements = append(statements, decl)
+		statements = append(statements, p.declaration())
 	}
 
 	_, err := p.consume(RIGHT_BRACE, "Expect '}' after block.")
@@ -225,21 +255,21 @@ func (p *Parser) expressionStatement() (Stmt, error) {
 func (p *Parser) function(kind string) (*Function, error) {
 	name, err := p.consume(IDENTIFIER, fmt.Sprintf("Expect %v name.", kind))
 	if err != nil {
-		return &Function{}, err
+		return nil, err
 	}
 	_, err = p.consume(LEFT_PAREN, fmt.Sprintf("Expect '(' after %v name.", kind))
 	if err != nil {
-		return &Function{}, err
+		return nil, err
 	}
 	parameters := []Token{}
 	if !p.check(RIGHT_PAREN) {
 		for {
 			if len(parameters) >= 255 {
-				logParseError(p.peek(), "Can't have more than 255 parameters.")
+				p.reportError(p.peek(), "Can't have more than 255 parameters.")
 			}
 			ident, err := p.consume(IDENTIFIER, "Expect parameters name.")
 			if err != nil {
-				return &Function{}, err
+				return nil, err
 			}
 			parameters = append(parameters, ident)
 			if !p.match(COMMA) {
@@ -247,14 +277,20 @@ func (p *Parser) function(kind string) (*Function, error) {
 			}
 		}
 	}
-	p.consume(RIGHT_PAREN, "Expect ')' after parameters.")
+	_, err = p.consume(RIGHT_PAREN, "Expect ')' after parameters.")
+	if err != nil {
+		return nil, err
+	}
 
-	p.consume(LEFT_BRACE, fmt.Sprintf("Expect '{' before %v body.", kind))
+	_, err = p.consume(LEFT_BRACE, fmt.Sprintf("Expect '{' before %v body.", kind))
+	if err != nil {
+		return nil, err
+	}
 	body, err := p.block()
 	if err != nil {
-		return &Function{}, err
+		return nil, err
 	}
-	return &Function{name, parameters, body}, nil
+	return &Function{name, parameters, body, nil, nil}, nil
 }
 
 func (p *Parser) or() (Expr, error) {
@@ -300,7 +336,7 @@ func (p *Parser) assignment() (Expr, error) {
 	}
 
 	if p.match(EQUAL) {
-		_ = p.previous()
+		equals := p.previous()
 		value, err := p.assignment()
 		if err != nil {
 			return nil, err
@@ -309,11 +345,14 @@ func (p *Parser) assignment() (Expr, error) {
 		switch v := expr.(type) {
 		case *Variable:
 			var name Token = v.name
-			return &Assign{name, value}, nil
+			return &Assign{name, value, nil}, nil
 		case *Get:
-			return &Set{v.object, v.name, value}, nil
+			return &Set{v.object, v.name, value, nil}, nil
 		default:
-			fmt.Printf("Invalid assignment target: %q\n", stringify(v))
+			// Like the book, report the error but don't return it:
+			// the parser isn't confused, so there's no need to
+			// synchronize.
+			p.reportError(equals, "Invalid assignment target.")
 		}
 	}
 
@@ -324,7 +363,21 @@ func (p *Parser) expression() (Expr, error) {
 	return p.assignment()
 }
 
-func (p *Parser) declaration() (Stmt, error) {
+// declaration is where we recover from syntax errors: if the declaration
+// can't be parsed, we skip ahead to what looks like the start of the next one
+// and hand back an ErrorStmt holding the tokens we skipped, so that the
+// caller always gets a non-nil statement.
+func (p *Parser) declaration() Stmt {
+	start := p.current
+	result, err := p.declarationOrError()
+	if err != nil {
+		p.synchronize()
+		return &ErrorStmt{p.tokens[start:p.current]}
+	}
+	return result
+}
+
+func (p *Parser) declarationOrError() (Stmt, error) {
 	if p.match(CLASS) {
 		return p.classDeclaration()
 	}
@@ -332,21 +385,9 @@ func (p *Parser) declaration() (Stmt, error) {
 		return p.function("function")
 	}
 	if p.match(VAR) {
-		result, err := p.varDeclaration()
-		if err != nil {
-			p.synchronize()
-			return nil, err
-		} else {
-			return result, nil
-		}
-	}
-	result, err := p.statement()
-	if err != nil {
-		p.synchronize()
-		return nil, err
-	} else {
-		return result, nil
+		return p.varDeclaration()
 	}
+	return p.statement()
 }
 
 func (p *Parser) classDeclaration() (Stmt, error) {
@@ -361,7 +402,7 @@ func (p *Parser) classDeclaration() (Stmt, error) {
 		if err != nil {
 			return nil, err
 		}
-		superclass = &Variable{p.previous()}
+		superclass = &Variable{p.previous(), nil}
 		// Kind of weird how the book does it here... Why not just
 		// consume and then take the name from the consume call?
 		// Why consume without assigning to a name, and then make
@@ -513,7 +554,7 @@ func (p *Parser) call() (Expr, error) {
 			if err != nil {
 				return nil, err
 			}
-			expr = &Get{expr, name}
+			expr = &Get{expr, name, nil}
 		} else {
 			break
 		}
@@ -527,7 +568,7 @@ func (p *Parser) finishCall(callee Expr) (Expr, error) {
 	if !p.check(RIGHT_PAREN) {
 		for {
 			if len(arguments) >= 255 {
-				logParseError(p.peek(), "Can't have more than 255 arguments.")
+				p.reportError(p.peek(), "Can't have more than 255 arguments.")
 			}
 			expr, err := p.expression()
 			if err != nil {
@@ -550,17 +591,17 @@ func (p *Parser) finishCall(callee Expr) (Expr, error) {
 
 func (p *Parser) primary() (Expr, error) {
 	if p.match(FALSE) {
-		return &Literal{false}, nil
+		return &Literal{false, p.previous()}, nil
 	}
 	if p.match(TRUE) {
-		return &Literal{true}, nil
+		return &Literal{true, p.previous()}, nil
 	}
 	if p.match(NIL) {
-		return &Literal{nil}, nil
+		return &Literal{nil, p.previous()}, nil
 	}
 
 	if p.match(NUMBER, STRING) {
-		return &Literal{p.previous().literal}, nil
+		return &Literal{p.previous().literal, p.previous()}, nil
 	}
 
 	if p.match(SUPER) {
@@ -573,15 +614,15 @@ func (p *Parser) primary() (Expr, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &Super{keyword, method}, nil
+		return &Super{keyword, method, nil, nil}, nil
 	}
 
 	if p.match(THIS) {
-		return &This{p.previous()}, nil
+		return &This{p.previous(), nil}, nil
 	}
 
 	if p.match(IDENTIFIER) {
-		return &Variable{p.previous()}, nil
+		return &Variable{p.previous(), nil}, nil
 	}
 
 	if p.match(LEFT_PAREN) {
@@ -596,8 +637,7 @@ func (p *Parser) primary() (Expr, error) {
 		return &Grouping{expr}, nil
 	}
 
-	logParseError(p.peek(), "Expect expression.")
-	return nil, nil
+	return nil, p.parseError(p.peek(), "Expect expression.")
 }
 
 func (p *Parser) match(tokenTypes ...TokenType) bool {
@@ -614,9 +654,12 @@ func (p *Parser) consume(tokenType TokenType, message string) (Token, error) {
 	if p.check(tokenType) {
 		return p.advance(), nil
 	}
-	logParseError(p.peek(), message)
-	err := errors.New("error inside of consume()")
-	return Token{}, err
+	return Token{}, p.parseError(p.peek(), message)
+}
+
+func (p *Parser) parseError(token Token, message string) error {
+	p.reportError(token, message)
+	return ParseError{token, message}
 }
 
 func logParseError(token Token, message string) {
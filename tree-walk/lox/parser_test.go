@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzParse checks that the parser never panics and never hands back an AST
+// with nil nodes in it, however broken the input is, and that the printers,
+// the JSON round trip and the resolver cope with whatever the parser produced.
+func FuzzParse(f *testing.F) {
+	examples, err := filepath.Glob("../examples/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	conformance, err := filepath.Glob("testdata/conformance/*/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, example := range append(examples, conformance...) {
+		source, err := os.ReadFile(example)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(source))
+	}
+	for _, source := range []string{
+		"var a = ;",
+		"print 1 +;",
+		"fun f(a, b { print a; }",
+		"class C { m( { } }",
+		"1 = 2;",
+		"if (true print 3;",
+		"{ var x = 1 print x; }",
+		"a.b.c = d(e, f)(g);",
+		"for (;;",
+		"super",
+		"((((",
+		"}}}",
+		"print \"unterminated;",
+		"var @ = 1; print # 2;",
+		strings.Repeat("9", 400) + ";",
+	} {
+		f.Add(source)
+	}
+
+	f.Fuzz(func(t *testing.T, source string) {
+		statements := NewParser(NewScanner(source).ScanTokens()).parse()
+		for _, stmt := range statements {
+			checkStmt(t, stmt)
+		}
+
+		printTree(statements)
+
+		data, err := astToJSON(statements, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := astFromJSON(data)
+		if err != nil {
+			t.Fatalf("%v in\n%s", err, data)
+		}
+		if got, want := printStatements(loaded), printStatements(statements); got != want {
+			t.Fatalf("AST changed on its way through JSON:\n%v\nbecame\n%v", want, got)
+		}
+
+		NewResolver().resolveStatements(statements)
+	})
+}
+
+func checkStmt(t *testing.T, stmt Stmt) {
+	t.Helper()
+	switch v := stmt.(type) {
+	case *Block:
+		for _, s := range v.statements {
+			checkStmt(t, s)
+		}
+	case *Class:
+		for _, method := range v.methods {
+			checkStmt(t, method)
+		}
+	case *ErrorStmt:
+	case *Expression:
+		checkExpr(t, v.expression)
+	case *Function:
+		if v == nil {
+			t.Fatal("nil function")
+		}
+		for _, s := range v.body {
+			checkStmt(t, s)
+		}
+	case *If:
+		checkExpr(t, v.condition)
+		checkStmt(t, v.thenBranch)
+		if v.elseBranch != nil {
+			checkStmt(t, v.elseBranch)
+		}
+	case *Print:
+		checkExpr(t, v.expression)
+	case *Return:
+		if v.value != nil {
+			checkExpr(t, v.value)
+		}
+	case *Var:
+		if v.initializer != nil {
+			checkExpr(t, v.initializer)
+		}
+	case *While:
+		checkExpr(t, v.condition)
+		checkStmt(t, v.body)
+	default:
+		t.Fatalf("unexpected statement %#v", stmt)
+	}
+}
+
+func checkExpr(t *testing.T, expr Expr) {
+	t.Helper()
+	switch v := expr.(type) {
+	case *Assign:
+		checkExpr(t, v.value)
+	case *Binary:
+		checkExpr(t, v.left)
+		checkExpr(t, v.right)
+	case *Call:
+		checkExpr(t, v.callee)
+		for _, argument := range v.arguments {
+			checkExpr(t, argument)
+		}
+	case *Get:
+		checkExpr(t, v.object)
+	case *Grouping:
+		checkExpr(t, v.expression)
+	case *Literal:
+	case *Logical:
+		checkExpr(t, v.left)
+		checkExpr(t, v.right)
+	case *Set:
+		checkExpr(t, v.object)
+		checkExpr(t, v.value)
+	case *Super:
+	case *This:
+	case *Unary:
+		checkExpr(t, v.right)
+	case *Variable:
+	default:
+		t.Fatalf("unexpected expression %#v", expr)
+	}
+}
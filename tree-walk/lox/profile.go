@@ -0,0 +1,314 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"time"
+)
+
+// The profiler behind "jlox --profile" measures where a Lox program spends
+// its time. Rather than sampling, it uses the interpreter's hooks to count
+// every statement and to time everything between one hook and the next, and
+// charges it to the Lox call stack at that moment. Each frame of the stack is
+// a function and the line it's on, so the profile can be looked at by
+// function or by line.
+//
+// It's written in pprof's format, so "go tool pprof" can show it, as a flame
+// graph or otherwise. The format is a gzipped protocol buffer; see
+// https://github.com/google/pprof/blob/main/proto/profile.proto. We only
+// need to write a few of its messages, so they're encoded by hand below.
+
+type profiler struct {
+	NoHooks
+	// filename is the script's path, which pprof shows next to each
+	// function.
+	filename string
+	start    time.Time
+	// last is when time was last charged to the stack.
+	last time.Time
+	// root is the bottom of the tree of call stacks. It doesn't stand for
+	// a location itself; its children are the script's lines.
+	root  *profileNode
+	stack []*profileFrame
+	// functions and locations give each function and each line of a
+	// function the ID it has in the profile.
+	functions map[profileFunction]uint64
+	locations map[profileLocation]uint64
+	// lines caches the line each statement starts on.
+	lines map[Stmt]int
+}
+
+type profileFunction struct {
+	name string
+	// line is the line the function is declared on, or 0 if it isn't
+	// declared in the script, like a native function.
+	line int
+}
+
+type profileLocation struct {
+	function uint64
+	line     int
+}
+
+// profileNode is a call stack, in a tree where each node's parent is the same
+// stack without its innermost location. It's what time is charged to.
+type profileNode struct {
+	location uint64
+	children map[uint64]*profileNode
+	// statements is how many statements ran with this stack, and nanos
+	// is how much time was spent with it.
+	statements int64
+	nanos      int64
+}
+
+type profileFrame struct {
+	function uint64
+	// caller is the node for the stack that made the call, and node is
+	// the one for the line the frame is on now.
+	caller *profileNode
+	node   *profileNode
+}
+
+func newProfiler(filename string) *profiler {
+	p := &profiler{
+		filename:  filename,
+		root:      &profileNode{},
+		functions: make(map[profileFunction]uint64),
+		locations: make(map[profileLocation]uint64),
+		lines:     make(map[Stmt]int),
+	}
+	p.push(profileFunction{"script", 0})
+	p.start = time.Now()
+	p.last = p.start
+	return p
+}
+
+func (p *profiler) BeforeStatement(i *Interpreter, stmt Stmt) {
+	// Like the debugger, don't count blocks as statements of their own;
+	// count the statements inside them.
+	if _, ok := stmt.(*Block); ok {
+		return
+	}
+	p.charge()
+	line, ok := p.lines[stmt]
+	if !ok {
+		line = stmtLine(stmt)
+		p.lines[stmt] = line
+	}
+	top := p.stack[len(p.stack)-1]
+	top.node = top.caller.child(p.location(top.function, line))
+	top.node.statements++
+}
+
+func (p *profiler) BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any) {
+	p.charge()
+	line := 0
+	switch v := callee.(type) {
+	case *LoxFunction:
+		line = v.declaration.name.line
+	case *LoxClass:
+		if init := v.findMethod("init"); init != nil {
+			line = init.declaration.name.line
+		}
+	}
+	p.push(profileFunction{callableName(call, callee), line})
+}
+
+func (p *profiler) AfterCall(i *Interpreter, call *Call, callee LoxCallable, result any, err error) {
+	p.charge()
+	p.stack = p.stack[:len(p.stack)-1]
+}
+
+// push starts a frame for function. Until its first statement, it's on the
+// line the function is declared on.
+func (p *profiler) push(function profileFunction) {
+	caller := p.root
+	if len(p.stack) > 0 {
+		caller = p.stack[len(p.stack)-1].node
+	}
+	id := p.function(function)
+	p.stack = append(p.stack, &profileFrame{id, caller, caller.child(p.location(id, function.line))})
+}
+
+// charge charges the time since it was last called to the current stack.
+func (p *profiler) charge() {
+	now := time.Now()
+	p.stack[len(p.stack)-1].node.nanos += now.Sub(p.last).Nanoseconds()
+	p.last = now
+}
+
+func (p *profiler) function(function profileFunction) uint64 {
+	id, ok := p.functions[function]
+	if !ok {
+		id = uint64(len(p.functions) + 1)
+		p.functions[function] = id
+	}
+	return id
+}
+
+func (p *profiler) location(function uint64, line int) uint64 {
+	location := profileLocation{function, line}
+	id, ok := p.locations[location]
+	if !ok {
+		id = uint64(len(p.locations) + 1)
+		p.locations[location] = id
+	}
+	return id
+}
+
+func (n *profileNode) child(location uint64) *profileNode {
+	if n.children == nil {
+		n.children = make(map[uint64]*profileNode)
+	}
+	child, ok := n.children[location]
+	if !ok {
+		child = &profileNode{location: location}
+		n.children[location] = child
+	}
+	return child
+}
+
+func writeProfile(p *profiler, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := p.write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// write writes the profile, gzipped, to w.
+func (p *profiler) write(w io.Writer) error {
+	p.charge()
+	duration := p.last.Sub(p.start)
+
+	var profile protoBuffer
+	indexes := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		index, ok := indexes[s]
+		if !ok {
+			index = int64(len(table))
+			indexes[s] = index
+			table = append(table, s)
+		}
+		return index
+	}
+	valueType := func(kind, unit string) []byte {
+		var b protoBuffer
+		b.varint(1, uint64(str(kind)))
+		b.varint(2, uint64(str(unit)))
+		return b
+	}
+
+	// Profile.sample_type
+	profile.bytes(1, valueType("statements", "count"))
+	profile.bytes(1, valueType("time", "nanoseconds"))
+
+	// Profile.sample, one for each stack that anything was charged to.
+	// pprof wants the innermost location first.
+	var stack []uint64
+	var walk func(n *profileNode)
+	walk = func(n *profileNode) {
+		stack = append([]uint64{n.location}, stack...)
+		if n.statements > 0 || n.nanos > 0 {
+			var sample protoBuffer
+			sample.packed(1, stack)
+			sample.packed(2, []uint64{uint64(n.statements), uint64(n.nanos)})
+			profile.bytes(2, sample)
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+		stack = stack[1:]
+	}
+	for _, child := range p.root.children {
+		walk(child)
+	}
+
+	// Profile.location
+	for location, id := range p.locations {
+		var line protoBuffer
+		line.varint(1, location.function)
+		line.varint(2, uint64(location.line))
+		var b protoBuffer
+		b.varint(1, id)
+		b.bytes(4, line)
+		profile.bytes(4, b)
+	}
+
+	// Profile.function
+	for function, id := range p.functions {
+		var b protoBuffer
+		b.varint(1, id)
+		b.varint(2, uint64(str(function.name)))
+		b.varint(3, uint64(str(function.name)))
+		b.varint(4, uint64(str(p.filename)))
+		b.varint(5, uint64(function.line))
+		profile.bytes(5, b)
+	}
+
+	timeType := valueType("time", "nanoseconds")
+	defaultType := str("time")
+	// Profile.string_table, which has to come after everything that
+	// adds to it.
+	for _, s := range table {
+		profile.bytes(6, []byte(s))
+	}
+	profile.varint(9, uint64(p.start.UnixNano()))
+	profile.varint(10, uint64(duration.Nanoseconds()))
+	profile.bytes(11, timeType)
+	profile.varint(12, 1)
+	profile.varint(14, uint64(defaultType))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protoBuffer builds a protocol buffer message, one field at a time.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field int, wireType int) {
+	b.uvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uvarint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+// varint writes an integer field. Fields that are zero are left out, since
+// that's their default.
+func (b *protoBuffer) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, 0)
+	b.uvarint(v)
+}
+
+// bytes writes a string, bytes or embedded message field.
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	b.uvarint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// packed writes a repeated integer field.
+func (b *protoBuffer) packed(field int, vs []uint64) {
+	var values protoBuffer
+	for _, v := range vs {
+		values.uvarint(v)
+	}
+	b.bytes(field, values)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// protoField is one field of a protocol buffer message: a varint or, for
+// strings, bytes and messages, data.
+type protoField struct {
+	number int
+	value  uint64
+	data   []byte
+}
+
+// readProto splits a protocol buffer message into its fields.
+func readProto(t *testing.T, message []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		message = message[n:]
+		field := protoField{number: int(key >> 3)}
+		value, n := binary.Uvarint(message)
+		if n <= 0 {
+			t.Fatalf("bad varint in field %v", field.number)
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			field.value = value
+		case 2:
+			field.data, message = message[:value], message[value:]
+		default:
+			t.Fatalf("unexpected wire type %v", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protoValues are the varint fields of a message, by number. A field that's
+// left out is zero.
+func protoValues(fields []protoField) map[int]uint64 {
+	values := make(map[int]uint64)
+	for _, field := range fields {
+		values[field.number] = field.value
+	}
+	return values
+}
+
+// readPacked reads a packed repeated integer field.
+func readPacked(data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values
+}
+
+// TestProfile checks the profile of a program that's written for pprof: the
+// functions and the lines of each stack, outermost first, with how many
+// statements ran there. How long they took can't be checked, but they have
+// to have taken some time between them.
+func TestProfile(t *testing.T) {
+	const source = `fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 1) + fib(n - 2);
+}
+class Counter {
+  init() { this.count = 0; }
+}
+var counter = Counter();
+print fib(3);
+print clock() > 0;`
+	hadError = false
+	interpreter := NewInterpreter()
+	statements := NewParser(NewScanner(source).ScanTokens()).parse()
+	NewResolver().resolveStatements(statements)
+	if hadError {
+		t.Fatal("the program doesn't compile")
+	}
+	interpreter.stdout = io.Discard
+	profiler := newProfiler("fib.lox")
+	interpreter.addHooks(profiler)
+	for _, stmt := range statements {
+		if _, err := interpreter.execute(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var file bytes.Buffer
+	if err := profiler.write(&file); err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := gzip.NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(unzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The strings come last, so collect everything else first.
+	var table []string
+	var sampleTypes, samples, locations, functions [][]byte
+	for _, field := range readProto(t, data) {
+		switch field.number {
+		case 1:
+			sampleTypes = append(sampleTypes, field.data)
+		case 2:
+			samples = append(samples, field.data)
+		case 4:
+			locations = append(locations, field.data)
+		case 5:
+			functions = append(functions, field.data)
+		case 6:
+			table = append(table, string(field.data))
+		}
+	}
+	var types []string
+	for _, sampleType := range sampleTypes {
+		values := protoValues(readProto(t, sampleType))
+		types = append(types, table[values[1]]+"/"+table[values[2]])
+	}
+	if got := strings.Join(types, " "); got != "statements/count time/nanoseconds" {
+		t.Errorf("got the sample types %v", got)
+	}
+	names := make(map[uint64]string)
+	var declared []string
+	for _, function := range functions {
+		values := protoValues(readProto(t, function))
+		names[values[1]] = table[values[2]]
+		declared = append(declared, fmt.Sprintf("%v in %v at line %v", table[values[2]], table[values[4]], values[5]))
+	}
+	sort.Strings(declared)
+	if got, want := strings.Join(declared, "\n"), "Counter in fib.lox at line 6\nclock in fib.lox at line 0\nfib in fib.lox at line 1\nscript in fib.lox at line 0"; got != want {
+		t.Errorf("got the functions\n%v\nwant\n%v", got, want)
+	}
+	places := make(map[uint64]string)
+	for _, location := range locations {
+		fields := readProto(t, location)
+		line := protoValues(readProto(t, fields[1].data))
+		places[fields[0].value] = fmt.Sprintf("%v:%v", names[line[1]], line[2])
+	}
+
+	var stacks []string
+	nanos := uint64(0)
+	for _, sample := range samples {
+		fields := readProto(t, sample)
+		ids, values := readPacked(fields[0].data), readPacked(fields[1].data)
+		var stack []string
+		for j := len(ids) - 1; j >= 0; j-- {
+			stack = append(stack, places[ids[j]])
+		}
+		if values[0] > 0 {
+			stacks = append(stacks, fmt.Sprintf("%v %v", strings.Join(stack, " "), values[0]))
+		}
+		nanos += values[1]
+	}
+	sort.Strings(stacks)
+	want := []string{
+		"script:1 1",
+		"script:5 1",
+		"script:8 1",
+		"script:8 Counter:6 1",
+		"script:9 1",
+		// fib(3), then the fib(1) and fib(2) it calls. A call that
+		// returns n runs two statements on line 2.
+		"script:9 fib:2 1",
+		"script:9 fib:3 1",
+		"script:9 fib:3 fib:2 3",
+		"script:9 fib:3 fib:3 1",
+		"script:9 fib:3 fib:3 fib:2 4",
+		"script:10 1",
+	}
+	sort.Strings(want)
+	if got := strings.Join(stacks, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("wrong stacks: got\n%v\nwant\n%v", got, strings.Join(want, "\n"))
+	}
+	if nanos == 0 {
+		t.Errorf("no time was charged to anything")
+	}
+}
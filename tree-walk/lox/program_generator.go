@@ -0,0 +1,743 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// A programGenerator writes random Lox programs for "jlox difftest" to run on
+// each implementation: variables, blocks, ifs and loops, functions and
+// closures, and classes with fields, methods, inheritance and super.
+//
+// The programs are valid (they scan, parse and resolve without errors), and
+// they always finish: loops only count up to a small number, with a counter
+// nothing else assigns, and a function or method can only call the ones
+// declared before it, or (for methods) the ones that come before it in a way
+// that rules out endless recursion. Lox has no types, but the generator keeps
+// track of what kind of value each expression gives, so that a program
+// usually runs to the end instead of stopping at its first runtime error.
+// Some programs end on purpose with a statement that's a runtime error, to
+// compare how the implementations report it.
+
+type genKind int
+
+const (
+	GK_NUMBER genKind = iota
+	GK_STRING
+	GK_BOOLEAN
+	GK_FUNCTION
+	GK_CLASS
+	GK_INSTANCE
+)
+
+// genType is what kind of value an expression gives. A function takes arity
+// numbers and returns what returns says, and a call to it makes about cost
+// calls in all. A class's value is the class itself, and an instance's is its
+// class.
+type genType struct {
+	kind    genKind
+	arity   int
+	returns *genType
+	cost    int
+	class   *genClass
+}
+
+var (
+	genNumber  = &genType{kind: GK_NUMBER}
+	genString  = &genType{kind: GK_STRING}
+	genBoolean = &genType{kind: GK_BOOLEAN}
+)
+
+type genClass struct {
+	name       string
+	superclass *genClass
+	// init is the type of the class itself, as a function that makes an
+	// instance.
+	init    *genType
+	fields  []string
+	methods []genMethod
+}
+
+// A genMethod's rank is the order methods were first declared in, across all
+// classes. A method can only call the methods on this (or super) that rank
+// below it, or the one it overrides, so no call can lead back to itself.
+type genMethod struct {
+	name string
+	rank int
+	// function always returns a number.
+	function *genType
+}
+
+// allFields are the fields the class's init sets, including inherited ones.
+func (c *genClass) allFields() []string {
+	if c.superclass == nil {
+		return c.fields
+	}
+	return append(c.superclass.allFields(), c.fields...)
+}
+
+// allMethods are the class's methods, including inherited ones that it
+// doesn't override.
+func (c *genClass) allMethods() []genMethod {
+	if c.superclass == nil {
+		return c.methods
+	}
+	var methods []genMethod
+	for _, inherited := range c.superclass.allMethods() {
+		if _, ok := c.findOwnMethod(inherited.name); !ok {
+			methods = append(methods, inherited)
+		}
+	}
+	return append(methods, c.methods...)
+}
+
+func (c *genClass) findOwnMethod(name string) (genMethod, bool) {
+	for _, method := range c.methods {
+		if method.name == name {
+			return method, true
+		}
+	}
+	return genMethod{}, false
+}
+
+type genVariable struct {
+	name string
+	t    *genType
+	// assignable is false for loop counters (so that loops end) and for
+	// anything that isn't a number, string or Boolean (so that nothing
+	// can be made to call itself).
+	assignable bool
+}
+
+// genFunction is what the generator knows about the function it's writing
+// (or the script, at the top level).
+type genFunction struct {
+	// cost is roughly how many calls the function makes so far, and
+	// maxCost how many it can make in all.
+	cost, maxCost int
+	// loops is how many times the statement being written runs each time
+	// the function is called.
+	loops int
+	// returnsNumber is whether the function returns a number, and so can
+	// return early.
+	returnsNumber bool
+	// class is the class of the method being written, if it's a method,
+	// with rank its rank and fields the fields it can read; init can only
+	// read the ones it's already set.
+	class  *genClass
+	rank   int
+	fields []string
+	isInit bool
+}
+
+const (
+	maxGenDepth           = 3
+	maxGenExpressionDepth = 3
+	maxGenFunctionCost    = 200
+	maxGenScriptCost      = 20000
+)
+
+type programGenerator struct {
+	rand     *rand.Rand
+	b        strings.Builder
+	indent   int
+	depth    int
+	scopes   [][]genVariable
+	function *genFunction
+	// names is how many names the generator has made up, so that each one
+	// is new.
+	names int
+}
+
+func newProgramGenerator(seed uint64) *programGenerator {
+	return &programGenerator{
+		rand:     rand.New(rand.NewPCG(seed, seed)),
+		scopes:   [][]genVariable{{}},
+		function: &genFunction{maxCost: maxGenScriptCost, loops: 1},
+	}
+}
+
+// generateProgram writes the random program for seed.
+func generateProgram(seed uint64) string {
+	g := newProgramGenerator(seed)
+	for range 5 + g.rand.IntN(15) {
+		g.declaration()
+	}
+	if g.rand.IntN(5) == 0 {
+		g.runtimeError()
+	}
+	return g.b.String()
+}
+
+func (g *programGenerator) line(format string, a ...any) {
+	g.b.WriteString(strings.Repeat("  ", g.indent))
+	fmt.Fprintf(&g.b, format, a...)
+	g.b.WriteString("\n")
+}
+
+func (g *programGenerator) fresh(prefix string) string {
+	g.names++
+	return fmt.Sprintf("%v%v", prefix, g.names)
+}
+
+func (g *programGenerator) chance(n int) bool {
+	return g.rand.IntN(n) == 0
+}
+
+func (g *programGenerator) declare(name string, t *genType, assignable bool) {
+	scope := &g.scopes[len(g.scopes)-1]
+	*scope = append(*scope, genVariable{name, t, assignable})
+}
+
+// variables are the variables in scope that match.
+func (g *programGenerator) variables(match func(genVariable) bool) []genVariable {
+	var matching []genVariable
+	for _, scope := range g.scopes {
+		for _, variable := range scope {
+			if match(variable) {
+				matching = append(matching, variable)
+			}
+		}
+	}
+	return matching
+}
+
+func (g *programGenerator) variablesOfKind(kind genKind) []genVariable {
+	return g.variables(func(v genVariable) bool { return v.t.kind == kind })
+}
+
+func pick[T any](g *programGenerator, choices []T) T {
+	return choices[g.rand.IntN(len(choices))]
+}
+
+// afford adds the cost of calling a function with cost to the function being
+// written, if it can afford it.
+func (g *programGenerator) afford(cost int) bool {
+	if !g.canAfford(cost) {
+		return false
+	}
+	g.function.cost += cost * g.function.loops
+	return true
+}
+
+func (g *programGenerator) canAfford(cost int) bool {
+	return g.function.cost+cost*g.function.loops <= g.function.maxCost
+}
+
+func (g *programGenerator) declaration() {
+	switch n := g.rand.IntN(12); {
+	case n < 3:
+		g.varDeclaration()
+	case n < 5 && g.depth < maxGenDepth-1:
+		g.funDeclaration(g.chance(3))
+	case n < 6 && g.depth == 0:
+		g.classDeclaration()
+	default:
+		g.statement()
+	}
+}
+
+func (g *programGenerator) varDeclaration() {
+	name := g.fresh("v")
+	value, t := g.value()
+	g.line("var %v = %v;", name, value)
+	g.declare(name, t, t.kind == GK_NUMBER || t.kind == GK_STRING || t.kind == GK_BOOLEAN)
+}
+
+// block writes the statements of a block (or a loop's body, with last as its
+// last statement) in a scope of its own.
+func (g *programGenerator) block(last string) {
+	g.indent++
+	g.depth++
+	g.scopes = append(g.scopes, nil)
+	for range 1 + g.rand.IntN(3) {
+		g.declaration()
+	}
+	if last != "" {
+		g.line("%v", last)
+	}
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.depth--
+	g.indent--
+}
+
+func (g *programGenerator) statement() {
+	switch n := g.rand.IntN(12); {
+	case n < 4 || g.depth >= maxGenDepth:
+		g.line("print %v;", g.anyValue())
+	case n < 6:
+		g.line("%v;", g.sideEffect())
+	case n < 8:
+		g.line("if (%v) {", g.boolean(0))
+		g.block("")
+		if g.chance(2) {
+			g.line("} else {")
+			g.block("")
+		}
+		g.line("}")
+	case n < 9:
+		g.line("{")
+		g.block("")
+		g.line("}")
+	case n < 11:
+		g.loop()
+	default:
+		if g.function.returnsNumber {
+			g.line("if (%v) return %v;", g.boolean(0), g.number(0))
+		} else {
+			g.line("print %v;", g.anyValue())
+		}
+	}
+}
+
+// loop writes a for or while loop that runs a few times.
+func (g *programGenerator) loop() {
+	counter := g.fresh("i")
+	times := 1 + g.rand.IntN(3)
+	g.function.loops *= times
+	if g.chance(2) {
+		g.line("for (var %v = 0; %v < %v; %v = %v + 1) {", counter, counter, times, counter, counter)
+		g.scopes = append(g.scopes, []genVariable{{counter, genNumber, false}})
+		g.block("")
+		g.scopes = g.scopes[:len(g.scopes)-1]
+	} else {
+		g.line("var %v = 0;", counter)
+		g.declare(counter, genNumber, false)
+		g.line("while (%v < %v) {", counter, times)
+		g.block(fmt.Sprintf("%v = %v + 1;", counter, counter))
+	}
+	g.line("}")
+	g.function.loops /= times
+}
+
+// sideEffect is an expression that's worth using as a statement: an
+// assignment or a call.
+func (g *programGenerator) sideEffect() string {
+	if g.chance(2) {
+		if assignment, ok := g.assignment(0); ok {
+			return assignment
+		}
+	}
+	if call, _, ok := g.call(0, false); ok {
+		return call
+	}
+	return g.anyValue()
+}
+
+// assignment assigns to a variable or a field, if there's one to assign.
+func (g *programGenerator) assignment(depth int) (string, bool) {
+	var targets []string
+	var types []*genType
+	for _, variable := range g.variables(func(v genVariable) bool { return v.assignable }) {
+		targets = append(targets, variable.name)
+		types = append(types, variable.t)
+	}
+	for _, instance := range g.variablesOfKind(GK_INSTANCE) {
+		for _, field := range instance.t.class.allFields() {
+			targets = append(targets, instance.name+"."+field)
+			types = append(types, genNumber)
+		}
+	}
+	if g.function.class != nil && !g.function.isInit {
+		for _, field := range g.function.fields {
+			targets = append(targets, "this."+field)
+			types = append(types, genNumber)
+		}
+	}
+	if len(targets) == 0 {
+		return "", false
+	}
+	i := g.rand.IntN(len(targets))
+	return fmt.Sprintf("%v = %v", targets[i], g.expression(types[i], depth+1)), true
+}
+
+// funDeclaration writes a function that returns a number, or, if closure, a
+// function declared inside it.
+func (g *programGenerator) funDeclaration(closure bool) genVariable {
+	name := g.fresh("f")
+	params := g.params()
+	g.line("fun %v(%v) {", name, strings.Join(params, ", "))
+	t := g.functionBody(params, closure, &genFunction{})
+	g.line("}")
+	g.declare(name, t, false)
+	return genVariable{name, t, false}
+}
+
+func (g *programGenerator) params() []string {
+	params := make([]string, g.rand.IntN(3))
+	for i := range params {
+		params[i] = g.fresh("p")
+	}
+	return params
+}
+
+// functionBody writes the body of a function (or method) with params, and
+// says what type of function it is.
+func (g *programGenerator) functionBody(params []string, closure bool, function *genFunction) *genType {
+	function.maxCost = maxGenFunctionCost
+	function.loops = 1
+	function.returnsNumber = !closure && !function.isInit
+	enclosing := g.function
+	g.function = function
+	g.indent++
+	g.depth++
+	scope := make([]genVariable, len(params))
+	for i, param := range params {
+		scope[i] = genVariable{param, genNumber, true}
+	}
+	g.scopes = append(g.scopes, scope)
+
+	if function.isInit {
+		g.initBody(params)
+	} else {
+		for range 1 + g.rand.IntN(3) {
+			g.declaration()
+		}
+	}
+	returns := genNumber
+	if closure {
+		inner := g.funDeclaration(false)
+		g.line("return %v;", inner.name)
+		returns = inner.t
+	} else if !function.isInit {
+		g.line("return %v;", g.number(0))
+	}
+
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.depth--
+	g.indent--
+	g.function = enclosing
+	return &genType{kind: GK_FUNCTION, arity: len(params), returns: returns, cost: 1 + function.cost}
+}
+
+// initBody writes an init method's body: a call to the superclass's init, if
+// there is one, then the class's own fields.
+func (g *programGenerator) initBody(params []string) {
+	class := g.function.class
+	if class.superclass != nil {
+		init := class.superclass.init
+		g.afford(init.cost)
+		g.line("super.init(%v);", g.arguments(init.arity, 0))
+		g.function.fields = class.superclass.allFields()
+	}
+	for range 1 + g.rand.IntN(2) {
+		field := g.fresh("x")
+		g.line("this.%v = %v;", field, g.number(0))
+		class.fields = append(class.fields, field)
+		g.function.fields = append(g.function.fields, field)
+	}
+}
+
+func (g *programGenerator) classDeclaration() {
+	class := &genClass{name: g.fresh("C")}
+	if superclasses := g.variablesOfKind(GK_CLASS); len(superclasses) > 0 && g.chance(2) {
+		class.superclass = pick(g, superclasses).t.class
+		g.line("class %v < %v {", class.name, class.superclass.name)
+	} else {
+		g.line("class %v {", class.name)
+	}
+	g.indent++
+
+	params := g.params()
+	g.line("init(%v) {", strings.Join(params, ", "))
+	class.init = g.functionBody(params, false, &genFunction{class: class, isInit: true})
+	class.init.kind = GK_CLASS
+	class.init.class = class
+	g.line("}")
+
+	for range g.rand.IntN(4) {
+		var method genMethod
+		var inherited []genMethod
+		if class.superclass != nil {
+			for _, m := range class.superclass.allMethods() {
+				if _, overridden := class.findOwnMethod(m.name); !overridden {
+					inherited = append(inherited, m)
+				}
+			}
+		}
+		if len(inherited) > 0 && g.chance(3) {
+			// Override one, with the same number of parameters.
+			overridden := pick(g, inherited)
+			method.name, method.rank = overridden.name, overridden.rank
+			params = make([]string, overridden.function.arity)
+			for i := range params {
+				params[i] = g.fresh("p")
+			}
+		} else {
+			method.name = g.fresh("m")
+			method.rank = g.names
+			params = g.params()
+		}
+		g.line("%v(%v) {", method.name, strings.Join(params, ", "))
+		method.function = g.functionBody(params, false, &genFunction{class: class, rank: method.rank, fields: class.allFields()})
+		g.line("}")
+		class.methods = append(class.methods, method)
+	}
+
+	g.indent--
+	g.line("}")
+	g.declare(class.name, class.init, false)
+}
+
+// anyValue is an expression of any type, for printing.
+func (g *programGenerator) anyValue() string {
+	if g.chance(10) {
+		return "nil"
+	}
+	value, _ := g.value()
+	return value
+}
+
+// value is an expression of any type other than nil: usually a number, string
+// or Boolean, but sometimes a function, class or instance.
+func (g *programGenerator) value() (string, *genType) {
+	switch n := g.rand.IntN(10); {
+	case n < 4:
+		return g.number(0), genNumber
+	case n < 6:
+		return g.string(0), genString
+	case n < 7:
+		return g.boolean(0), genBoolean
+	case n < 8:
+		if classes := g.variablesOfKind(GK_CLASS); len(classes) > 0 {
+			class := pick(g, classes)
+			if g.chance(4) {
+				return class.name, class.t
+			}
+			if g.afford(class.t.cost) {
+				return fmt.Sprintf("%v(%v)", class.name, g.arguments(class.t.arity, 1)),
+					&genType{kind: GK_INSTANCE, class: class.t.class}
+			}
+		}
+	case n < 9:
+		if callee, t, ok := g.callee(1, false); ok {
+			return callee, t
+		}
+	}
+	return g.number(0), genNumber
+}
+
+func (g *programGenerator) expression(t *genType, depth int) string {
+	switch t.kind {
+	case GK_STRING:
+		return g.string(depth)
+	case GK_BOOLEAN:
+		return g.boolean(depth)
+	default:
+		return g.number(depth)
+	}
+}
+
+func (g *programGenerator) number(depth int) string {
+	if depth >= maxGenExpressionDepth {
+		if numbers := g.variablesOfKind(GK_NUMBER); len(numbers) > 0 && g.chance(2) {
+			return pick(g, numbers).name
+		}
+		return g.numberLiteral()
+	}
+	switch n := g.rand.IntN(14); {
+	case n < 2:
+		return g.numberLiteral()
+	case n < 5:
+		if numbers := g.variablesOfKind(GK_NUMBER); len(numbers) > 0 {
+			return pick(g, numbers).name
+		}
+	case n < 6:
+		return "-" + g.number(depth+1)
+	case n < 9:
+		operator := pick(g, []string{"+", "-", "*", "/"})
+		return fmt.Sprintf("(%v %v %v)", g.number(depth+1), operator, g.number(depth+1))
+	case n < 11:
+		if call, _, ok := g.call(depth, true); ok {
+			return call
+		}
+	case n < 12:
+		if field, ok := g.field(); ok {
+			return field
+		}
+	case n < 13:
+		if assignment, ok := g.numberAssignment(depth); ok {
+			return assignment
+		}
+	default:
+		return fmt.Sprintf("(%v or %v)", pick(g, []string{"nil", "false"}), g.number(depth+1))
+	}
+	return g.numberLiteral()
+}
+
+func (g *programGenerator) numberLiteral() string {
+	if g.chance(4) {
+		return fmt.Sprintf("%v.%v", g.rand.IntN(10), 1+g.rand.IntN(99))
+	}
+	return fmt.Sprint(g.rand.IntN(20))
+}
+
+func (g *programGenerator) numberAssignment(depth int) (string, bool) {
+	numbers := g.variables(func(v genVariable) bool { return v.assignable && v.t.kind == GK_NUMBER })
+	if len(numbers) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("(%v = %v)", pick(g, numbers).name, g.number(depth+1)), true
+}
+
+// field reads a field of an instance, or of this in a method.
+func (g *programGenerator) field() (string, bool) {
+	var fields []string
+	for _, instance := range g.variablesOfKind(GK_INSTANCE) {
+		for _, field := range instance.t.class.allFields() {
+			fields = append(fields, instance.name+"."+field)
+		}
+	}
+	if g.function.class != nil {
+		for _, field := range g.function.fields {
+			fields = append(fields, "this."+field)
+		}
+	}
+	if len(fields) == 0 {
+		return "", false
+	}
+	return pick(g, fields), true
+}
+
+var genWords = []string{"a", "b", "lox", "jam", "scone", "cream", " ", ""}
+
+// string is a string expression. Strings are only ever added to literals, so
+// that a loop can't double a string's length each time around.
+func (g *programGenerator) string(depth int) string {
+	texts := g.variablesOfKind(GK_STRING)
+	switch n := g.rand.IntN(6); {
+	case n < 2 || depth >= maxGenExpressionDepth:
+		return fmt.Sprintf("%q", pick(g, genWords))
+	case n < 4 && len(texts) > 0:
+		return pick(g, texts).name
+	default:
+		return fmt.Sprintf("(%v + %q)", g.string(depth+1), pick(g, genWords))
+	}
+}
+
+func (g *programGenerator) boolean(depth int) string {
+	if depth >= maxGenExpressionDepth {
+		return pick(g, []string{"true", "false"})
+	}
+	switch n := g.rand.IntN(10); {
+	case n < 1:
+		return pick(g, []string{"true", "false"})
+	case n < 2:
+		if booleans := g.variablesOfKind(GK_BOOLEAN); len(booleans) > 0 {
+			return pick(g, booleans).name
+		}
+	case n < 5:
+		operator := pick(g, []string{"<", "<=", ">", ">=", "==", "!="})
+		return fmt.Sprintf("(%v %v %v)", g.number(depth+1), operator, g.number(depth+1))
+	case n < 6:
+		operator := pick(g, []string{"==", "!="})
+		return fmt.Sprintf("(%v %v %v)", g.string(depth+1), operator, g.string(depth+1))
+	case n < 7:
+		return "!" + g.boolean(depth+1)
+	default:
+		operator := pick(g, []string{"and", "or"})
+		return fmt.Sprintf("(%v %v %v)", g.boolean(depth+1), operator, g.boolean(depth+1))
+	}
+	return pick(g, []string{"true", "false"})
+}
+
+func (g *programGenerator) arguments(arity int, depth int) string {
+	arguments := make([]string, arity)
+	for i := range arguments {
+		arguments[i] = g.number(depth + 1)
+	}
+	return strings.Join(arguments, ", ")
+}
+
+// callee is an expression whose value is a function (one that returns a
+// number, if wantNumber): a function, a method of an instance, of this or of
+// super, or a call to a function that returns a closure.
+func (g *programGenerator) callee(depth int, wantNumber bool) (string, *genType, bool) {
+	type candidate struct {
+		t     *genType
+		write func() string
+	}
+	var candidates []candidate
+	add := func(t *genType, write func() string) {
+		if !wantNumber || t.returns == genNumber {
+			candidates = append(candidates, candidate{t, write})
+		}
+	}
+	named := func(name string) func() string {
+		return func() string { return name }
+	}
+	for _, function := range g.variablesOfKind(GK_FUNCTION) {
+		add(function.t, named(function.name))
+		if closure := function.t.returns; closure.kind == GK_FUNCTION && g.canAfford(function.t.cost) {
+			add(closure, func() string {
+				g.afford(function.t.cost)
+				return fmt.Sprintf("%v(%v)", function.name, g.arguments(function.t.arity, depth))
+			})
+		}
+	}
+	for _, instance := range g.variablesOfKind(GK_INSTANCE) {
+		for _, method := range instance.t.class.allMethods() {
+			add(method.function, named(instance.name+"."+method.name))
+		}
+	}
+	if class := g.function.class; class != nil && !g.function.isInit {
+		for _, method := range class.allMethods() {
+			if method.rank < g.function.rank {
+				add(method.function, named("this."+method.name))
+			}
+		}
+		if class.superclass != nil {
+			for _, method := range class.superclass.allMethods() {
+				if method.rank <= g.function.rank {
+					add(method.function, named("super."+method.name))
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil, false
+	}
+	chosen := pick(g, candidates)
+	return chosen.write(), chosen.t, true
+}
+
+// call calls a function (one that returns a number, if wantNumber), if
+// there's one that the function being written can afford to call.
+func (g *programGenerator) call(depth int, wantNumber bool) (string, *genType, bool) {
+	callee, t, ok := g.callee(depth+1, wantNumber)
+	if !ok || !g.afford(t.cost) {
+		return "", nil, false
+	}
+	return fmt.Sprintf("%v(%v)", callee, g.arguments(t.arity, depth)), t.returns, true
+}
+
+// runtimeError writes a statement that's a runtime error, sometimes inside a
+// function so that it happens in a call.
+func (g *programGenerator) runtimeError() {
+	statements := []string{
+		fmt.Sprintf("print -%q;", pick(g, genWords)),
+		fmt.Sprintf("print %v + %q;", g.numberLiteral(), pick(g, genWords)),
+		fmt.Sprintf("print nil < %v;", g.numberLiteral()),
+		fmt.Sprintf("print (%v).x;", g.numberLiteral()),
+		"nope();",
+		fmt.Sprintf("%v();", g.numberLiteral()),
+	}
+	if functions := g.variablesOfKind(GK_FUNCTION); len(functions) > 0 {
+		function := pick(g, functions)
+		statements = append(statements, fmt.Sprintf("%v(%v);", function.name, g.arguments(function.t.arity+1, maxGenExpressionDepth)))
+	}
+	if instances := g.variablesOfKind(GK_INSTANCE); len(instances) > 0 {
+		statements = append(statements, fmt.Sprintf("print %v.nope;", pick(g, instances).name))
+	}
+	statement := pick(g, statements)
+	if g.chance(2) {
+		name := g.fresh("fail")
+		g.line("fun %v() {", name)
+		g.line("  %v", statement)
+		g.line("}")
+		g.line("%v();", name)
+	} else {
+		g.line("%v", statement)
+	}
+}
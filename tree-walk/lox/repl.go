@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const replHelp = `Type Lox code to run it. It can go over several lines, as long as there
+are brackets or a string left open. The value of an expression statement is
+printed, and an expression on its own doesn't need its semicolon.
+Commands:
+  :load FILE  run FILE here, so that what it defines can be used
+  :env        list the global variables
+  :ast CODE   show the syntax tree of CODE without running it
+  :reset      forget everything that's been defined
+  :help       show this
+  :quit       leave (or press Ctrl-D)`
+
+// runPrompt is the REPL. The input is kept in the global interpreter, so
+// that what's defined on one line can be used on the next.
+func runPrompt() {
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".jlox_history")
+	}
+	reader := newLineReader(os.Stdin, os.Stdout, historyPath)
+
+	for {
+		source, err := readInput(reader)
+		if err == errInterrupted {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+			} else if reader.fd < 0 {
+				// Finish the line with the prompt on it.
+				fmt.Println()
+			}
+			return
+		}
+
+		if quit := replInput(source); quit {
+			return
+		}
+	}
+}
+
+// replInput handles one input at the prompt, code or command, and returns
+// whether it was the command to quit.
+func replInput(source string) bool {
+	if strings.HasPrefix(strings.TrimSpace(source), ":") {
+		return replCommand(strings.TrimSpace(source))
+	}
+	if statements, ok := parseInput(source); ok {
+		runInput(statements, true)
+	}
+	hadError = false
+	hadRuntimeError = false
+	return false
+}
+
+// readInput reads lines until it has something that looks complete: with
+// no brackets or strings left open.
+func readInput(reader *lineReader) (string, error) {
+	source, err := reader.readLine("> ")
+	if err != nil {
+		return "", err
+	}
+	for needsMore(source) {
+		line, err := reader.readLine("... ")
+		if err == io.EOF {
+			// Let the parser complain about whatever's missing.
+			return source, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		source += "\n" + line
+	}
+	return source, nil
+}
+
+// needsMore is whether source has brackets or a string that haven't been
+// closed yet.
+func needsMore(source string) bool {
+	scanner := NewScanner(source)
+	scanner.reportError = func(int, string) {}
+	depth := 0
+	for _, token := range scanner.ScanTokens() {
+		switch token.tokenType {
+		case LEFT_PAREN, LEFT_BRACE:
+			depth++
+		case RIGHT_PAREN, RIGHT_BRACE:
+			depth--
+		case ERROR:
+			if token.literal == "Unterminated string." {
+				return true
+			}
+		}
+	}
+	return depth > 0
+}
+
+// parseInput parses what was typed at the prompt, reporting any syntax
+// errors. If it doesn't parse as it is but would with a semicolon at the
+// end, as with a bare expression, the semicolon is added.
+func parseInput(source string) ([]Stmt, bool) {
+	for _, candidate := range []string{source, source + ";"} {
+		failed := false
+		scanner := NewScanner(candidate)
+		scanner.reportError = func(int, string) { failed = true }
+		parser := NewParser(scanner.ScanTokens())
+		parser.reportError = func(Token, string) { failed = true }
+		statements := parser.parse()
+		if !failed {
+			return statements, true
+		}
+	}
+	// Parse it again to report the errors in the usual way.
+	NewParser(NewScanner(source).ScanTokens()).parse()
+	return nil, false
+}
+
+// runInput resolves and runs statements in the global interpreter. If echo
+// is true, the value of each expression statement is printed, apart from
+// assignments, which are there for their effect.
+func runInput(statements []Stmt, echo bool) {
+	NewResolver().resolveStatements(statements)
+	if hadError {
+		return
+	}
+	for _, stmt := range statements {
+		var err error
+		if expression, ok := stmt.(*Expression); ok && echo && echoes(expression.expression) {
+			var value any
+			if value, err = interpreter.evaluate(expression.expression); err == nil {
+				fmt.Fprintln(interpreter.stdout, describe(value))
+			}
+		} else {
+			_, err = interpreter.execute(stmt)
+		}
+		if err != nil {
+			if rte, ok := err.(RuntimeError); ok {
+				runtimeError(rte)
+			}
+			return
+		}
+	}
+}
+
+func echoes(expr Expr) bool {
+	switch expr.(type) {
+	case *Assign, *Set:
+		return false
+	}
+	return true
+}
+
+// replCommand runs one of the REPL's own commands, and returns whether it
+// was the one to quit.
+func replCommand(line string) bool {
+	command, argument, _ := strings.Cut(line, " ")
+	argument = strings.TrimSpace(argument)
+	switch command {
+	case ":load":
+		source, err := os.ReadFile(argument)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		statements := NewParser(NewScanner(string(source)).ScanTokens()).parse()
+		if !hadError {
+			runInput(statements, false)
+		}
+		hadError = false
+		hadRuntimeError = false
+	case ":env":
+		for _, v := range valuesVariables(interpreter.globals.values) {
+			fmt.Fprintf(interpreter.stdout, "%v = %v\n", v.name, describe(v.value))
+		}
+	case ":ast":
+		if statements, ok := parseInput(argument); ok {
+			fmt.Fprint(interpreter.stdout, printTree(statements))
+		}
+		hadError = false
+	case ":reset":
+		limit, stdout := interpreter.memory.limit, interpreter.stdout
+		interpreter = NewInterpreter()
+		interpreter.memory.limit, interpreter.stdout = limit, stdout
+	case ":help":
+		fmt.Fprintln(interpreter.stdout, replHelp)
+	case ":quit":
+		return true
+	default:
+		fmt.Fprintf(interpreter.stdout, "Unknown command %q. Type :help for a list.\n", command)
+	}
+	return false
+}
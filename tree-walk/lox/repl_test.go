@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNeedsMore(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		want   bool
+	}{
+		{"print 1;", false},
+		{"1 + 2", false},
+		{"fun f() {", true},
+		{"fun f() {\n  print 1;\n}", false},
+		{"print (1 +", true},
+		{"print (1 +\n2);", false},
+		{"class A {\n  m() {", true},
+		{"class A {\n  m() {\n  }", true},
+		{`print "abc`, true},
+		{"print \"abc\ndef\";", false},
+		{`print "{";`, false},
+		{"// {", false},
+		// Too many closing brackets is the parser's problem.
+		{"}", false},
+	} {
+		if got := needsMore(test.source); got != test.want {
+			t.Errorf("needsMore(%q) = %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestParseInput(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		// tree is the syntax tree, or "" if the input doesn't parse.
+		tree string
+	}{
+		{"print 1;", "Print\n  Literal 1\n"},
+		{"1 + 2", "Expression\n  Binary +\n    Literal 1\n    Literal 2\n"},
+		{"var a = 1", "Var a\n  Literal 1\n"},
+		{"a = 2;", "Expression\n  Assign a\n    Literal 2\n"},
+		{"{ print 1; }", "Block\n  Print\n    Literal 1\n"},
+		{"print 1; 2", "Print\n  Literal 1\nExpression\n  Literal 2\n"},
+		{"print", ""},
+		{"1 +", ""},
+		{"var = 1", ""},
+	} {
+		statements, ok := parseInput(test.source)
+		hadError = false
+		got := ""
+		if ok {
+			got = printTree(statements)
+		}
+		if got != test.tree {
+			t.Errorf("parseInput(%q) gave\n%vwant\n%v", test.source, got, test.tree)
+		}
+	}
+}
+
+// TestREPL runs inputs at the prompt, one after another in the same
+// interpreter, and checks what each one prints.
+func TestREPL(t *testing.T) {
+	saved := interpreter
+	t.Cleanup(func() { interpreter = saved })
+	interpreter = NewInterpreter()
+	interpreter.memory.limit = 100_000
+	var output strings.Builder
+	interpreter.stdout = &output
+
+	library := filepath.Join(t.TempDir(), "library.lox")
+	if err := os.WriteFile(library, []byte("fun double(n) { return n * 2; }\nprint \"loaded\";\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		input, want string
+	}{
+		{"var a = 1", ""},
+		{"a", "1\n"},
+		{"a = 2", ""},
+		{"a + 1;", "3\n"},
+		{`"a" + "b"`, "\"ab\"\n"},
+		{"class Point {}", ""},
+		{"var p = Point()", ""},
+		{"p.x = 5", ""},
+		{"p.x", "5\n"},
+		{"p", "Point instance\n"},
+		{"print a; a", "2\n2\n"},
+		{"fun f() {\n  return a * 10;\n}", ""},
+		{"f()", "20\n"},
+		{":load " + library, "loaded\n"},
+		{"double(a)", "4\n"},
+		{":env", "Point = Point\na = 2\nclock = <native fn>\ndouble = <fn double >\nf = <fn f >\np = Point instance\n"},
+		{":ast a + 1", "Expression\n  Binary +\n    Variable a\n    Literal 1\n"},
+		{":nope", "Unknown command \":nope\". Type :help for a list.\n"},
+		{":reset", ""},
+		{":env", "clock = <native fn>\n"},
+		{"var b = 3", ""},
+		{"b", "3\n"},
+	} {
+		output.Reset()
+		if quit := replInput(test.input); quit {
+			t.Fatalf("%q quit", test.input)
+		}
+		if got := output.String(); got != test.want {
+			t.Errorf("%q printed %q, want %q", test.input, got, test.want)
+		}
+	}
+	if interpreter.memory.limit != 100_000 {
+		t.Errorf(":reset changed the memory limit to %v", interpreter.memory.limit)
+	}
+	if !replInput(":quit") {
+		t.Errorf(":quit didn't quit")
+	}
+}
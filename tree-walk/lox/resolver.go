@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"slices"
+)
+
 type FunctionType int
 
 const (
@@ -17,22 +22,124 @@ const (
 	CT_SUBCLASS
 )
 
+type DeclarationKind int
+
+const (
+	DK_VARIABLE DeclarationKind = iota
+	DK_PARAMETER
+	DK_FUNCTION
+	DK_CLASS
+	DK_METHOD
+	DK_THIS
+	DK_SUPER
+)
+
+func (k DeclarationKind) String() string {
+	switch k {
+	case DK_VARIABLE:
+		return "variable"
+	case DK_PARAMETER:
+		return "parameter"
+	case DK_FUNCTION:
+		return "function"
+	case DK_CLASS:
+		return "class"
+	case DK_METHOD:
+		return "method"
+	case DK_THIS:
+		return "this"
+	case DK_SUPER:
+		return "super"
+	default:
+		panic(fmt.Sprintf("Unreachable. The DeclarationKind has value %d, and we don't handle that case.", int(k)))
+	}
+}
+
+// Declaration is something that a name can refer to. The interpreter only
+// needs to know how many scopes away each variable is, but the resolver
+// keeps track of the declarations themselves (and of which one each
+// reference resolved to) for the sake of tools like the language server.
+type Declaration struct {
+	name Token
+	kind DeclarationKind
+	// node is the statement that made the declaration: a Var, Function or
+	// Class, or for a parameter, the Function it belongs to. For "this"
+	// and "super" it's the Class they're in, and name is the class's name.
+	node Stmt
+	// global is whether it was declared outside of any scope.
+	global  bool
+	defined bool
+	// index is a local's slot in its scope's environment: how many
+	// variables were declared in the scope before it.
+	index int
+}
+
+// Reference is a use of a name, and the declaration it refers to. The
+// declaration is nil for globals, since a global can be used (in a function
+// body) before it's declared, so we only know which one it is once the whole
+// program has been resolved. Use Resolver.declarationOf to find it.
+type Reference struct {
+	token       Token
+	declaration *Declaration
+	// expr is the Variable, Assign, This or Super that token is from.
+	expr Expr
+}
+
 type Resolver struct {
-	interpreter     *Interpreter
-	scopes          []map[string]bool
+	scopes          []map[string]*Declaration
 	currentFunction FunctionType
 	currentClass    ClassType
-}
 
-func NewResolver(interpreter *Interpreter) *Resolver {
+	// reportError is called for each error found. It's logParseError
+	// unless someone (like the language server) wants the errors for
+	// themselves.
+	reportError func(token Token, message string)
+
+	// declarations are all the declarations in the program, in the order
+	// they were resolved, and references are all the uses of names.
+	declarations []*Declaration
+	references   []Reference
+	// globals are the global declarations by name. If a global is
+	// declared more than once, the first declaration is the one we keep.
+	globals map[string]*Declaration
+	// captures are the local variables that each function uses from the
+	// functions around it, in the order it first uses them.
+	captures map[*Function][]*Declaration
+	// functions are the functions being resolved, innermost last, with
+	// the index in scopes of each one's scope.
+	functions []resolverFunction
+}
+
+type resolverFunction struct {
+	function *Function
+	scope    int
+	// made is the index in scopes of the scope whose environment the
+	// function is made in. That's the one around its own, except for a
+	// method, whose "this" scope has no environment: a method gets this
+	// when it's called instead.
+	made int
+}
+
+func NewResolver() *Resolver {
 	return &Resolver{
-		interpreter:     interpreter,
 		scopes:          nil,
 		currentFunction: FT_NONE,
 		currentClass:    CT_NONE,
+		reportError:     logParseError,
+		globals:         make(map[string]*Declaration),
+		captures:        make(map[*Function][]*Declaration),
 	}
 }
 
+// declarationOf finds the declaration that reference refers to, or nil for
+// a global that's never declared (like the native functions).
+func (r *Resolver) declarationOf(reference Reference) *Declaration {
+	if reference.declaration != nil {
+		return reference.declaration
+	}
+	return r.globals[reference.token.lexeme]
+}
+
 func (r *Resolver) resolveStatements(statements []Stmt) {
 	for _, statement := range statements {
 		r.resolveStmt(statement)
@@ -59,6 +166,8 @@ func (r *Resolver) resolveStmt(stmt Stmt) {
 		r.resolveReturnStmt(v)
 	case *While:
 		r.resolveWhileStmt(v)
+	case *ErrorStmt:
+		// Nothing to resolve; the parser has already reported it.
 	default:
 		panic("Unreachable.")
 	}
@@ -102,16 +211,25 @@ func (r *Resolver) resolveSetExpr(expr *Set) {
 
 func (r *Resolver) resolveSuperExpr(expr *Super) {
 	if r.currentClass == CT_NONE {
-		logParseError(expr.keyword, "Can't use 'super' outside of a class.")
+		r.reportError(expr.keyword, "Can't use 'super' outside of a class.")
 	} else if r.currentClass != CT_SUBCLASS {
-		logParseError(expr.keyword, "Can't use 'super' in a class with no superclass.")
+		r.reportError(expr.keyword, "Can't use 'super' in a class with no superclass.")
 	}
 	r.resolveLocal(expr, expr.keyword)
+
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if declaration, ok := r.scopes[i]["this"]; ok {
+			r.capture(declaration, i)
+			this := r.slotOf(declaration, i)
+			expr.this = &this
+			return
+		}
+	}
 }
 
 func (r *Resolver) resolveThisExpr(expr *This) {
 	if r.currentClass == CT_NONE {
-		logParseError(expr.keyword, "Can't use 'this' outside of a class.")
+		r.reportError(expr.keyword, "Can't use 'this' outside of a class.")
 		return
 	}
 	r.resolveLocal(expr, expr.keyword)
@@ -124,20 +242,20 @@ func (r *Resolver) resolveGetExpr(expr *Get) {
 func (r *Resolver) resolveBlockStmt(stmt *Block) {
 	r.beginScope()
 	r.resolveStatements(stmt.statements)
-	r.endScope()
+	stmt.slots = r.endScope()
 }
 
 func (r *Resolver) resolveClassStmt(stmt *Class) {
 	enclosingClass := r.currentClass
 	r.currentClass = CT_CLASS
 
-	r.declare(stmt.name)
+	r.declare(stmt.name, DK_CLASS, stmt)
 	r.define(stmt.name)
 
 	if stmt.superclass != nil && stmt.name.lexeme == stmt.superclass.name.lexeme {
 		// Why do we detect just a simple cycle like this? Why not more
 		// complicated cycles?
-		logParseError(stmt.superclass.name, "A class can't inherit from itself.")
+		r.reportError(stmt.superclass.name, "A class can't inherit from itself.")
 	}
 
 	if stmt.superclass != nil {
@@ -147,13 +265,17 @@ func (r *Resolver) resolveClassStmt(stmt *Class) {
 
 	if stmt.superclass != nil {
 		r.beginScope()
-		r.scopes[len(r.scopes)-1]["super"] = true
+		r.scopes[len(r.scopes)-1]["super"] = &Declaration{stmt.name, DK_SUPER, stmt, false, true, 0}
 	}
 
 	r.beginScope()
-	r.scopes[len(r.scopes)-1]["this"] = true
+	r.scopes[len(r.scopes)-1]["this"] = &Declaration{stmt.name, DK_THIS, stmt, false, true, 0}
 
 	for _, method := range stmt.methods {
+		// Methods aren't variables, so they don't go in any scope, but
+		// tools still want to know about them.
+		r.declarations = append(r.declarations, &Declaration{method.name, DK_METHOD, method, false, true, 0})
+
 		var declaration FunctionType = FT_METHOD
 		if method.name.lexeme == "init" {
 			declaration = FT_INITIALIZER
@@ -171,14 +293,14 @@ func (r *Resolver) resolveClassStmt(stmt *Class) {
 }
 
 func (r *Resolver) resolveFunctionStmt(stmt *Function) {
-	r.declare(stmt.name)
+	r.declare(stmt.name, DK_FUNCTION, stmt)
 	r.define(stmt.name)
 
 	r.resolveFunction(stmt, FT_FUNCTION)
 }
 
 func (r *Resolver) resolveVarStmt(stmt *Var) {
-	r.declare(stmt.name)
+	r.declare(stmt.name, DK_VARIABLE, stmt)
 	if stmt.initializer != nil {
 		r.resolveExpr(stmt.initializer)
 	}
@@ -193,8 +315,8 @@ func (r *Resolver) resolveAssignExpr(expr *Assign) {
 func (r *Resolver) resolveVariableExpr(expr *Variable) {
 	if len(r.scopes) > 0 {
 		v, ok := r.scopes[len(r.scopes)-1][expr.name.lexeme]
-		if ok && !v {
-			logParseError(expr.name, "Can't read local variable in its own initializer.")
+		if ok && !v.defined {
+			r.reportError(expr.name, "Can't read local variable in its own initializer.")
 		}
 	}
 
@@ -202,52 +324,126 @@ func (r *Resolver) resolveVariableExpr(expr *Variable) {
 }
 
 func (r *Resolver) beginScope() {
-	r.scopes = append(r.scopes, make(map[string]bool))
+	r.scopes = append(r.scopes, make(map[string]*Declaration))
 }
 
-func (r *Resolver) endScope() {
+// endScope ends the innermost scope, and returns the names of the slots in
+// its environment.
+func (r *Resolver) endScope() []string {
+	scope := r.scopes[len(r.scopes)-1]
 	r.scopes = r.scopes[:len(r.scopes)-1]
+	// A name declared twice (which is an error) replaces the first
+	// declaration in scope, so there can be fewer names than slots.
+	var names []string
+	for name, declaration := range scope {
+		if declaration.index >= len(names) {
+			names = append(names, make([]string, declaration.index+1-len(names))...)
+		}
+		names[declaration.index] = name
+	}
+	return names
 }
 
-func (r *Resolver) declare(name Token) {
+func (r *Resolver) declare(name Token, kind DeclarationKind, node Stmt) {
+	declaration := &Declaration{name, kind, node, len(r.scopes) == 0, false, 0}
+	r.declarations = append(r.declarations, declaration)
+
 	if len(r.scopes) == 0 {
+		if _, ok := r.globals[name.lexeme]; !ok {
+			r.globals[name.lexeme] = declaration
+		}
 		return
 	}
 
 	scope := r.scopes[len(r.scopes)-1]
+	declaration.index = len(scope)
 	if _, ok := scope[name.lexeme]; ok {
-		logParseError(name, "Already a variable with this name in this scope")
+		r.reportError(name, "Already a variable with this name in this scope")
 	}
-	scope[name.lexeme] = false
+	scope[name.lexeme] = declaration
 }
 
 func (r *Resolver) define(name Token) {
 	if len(r.scopes) == 0 {
 		return
 	}
-	r.scopes[len(r.scopes)-1][name.lexeme] = true
+	r.scopes[len(r.scopes)-1][name.lexeme].defined = true
 }
 
 func (r *Resolver) resolveLocal(expr Expr, name Token) {
 	for i := len(r.scopes) - 1; i >= 0; i-- {
-		if _, ok := r.scopes[i][name.lexeme]; ok {
-			r.resolve(expr, len(r.scopes)-1-i)
+		if declaration, ok := r.scopes[i][name.lexeme]; ok {
+			r.capture(declaration, i)
+			r.resolve(expr, r.slotOf(declaration, i))
+			r.references = append(r.references, Reference{name, declaration, expr})
 			return
 		}
 	}
+	r.references = append(r.references, Reference{name, nil, expr})
+}
+
+// slotOf is where the code being resolved finds declaration, from the scope at
+// index scope: in one of the current function's environments, or if it's from
+// outside the function, among the upvalues of the function's call.
+func (r *Resolver) slotOf(declaration *Declaration, scope int) localSlot {
+	if len(r.functions) > 0 {
+		function := r.functions[len(r.functions)-1]
+		if scope < function.scope {
+			upvalue := slices.Index(r.captures[function.function], declaration)
+			return localSlot{len(r.scopes) - 1 - function.scope, upvalue, true}
+		}
+	}
+	return localSlot{len(r.scopes) - 1 - scope, declaration.index, false}
+}
+
+// capture records that declaration, from the scope at index scope, is
+// captured by the functions being resolved whose scopes are inside that one,
+// and where each of them gets it from: the outermost from the environment
+// it's made in, and the others from the upvalues of the one around them.
+func (r *Resolver) capture(declaration *Declaration, scope int) {
+	first := len(r.functions)
+	for first > 0 && r.functions[first-1].scope > scope {
+		first--
+	}
+	for j := first; j < len(r.functions); j++ {
+		function := r.functions[j]
+		if slices.Contains(r.captures[function.function], declaration) {
+			continue
+		}
+		r.captures[function.function] = append(r.captures[function.function], declaration)
+
+		var source upvalueSource
+		if j > first {
+			enclosing := r.functions[j-1]
+			upvalue := slices.Index(r.captures[enclosing.function], declaration)
+			source.from = localSlot{function.made - enclosing.scope, upvalue, true}
+		} else if declaration.kind == DK_THIS {
+			source.isThis = true
+		} else {
+			source.from = localSlot{function.made - scope, declaration.index, false}
+		}
+		function.function.upvalues = append(function.function.upvalues, source)
+	}
 }
 
 func (r *Resolver) resolveFunction(function *Function, ft FunctionType) {
 	enclosingFunction := r.currentFunction
 	r.currentFunction = ft
 
+	made := len(r.scopes) - 1
+	if ft == FT_METHOD || ft == FT_INITIALIZER {
+		made--
+	}
 	r.beginScope()
+	r.functions = append(r.functions, resolverFunction{function, len(r.scopes) - 1, made})
+	function.upvalues = nil
 	for _, param := range function.params {
-		r.declare(param)
+		r.declare(param, DK_PARAMETER, function)
 		r.define(param)
 	}
 	r.resolveStatements(function.body)
-	r.endScope()
+	r.functions = r.functions[:len(r.functions)-1]
+	function.slots = r.endScope()
 	r.currentFunction = enclosingFunction
 }
 
@@ -269,12 +465,12 @@ func (r *Resolver) resolvePrintStmt(stmt *Print) {
 
 func (r *Resolver) resolveReturnStmt(stmt *Return) {
 	if r.currentFunction == FT_NONE {
-		logParseError(stmt.keyword, "Can't return from top-level code")
+		r.reportError(stmt.keyword, "Can't return from top-level code")
 	}
 
 	if stmt.value != nil {
 		if r.currentFunction == FT_INITIALIZER {
-			logParseError(stmt.keyword, "Can't return a value from an initializer.")
+			r.reportError(stmt.keyword, "Can't return a value from an initializer.")
 		}
 
 		r.resolveExpr(stmt.value)
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// "jlox resolve" shows what the resolver decided about a program: the syntax
+// tree (as "jlox ast -format tree" prints it), with each Variable, Assign,
+// This and Super annotated with how many scopes away its variable is and its
+// slot in that scope (or its upvalue in the function's call there, or that
+// it's global) and the declaration it refers to, and each function with the
+// variables it captures from the functions around it:
+//
+//	Function count() [captures: variable i at 2:7]
+//	  Return
+//	    Variable i [depth 0, upvalue 0: variable i at 2:7]
+//
+// With -json it prints the same as a list of references and a list of
+// functions instead, which is easier to check in a test.
+
+func resolveCommand(args []string) {
+	flags := flag.NewFlagSet("resolve", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the references and captures as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox resolve [flags] file.lox")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	bytes, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(66)
+	}
+	statements := NewParser(NewScanner(string(bytes)).ScanTokens()).parse()
+	interpreter := NewInterpreter()
+	resolver := NewResolver()
+	resolver.resolveStatements(statements)
+
+	if *asJSON {
+		output, err := json.MarshalIndent(resolutionToJSON(resolver), "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(70)
+		}
+		fmt.Println(string(output))
+	} else {
+		fmt.Print(printAnnotatedTree(statements, resolutionNotes(resolver, interpreter.globals)))
+	}
+
+	if hadError {
+		os.Exit(65)
+	}
+}
+
+// resolutionNotes are the notes for printAnnotatedTree that say what the
+// resolver decided. natives are the globals the program starts out with.
+func resolutionNotes(r *Resolver, natives *Environment) map[any]string {
+	notes := make(map[any]string)
+	for _, reference := range r.references {
+		declaration := describeDeclaration(r.declarationOf(reference))
+		if _, ok := natives.values[reference.token.lexeme]; ok && r.declarationOf(reference) == nil {
+			declaration = "native"
+		}
+		if local := localOf(reference.expr); local != nil && local.upvalue {
+			notes[reference.expr] = fmt.Sprintf(" [depth %v, upvalue %v: %v]", local.depth, local.index, declaration)
+		} else if local != nil {
+			notes[reference.expr] = fmt.Sprintf(" [depth %v, slot %v: %v]", local.depth, local.index, declaration)
+		} else {
+			notes[reference.expr] = fmt.Sprintf(" [global: %v]", declaration)
+		}
+	}
+	for function, captures := range r.captures {
+		described := make([]string, len(captures))
+		for i, capture := range captures {
+			described[i] = describeDeclaration(capture)
+		}
+		notes[function] = fmt.Sprintf(" [captures: %v]", strings.Join(described, ", "))
+	}
+	return notes
+}
+
+// localOf is where the resolver found the variable that expr (a Variable,
+// Assign, This or Super) refers to, or nil for a global.
+func localOf(expr Expr) *localSlot {
+	switch v := expr.(type) {
+	case *Assign:
+		return v.local
+	case *Super:
+		return v.local
+	case *This:
+		return v.local
+	case *Variable:
+		return v.local
+	default:
+		return nil
+	}
+}
+
+// describeDeclaration says what a declaration is and where, as in "variable
+// i at 2:7", or for this and super, which class they belong to.
+func describeDeclaration(d *Declaration) string {
+	if d == nil {
+		return "not declared"
+	}
+	if d.kind == DK_THIS || d.kind == DK_SUPER {
+		return fmt.Sprintf("%v of class %v at %v:%v", d.kind, d.name.lexeme, d.name.line, d.name.column)
+	}
+	return fmt.Sprintf("%v %v at %v:%v", d.kind, d.name.lexeme, d.name.line, d.name.column)
+}
+
+// resolutionToJSON is the JSON form of what the resolver decided:
+//
+//	{"references": [{"name": "i", "line": 4, "column": 12, "global": false,
+//	                 "depth": 0, "slot": null, "upvalue": 0,
+//	                 "declaration": {"kind": "variable", ...}}],
+//	 "functions": [{"name": "count", "line": 3, "column": 7,
+//	                "captures": [{"kind": "variable", "name": "i", ...}]}]}
+//
+// The references are in the order they appear. A global's depth, slot and
+// upvalue are null, and so is the declaration of a global that's never
+// declared (like a native function). A local has a slot or an upvalue, and
+// the other is null. The functions include methods, in the order they appear
+// too.
+func resolutionToJSON(r *Resolver) jsonObject {
+	inOrder := slices.Clone(r.references)
+	slices.SortStableFunc(inOrder, func(a, b Reference) int {
+		return a.token.offset - b.token.offset
+	})
+	references := []any{}
+	for _, reference := range inOrder {
+		var depth, slot, upvalue any
+		global := true
+		if local := localOf(reference.expr); local != nil {
+			depth = local.depth
+			if local.upvalue {
+				upvalue = local.index
+			} else {
+				slot = local.index
+			}
+			global = false
+		}
+		references = append(references, jsonObject{
+			{"name", reference.token.lexeme},
+			{"line", reference.token.line},
+			{"column", reference.token.column},
+			{"global", global},
+			{"depth", depth},
+			{"slot", slot},
+			{"upvalue", upvalue},
+			{"declaration", declarationToJSON(r.declarationOf(reference))},
+		})
+	}
+
+	functions := []any{}
+	for _, declaration := range r.declarations {
+		if declaration.kind != DK_FUNCTION && declaration.kind != DK_METHOD {
+			continue
+		}
+		function := declaration.node.(*Function)
+		captures := []any{}
+		for _, capture := range r.captures[function] {
+			captures = append(captures, declarationToJSON(capture))
+		}
+		functions = append(functions, jsonObject{
+			{"name", function.name.lexeme},
+			{"line", function.name.line},
+			{"column", function.name.column},
+			{"captures", captures},
+		})
+	}
+
+	return jsonObject{{"references", references}, {"functions", functions}}
+}
+
+func declarationToJSON(d *Declaration) any {
+	if d == nil {
+		return nil
+	}
+	return jsonObject{
+		{"kind", d.kind.String()},
+		{"name", d.name.lexeme},
+		{"line", d.name.line},
+		{"column", d.name.column},
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"strconv"
 )
 
@@ -11,6 +10,17 @@ type Scanner struct {
 	start   int
 	current int
 	line    int
+	// lineStart is the offset of the first byte of the current line, and
+	// column is the column the current token started at.
+	lineStart int
+	column    int
+	// triviaStart is where the trivia for the next token starts, which is
+	// just after the end of the last token.
+	triviaStart int
+	// reportError is called for each error, which also gets an ERROR
+	// token in tokens. It's logError unless the caller wants the errors
+	// for itself, or only wants the tokens.
+	reportError func(line int, message string)
 }
 
 var keywords = map[string]TokenType{
@@ -36,16 +46,19 @@ func NewScanner(source string) *Scanner {
 	scanner := &Scanner{}
 	scanner.source = source
 	scanner.line = 1
+	scanner.reportError = logError
 	return scanner
 }
 
 func (s *Scanner) ScanTokens() []Token {
 	for !s.isAtEnd() {
 		s.start = s.current
+		s.column = s.start - s.lineStart + 1
 		s.scanToken()
 	}
 
-	s.tokens = append(s.tokens, Token{EOF, "", nil, s.line})
+	trivia := s.source[s.triviaStart:]
+	s.tokens = append(s.tokens, Token{EOF, "", nil, s.line, s.current - s.lineStart + 1, s.current, trivia})
 	return s.tokens
 }
 
@@ -65,7 +78,16 @@ func (s *Scanner) addSimpleToken(tokenType TokenType) {
 
 func (s *Scanner) addToken(tokenType TokenType, literal any) {
 	text := s.source[s.start:s.current]
-	s.tokens = append(s.tokens, Token{tokenType, text, literal, s.line})
+	trivia := s.source[s.triviaStart:s.start]
+	s.tokens = append(s.tokens, Token{tokenType, text, literal, s.line, s.column, s.start, trivia})
+	s.triviaStart = s.current
+}
+
+// addErrorToken reports an error about the current lexeme and adds an ERROR
+// token for it. The scanner then carries on from after the lexeme.
+func (s *Scanner) addErrorToken(message string) {
+	s.reportError(s.line, message)
+	s.addToken(ERROR, message)
 }
 
 func (s *Scanner) scanToken() {
@@ -117,7 +139,8 @@ func (s *Scanner) scanToken() {
 		}
 	case '/':
 		if s.match('/') {
-			// A comment goes until the end of the line
+			// A comment goes until the end of the line. Like whitespace,
+			// it ends up in the trivia of the next token.
 			for s.peek() != '\n' && !s.isAtEnd() {
 				s.advance()
 			}
@@ -132,6 +155,7 @@ func (s *Scanner) scanToken() {
 		// do nothing
 	case '\n':
 		s.line++
+		s.lineStart = s.current
 	case '"':
 		s.scanString()
 	default:
@@ -140,7 +164,7 @@ func (s *Scanner) scanToken() {
 		} else if isAlpha(c) {
 			s.scanIdentifier()
 		} else {
-			logError(s.line, "Unexpected character.")
+			s.addErrorToken("Unexpected character.")
 		}
 	}
 }
@@ -158,10 +182,11 @@ func (s *Scanner) scanNumber() {
 		}
 	}
 
-	f, err := strconv.ParseFloat(s.source[s.start:s.current], 64)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// The only error ParseFloat can give for digits with an optional
+	// fraction is that the number is too big for a float64. Java's
+	// Double.parseDouble (and so the book) just makes it infinity, which
+	// is what ParseFloat hands back along with the error.
+	f, _ := strconv.ParseFloat(s.source[s.start:s.current], 64)
 	s.addToken(NUMBER, f)
 }
 
@@ -169,12 +194,13 @@ func (s *Scanner) scanString() {
 	for s.peek() != '"' && !s.isAtEnd() {
 		if s.peek() == '\n' {
 			s.line++
+			s.lineStart = s.current + 1
 		}
 		s.advance()
 	}
 
 	if s.isAtEnd() {
-		logError(s.line, "Unterminated string.")
+		s.addErrorToken("Unterminated string.")
 		return
 	}
 
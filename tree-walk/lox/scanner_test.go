@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzScanTokens checks that the scanner never panics, that it always ends
+// with an EOF token, that each token's offset points at its lexeme, and that
+// the tokens and their trivia put back together give the source.
+func FuzzScanTokens(f *testing.F) {
+	paths, err := filepath.Glob("testdata/conformance/scanning/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	examples, err := filepath.Glob("../examples/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range append(paths, examples...) {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(source))
+	}
+	for _, source := range []string{
+		"",
+		"\"",
+		"/",
+		"//",
+		"1.",
+		".1",
+		"\x00\xff",
+		"var π = 3.14;",
+		"\"a\nb\nc",
+	} {
+		f.Add(source)
+	}
+
+	f.Fuzz(func(t *testing.T, source string) {
+		scanner := NewScanner(source)
+		reported := 0
+		scanner.reportError = func(int, string) { reported++ }
+		tokens := scanner.ScanTokens()
+		if len(tokens) == 0 || tokens[len(tokens)-1].tokenType != EOF {
+			t.Fatalf("the tokens for %q don't end with EOF", source)
+		}
+
+		var rebuilt strings.Builder
+		errors := 0
+		for i, token := range tokens {
+			if token.tokenType == EOF && i != len(tokens)-1 {
+				t.Fatalf("EOF in the middle of the tokens for %q", source)
+			}
+			if token.tokenType == ERROR {
+				errors++
+			}
+			end := token.offset + len(token.lexeme)
+			if token.offset < 0 || end > len(source) || source[token.offset:end] != token.lexeme {
+				t.Fatalf("token %v has the wrong offset %v in %q", token, token.offset, source)
+			}
+			rebuilt.WriteString(token.trivia)
+			rebuilt.WriteString(token.lexeme)
+		}
+		if rebuilt.String() != source {
+			t.Fatalf("the tokens give back\n%q\ninstead of\n%q", rebuilt.String(), source)
+		}
+		if errors != reported {
+			t.Fatalf("%v ERROR tokens but %v errors reported for %q", errors, reported, source)
+		}
+	})
+}
@@ -6,6 +6,9 @@ type Stmt interface {
 
 type Block struct {
 	statements []Stmt
+	// slots are the names of the slots in the block's environment, which
+	// the resolver works out.
+	slots []string
 }
 
 type Class struct {
@@ -14,6 +17,12 @@ type Class struct {
 	methods    []*Function
 }
 
+// ErrorStmt stands in for a declaration that had a syntax error. tokens are
+// the tokens the parser skipped over while recovering from it.
+type ErrorStmt struct {
+	tokens []Token
+}
+
 type Expression struct {
 	expression Expr
 }
@@ -22,6 +31,13 @@ type Function struct {
 	name   Token
 	params []Token
 	body   []Stmt
+	// slots are the names of the slots in a call's environment: the
+	// parameters, then what the body declares. The resolver works them out.
+	slots []string
+	// upvalues are where the resolver found the variables the function
+	// uses from around it, for when it's made, in the order of its
+	// upvalues.
+	upvalues []upvalueSource
 }
 
 type If struct {
@@ -51,6 +67,7 @@ type While struct {
 
 func (b *Block) sealStmt()      {}
 func (c *Class) sealStmt()      {}
+func (e *ErrorStmt) sealStmt()  {}
 func (e *Expression) sealStmt() {}
 func (f *Function) sealStmt()   {}
 func (i *If) sealStmt()         {}
@@ -62,6 +79,7 @@ func (w *While) sealStmt()      {}
 // Assert that we've implemented the interface
 var _ Stmt = &Block{}
 var _ Stmt = &Class{}
+var _ Stmt = &ErrorStmt{}
 var _ Stmt = &Expression{}
 var _ Stmt = &Function{}
 var _ Stmt = &If{}
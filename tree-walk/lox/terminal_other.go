@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Line editing is only supported on Linux, so elsewhere the REPL reads plain
+// lines, as if its input weren't a terminal.
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("line editing isn't supported on this system")
+}
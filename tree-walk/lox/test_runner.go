@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jlox/lox/vm"
+)
+
+// "jlox test" runs Lox test files, which say what they should do in comments,
+// in the style of the book's test suite:
+//
+//	print 1 + 2; // expect: 3
+//	print nope;  // expect runtime error: Undefined variable "nope".
+//	super.x;     // Error at 'super': Can't use 'super' outside of a class.
+//
+// Each "expect:" is a line the program should print, in order. A runtime
+// error is expected on the line its comment is on, and so is a syntax or
+// resolution error, unless the comment gives another line, as in
+// "// [line 3] Error at end: Expect ';' after value.".
+//
+// Tests can also call assert and assertEqual, which fail with a runtime error
+// unless their condition holds.
+
+var (
+	expectOutput       = regexp.MustCompile(`// expect: ?(.*)`)
+	expectRuntimeError = regexp.MustCompile(`// expect runtime error: (.+)`)
+	expectSyntaxError  = regexp.MustCompile(`// (Error.*)`)
+	expectErrorAtLine  = regexp.MustCompile(`// \[line (\d+)\] (Error.*)`)
+	assertionCall      = regexp.MustCompile(`\bassert(Equal)?\s*\(`)
+)
+
+type testExpectations struct {
+	output []string
+	// errors are the syntax and resolution errors, formatted as they're
+	// reported.
+	errors []string
+	// runtimeError is the message of the runtime error, or "" if there
+	// shouldn't be one, and runtimeErrorLine is its line.
+	runtimeError     string
+	runtimeErrorLine int
+}
+
+type testResult struct {
+	path     string
+	duration time.Duration
+	// failures says what went wrong, with nothing in it if the test
+	// passed.
+	failures []string
+}
+
+func parseExpectations(source string) testExpectations {
+	var e testExpectations
+	for i, line := range strings.Split(source, "\n") {
+		number := i + 1
+		if m := expectOutput.FindStringSubmatch(line); m != nil {
+			e.output = append(e.output, m[1])
+		} else if m := expectRuntimeError.FindStringSubmatch(line); m != nil {
+			e.runtimeError, e.runtimeErrorLine = m[1], number
+		} else if m := expectErrorAtLine.FindStringSubmatch(line); m != nil {
+			e.errors = append(e.errors, fmt.Sprintf("[line %v] %v", m[1], m[2]))
+		} else if m := expectSyntaxError.FindStringSubmatch(line); m != nil {
+			e.errors = append(e.errors, fmt.Sprintf("[line %v] %v", number, m[1]))
+		}
+	}
+	return e
+}
+
+// isTestFile is whether a file found in a directory is a test: whether it's a
+// Lox file that has expectations in it or calls assert or assertEqual.
+func isTestFile(path string) bool {
+	if filepath.Ext(path) != ".lox" {
+		return false
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		// Include it, so that the error gets reported.
+		return true
+	}
+	return bytes.Contains(source, []byte("// expect")) ||
+		bytes.Contains(source, []byte("// Error")) ||
+		bytes.Contains(source, []byte("// [line ")) ||
+		assertionCall.Match(source)
+}
+
+// isolatedRun is what a program did when it was run by runIsolated.
+type isolatedRun struct {
+	output string
+	// errors are the syntax and resolution errors, formatted as they'd
+	// be reported.
+	errors       []string
+	runtimeError *RuntimeError
+}
+
+// runIsolated runs source on engine in an interpreter (or VM) of its own,
+// collecting everything it prints and everything that would normally be
+// reported, so that it can run at the same time as other programs. natives are
+// added to the globals.
+func runIsolated(source string, engine string, natives map[string]*LoxNativeFunction) isolatedRun {
+	var run isolatedRun
+	scanner := NewScanner(source)
+	scanner.reportError = func(line int, message string) {
+		run.errors = append(run.errors, fmt.Sprintf("[line %v] Error: %v", line, message))
+	}
+	reportError := func(token Token, message string) {
+		if token.tokenType == EOF {
+			run.errors = append(run.errors, fmt.Sprintf("[line %v] Error at end: %v", token.line, message))
+		} else {
+			run.errors = append(run.errors, fmt.Sprintf("[line %v] Error at '%v': %v", token.line, token.lexeme, message))
+		}
+	}
+	parser := NewParser(scanner.ScanTokens())
+	parser.reportError = reportError
+	statements := parser.parse()
+
+	interpreter := NewInterpreter()
+	var output bytes.Buffer
+	interpreter.stdout = &output
+	for name, native := range natives {
+		interpreter.globals.define(name, native)
+	}
+	if len(run.errors) == 0 {
+		resolver := NewResolver()
+		resolver.reportError = reportError
+		resolver.resolveStatements(statements)
+	}
+	if len(run.errors) == 0 && engine == engineVM {
+		compiler := NewCompiler()
+		compiler.reportError = reportError
+		function := compiler.compile(statements)
+		if len(run.errors) == 0 {
+			machine := vm.New()
+			machine.Stdout = &output
+			for name, native := range natives {
+				machine.Define(name, native.forVM())
+			}
+			if err := machine.Interpret(function); err != nil {
+				rte := vmRuntimeError(err)
+				run.runtimeError = &rte
+			}
+		}
+	} else if len(run.errors) == 0 {
+		for _, stmt := range statements {
+			if _, err := interpreter.execute(stmt); err != nil {
+				// Runtime errors are the only errors that
+				// execute returns.
+				rte := err.(RuntimeError)
+				run.runtimeError = &rte
+				break
+			}
+		}
+	}
+	run.output = output.String()
+	return run
+}
+
+// runTest runs the test at path on engine in an interpreter of its own, and
+// checks what it did against what it expected.
+func runTest(path string, engine string) testResult {
+	start := time.Now()
+	result := testResult{path: path}
+	defer func() { result.duration = time.Since(start) }()
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		result.failures = append(result.failures, err.Error())
+		return result
+	}
+	expected := parseExpectations(string(source))
+	run := runIsolated(string(source), engine, assertions)
+	runtimeError := run.runtimeError
+
+	if diff := diffLines(expected.errors, run.errors); diff != "" {
+		result.failures = append(result.failures, "Wrong syntax errors (- expected, + got):\n"+diff)
+	}
+	switch {
+	case runtimeError == nil && expected.runtimeError != "":
+		result.failures = append(result.failures, fmt.Sprintf(
+			"Expected the runtime error %q on line %v, but there wasn't one.",
+			expected.runtimeError, expected.runtimeErrorLine))
+	case runtimeError != nil && expected.runtimeError == "":
+		result.failures = append(result.failures, fmt.Sprintf("Unexpected runtime error: %v", runtimeError.Error()))
+	case runtimeError != nil && (runtimeError.message != expected.runtimeError || runtimeError.token.line != expected.runtimeErrorLine):
+		result.failures = append(result.failures, fmt.Sprintf(
+			"Expected the runtime error %q on line %v, but got %q on line %v.",
+			expected.runtimeError, expected.runtimeErrorLine, runtimeError.message, runtimeError.token.line))
+	}
+	var got []string
+	if run.output != "" {
+		got = strings.Split(strings.TrimSuffix(run.output, "\n"), "\n")
+	}
+	if diff := diffLines(expected.output, got); diff != "" {
+		result.failures = append(result.failures, "Wrong output (- expected, + got):\n"+diff)
+	}
+	return result
+}
+
+// assertions are the natives that tests can use: assert(condition), which
+// fails unless condition is truthy, and assertEqual(actual, expected), which
+// fails unless they're equal.
+var assertions = map[string]*LoxNativeFunction{
+	"assert": {
+		arity: 1,
+		fn: func(interpreter *Interpreter, arguments []any) (any, error) {
+			if !isTruthy(arguments[0]) {
+				return nil, errors.New("Assertion failed.")
+			}
+			return nil, nil
+		},
+		name: "<native fn>",
+	},
+	"assertEqual": {
+		arity: 2,
+		fn: func(interpreter *Interpreter, arguments []any) (any, error) {
+			if !isEqual(arguments[0], arguments[1]) {
+				return nil, fmt.Errorf("Expected %v but got %v.", describe(arguments[1]), describe(arguments[0]))
+			}
+			return nil, nil
+		},
+		name: "<native fn>",
+	},
+}
+
+// diffLines shows how got differs from expected, a line at a time, or
+// returns "" if they're the same.
+func diffLines(expected []string, got []string) string {
+	// lengths[i][j] is the length of the longest common subsequence of
+	// expected[i:] and got[j:].
+	lengths := make([][]int, len(expected)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(got)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if expected[i] == got[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	var diff strings.Builder
+	changed := false
+	i, j := 0, 0
+	for i < len(expected) || j < len(got) {
+		switch {
+		case i < len(expected) && j < len(got) && expected[i] == got[j]:
+			fmt.Fprintf(&diff, "  %v\n", expected[i])
+			i++
+			j++
+		case i < len(expected) && (j == len(got) || lengths[i+1][j] >= lengths[i][j+1]):
+			fmt.Fprintf(&diff, "- %v\n", expected[i])
+			changed = true
+			i++
+		default:
+			fmt.Fprintf(&diff, "+ %v\n", got[j])
+			changed = true
+			j++
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return diff.String()
+}
+
+// testCommand implements "jlox test".
+func testCommand(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: jlox test [flags] [path ...]")
+		fmt.Fprintln(flags.Output(), "Runs the tests in each path, or in the current directory. In a")
+		fmt.Fprintln(flags.Output(), "directory, a test is a .lox file with expectation comments or")
+		fmt.Fprintln(flags.Output(), "assertions in it.")
+		flags.PrintDefaults()
+	}
+	verbose := flags.Bool("v", false, "list the tests that pass too")
+	parallel := flags.Int("j", runtime.NumCPU(), "run this many tests at a time")
+	junit := flags.String("junit", "", "also write the results as JUnit XML to `file`")
+	engine := flags.String("engine", engineTreeWalk, "run the tests on this `engine`: tree-walk or vm")
+	flags.Parse(args)
+	if *parallel < 1 || !isEngine(*engine) {
+		flags.Usage()
+		os.Exit(64)
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var tests []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(66)
+		}
+		if !info.IsDir() {
+			tests = append(tests, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && isTestFile(path) {
+				tests = append(tests, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(66)
+		}
+	}
+	sort.Strings(tests)
+
+	start := time.Now()
+	results := make([]testResult, len(tests))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range *parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = runTest(tests[i], *engine)
+			}
+		}()
+	}
+	for i := range tests {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	failed := 0
+	for _, result := range results {
+		if len(result.failures) > 0 {
+			failed++
+			fmt.Printf("FAIL %v\n", result.path)
+			for _, failure := range result.failures {
+				fmt.Println(indent(failure, "    "))
+			}
+		} else if *verbose {
+			fmt.Printf("PASS %v\n", result.path)
+		}
+	}
+	fmt.Printf("%v passed, %v failed (%.2fs)\n", len(results)-failed, failed, elapsed.Seconds())
+
+	if *junit != "" {
+		if err := writeJUnit(*junit, results, elapsed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(74)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func indent(text string, prefix string) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	return prefix + strings.Join(lines, "\n"+prefix)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the results to path in the JUnit XML format that CI
+// systems understand, with one test case for each file.
+func writeJUnit(path string, results []testResult, elapsed time.Duration) error {
+	suite := junitTestSuite{Name: "jlox", Tests: len(results), Time: seconds(elapsed)}
+	for _, result := range results {
+		c := junitTestCase{
+			Name:      result.path,
+			ClassName: strings.TrimSuffix(filepath.ToSlash(result.path), ".lox"),
+			Time:      seconds(result.duration),
+		}
+		if len(result.failures) > 0 {
+			suite.Failures++
+			c.Failure = &junitFailure{
+				Message: strings.SplitN(result.failures[0], "\n", 2)[0],
+				Text:    strings.Join(result.failures, "\n"),
+			}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0o644)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
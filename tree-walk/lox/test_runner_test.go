@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunTest runs Lox tests that pass and tests that fail in each of the
+// ways a test can, on both engines, and checks what "jlox test" would say
+// about each of them.
+func TestRunTest(t *testing.T) {
+	for _, test := range []struct {
+		name, source string
+		// failures are what's wrong with the test, or nothing if it
+		// passes.
+		failures []string
+	}{
+		{"output", `
+print 1 + 2; // expect: 3
+print "";    // expect:
+print nil;   // expect: nil`, nil},
+		{"wrong output", `
+print 1; // expect: 1
+print 2; // expect: 3
+print 4; // expect: 4`, []string{
+			"Wrong output (- expected, + got):\n  1\n- 3\n+ 2\n  4\n",
+		}},
+		{"missing output", `
+print 1; // expect: 1
+// expect: 2`, []string{
+			"Wrong output (- expected, + got):\n  1\n- 2\n",
+		}},
+		{"assertions", `
+assert(true);
+assertEqual(1 + 1, 2);
+assertEqual("a" + "b", "ab");
+print "done"; // expect: done`, nil},
+		{"failed assert", `
+print "before"; // expect: before
+assert(1 > 2);
+print "after";`, []string{
+			"Unexpected runtime error: [line 3] Assertion failed.",
+		}},
+		{"failed assertEqual", `
+assertEqual(1 + 2, "3");`, []string{
+			"Unexpected runtime error: [line 2] Expected \"3\" but got 3.",
+		}},
+		{"runtime error", `
+print "before"; // expect: before
+print nope; // expect runtime error: Undefined variable "nope".
+print "after";`, nil},
+		{"runtime error on another line", `
+print nope;
+// expect runtime error: Undefined variable "nope".`, []string{
+			"Expected the runtime error \"Undefined variable \\\"nope\\\".\" on line 3, but got \"Undefined variable \\\"nope\\\".\" on line 2.",
+		}},
+		{"wrong runtime error", `
+"a"(); // expect runtime error: Undefined variable "a".`, []string{
+			"Expected the runtime error \"Undefined variable \\\"a\\\".\" on line 2, but got \"Can only call functions and classes.\" on line 2.",
+		}},
+		{"no runtime error", `
+print 1; // expect runtime error: Operand must be a number.`, []string{
+			"Expected the runtime error \"Operand must be a number.\" on line 2, but there wasn't one.",
+			"Wrong output (- expected, + got):\n+ 1\n",
+		}},
+		{"syntax errors", `
+print 1 +; // Error at ';': Expect expression.
+var = 2;   // Error at '=': Expect variable name.
+print 3` + "\n// [line 5] Error at end: Expect ';' after value.", nil},
+		{"resolution error", `
+return 1; // Error at 'return': Can't return from top-level code`, nil},
+		{"unexpected syntax error", `
+print 1 +;
+print 2; // expect: 2`, []string{
+			"Wrong syntax errors (- expected, + got):\n+ [line 2] Error at ';': Expect expression.\n",
+			"Wrong output (- expected, + got):\n- 2\n",
+		}},
+		{"missing syntax error", `
+print 1; // expect: 1
+// Error at end: Expect expression.`, []string{
+			"Wrong syntax errors (- expected, + got):\n- [line 3] Error at end: Expect expression.\n",
+		}},
+	} {
+		path := filepath.Join(t.TempDir(), "test.lox")
+		if err := os.WriteFile(path, []byte(test.source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, engine := range []string{engineTreeWalk, engineVM} {
+			result := runTest(path, engine)
+			got := strings.Join(result.failures, "\n---\n")
+			if want := strings.Join(test.failures, "\n---\n"); got != want {
+				t.Errorf("%v on the %v engine: got the failures\n%v\nwant\n%v", test.name, engine, got, want)
+			}
+		}
+	}
+}
+
+func TestIsTestFile(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		want   bool
+	}{
+		{"print 1; // expect: 1", true},
+		{"print nope; // expect runtime error: Undefined variable \"nope\".", true},
+		{"print 1 +; // Error at ';': Expect expression.", true},
+		{"// [line 2] Error at end: Expect ';' after value.", true},
+		{"assert(true);", true},
+		{"assertEqual (1, 1);", true},
+		{"print 1;", false},
+		{"var asserted = true; print asserted;", false},
+		{"fun reassert(x) { return x; }\nreassert(1);", false},
+		{"print \"assertion\";", false},
+	} {
+		path := filepath.Join(t.TempDir(), "file.lox")
+		if err := os.WriteFile(path, []byte(test.source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got := isTestFile(path); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.source, got, test.want)
+		}
+	}
+	if isTestFile("notes.txt") {
+		t.Errorf("notes.txt is a test")
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, test := range []struct {
+		expected, got []string
+		want          string
+	}{
+		{nil, nil, ""},
+		{[]string{"a", "b"}, []string{"a", "b"}, ""},
+		{[]string{"a", "b"}, []string{"a"}, "  a\n- b\n"},
+		{nil, []string{"a"}, "+ a\n"},
+		{[]string{"a", "b", "c"}, []string{"a", "x", "c"}, "  a\n- b\n+ x\n  c\n"},
+		{[]string{"a", "b", "c"}, []string{"b", "c", "d"}, "- a\n  b\n  c\n+ d\n"},
+	} {
+		if got := diffLines(test.expected, test.got); got != test.want {
+			t.Errorf("diffLines(%q, %q): got\n%v\nwant\n%v", test.expected, test.got, got, test.want)
+		}
+	}
+}
+
+// TestJUnit checks the JUnit XML for a test that passes and one that fails
+// against testdata/junit.xml, which "go test -run TestJUnit -update"
+// rewrites.
+func TestJUnit(t *testing.T) {
+	results := []testResult{
+		{"tests/pass.lox", 1500 * time.Millisecond, nil},
+		{"tests/fail.lox", 250 * time.Millisecond, []string{
+			"Wrong output (- expected, + got):\n- 2\n+ 1\n",
+			"Unexpected runtime error: [line 3] Assertion failed.",
+		}},
+	}
+	path := filepath.Join(t.TempDir(), "junit.xml")
+	if err := writeJUnit(path, results, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const golden = "testdata/junit.xml"
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -6,9 +6,19 @@ import (
 
 type Token struct {
 	tokenType TokenType
-	lexeme     string
-	literal    any
-	line       int
+	lexeme    string
+	literal   any
+	line      int
+	// column is where the token starts on its line, counting bytes from 1.
+	// (Like the book, line is the line a token *ends* on, which only
+	// matters for strings that span several lines.)
+	column int
+	// offset is the index in the source of the token's first byte.
+	offset int
+	// trivia is the whitespace and comments between the previous token and
+	// this one. Putting together the trivia and lexeme of every token,
+	// including ERROR tokens, gives back the source exactly.
+	trivia string
 }
 
 func (t Token) String() string {
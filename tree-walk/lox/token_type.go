@@ -51,6 +51,9 @@ const (
 	VAR
 	WHILE
 
+	// ERROR tokens stand in for source text the scanner couldn't make
+	// sense of. The error has already been reported when one is made.
+	ERROR
 	EOF
 )
 
@@ -132,6 +135,8 @@ func (t TokenType) String() string {
 		return "VAR"
 	case WHILE:
 		return "WHILE"
+	case ERROR:
+		return "ERROR"
 	case EOF:
 		return "EOF"
 	default:
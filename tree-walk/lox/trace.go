@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// "jlox --trace" logs each statement as it runs, the values of the
+// expressions that statements are made of (like a condition, or what's being
+// printed), and each call and return. Each entry has the line it's on and the
+// call depth, which is 0 in the script itself. In the call and return entries,
+// the depth and function are the caller's.
+//
+// By default the trace is text meant for reading, but it can also be JSON
+// lines, one object per entry, which are easier to compare between versions
+// of the interpreter.
+
+type tracer struct {
+	NoHooks
+	out  *bufio.Writer
+	json bool
+	// functions, if it isn't nil, limits the trace to what happens in
+	// those functions, and calls to them. from and to limit it to lines
+	// from..to; 0 means there's no limit.
+	functions map[string]bool
+	from, to  int
+	// source is the script's lines, or nil if we don't have them, as
+	// when running a JSON AST.
+	source []string
+	// frames has the name of each function being called, with the
+	// script itself at the bottom.
+	frames []string
+	lines  map[Stmt]int
+	// values has the line of each statement's own expressions.
+	values map[Expr]int
+}
+
+type traceEntry struct {
+	// Event is "statement", "value", "call", "return" or "error".
+	Event    string `json:"event"`
+	Line     int    `json:"line"`
+	Depth    int    `json:"depth"`
+	Function string `json:"function"`
+	// Source is the statement's line of code, for "statement".
+	Source string `json:"source,omitempty"`
+	// Callee is what's being called, for "call" and "return".
+	Callee    string   `json:"callee,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+	// Value is the value of an expression or what a call returned, and
+	// Error is the message of an error, including one that a call failed
+	// with.
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func newTracer(out io.Writer, source string) *tracer {
+	t := &tracer{
+		out:    bufio.NewWriter(out),
+		frames: []string{"script"},
+		lines:  make(map[Stmt]int),
+		values: make(map[Expr]int),
+	}
+	if source != "" {
+		t.source = strings.Split(source, "\n")
+	}
+	return t
+}
+
+// setFilters limits the trace to the comma-separated list of functions (where
+// "script" means the top level), and to a range of lines like "10-20" or a
+// single line like "12". Either can be "" for no limit.
+func (t *tracer) setFilters(functions string, lines string) error {
+	if functions != "" {
+		t.functions = make(map[string]bool)
+		for _, name := range strings.Split(functions, ",") {
+			t.functions[strings.TrimSpace(name)] = true
+		}
+	}
+	if lines != "" {
+		fromText, toText, isRange := strings.Cut(lines, "-")
+		if !isRange {
+			toText = fromText
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(fromText))
+		to, err2 := strconv.Atoi(strings.TrimSpace(toText))
+		if err1 != nil || err2 != nil || from < 1 || to < from {
+			return fmt.Errorf("%q isn't a line or a range of lines like 10-20", lines)
+		}
+		t.from, t.to = from, to
+	}
+	return nil
+}
+
+func (t *tracer) BeforeStatement(i *Interpreter, stmt Stmt) {
+	if _, ok := stmt.(*Block); ok {
+		return
+	}
+	line, ok := t.lines[stmt]
+	if !ok {
+		line = stmtLine(stmt)
+		t.lines[stmt] = line
+		switch v := stmt.(type) {
+		case *Expression:
+			t.values[v.expression] = line
+		case *If:
+			t.values[v.condition] = line
+		case *Print:
+			t.values[v.expression] = line
+		case *Return:
+			if v.value != nil {
+				t.values[v.value] = line
+			}
+		case *Var:
+			if v.initializer != nil {
+				t.values[v.initializer] = line
+			}
+		case *While:
+			t.values[v.condition] = line
+		}
+	}
+
+	var source string
+	if line >= 1 && line <= len(t.source) {
+		source = strings.TrimSpace(t.source[line-1])
+	} else {
+		source = printStmt(stmt)
+	}
+	t.log(traceEntry{Event: "statement", Line: line, Source: source}, "")
+}
+
+func (t *tracer) AfterExpression(i *Interpreter, expr Expr, value any) {
+	if line, ok := t.values[expr]; ok {
+		t.log(traceEntry{Event: "value", Line: line, Value: describe(value)}, "")
+	}
+}
+
+func (t *tracer) BeforeCall(i *Interpreter, call *Call, callee LoxCallable, arguments []any) {
+	name := callableName(call, callee)
+	described := make([]string, len(arguments))
+	for i, argument := range arguments {
+		described[i] = describe(argument)
+	}
+	t.log(traceEntry{Event: "call", Line: call.paren.line, Callee: name, Arguments: described}, name)
+	t.frames = append(t.frames, name)
+}
+
+func (t *tracer) AfterCall(i *Interpreter, call *Call, callee LoxCallable, result any, err error) {
+	t.frames = t.frames[:len(t.frames)-1]
+	entry := traceEntry{Event: "return", Line: call.paren.line, Callee: callableName(call, callee)}
+	if rte, ok := err.(RuntimeError); ok {
+		entry.Error = rte.message
+	} else if err == nil {
+		entry.Value = describe(result)
+	}
+	t.log(entry, entry.Callee)
+}
+
+func (t *tracer) OnRuntimeError(i *Interpreter, err RuntimeError) {
+	t.log(traceEntry{Event: "error", Line: err.token.line, Error: err.message}, "")
+	// The error is about to be reported, and its entry should come first.
+	t.out.Flush()
+}
+
+// log writes entry, filling in where it happened, unless the filters leave
+// it out. callee is the function being called or returned from, if it is a
+// call or a return.
+func (t *tracer) log(entry traceEntry, callee string) {
+	entry.Depth = len(t.frames) - 1
+	entry.Function = t.frames[len(t.frames)-1]
+	if t.functions != nil && !t.functions[entry.Function] && !t.functions[callee] {
+		return
+	}
+	if t.to != 0 && (entry.Line < t.from || entry.Line > t.to) {
+		return
+	}
+
+	if t.json {
+		data, _ := json.Marshal(entry)
+		t.out.Write(data)
+		t.out.WriteByte('\n')
+		return
+	}
+	fmt.Fprintf(t.out, "[line %v] %v", entry.Line, strings.Repeat("  ", entry.Depth))
+	switch entry.Event {
+	case "statement":
+		fmt.Fprintln(t.out, entry.Source)
+	case "value":
+		fmt.Fprintf(t.out, "=> %v\n", entry.Value)
+	case "call":
+		fmt.Fprintf(t.out, "call %v(%v)\n", entry.Callee, strings.Join(entry.Arguments, ", "))
+	case "return":
+		if entry.Error != "" {
+			fmt.Fprintf(t.out, "%v failed: %v\n", entry.Callee, entry.Error)
+		} else {
+			fmt.Fprintf(t.out, "%v returned %v\n", entry.Callee, entry.Value)
+		}
+	case "error":
+		fmt.Fprintf(t.out, "error: %v\n", entry.Error)
+	}
+}
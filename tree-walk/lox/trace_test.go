@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestTrace traces testdata/trace/calls.lox with each set of flags, and checks
+// the trace against testdata/trace/calls.<name>.golden, which
+// "go test -run TestTrace -update" rewrites.
+func TestTrace(t *testing.T) {
+	const path = "testdata/trace/calls.lox"
+	source, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		// name is what the golden file is called, and functions,
+		// lines and json are the -trace-func, -trace-lines and
+		// -trace-json flags.
+		name, functions, lines string
+		json                   bool
+	}{
+		{"all", "", "", false},
+		{"func", "fib", "", false},
+		{"script", "script", "", false},
+		{"lines", "", "5-7", false},
+		{"func-lines", "fib,check", "2", false},
+		{"json", "", "", true},
+		{"json-func", "check", "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hadError = false
+			interpreter := NewInterpreter()
+			statements := NewParser(NewScanner(string(source)).ScanTokens()).parse()
+			NewResolver().resolveStatements(statements)
+			if hadError {
+				t.Fatal("the program doesn't compile")
+			}
+			var trace strings.Builder
+			tracer := newTracer(&trace, string(source))
+			tracer.json = test.json
+			if err := tracer.setFilters(test.functions, test.lines); err != nil {
+				t.Fatal(err)
+			}
+			interpreter.stdout = io.Discard
+			interpreter.addHooks(tracer)
+			for _, stmt := range statements {
+				if _, err := interpreter.execute(stmt); err != nil {
+					break
+				}
+			}
+			tracer.out.Flush()
+
+			golden := strings.TrimSuffix(path, ".lox") + "." + test.name + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(trace.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got := trace.String(); got != string(want) {
+				t.Errorf("%v doesn't match: got\n%v", golden, got)
+			}
+		})
+	}
+}
+
+func TestTraceLinesFilter(t *testing.T) {
+	for _, lines := range []string{"x", "0", "5-", "-5", "7-5", "1-2-3"} {
+		if err := newTracer(io.Discard, "").setFilters("", lines); err == nil {
+			t.Errorf("-trace-lines=%v was allowed", lines)
+		}
+	}
+	tracer := newTracer(io.Discard, "")
+	if err := tracer.setFilters(" fib , script", " 3 - 8 "); err != nil {
+		t.Fatal(err)
+	}
+	if !tracer.functions["fib"] || !tracer.functions["script"] || len(tracer.functions) != 2 || tracer.from != 3 || tracer.to != 8 {
+		t.Errorf("got the functions %v and lines %v-%v", tracer.functions, tracer.from, tracer.to)
+	}
+}
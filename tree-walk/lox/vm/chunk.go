@@ -0,0 +1,268 @@
+// Package vm is the bytecode engine ("jlox --engine=vm"), the design from
+// Part III of the book: jlox's compiler turns the resolved AST into chunks of
+// bytecode, and the VM here runs them on a stack. The opcodes are clox's,
+// apart from a few changes:
+//
+//   - Constants, and the names of globals and properties, are indexed with
+//     two bytes rather than one, so that a chunk can have 65536 of them.
+//   - There are OP_GREATER_EQUAL and OP_LESS_EQUAL, rather than compiling a
+//     >= b as !(a < b), which gives the wrong answer for NaN.
+//
+// Operands come straight after their opcode, most significant byte first.
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+type OpCode byte
+
+const (
+	// OP_CONSTANT pushes the constant at its two-byte operand.
+	OP_CONSTANT OpCode = iota
+	OP_NIL
+	OP_TRUE
+	OP_FALSE
+	OP_POP
+	// OP_GET_LOCAL and OP_SET_LOCAL have a one-byte operand, the local's
+	// slot in the current frame.
+	OP_GET_LOCAL
+	OP_SET_LOCAL
+	// The globals' opcodes have a two-byte operand, the constant with the
+	// global's name.
+	OP_GET_GLOBAL
+	OP_DEFINE_GLOBAL
+	OP_SET_GLOBAL
+	// OP_GET_UPVALUE and OP_SET_UPVALUE have a one-byte operand, the
+	// upvalue's index in the current closure.
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
+	// The property opcodes have a two-byte operand, the constant with the
+	// property's name.
+	OP_GET_PROPERTY
+	OP_SET_PROPERTY
+	OP_GET_SUPER
+	OP_EQUAL
+	OP_GREATER
+	OP_GREATER_EQUAL
+	OP_LESS
+	OP_LESS_EQUAL
+	OP_ADD
+	OP_SUBTRACT
+	OP_MULTIPLY
+	OP_DIVIDE
+	OP_NOT
+	OP_NEGATE
+	OP_PRINT
+	// The jumps have a two-byte operand, how far to jump forwards (or,
+	// for OP_LOOP, backwards) from the end of the instruction.
+	OP_JUMP
+	OP_JUMP_IF_FALSE
+	OP_LOOP
+	// OP_CALL has a one-byte operand, the number of arguments.
+	OP_CALL
+	// OP_INVOKE and OP_SUPER_INVOKE call a method without making a bound
+	// method first. Their operands are the two-byte constant with the
+	// method's name and the one-byte number of arguments.
+	OP_INVOKE
+	OP_SUPER_INVOKE
+	// OP_CLOSURE's operand is the two-byte constant with the function,
+	// followed by two bytes for each of its upvalues: whether it's a
+	// local of the enclosing function (1) or one of its upvalues (0), and
+	// the local's slot or the upvalue's index.
+	OP_CLOSURE
+	OP_CLOSE_UPVALUE
+	OP_RETURN
+	// OP_CLASS and OP_METHOD have a two-byte operand, the constant with
+	// the class's or method's name.
+	OP_CLASS
+	OP_INHERIT
+	OP_METHOD
+)
+
+func (op OpCode) String() string {
+	switch op {
+	case OP_CONSTANT:
+		return "OP_CONSTANT"
+	case OP_NIL:
+		return "OP_NIL"
+	case OP_TRUE:
+		return "OP_TRUE"
+	case OP_FALSE:
+		return "OP_FALSE"
+	case OP_POP:
+		return "OP_POP"
+	case OP_GET_LOCAL:
+		return "OP_GET_LOCAL"
+	case OP_SET_LOCAL:
+		return "OP_SET_LOCAL"
+	case OP_GET_GLOBAL:
+		return "OP_GET_GLOBAL"
+	case OP_DEFINE_GLOBAL:
+		return "OP_DEFINE_GLOBAL"
+	case OP_SET_GLOBAL:
+		return "OP_SET_GLOBAL"
+	case OP_GET_UPVALUE:
+		return "OP_GET_UPVALUE"
+	case OP_SET_UPVALUE:
+		return "OP_SET_UPVALUE"
+	case OP_GET_PROPERTY:
+		return "OP_GET_PROPERTY"
+	case OP_SET_PROPERTY:
+		return "OP_SET_PROPERTY"
+	case OP_GET_SUPER:
+		return "OP_GET_SUPER"
+	case OP_EQUAL:
+		return "OP_EQUAL"
+	case OP_GREATER:
+		return "OP_GREATER"
+	case OP_GREATER_EQUAL:
+		return "OP_GREATER_EQUAL"
+	case OP_LESS:
+		return "OP_LESS"
+	case OP_LESS_EQUAL:
+		return "OP_LESS_EQUAL"
+	case OP_ADD:
+		return "OP_ADD"
+	case OP_SUBTRACT:
+		return "OP_SUBTRACT"
+	case OP_MULTIPLY:
+		return "OP_MULTIPLY"
+	case OP_DIVIDE:
+		return "OP_DIVIDE"
+	case OP_NOT:
+		return "OP_NOT"
+	case OP_NEGATE:
+		return "OP_NEGATE"
+	case OP_PRINT:
+		return "OP_PRINT"
+	case OP_JUMP:
+		return "OP_JUMP"
+	case OP_JUMP_IF_FALSE:
+		return "OP_JUMP_IF_FALSE"
+	case OP_LOOP:
+		return "OP_LOOP"
+	case OP_CALL:
+		return "OP_CALL"
+	case OP_INVOKE:
+		return "OP_INVOKE"
+	case OP_SUPER_INVOKE:
+		return "OP_SUPER_INVOKE"
+	case OP_CLOSURE:
+		return "OP_CLOSURE"
+	case OP_CLOSE_UPVALUE:
+		return "OP_CLOSE_UPVALUE"
+	case OP_RETURN:
+		return "OP_RETURN"
+	case OP_CLASS:
+		return "OP_CLASS"
+	case OP_INHERIT:
+		return "OP_INHERIT"
+	case OP_METHOD:
+		return "OP_METHOD"
+	default:
+		panic(fmt.Sprintf("Unknown opcode %d", byte(op)))
+	}
+}
+
+// Chunk is a function's bytecode.
+type Chunk struct {
+	Code []byte
+	// Lines has the source line of each byte in Code, for error messages.
+	Lines []int
+	// Constants are numbers, strings and *Functions.
+	Constants []any
+}
+
+func (c *Chunk) Write(b byte, line int) {
+	c.Code = append(c.Code, b)
+	c.Lines = append(c.Lines, line)
+}
+
+// AddConstant adds value to the constants, unless it's a number or string
+// that's already there, and returns its index.
+func (c *Chunk) AddConstant(value any) int {
+	switch value.(type) {
+	case float64, string:
+		for i, constant := range c.Constants {
+			if constant == value {
+				return i
+			}
+		}
+	}
+	c.Constants = append(c.Constants, value)
+	return len(c.Constants) - 1
+}
+
+// Disassemble lists the instructions in the chunk, and then those in the
+// functions it has as constants, the way clox's debug.c does.
+func (c *Chunk) Disassemble(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "== %v ==\n", name)
+	for offset := 0; offset < len(c.Code); {
+		offset = c.disassembleInstruction(&b, offset)
+	}
+	for _, constant := range c.Constants {
+		if function, ok := constant.(*Function); ok {
+			b.WriteString(function.Chunk.Disassemble(function.String()))
+		}
+	}
+	return b.String()
+}
+
+// disassembleInstruction writes the instruction at offset, and returns the
+// offset of the next one.
+func (c *Chunk) disassembleInstruction(b *strings.Builder, offset int) int {
+	fmt.Fprintf(b, "%04d ", offset)
+	if offset > 0 && c.Lines[offset] == c.Lines[offset-1] {
+		b.WriteString("   | ")
+	} else {
+		fmt.Fprintf(b, "%4d ", c.Lines[offset])
+	}
+
+	op := OpCode(c.Code[offset])
+	switch op {
+	case OP_CONSTANT, OP_GET_GLOBAL, OP_DEFINE_GLOBAL, OP_SET_GLOBAL,
+		OP_GET_PROPERTY, OP_SET_PROPERTY, OP_GET_SUPER, OP_CLASS, OP_METHOD:
+		constant := c.readShort(offset + 1)
+		fmt.Fprintf(b, "%-16v %4d '%v'\n", op, constant, stringify(c.Constants[constant]))
+		return offset + 3
+	case OP_GET_LOCAL, OP_SET_LOCAL, OP_GET_UPVALUE, OP_SET_UPVALUE, OP_CALL:
+		fmt.Fprintf(b, "%-16v %4d\n", op, c.Code[offset+1])
+		return offset + 2
+	case OP_JUMP, OP_JUMP_IF_FALSE:
+		jump := c.readShort(offset + 1)
+		fmt.Fprintf(b, "%-16v %4d -> %d\n", op, offset, offset+3+jump)
+		return offset + 3
+	case OP_LOOP:
+		jump := c.readShort(offset + 1)
+		fmt.Fprintf(b, "%-16v %4d -> %d\n", op, offset, offset+3-jump)
+		return offset + 3
+	case OP_INVOKE, OP_SUPER_INVOKE:
+		constant := c.readShort(offset + 1)
+		fmt.Fprintf(b, "%-16v (%d args) %4d '%v'\n", op, c.Code[offset+3], constant, c.Constants[constant])
+		return offset + 4
+	case OP_CLOSURE:
+		constant := c.readShort(offset + 1)
+		function := c.Constants[constant].(*Function)
+		fmt.Fprintf(b, "%-16v %4d %v\n", op, constant, function)
+		offset += 3
+		for range function.UpvalueCount {
+			kind := "upvalue"
+			if c.Code[offset] == 1 {
+				kind = "local"
+			}
+			fmt.Fprintf(b, "%04d    |                     %v %d\n", offset, kind, c.Code[offset+1])
+			offset += 2
+		}
+		return offset
+	default:
+		fmt.Fprintf(b, "%v\n", op)
+		return offset + 1
+	}
+}
+
+func (c *Chunk) readShort(offset int) int {
+	return int(c.Code[offset])<<8 | int(c.Code[offset+1])
+}
@@ -0,0 +1,553 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"time"
+)
+
+// VM runs the bytecode that jlox's compiler makes. It's clox's VM, except
+// that Go's garbage collector looks after the objects, and values are Go
+// values like the tree-walk interpreter's: nil, bool, float64 and string, and
+// pointers to the objects below. It reports the same runtime errors as the
+// tree-walk interpreter, on the same lines, so that programs behave the same
+// on both.
+type VM struct {
+	frames []callFrame
+	stack  []any
+	// openUpvalues are the upvalues that still refer to a slot on the
+	// stack, highest slot first.
+	openUpvalues *objUpvalue
+	globals      map[string]any
+	// Stdout is where print writes to.
+	Stdout io.Writer
+}
+
+type callFrame struct {
+	closure *objClosure
+	ip      int
+	// slots is where the frame's slot 0 is on the stack.
+	slots int
+}
+
+// framesMax is how deep calls can go before the VM gives up with a stack
+// overflow, rather than letting the stack grow until it runs out of memory.
+const framesMax = 1 << 16
+
+// Function is a compiled function, or the script.
+type Function struct {
+	Arity        int
+	UpvalueCount int
+	Chunk        Chunk
+	// Name is "" for the script.
+	Name string
+}
+
+func (f *Function) String() string {
+	if f.Name == "" {
+		return "<script>"
+	}
+	return fmt.Sprintf("<fn %v >", f.Name)
+}
+
+type objClosure struct {
+	function *Function
+	upvalues []*objUpvalue
+}
+
+func (c *objClosure) String() string {
+	return c.function.String()
+}
+
+// objUpvalue is a variable that a closure has captured. While the variable is
+// still on the stack, slot is where; once it's gone, slot is -1 and the
+// upvalue holds the value itself.
+type objUpvalue struct {
+	slot   int
+	closed any
+	next   *objUpvalue
+}
+
+type objClass struct {
+	name string
+	// methods includes the inherited ones, which are copied down from the
+	// superclass when the class is made.
+	methods map[string]*objClosure
+}
+
+func (c *objClass) String() string {
+	return c.name
+}
+
+type objInstance struct {
+	class  *objClass
+	fields map[string]any
+}
+
+func (i *objInstance) String() string {
+	return i.class.name + " instance"
+}
+
+type objBoundMethod struct {
+	receiver any
+	method   *objClosure
+}
+
+func (b *objBoundMethod) String() string {
+	return b.method.String()
+}
+
+// Native is a function written in Go.
+type Native struct {
+	Arity int
+	// Fn can fail with any error, which is reported as a runtime error at
+	// the call.
+	Fn func(arguments []any) (any, error)
+}
+
+func (n *Native) String() string {
+	return "<native fn>"
+}
+
+var clockNative = &Native{
+	Arity: 0,
+	Fn: func(arguments []any) (any, error) {
+		return float64(time.Now().UnixMilli()) / 1000.0, nil
+	},
+}
+
+// RuntimeError is an error that stops the program, and the line it happened
+// on.
+type RuntimeError struct {
+	Line    int
+	Message string
+}
+
+func (e RuntimeError) Error() string {
+	return fmt.Sprintf("[line %v] %v", e.Line, e.Message)
+}
+
+func New() *VM {
+	return &VM{
+		globals: map[string]any{"clock": clockNative},
+		Stdout:  os.Stdout,
+	}
+}
+
+// Define adds a native other than the built-in ones to the globals.
+func (vm *VM) Define(name string, native *Native) {
+	vm.globals[name] = native
+}
+
+// Interpret runs the script function, returning the RuntimeError that stopped
+// it, if any.
+func (vm *VM) Interpret(function *Function) error {
+	closure := &objClosure{function, nil}
+	vm.push(closure)
+	vm.frames = append(vm.frames, callFrame{closure, 0, 0})
+	err := vm.run()
+	if err != nil {
+		vm.frames = vm.frames[:0]
+		vm.stack = vm.stack[:0]
+		vm.openUpvalues = nil
+	}
+	return err
+}
+
+func (vm *VM) run() error {
+	frame := &vm.frames[len(vm.frames)-1]
+	code := frame.closure.function.Chunk.Code
+	constants := frame.closure.function.Chunk.Constants
+	readShort := func() int {
+		frame.ip += 2
+		return int(code[frame.ip-2])<<8 | int(code[frame.ip-1])
+	}
+	// After a call or a return, the frame (and so the code) has changed.
+	changeFrame := func() {
+		frame = &vm.frames[len(vm.frames)-1]
+		code = frame.closure.function.Chunk.Code
+		constants = frame.closure.function.Chunk.Constants
+	}
+
+	for {
+		op := OpCode(code[frame.ip])
+		frame.ip++
+		switch op {
+		case OP_CONSTANT:
+			vm.push(constants[readShort()])
+		case OP_NIL:
+			vm.push(nil)
+		case OP_TRUE:
+			vm.push(true)
+		case OP_FALSE:
+			vm.push(false)
+		case OP_POP:
+			vm.pop()
+		case OP_GET_LOCAL:
+			slot := int(code[frame.ip])
+			frame.ip++
+			vm.push(vm.stack[frame.slots+slot])
+		case OP_SET_LOCAL:
+			slot := int(code[frame.ip])
+			frame.ip++
+			vm.stack[frame.slots+slot] = vm.peek(0)
+		case OP_GET_GLOBAL:
+			name := constants[readShort()].(string)
+			value, ok := vm.globals[name]
+			if !ok {
+				return vm.runtimeError("Undefined variable %q.", name)
+			}
+			vm.push(value)
+		case OP_DEFINE_GLOBAL:
+			vm.globals[constants[readShort()].(string)] = vm.pop()
+		case OP_SET_GLOBAL:
+			name := constants[readShort()].(string)
+			if _, ok := vm.globals[name]; !ok {
+				return vm.runtimeError("Inside assign: Undefined variable %q", name)
+			}
+			vm.globals[name] = vm.peek(0)
+		case OP_GET_UPVALUE:
+			upvalue := frame.closure.upvalues[code[frame.ip]]
+			frame.ip++
+			if upvalue.slot >= 0 {
+				vm.push(vm.stack[upvalue.slot])
+			} else {
+				vm.push(upvalue.closed)
+			}
+		case OP_SET_UPVALUE:
+			upvalue := frame.closure.upvalues[code[frame.ip]]
+			frame.ip++
+			if upvalue.slot >= 0 {
+				vm.stack[upvalue.slot] = vm.peek(0)
+			} else {
+				upvalue.closed = vm.peek(0)
+			}
+		case OP_GET_PROPERTY:
+			name := constants[readShort()].(string)
+			instance, ok := vm.peek(0).(*objInstance)
+			if !ok {
+				return vm.runtimeError("Only instances have properties.")
+			}
+			if value, ok := instance.fields[name]; ok {
+				vm.stack[len(vm.stack)-1] = value
+			} else if err := vm.bindMethod(instance.class, name); err != nil {
+				return err
+			}
+		case OP_SET_PROPERTY:
+			name := constants[readShort()].(string)
+			instance, ok := vm.peek(1).(*objInstance)
+			if !ok {
+				return vm.runtimeError("Only instances have fields.")
+			}
+			value := vm.pop()
+			instance.fields[name] = value
+			vm.stack[len(vm.stack)-1] = value
+		case OP_GET_SUPER:
+			name := constants[readShort()].(string)
+			superclass := vm.pop().(*objClass)
+			if err := vm.bindMethod(superclass, name); err != nil {
+				return err
+			}
+		case OP_EQUAL:
+			b := vm.pop()
+			vm.stack[len(vm.stack)-1] = isEqual(vm.peek(0), b)
+		case OP_GREATER, OP_GREATER_EQUAL, OP_LESS, OP_LESS_EQUAL, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE:
+			b, bIsNumber := vm.peek(0).(float64)
+			a, aIsNumber := vm.peek(1).(float64)
+			if !aIsNumber || !bIsNumber {
+				return vm.runtimeError("Operands must be numbers.")
+			}
+			vm.pop()
+			var result any
+			switch op {
+			case OP_GREATER:
+				result = a > b
+			case OP_GREATER_EQUAL:
+				result = a >= b
+			case OP_LESS:
+				result = a < b
+			case OP_LESS_EQUAL:
+				result = a <= b
+			case OP_SUBTRACT:
+				result = a - b
+			case OP_MULTIPLY:
+				result = a * b
+			case OP_DIVIDE:
+				result = a / b
+			}
+			vm.stack[len(vm.stack)-1] = result
+		case OP_ADD:
+			switch a := vm.peek(1).(type) {
+			case float64:
+				if b, ok := vm.peek(0).(float64); ok {
+					vm.pop()
+					vm.stack[len(vm.stack)-1] = a + b
+					continue
+				}
+			case string:
+				if b, ok := vm.peek(0).(string); ok {
+					vm.pop()
+					vm.stack[len(vm.stack)-1] = a + b
+					continue
+				}
+			}
+			return vm.runtimeError("Operands must be two numbers or two strings.")
+		case OP_NOT:
+			vm.stack[len(vm.stack)-1] = !isTruthy(vm.peek(0))
+		case OP_NEGATE:
+			value, ok := vm.peek(0).(float64)
+			if !ok {
+				return vm.runtimeError("Operand must be a number.")
+			}
+			vm.stack[len(vm.stack)-1] = -value
+		case OP_PRINT:
+			fmt.Fprintln(vm.Stdout, stringify(vm.pop()))
+		case OP_JUMP:
+			offset := readShort()
+			frame.ip += offset
+		case OP_JUMP_IF_FALSE:
+			offset := readShort()
+			if !isTruthy(vm.peek(0)) {
+				frame.ip += offset
+			}
+		case OP_LOOP:
+			offset := readShort()
+			frame.ip -= offset
+		case OP_CALL:
+			argCount := int(code[frame.ip])
+			frame.ip++
+			if err := vm.callValue(vm.peek(argCount), argCount); err != nil {
+				return err
+			}
+			changeFrame()
+		case OP_INVOKE:
+			name := constants[readShort()].(string)
+			argCount := int(code[frame.ip])
+			frame.ip++
+			if err := vm.invoke(name, argCount); err != nil {
+				return err
+			}
+			changeFrame()
+		case OP_SUPER_INVOKE:
+			name := constants[readShort()].(string)
+			argCount := int(code[frame.ip])
+			frame.ip++
+			superclass := vm.pop().(*objClass)
+			if err := vm.invokeFromClass(superclass, name, argCount); err != nil {
+				return err
+			}
+			changeFrame()
+		case OP_CLOSURE:
+			function := constants[readShort()].(*Function)
+			closure := &objClosure{function, make([]*objUpvalue, function.UpvalueCount)}
+			vm.push(closure)
+			for i := range closure.upvalues {
+				isLocal := code[frame.ip]
+				index := int(code[frame.ip+1])
+				frame.ip += 2
+				if isLocal == 1 {
+					closure.upvalues[i] = vm.captureUpvalue(frame.slots + index)
+				} else {
+					closure.upvalues[i] = frame.closure.upvalues[index]
+				}
+			}
+		case OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(len(vm.stack) - 1)
+			vm.pop()
+		case OP_RETURN:
+			result := vm.pop()
+			vm.closeUpvalues(frame.slots)
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			if len(vm.frames) == 0 {
+				vm.pop()
+				return nil
+			}
+			vm.stack = vm.stack[:frame.slots]
+			vm.push(result)
+			changeFrame()
+		case OP_CLASS:
+			name := constants[readShort()].(string)
+			vm.push(&objClass{name, make(map[string]*objClosure)})
+		case OP_INHERIT:
+			superclass, ok := vm.peek(1).(*objClass)
+			if !ok {
+				return vm.runtimeError("Superclass must be a class.")
+			}
+			subclass := vm.peek(0).(*objClass)
+			maps.Copy(subclass.methods, superclass.methods)
+			vm.pop()
+		case OP_METHOD:
+			name := constants[readShort()].(string)
+			class := vm.peek(1).(*objClass)
+			class.methods[name] = vm.pop().(*objClosure)
+		default:
+			panic(fmt.Sprintf("Unreachable. The opcode is %d, and we don't handle that case.", byte(op)))
+		}
+	}
+}
+
+func (vm *VM) push(value any) {
+	vm.stack = append(vm.stack, value)
+}
+
+func (vm *VM) pop() any {
+	value := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return value
+}
+
+// peek returns the value distance slots down from the top of the stack.
+func (vm *VM) peek(distance int) any {
+	return vm.stack[len(vm.stack)-1-distance]
+}
+
+// callValue calls callee with the argCount arguments on top of the stack. A
+// closure gets a new frame, which the caller has to switch to; anything else
+// is done by the time callValue returns.
+func (vm *VM) callValue(callee any, argCount int) error {
+	switch callee := callee.(type) {
+	case *objBoundMethod:
+		vm.stack[len(vm.stack)-argCount-1] = callee.receiver
+		return vm.call(callee.method, argCount)
+	case *objClass:
+		vm.stack[len(vm.stack)-argCount-1] = &objInstance{callee, make(map[string]any)}
+		if initializer, ok := callee.methods["init"]; ok {
+			return vm.call(initializer, argCount)
+		}
+		if argCount != 0 {
+			return vm.runtimeError("Expected 0 arguments but got %d.", argCount)
+		}
+		return nil
+	case *objClosure:
+		return vm.call(callee, argCount)
+	case *Native:
+		if argCount != callee.Arity {
+			return vm.runtimeError("Expected %d arguments but got %d.", callee.Arity, argCount)
+		}
+		result, err := callee.Fn(vm.stack[len(vm.stack)-argCount:])
+		if err != nil {
+			return vm.runtimeError("%v", err)
+		}
+		vm.stack = vm.stack[:len(vm.stack)-argCount]
+		vm.stack[len(vm.stack)-1] = result
+		return nil
+	}
+	return vm.runtimeError("Can only call functions and classes.")
+}
+
+func (vm *VM) call(closure *objClosure, argCount int) error {
+	if argCount != closure.function.Arity {
+		return vm.runtimeError("Expected %d arguments but got %d.", closure.function.Arity, argCount)
+	}
+	if len(vm.frames) == framesMax {
+		return vm.runtimeError("Stack overflow.")
+	}
+	vm.frames = append(vm.frames, callFrame{closure, 0, len(vm.stack) - argCount - 1})
+	return nil
+}
+
+// invoke calls the method called name on the receiver under the arguments,
+// without making a bound method for it.
+func (vm *VM) invoke(name string, argCount int) error {
+	instance, ok := vm.peek(argCount).(*objInstance)
+	if !ok {
+		return vm.runtimeError("Only instances have properties.")
+	}
+	// A field with the name shadows the method.
+	if value, ok := instance.fields[name]; ok {
+		vm.stack[len(vm.stack)-argCount-1] = value
+		return vm.callValue(value, argCount)
+	}
+	return vm.invokeFromClass(instance.class, name, argCount)
+}
+
+func (vm *VM) invokeFromClass(class *objClass, name string, argCount int) error {
+	method, ok := class.methods[name]
+	if !ok {
+		return vm.runtimeError("Undefined property %q.", name)
+	}
+	return vm.call(method, argCount)
+}
+
+// bindMethod replaces the instance on top of the stack with its method
+// called name from class.
+func (vm *VM) bindMethod(class *objClass, name string) error {
+	method, ok := class.methods[name]
+	if !ok {
+		return vm.runtimeError("Undefined property %q.", name)
+	}
+	vm.stack[len(vm.stack)-1] = &objBoundMethod{vm.peek(0), method}
+	return nil
+}
+
+// captureUpvalue returns the upvalue for the variable in slot, reusing the
+// open one if another closure has already captured it.
+func (vm *VM) captureUpvalue(slot int) *objUpvalue {
+	var previous *objUpvalue
+	upvalue := vm.openUpvalues
+	for upvalue != nil && upvalue.slot > slot {
+		previous = upvalue
+		upvalue = upvalue.next
+	}
+	if upvalue != nil && upvalue.slot == slot {
+		return upvalue
+	}
+
+	created := &objUpvalue{slot, nil, upvalue}
+	if previous == nil {
+		vm.openUpvalues = created
+	} else {
+		previous.next = created
+	}
+	return created
+}
+
+// closeUpvalues moves the variables in slot last and above off the stack and
+// into their upvalues, since they're about to be popped.
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= last {
+		upvalue := vm.openUpvalues
+		upvalue.closed = vm.stack[upvalue.slot]
+		upvalue.slot = -1
+		vm.openUpvalues = upvalue.next
+	}
+}
+
+// runtimeError makes a RuntimeError on the line of the instruction being run.
+func (vm *VM) runtimeError(format string, a ...any) RuntimeError {
+	frame := &vm.frames[len(vm.frames)-1]
+	line := frame.closure.function.Chunk.Lines[frame.ip-1]
+	return RuntimeError{line, fmt.Sprintf(format, a...)}
+}
+
+// stringify is how print shows value, the same way as the tree-walk
+// interpreter.
+func stringify(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case float64:
+		return strings.TrimSuffix(fmt.Sprintf("%v", v), ".0")
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// isTruthy is whether value counts as true: anything but nil and false.
+func isTruthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	default:
+		return true
+	}
+}
+
+func isEqual(a any, b any) bool {
+	return a == b
+}
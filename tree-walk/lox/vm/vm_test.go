@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// assemble makes a chunk, all on line 1, of ops and their operands, where
+// anything but an OpCode or an int is a constant, and is replaced by its
+// two-byte index.
+func assemble(code ...any) Chunk {
+	var chunk Chunk
+	for _, b := range code {
+		switch b := b.(type) {
+		case OpCode:
+			chunk.Write(byte(b), 1)
+		case int:
+			chunk.Write(byte(b), 1)
+		default:
+			constant := chunk.AddConstant(b)
+			chunk.Write(byte(constant>>8), 1)
+			chunk.Write(byte(constant), 1)
+		}
+	}
+	return chunk
+}
+
+func TestInterpret(t *testing.T) {
+	// var total = 0; fun add(n) { total = total + n; }
+	// add(1.5); add(2); print total; print "a" + "b"; print half(3);
+	add := &Function{Arity: 1, Name: "add", Chunk: assemble(
+		OP_GET_GLOBAL, "total", OP_GET_LOCAL, 1, OP_ADD, OP_SET_GLOBAL, "total", OP_POP,
+		OP_NIL, OP_RETURN,
+	)}
+	script := &Function{Chunk: assemble(
+		OP_CONSTANT, 0.0, OP_DEFINE_GLOBAL, "total",
+		OP_CLOSURE, add, OP_DEFINE_GLOBAL, "add",
+		OP_GET_GLOBAL, "add", OP_CONSTANT, 1.5, OP_CALL, 1, OP_POP,
+		OP_GET_GLOBAL, "add", OP_CONSTANT, 2.0, OP_CALL, 1, OP_POP,
+		OP_GET_GLOBAL, "total", OP_PRINT,
+		OP_CONSTANT, "a", OP_CONSTANT, "b", OP_ADD, OP_PRINT,
+		OP_GET_GLOBAL, "half", OP_CONSTANT, 3.0, OP_CALL, 1, OP_PRINT,
+		OP_NIL, OP_RETURN,
+	)}
+	vm := New()
+	var output strings.Builder
+	vm.Stdout = &output
+	vm.Define("half", &Native{1, func(arguments []any) (any, error) {
+		return arguments[0].(float64) / 2, nil
+	}})
+	if err := vm.Interpret(script); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := output.String(), "3.5\nab\n1.5\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	for _, test := range []struct {
+		code []any
+		want string
+	}{
+		{[]any{OP_CONSTANT, 1.0, OP_CONSTANT, "a", OP_ADD}, "[line 1] Operands must be two numbers or two strings."},
+		{[]any{OP_TRUE, OP_NEGATE}, "[line 1] Operand must be a number."},
+		{[]any{OP_GET_GLOBAL, "nope"}, `[line 1] Undefined variable "nope".`},
+		{[]any{OP_CONSTANT, 1.0, OP_CALL, 0}, "[line 1] Can only call functions and classes."},
+		{[]any{OP_GET_GLOBAL, "fail", OP_CALL, 0}, "[line 1] Failed."},
+		{[]any{OP_GET_GLOBAL, "clock", OP_NIL, OP_CALL, 1}, "[line 1] Expected 0 arguments but got 1."},
+	} {
+		vm := New()
+		vm.Define("fail", &Native{0, func(arguments []any) (any, error) {
+			return nil, errors.New("Failed.")
+		}})
+		err := vm.Interpret(&Function{Chunk: assemble(append(test.code, OP_NIL, OP_RETURN)...)})
+		if _, ok := err.(RuntimeError); !ok || err.Error() != test.want {
+			t.Errorf("%v: got the error %v, want %v", test.code, err, test.want)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	chunk := assemble(OP_CONSTANT, 1.5, OP_JUMP_IF_FALSE, 0, 1, OP_NEGATE, OP_PRINT, OP_NIL, OP_RETURN)
+	want := `== test ==
+0000    1 OP_CONSTANT         0 '1.5'
+0003    | OP_JUMP_IF_FALSE    3 -> 7
+0006    | OP_NEGATE
+0007    | OP_PRINT
+0008    | OP_NIL
+0009    | OP_RETURN
+`
+	if got := chunk.Disassemble("test"); got != want {
+		t.Errorf("got\n%vwant\n%v", got, want)
+	}
+}